@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"time"
+)
+
+// Backend is a (usually persistent) storage behind a Cache. Backends
+// log or count their own errors. Backend must be safe for concurrent use.
+type Backend[K Key, V Value] interface {
+	// Get returns the value of key. Expired values must not be returned.
+	Get(key K) (v V, expirationTime time.Time, ok bool)
+	Store(key K, v V, expirationTime time.Time)
+	Delete(key K)
+	// Range calls f through all values. f must not call other
+	// methods of the Backend.
+	Range(f func(key K, v V, expirationTime time.Time) error) error
+	Len() int
+	Flush()
+	Close() error
+}
+
+// NewWithBackend returns a Cache that stores all values in backend,
+// and keeps at most opts.Size hot values in memory.
+// The Cache takes the ownership of backend and closes it on Close.
+func NewWithBackend[K Key, V Value](opts Opts, backend Backend[K, V]) *Cache[K, V] {
+	c := New[K, V](opts)
+	c.backend = backend
+	return c
+}
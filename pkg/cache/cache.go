@@ -39,18 +39,41 @@ type Value interface {
 	any
 }
 
+// Coster can be implemented by values to report their cost for Opts.MaxCost.
+// e.g. memory size in bytes. Other values cost 1.
+type Coster interface {
+	Cost() int
+}
+
+// Policy is the eviction policy of a full Cache.
+type Policy int
+
+const (
+	// PolicyRandom evicts random entries. It is the default.
+	PolicyRandom Policy = iota
+	// PolicyTinyLFU evicts entries by W-TinyLFU. It resists scans and
+	// supports Opts.MaxCost.
+	PolicyTinyLFU
+)
+
 // Cache is a simple map cache that stores values in memory.
+// It can have a Backend (see NewWithBackend).
 // It is safe for concurrent use.
 type Cache[K Key, V Value] struct {
 	opts Opts
 
 	closed      atomic.Bool
 	closeNotify chan struct{}
-	m           *concurrent_map.Map[K, *elem[V]]
+	m           store[K, V]
+	backend     Backend[K, V] // May be nil.
 }
 
 type Opts struct {
-	Size            int
+	Size int
+	// MaxCost limits the total cost of entries if > 0.
+	// Only used by PolicyTinyLFU.
+	MaxCost         int
+	Policy          Policy
 	CleanerInterval time.Duration
 }
 
@@ -72,39 +95,74 @@ type elem[V Value] struct {
 func New[K Key, V Value](opts Opts) *Cache[K, V] {
 	opts.init()
 	c := &Cache[K, V]{
+		opts:        opts,
 		closeNotify: make(chan struct{}),
-		m:           concurrent_map.NewMapCache[K, *elem[V]](opts.Size),
+	}
+	switch opts.Policy {
+	case PolicyTinyLFU:
+		c.m = newLFUStore[K, V](opts.Size, opts.MaxCost)
+	default:
+		c.m = mapStore[K, V]{m: concurrent_map.NewMapCache[K, *elem[V]](opts.Size)}
 	}
 	go c.gcLoop(opts.CleanerInterval)
 	return c
 }
 
-// Close closes the inner cleaner of this cache.
+// Close closes the inner cleaner and the backend of this cache.
 func (c *Cache[K, V]) Close() error {
 	if ok := c.closed.CompareAndSwap(false, true); ok {
 		close(c.closeNotify)
+		if c.backend != nil {
+			return c.backend.Close()
+		}
 	}
 	return nil
 }
 
+// Get returns the value of key. If it is not in memory, the backend
+// will be checked, and the value will be kept in memory.
 func (c *Cache[K, V]) Get(key K) (v V, expirationTime time.Time, ok bool) {
-	if e, hasEntry := c.m.Get(key); hasEntry {
+	if e, hasEntry := c.m.get(key); hasEntry {
 		if e.expirationTime.Before(time.Now()) {
-			c.m.Del(key)
+			c.m.del(key)
 			return
 		}
 		return e.v, e.expirationTime, true
 	}
+	if c.backend != nil {
+		if v, expirationTime, ok = c.backend.Get(key); ok {
+			c.m.set(key, &elem[V]{v: v, expirationTime: expirationTime})
+		}
+	}
 	return
 }
 
 // Range calls f through all entries. If f returns an error, the same error will be returned
 // by Range.
 func (c *Cache[K, V]) Range(f func(key K, v V, expirationTime time.Time) error) error {
-	cf := func(key K, v *elem[V]) (newV *elem[V], setV bool, delV bool, err error) {
-		return nil, false, false, f(key, v.v, v.expirationTime)
+	var err error
+	var inMem map[K]struct{}
+	if c.backend != nil {
+		inMem = make(map[K]struct{})
+	}
+	c.m.clean(func(key K, e *elem[V]) bool {
+		if err == nil {
+			err = f(key, e.v, e.expirationTime)
+		}
+		if inMem != nil {
+			inMem[key] = struct{}{}
+		}
+		return false
+	})
+	if err != nil || c.backend == nil {
+		return err
 	}
-	return c.m.RangeDo(cf)
+	return c.backend.Range(func(key K, v V, expirationTime time.Time) error {
+		if _, ok := inMem[key]; ok {
+			return nil
+		}
+		return f(key, v, expirationTime)
+	})
 }
 
 // Store stores this kv in cache. If expirationTime is before time.Now(),
@@ -119,8 +177,50 @@ func (c *Cache[K, V]) Store(key K, v V, expirationTime time.Time) {
 		v:              v,
 		expirationTime: expirationTime,
 	}
-	c.m.Set(key, e)
-	return
+	c.m.set(key, e)
+	if c.backend != nil {
+		c.backend.Store(key, v, expirationTime)
+	}
+}
+
+// Delete removes the entry of key.
+func (c *Cache[K, V]) Delete(key K) {
+	c.m.del(key)
+	if c.backend != nil {
+		c.backend.Delete(key)
+	}
+}
+
+// Clean removes all entries that f returns true and returns
+// the number of removed entries.
+func (c *Cache[K, V]) Clean(f func(key K, v V, expirationTime time.Time) (remove bool)) (removed int) {
+	removedKeys := make(map[K]struct{})
+	c.m.clean(func(key K, e *elem[V]) bool {
+		if f(key, e.v, e.expirationTime) {
+			removedKeys[key] = struct{}{}
+			return true
+		}
+		return false
+	})
+	if c.backend != nil {
+		// Keys removed from the memory tier are deleted from the backend
+		// as well, even if the backend does not list them in Range.
+		keys := make([]K, 0, len(removedKeys))
+		for key := range removedKeys {
+			keys = append(keys, key)
+		}
+		_ = c.backend.Range(func(key K, v V, expirationTime time.Time) error {
+			if _, ok := removedKeys[key]; !ok && f(key, v, expirationTime) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		for _, key := range keys {
+			c.backend.Delete(key)
+			removedKeys[key] = struct{}{}
+		}
+	}
+	return len(removedKeys)
 }
 
 func (c *Cache[K, V]) gcLoop(interval time.Duration) {
@@ -140,18 +240,97 @@ func (c *Cache[K, V]) gcLoop(interval time.Duration) {
 }
 
 func (c *Cache[K, V]) gc(now time.Time) {
-	f := func(key K, v *elem[V]) (newV *elem[V], setV, delV bool, err error) {
-		return nil, false, now.After(v.expirationTime), nil
-	}
-	_ = c.m.RangeDo(f)
+	c.m.clean(func(key K, e *elem[V]) bool {
+		return now.After(e.expirationTime)
+	})
 }
 
-// Len returns the current size of this cache.
+// Len returns the current size of this cache. If the cache has a
+// backend, it is the size of the backend.
 func (c *Cache[K, V]) Len() int {
-	return c.m.Len()
+	if c.backend != nil {
+		return c.backend.Len()
+	}
+	return c.m.len()
+}
+
+// MemLen returns the number of entries in memory.
+func (c *Cache[K, V]) MemLen() int {
+	return c.m.len()
+}
+
+// Cost returns the total cost of entries. It is only tracked by
+// PolicyTinyLFU with a MaxCost. Otherwise, it is 0.
+func (c *Cache[K, V]) Cost() int {
+	return c.m.cost()
 }
 
 // Flush removes all stored entries from this cache.
 func (c *Cache[K, V]) Flush() {
-	c.m.Flush()
+	c.m.flush()
+	if c.backend != nil {
+		c.backend.Flush()
+	}
+}
+
+type store[K Key, V Value] interface {
+	get(key K) (*elem[V], bool)
+	set(key K, e *elem[V])
+	del(key K)
+	clean(f func(key K, e *elem[V]) (remove bool)) (removed int)
+	len() int
+	cost() int
+	flush()
+}
+
+type mapStore[K Key, V Value] struct {
+	m *concurrent_map.Map[K, *elem[V]]
+}
+
+func (s mapStore[K, V]) get(key K) (*elem[V], bool) { return s.m.Get(key) }
+func (s mapStore[K, V]) set(key K, e *elem[V])      { s.m.Set(key, e) }
+func (s mapStore[K, V]) del(key K)                  { s.m.Del(key) }
+func (s mapStore[K, V]) len() int                   { return s.m.Len() }
+func (s mapStore[K, V]) cost() int                  { return 0 }
+func (s mapStore[K, V]) flush()                     { s.m.Flush() }
+
+func (s mapStore[K, V]) clean(f func(key K, e *elem[V]) (remove bool)) (removed int) {
+	_ = s.m.RangeDo(func(key K, e *elem[V]) (newV *elem[V], setV, delV bool, err error) {
+		if f(key, e) {
+			removed++
+			return nil, false, true, nil
+		}
+		return nil, false, false, nil
+	})
+	return removed
+}
+
+type lfuStore[K Key, V Value] struct {
+	*concurrent_lru.ShardedTinyLFU[K, *elem[V]]
+}
+
+func newLFUStore[K Key, V Value](size, maxCost int) lfuStore[K, V] {
+	const shards = concurrent_map.MapShardSize
+	if maxCost > 0 {
+		maxCost = max(maxCost/shards, 1) // 0 means no limit.
+	}
+	return lfuStore[K, V]{concurrent_lru.NewShardedTinyLFU[K, *elem[V]](shards, max(size/shards, 1), maxCost, nil)}
+}
+
+func (s lfuStore[K, V]) get(key K) (*elem[V], bool) { return s.Get(key) }
+func (s lfuStore[K, V]) del(key K)                  { s.Del(key) }
+func (s lfuStore[K, V]) len() int                   { return s.Len() }
+func (s lfuStore[K, V]) cost() int                  { return s.Cost() }
+func (s lfuStore[K, V]) flush()                     { s.Flush() }
+
+func (s lfuStore[K, V]) set(key K, e *elem[V]) {
+	cost := 1
+	if c, ok := any(e.v).(Coster); ok {
+		cost = c.Cost()
+	}
+	s.Add(key, e, cost)
+}
+
+func (s lfuStore[K, V]) clean(f func(key K, e *elem[V]) (remove bool)) (removed int) {
+	return s.Clean(f)
 }
@@ -20,6 +20,12 @@
 package cache
 
 import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"math/rand"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -58,6 +64,151 @@ func Test_Cache(t *testing.T) {
 	}
 }
 
+func Test_Cache_Clean(t *testing.T) {
+	c := New[testKey, int](Opts{
+		Size: 1024,
+	})
+	defer c.Close()
+	for i := 0; i < 64; i++ {
+		c.Store(testKey(i), i, time.Now().Add(time.Minute))
+	}
+
+	c.Delete(testKey(0))
+	if _, _, ok := c.Get(testKey(0)); ok {
+		t.Fatal("deleted key still exists")
+	}
+	if n := c.Clean(func(key testKey, v int, _ time.Time) bool { return v%2 == 0 }); n != 31 {
+		t.Fatalf("want 31 removed entries, got %d", n)
+	}
+	if l := c.Len(); l != 32 {
+		t.Fatalf("want 32 entries, got %d", l)
+	}
+}
+
+type costValue int
+
+func (v costValue) Cost() int {
+	return int(v)
+}
+
+func Test_Cache_TinyLFU(t *testing.T) {
+	c := New[testKey, costValue](Opts{
+		Size:    1024,
+		MaxCost: 64 * 1000,
+		Policy:  PolicyTinyLFU,
+	})
+	defer c.Close()
+	for i := 0; i < 4096; i++ {
+		c.Store(testKey(i), costValue(i%200), time.Now().Add(time.Minute))
+		if cost := c.Cost(); cost > 64*1000 {
+			t.Fatalf("cost overflow: %d", cost)
+		}
+	}
+	if l := c.Len(); l > 1024 {
+		t.Fatal("cache overflow")
+	}
+	c.Store(testKey(1), 1, time.Now().Add(time.Minute))
+	if v, _, ok := c.Get(testKey(1)); !ok || v != 1 {
+		t.Fatalf("want 1, got %v", v)
+	}
+	c.Flush()
+	if c.Len() != 0 || c.Cost() != 0 {
+		t.Fatal("flush failed")
+	}
+}
+
+// mapBackend is a Backend for tests.
+type mapBackend struct {
+	sync.Mutex
+	m      map[testKey]int
+	closed bool
+}
+
+func (b *mapBackend) Get(key testKey) (int, time.Time, bool) {
+	b.Lock()
+	defer b.Unlock()
+	v, ok := b.m[key]
+	return v, time.Now().Add(time.Minute), ok
+}
+
+func (b *mapBackend) Store(key testKey, v int, _ time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.m[key] = v
+}
+
+func (b *mapBackend) Delete(key testKey) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.m, key)
+}
+
+func (b *mapBackend) Range(f func(key testKey, v int, expirationTime time.Time) error) error {
+	b.Lock()
+	defer b.Unlock()
+	for k, v := range b.m {
+		if err := f(k, v, time.Now().Add(time.Minute)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *mapBackend) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.m)
+}
+
+func (b *mapBackend) Flush() {
+	b.Lock()
+	defer b.Unlock()
+	b.m = make(map[testKey]int)
+}
+
+func (b *mapBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func Test_Cache_Backend(t *testing.T) {
+	b := &mapBackend{m: make(map[testKey]int)}
+	c := NewWithBackend[testKey, int](Opts{Size: 1024, Policy: PolicyTinyLFU}, b)
+	for i := 0; i < 4096; i++ {
+		c.Store(testKey(i), i, time.Now().Add(time.Minute))
+	}
+	if c.MemLen() > 1024 || c.Len() != 4096 {
+		t.Fatalf("unexpected len, mem %d, all %d", c.MemLen(), c.Len())
+	}
+	for i := 0; i < 4096; i++ { // All values can be read from the backend.
+		if v, _, ok := c.Get(testKey(i)); !ok || v != i {
+			t.Fatalf("want %d, got %d", i, v)
+		}
+	}
+
+	n := 0
+	if err := c.Range(func(key testKey, v int, _ time.Time) error {
+		n++
+		return nil
+	}); err != nil || n != 4096 {
+		t.Fatalf("Range got %d entries, err %v", n, err)
+	}
+	if removed := c.Clean(func(key testKey, v int, _ time.Time) bool { return v%2 == 0 }); removed != 2048 {
+		t.Fatalf("want 2048 removed entries, got %d", removed)
+	}
+	if _, _, ok := c.Get(testKey(0)); ok {
+		t.Fatal("removed key still exists")
+	}
+	c.Delete(testKey(1))
+	if _, ok := b.m[1]; ok {
+		t.Fatal("deleted key still exists in the backend")
+	}
+	c.Close()
+	if !b.closed {
+		t.Fatal("backend is not closed")
+	}
+}
+
 func Test_memCache_cleaner(t *testing.T) {
 	c := New[testKey, int](Opts{
 		Size:            1024,
@@ -96,3 +247,78 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+type strKey string
+
+var testSeed = maphash.MakeSeed()
+
+func (k strKey) Sum() uint64 {
+	return maphash.String(testSeed, string(k))
+}
+
+// loadTrace loads the query trace from the file in env TEST_CACHE_TRACE,
+// one key (e.g. "qname qtype") per line. If it is not set, a zipf
+// trace with periodic scans of one-time names is generated.
+func loadTrace(b *testing.B) []strKey {
+	if fp := os.Getenv("TEST_CACHE_TRACE"); len(fp) > 0 {
+		f, err := os.Open(fp)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		var trace []strKey
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if l := strings.TrimSpace(s.Text()); len(l) > 0 {
+				trace = append(trace, strKey(l))
+			}
+		}
+		if err := s.Err(); err != nil {
+			b.Fatal(err)
+		}
+		return trace
+	}
+
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 1<<20)
+	trace := make([]strKey, 0, 1<<20)
+	scan := 0
+	for i := 0; i < 1<<20; i++ {
+		if i%(1<<16) < 1<<13 { // Scans
+			scan++
+			trace = append(trace, strKey(fmt.Sprintf("scan%d.", scan)))
+			continue
+		}
+		trace = append(trace, strKey(fmt.Sprintf("q%d.", zipf.Uint64())))
+	}
+	return trace
+}
+
+// Benchmark_Cache_HitRate replays a query trace and reports the hit rate
+// of each policy.
+func Benchmark_Cache_HitRate(b *testing.B) {
+	trace := loadTrace(b)
+	for _, p := range []struct {
+		name   string
+		policy Policy
+	}{{"random", PolicyRandom}, {"tinylfu", PolicyTinyLFU}} {
+		b.Run(p.name, func(b *testing.B) {
+			var hitRate float64
+			for i := 0; i < b.N; i++ {
+				c := New[strKey, struct{}](Opts{Size: 1 << 14, Policy: p.policy})
+				exp := time.Now().Add(time.Hour)
+				hit := 0
+				for _, k := range trace {
+					if _, _, ok := c.Get(k); ok {
+						hit++
+					} else {
+						c.Store(k, struct{}{}, exp)
+					}
+				}
+				c.Close()
+				hitRate = float64(hit) / float64(len(trace)) * 100
+			}
+			b.ReportMetric(hitRate, "hit%")
+		})
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_lru
+
+import (
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/lru"
+)
+
+// ShardedTinyLFU is a concurrent safe lru.TinyLFU with shards.
+type ShardedTinyLFU[K Hashable, V any] struct {
+	l []*ConcurrentTinyLFU[K, V]
+}
+
+// NewShardedTinyLFU returns a ShardedTinyLFU. maxCostPerShard <= 0 means
+// no cost limit.
+func NewShardedTinyLFU[K Hashable, V any](
+	shardNum, maxSizePerShard, maxCostPerShard int,
+	onEvict func(key K, v V),
+) *ShardedTinyLFU[K, V] {
+	cl := &ShardedTinyLFU[K, V]{
+		l: make([]*ConcurrentTinyLFU[K, V], 0, shardNum),
+	}
+
+	for i := 0; i < shardNum; i++ {
+		cl.l = append(cl.l, NewConcurrentTinyLFU[K, V](maxSizePerShard, maxCostPerShard, onEvict))
+	}
+
+	return cl
+}
+
+func (c *ShardedTinyLFU[K, V]) Add(key K, v V, cost int) {
+	c.getShard(key).Add(key, v, cost)
+}
+
+func (c *ShardedTinyLFU[K, V]) Del(key K) {
+	c.getShard(key).Del(key)
+}
+
+func (c *ShardedTinyLFU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int) {
+	for _, l := range c.l {
+		removed += l.Clean(f)
+	}
+	return removed
+}
+
+func (c *ShardedTinyLFU[K, V]) Flush() {
+	for _, l := range c.l {
+		l.Flush()
+	}
+}
+
+func (c *ShardedTinyLFU[K, V]) Get(key K) (v V, ok bool) {
+	return c.getShard(key).Get(key)
+}
+
+func (c *ShardedTinyLFU[K, V]) Len() int {
+	sum := 0
+	for _, l := range c.l {
+		sum += l.Len()
+	}
+	return sum
+}
+
+func (c *ShardedTinyLFU[K, V]) Cost() int {
+	sum := 0
+	for _, l := range c.l {
+		sum += l.Cost()
+	}
+	return sum
+}
+
+func (c *ShardedTinyLFU[K, V]) getShard(key K) *ConcurrentTinyLFU[K, V] {
+	return c.l[key.Sum()%uint64(len(c.l))]
+}
+
+// ConcurrentTinyLFU is a lru.TinyLFU with a lock.
+// It is concurrent safe.
+type ConcurrentTinyLFU[K Hashable, V any] struct {
+	sync.Mutex
+	lfu *lru.TinyLFU[K, V]
+}
+
+func NewConcurrentTinyLFU[K Hashable, V any](maxSize, maxCost int, onEvict func(key K, v V)) *ConcurrentTinyLFU[K, V] {
+	return &ConcurrentTinyLFU[K, V]{
+		lfu: lru.NewTinyLFU[K, V](maxSize, maxCost, onEvict),
+	}
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Add(key K, v V, cost int) {
+	c.Lock()
+	defer c.Unlock()
+	c.lfu.Add(key, v, cost)
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Del(key K) {
+	c.Lock()
+	defer c.Unlock()
+	c.lfu.Del(key)
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.lfu.Clean(f)
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.lfu.Flush()
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Get(key K) (v V, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.lfu.Get(key)
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lfu.Len()
+}
+
+func (c *ConcurrentTinyLFU[K, V]) Cost() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lfu.Cost()
+}
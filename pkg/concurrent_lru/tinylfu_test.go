@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package concurrent_lru
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestShardedTinyLFU(t *testing.T) {
+	c := NewShardedTinyLFU[testKey, int](4, 16, 160, nil)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 256; j++ {
+				k := testKey(i*256 + j)
+				c.Add(k, j, 5)
+				c.Get(k)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if l := c.Len(); l > 64 {
+		t.Fatalf("size overflow: %v", l)
+	}
+	if cost := c.Cost(); cost > 640 {
+		t.Fatalf("cost overflow: %v", cost)
+	}
+	c.Clean(func(key testKey, v int) bool { return true })
+	if l := c.Len(); l != 0 || c.Cost() != 0 {
+		t.Fatalf("clean failed, %v remain", l)
+	}
+}
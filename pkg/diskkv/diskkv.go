@@ -0,0 +1,524 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package diskkv implements a simple append-only on-disk key-value store.
+//
+// Every Put and Delete is appended to the file as one record, and an
+// in-memory index maps keys to record offsets. Values are read from the
+// file on Get. On Open, the file is scanned to rebuild the index. A torn
+// record at the end of the file (e.g. after a crash) is truncated. Once the
+// file has grown to twice its size after the last compaction, it is
+// rewritten with only the live records in the background. The index is
+// only locked to copy the records that were appended during the rewrite.
+package diskkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// crc32, expiration time, key length, value length, flags
+	headerLen = 4 + 8 + 4 + 4 + 1
+
+	maxKeyLen   = 1 << 16
+	maxValueLen = 1 << 24
+
+	flagDeleted = 1
+
+	defaultMinCompactSize = 1 << 20
+)
+
+var (
+	ErrClosed      = errors.New("db closed")
+	ErrKeyTooLarge = errors.New("key or value too large")
+)
+
+type Opts struct {
+	// SyncInterval is the interval to fsync the file. Records are written
+	// to the OS on every Put, so they survive a process crash even without
+	// fsync. 0 means never.
+	SyncInterval time.Duration
+
+	// MinCompactSize is the minimum file size to start a compaction.
+	// Default is 1MB.
+	MinCompactSize int64
+
+	// OnCompactError is called if a background compaction failed.
+	OnCompactError func(err error)
+}
+
+type pos struct {
+	off    int64 // Offset of the record.
+	keyLen uint32
+	valLen uint32
+	expire int64 // Unix nano.
+}
+
+// DB is an append-only on-disk key-value store. It is safe for concurrent use.
+type DB struct {
+	path string
+	opts Opts
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	compactMu   sync.Mutex    // Serializes compactions.
+	compactC    chan struct{} // Signals the background compaction.
+
+	m        sync.RWMutex
+	f        *os.File
+	closed   bool
+	gen      uint64 // Increased by Flush.
+	size     int64  // File size.
+	liveSize int64  // File size after the last compaction.
+	index    map[string]pos
+}
+
+// compactSnapshotHook is called by Compact after it took the snapshot
+// of the index. For tests.
+var compactSnapshotHook func()
+
+// Open opens or creates the db file at path.
+func Open(path string, opts Opts) (*DB, error) {
+	if opts.MinCompactSize <= 0 {
+		opts.MinCompactSize = defaultMinCompactSize
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		path:        path,
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+		compactC:    make(chan struct{}, 1),
+		f:           f,
+	}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.liveSize = db.size
+	if opts.SyncInterval > 0 {
+		go db.syncLoop()
+	}
+	go db.compactLoop()
+	return db, nil
+}
+
+// load rebuilds the index from the file.
+func (db *DB) load() error {
+	db.index = make(map[string]pos)
+	r := bufio.NewReader(db.f)
+	var off int64
+	buf := make([]byte, headerLen)
+	for {
+		p, deleted, key, err := readRecord(r, off, buf)
+		if err != nil {
+			if err != io.EOF {
+				// Torn or corrupted tail. Drop it.
+				if err := db.f.Truncate(off); err != nil {
+					return fmt.Errorf("failed to truncate broken tail, %w", err)
+				}
+			}
+			break
+		}
+		if deleted {
+			delete(db.index, key)
+		} else {
+			db.index[key] = p
+		}
+		off += headerLen + int64(p.keyLen) + int64(p.valLen)
+	}
+	db.size = off
+	return nil
+}
+
+// readRecord reads the record at off. It returns io.EOF if there is no
+// more record.
+func readRecord(r io.Reader, off int64, buf []byte) (p pos, deleted bool, key string, err error) {
+	if _, err = io.ReadFull(r, buf[:headerLen]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("torn header")
+		}
+		return
+	}
+	crc := binary.BigEndian.Uint32(buf)
+	p = pos{
+		off:    off,
+		expire: int64(binary.BigEndian.Uint64(buf[4:])),
+		keyLen: binary.BigEndian.Uint32(buf[12:]),
+		valLen: binary.BigEndian.Uint32(buf[16:]),
+	}
+	deleted = buf[20]&flagDeleted != 0
+	if p.keyLen > maxKeyLen || p.valLen > maxValueLen {
+		err = errors.New("invalid record length")
+		return
+	}
+	h := crc32.NewIEEE()
+	h.Write(buf[4:headerLen])
+	kv := make([]byte, p.keyLen+p.valLen)
+	if _, err = io.ReadFull(r, kv); err != nil {
+		err = errors.New("torn record")
+		return
+	}
+	h.Write(kv)
+	if h.Sum32() != crc {
+		err = errors.New("crc mismatched")
+		return
+	}
+	return p, deleted, string(kv[:p.keyLen]), nil
+}
+
+func encodeRecord(key string, val []byte, expire int64, flags byte) []byte {
+	b := make([]byte, headerLen+len(key)+len(val))
+	binary.BigEndian.PutUint64(b[4:], uint64(expire))
+	binary.BigEndian.PutUint32(b[12:], uint32(len(key)))
+	binary.BigEndian.PutUint32(b[16:], uint32(len(val)))
+	b[20] = flags
+	copy(b[headerLen:], key)
+	copy(b[headerLen+len(key):], val)
+	binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// Get returns the value of key. Expired values are not returned.
+func (db *DB) Get(key string) (val []byte, expire time.Time, ok bool, err error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.closed {
+		return nil, time.Time{}, false, ErrClosed
+	}
+	p, ok := db.index[key]
+	if !ok || p.expire <= time.Now().UnixNano() {
+		return nil, time.Time{}, false, nil
+	}
+	val, err = readValue(db.f, p)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	return val, time.Unix(0, p.expire), true, nil
+}
+
+func readValue(f *os.File, p pos) ([]byte, error) {
+	val := make([]byte, p.valLen)
+	if _, err := f.ReadAt(val, p.off+headerLen+int64(p.keyLen)); err != nil {
+		return nil, fmt.Errorf("failed to read value, %w", err)
+	}
+	return val, nil
+}
+
+// Put stores the value of key. It will be dropped after expire.
+func (db *DB) Put(key string, val []byte, expire time.Time) error {
+	if len(key) > maxKeyLen || len(val) > maxValueLen {
+		return ErrKeyTooLarge
+	}
+	db.m.Lock()
+	defer db.m.Unlock()
+	p := pos{off: db.size, keyLen: uint32(len(key)), valLen: uint32(len(val)), expire: expire.UnixNano()}
+	if err := db.append(encodeRecord(key, val, p.expire, 0)); err != nil {
+		return err
+	}
+	db.index[key] = p
+	db.maybeCompact()
+	return nil
+}
+
+// Delete deletes the value of key.
+func (db *DB) Delete(key string) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if _, ok := db.index[key]; !ok {
+		return nil
+	}
+	if err := db.append(encodeRecord(key, nil, 0, flagDeleted)); err != nil {
+		return err
+	}
+	delete(db.index, key)
+	db.maybeCompact()
+	return nil
+}
+
+// append appends b to the file. If it failed, the partial write is
+// truncated.
+func (db *DB) append(b []byte) error {
+	if db.closed {
+		return ErrClosed
+	}
+	if _, err := db.f.WriteAt(b, db.size); err != nil {
+		_ = db.f.Truncate(db.size)
+		return fmt.Errorf("failed to write record, %w", err)
+	}
+	db.size += int64(len(b))
+	return nil
+}
+
+// maybeCompact signals the background compaction if the file is big
+// enough. Caller must hold db.m.
+func (db *DB) maybeCompact() {
+	if db.size < db.opts.MinCompactSize || db.size < 2*db.liveSize {
+		return
+	}
+	select {
+	case db.compactC <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) compactLoop() {
+	for {
+		select {
+		case <-db.compactC:
+			if err := db.Compact(); err != nil && !errors.Is(err, ErrClosed) && db.opts.OnCompactError != nil {
+				db.opts.OnCompactError(err)
+			}
+		case <-db.closeNotify:
+			return
+		}
+	}
+}
+
+// Compact rewrites the file with only the live records. Records are copied
+// from a snapshot of the index without holding the lock, so Get, Put and
+// Delete are only blocked while the records appended during the copy are
+// moved to the new file.
+func (db *DB) Compact() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.m.RLock()
+	if db.closed {
+		db.m.RUnlock()
+		return ErrClosed
+	}
+	f, gen, snapSize := db.f, db.gen, db.size
+	snapshot := maps.Clone(db.index)
+	db.m.RUnlock()
+	if compactSnapshotHook != nil {
+		compactSnapshotHook()
+	}
+
+	tmpPath := db.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// Copy the live records in the snapshot. f is only replaced by
+	// compactions, which are serialized, and closed by Close and Flush,
+	// which are detected by db.closed and db.gen below.
+	now := time.Now().UnixNano()
+	w := bufio.NewWriter(tmp)
+	index := make(map[string]pos, len(snapshot))
+	var off int64
+	for key, p := range snapshot {
+		if p.expire <= now {
+			continue
+		}
+		val, err := readValue(f, p)
+		if err != nil {
+			if db.changed(gen) {
+				return nil
+			}
+			return err
+		}
+		b := encodeRecord(key, val, p.expire, 0)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		np := p
+		np.off = off
+		index[key] = np
+		off += int64(len(b))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.gen != gen { // Flushed. The snapshot is gone.
+		return nil
+	}
+
+	// Move the records that were appended during the copy.
+	tail := db.size - snapSize
+	if tail > 0 {
+		if _, err := io.Copy(tmp, io.NewSectionReader(f, snapSize, tail)); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+	}
+	for key, p := range db.index {
+		if p.off >= snapSize {
+			p.off = off + p.off - snapSize
+			index[key] = p
+		}
+		// Otherwise, the record is not changed since the snapshot, and
+		// it is in index unless it was expired.
+	}
+	for key := range index {
+		if _, ok := db.index[key]; !ok { // Deleted during the copy.
+			delete(index, key)
+		}
+	}
+
+	// The old file must be closed before it is replaced on some systems.
+	db.f.Close()
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		f, openErr := os.OpenFile(db.path, os.O_RDWR, 0644)
+		if openErr != nil {
+			db.closed = true
+			return fmt.Errorf("failed to reopen db after %w, %w", err, openErr)
+		}
+		db.f = f
+		return err
+	}
+	renamed = true
+	db.f = tmp
+	db.index = index
+	db.size = off + tail
+	db.liveSize = db.size
+	return nil
+}
+
+// changed reports whether db was flushed or closed after gen.
+func (db *DB) changed(gen uint64) bool {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return db.closed || db.gen != gen
+}
+
+// Range calls f through all live records. If f returns an error, the
+// same error will be returned by Range. f must not call other methods of db.
+func (db *DB) Range(f func(key string, val []byte, expire time.Time) error) error {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	now := time.Now().UnixNano()
+	for key, p := range db.index {
+		if p.expire <= now {
+			continue
+		}
+		val, err := readValue(db.f, p)
+		if err != nil {
+			return err
+		}
+		if err := f(key, val, time.Unix(0, p.expire)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of records, including expired ones that have
+// not been compacted.
+func (db *DB) Len() int {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return len(db.index)
+}
+
+// Size returns the file size.
+func (db *DB) Size() int64 {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	return db.size
+}
+
+// Flush deletes all records.
+func (db *DB) Flush() error {
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := db.f.Truncate(0); err != nil {
+		return err
+	}
+	db.index = make(map[string]pos)
+	db.gen++
+	db.size = 0
+	db.liveSize = 0
+	return nil
+}
+
+// Sync commits the file to the disk.
+func (db *DB) Sync() error {
+	db.m.RLock()
+	defer db.m.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.f.Sync()
+}
+
+func (db *DB) syncLoop() {
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = db.Sync()
+		case <-db.closeNotify:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the file.
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() { close(db.closeNotify) })
+	db.m.Lock()
+	defer db.m.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if err := db.f.Sync(); err != nil {
+		db.f.Close()
+		return err
+	}
+	return db.f.Close()
+}
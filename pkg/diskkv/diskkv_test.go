@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package diskkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DB(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, Opts{})
+	r.NoError(err)
+
+	exp := time.Now().Add(time.Hour)
+	r.NoError(db.Put("a", []byte("1"), exp))
+	r.NoError(db.Put("b", []byte("2"), exp))
+	r.NoError(db.Put("a", []byte("3"), exp))
+	r.NoError(db.Put("expired", []byte("4"), time.Now().Add(-time.Second)))
+	r.NoError(db.Delete("b"))
+
+	check := func() {
+		t.Helper()
+		v, e, ok, err := db.Get("a")
+		r.NoError(err)
+		r.True(ok)
+		r.Equal("3", string(v))
+		r.Equal(exp.UnixNano(), e.UnixNano())
+		for _, k := range []string{"b", "expired", "none"} {
+			_, _, ok, err = db.Get(k)
+			r.NoError(err)
+			r.False(ok, k)
+		}
+	}
+	check()
+
+	// Reopen.
+	r.NoError(db.Close())
+	_, _, _, err = db.Get("a")
+	r.ErrorIs(err, ErrClosed)
+	db, err = Open(path, Opts{})
+	r.NoError(err)
+	check()
+
+	// Torn tail.
+	size := db.Size()
+	r.NoError(db.Close())
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	r.NoError(err)
+	_, err = f.Write(encodeRecord("c", []byte("5"), exp.UnixNano(), 0)[:headerLen+1])
+	r.NoError(err)
+	r.NoError(f.Close())
+	db, err = Open(path, Opts{})
+	r.NoError(err)
+	r.Equal(size, db.Size())
+	check()
+	r.NoError(db.Put("c", []byte("5"), exp))
+
+	// Compaction.
+	r.NoError(db.Compact())
+	r.Equal(2, db.Len())
+	check()
+	n := 0
+	r.NoError(db.Range(func(key string, val []byte, expire time.Time) error {
+		n++
+		return nil
+	}))
+	r.Equal(2, n)
+
+	r.NoError(db.Flush())
+	r.Equal(0, db.Len())
+	r.NoError(db.Close())
+}
+
+func Test_DB_AutoCompact(t *testing.T) {
+	r := require.New(t)
+	db, err := Open(filepath.Join(t.TempDir(), "db"), Opts{MinCompactSize: 4096})
+	r.NoError(err)
+	defer db.Close()
+
+	exp := time.Now().Add(time.Hour)
+	for i := 0; i < 10000; i++ {
+		r.NoError(db.Put(fmt.Sprintf("k%d", i%10), make([]byte, 100), exp))
+	}
+	r.Equal(10, db.Len())
+	r.Eventually(func() bool { return db.Size() < 3*4096 }, time.Second, time.Millisecond*10)
+}
+
+func Test_DB_WriteDuringCompaction(t *testing.T) {
+	r := require.New(t)
+	db, err := Open(filepath.Join(t.TempDir(), "db"), Opts{})
+	r.NoError(err)
+	defer db.Close()
+
+	exp := time.Now().Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		r.NoError(db.Put(fmt.Sprintf("k%d", i), []byte("old"), exp))
+	}
+
+	// Get, Put and Delete are not blocked by the copy of the snapshot.
+	compactSnapshotHook = func() {
+		r.NoError(db.Put("k0", []byte("new"), exp))
+		r.NoError(db.Put("new", []byte("new"), exp))
+		r.NoError(db.Delete("k1"))
+		_, _, ok, err := db.Get("k2")
+		r.NoError(err)
+		r.True(ok)
+	}
+	defer func() { compactSnapshotHook = nil }()
+	r.NoError(db.Compact())
+
+	check := func() {
+		t.Helper()
+		r.Equal(100, db.Len())
+		for k, want := range map[string]string{"k0": "new", "new": "new", "k2": "old", "k99": "old"} {
+			v, _, ok, err := db.Get(k)
+			r.NoError(err)
+			r.True(ok, k)
+			r.Equal(want, string(v), k)
+		}
+		_, _, ok, err := db.Get("k1")
+		r.NoError(err)
+		r.False(ok)
+	}
+	check()
+
+	// The compacted file is valid.
+	compactSnapshotHook = nil
+	path := db.path
+	r.NoError(db.Close())
+	db, err = Open(path, Opts{})
+	r.NoError(err)
+	check()
+	r.NoError(db.Close())
+}
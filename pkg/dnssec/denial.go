@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MaxNSEC3Iterations is the maximum NSEC3 iterations that will be processed.
+// Responses with higher iterations should be treated as insecure. (RFC 9276 3.2)
+const MaxNSEC3Iterations = 150
+
+// CanonicalCompare compares two names in the canonical order. (RFC 4034 6.1)
+func CanonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(la), len(lb))
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	return slices.Contains(bitmap, t)
+}
+
+func equalName(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// isDelegation reports whether the bitmap is from the parent side of a zone cut.
+func isDelegation(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// NSECCovers reports whether name is between the owner and the next name
+// of nsec. That is, name does not exist.
+func NSECCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if CanonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	// Names below a zone cut are not in this zone. (RFC 4035 5.4)
+	if (isDelegation(nsec.TypeBitMap) || hasType(nsec.TypeBitMap, dns.TypeDNAME)) && dns.IsSubDomain(owner, name) {
+		return false
+	}
+	if CanonicalCompare(owner, next) < 0 {
+		return CanonicalCompare(name, next) < 0
+	}
+	// The last NSEC of the zone. Next is the apex.
+	return dns.IsSubDomain(next, name)
+}
+
+// closestEncloser returns the closest encloser of name proved by an
+// nsec that covers name.
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	n := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+	return suffix(name, n)
+}
+
+// suffix returns the last n labels of name.
+func suffix(name string, n int) string {
+	idx := dns.Split(name)
+	if n <= 0 || len(idx) == 0 {
+		return "."
+	}
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+// nextCloser returns the name that is one label longer than ce towards name.
+func nextCloser(ce, name string) string {
+	return suffix(name, dns.CountLabel(ce)+1)
+}
+
+func wildcardOf(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// NSEC3IterationsTooHigh reports whether any record exceeds MaxNSEC3Iterations.
+func NSEC3IterationsTooHigh(nsec3s []*dns.NSEC3) bool {
+	for _, n := range nsec3s {
+		if n.Iterations > MaxNSEC3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Covers reports whether name is covered by n. Unlike n.Cover,
+// it is false if name matches n.
+func nsec3Covers(n *dns.NSEC3, name string) bool {
+	return n.Cover(name) && !n.Match(name)
+}
+
+// nsec3ClosestEncloser does the closest encloser proof. (RFC 5155 8.3)
+// ok is false if there is no proof or name exists.
+func nsec3ClosestEncloser(name string, nsec3s []*dns.NSEC3) (ce string, optOut bool, ok bool) {
+	next := name
+	for n := name; ; {
+		for _, m := range nsec3s {
+			if !m.Match(n) {
+				continue
+			}
+			if n == name {
+				return "", false, false
+			}
+			// The closest encloser can not be a zone cut. (RFC 5155 8.3)
+			if isDelegation(m.TypeBitMap) || hasType(m.TypeBitMap, dns.TypeDNAME) {
+				return "", false, false
+			}
+			for _, c := range nsec3s {
+				if nsec3Covers(c, next) {
+					return n, c.Flags&1 == 1, true
+				}
+			}
+			return "", false, false
+		}
+		if n == "." {
+			return "", false, false
+		}
+		next = n
+		i, end := dns.NextLabel(n, 0)
+		if end {
+			n = "."
+		} else {
+			n = n[i:]
+		}
+	}
+}
+
+// ClosestEncloser returns the closest encloser of name if the records
+// prove that name does not exist. The records must be validated by the caller.
+func ClosestEncloser(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) (string, bool) {
+	name = dns.CanonicalName(name)
+	if len(nsec3s) > 0 {
+		ce, _, ok := nsec3ClosestEncloser(name, nsec3s)
+		return ce, ok
+	}
+	for _, n := range nsecs {
+		if NSECCovers(n, name) && !dns.IsSubDomain(name, n.NextDomain) {
+			return closestEncloser(name, n), true
+		}
+	}
+	return "", false
+}
+
+// ProveNXDomain reports whether the records prove that name does not exist
+// and there is no wildcard that can be expanded to name.
+// The records must be validated by the caller.
+func ProveNXDomain(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	name = dns.CanonicalName(name)
+	if len(nsec3s) > 0 {
+		ce, _, ok := nsec3ClosestEncloser(name, nsec3s)
+		if !ok {
+			return false
+		}
+		wc := wildcardOf(ce)
+		for _, n := range nsec3s {
+			if nsec3Covers(n, wc) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, n := range nsecs {
+		if !NSECCovers(n, name) || dns.IsSubDomain(name, n.NextDomain) {
+			continue // Not covered or an empty non-terminal.
+		}
+		wc := wildcardOf(closestEncloser(name, n))
+		for _, w := range nsecs {
+			if NSECCovers(w, wc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProveNoData reports whether the records prove that name exists but has
+// no record of qtype (including wildcard no data). For DS, an insecure
+// delegation (opt-out) is also a proof. The records must be validated by the caller.
+func ProveNoData(name string, qtype uint16, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	name = dns.CanonicalName(name)
+	noType := func(bitmap []uint16) bool {
+		if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+			return false
+		}
+		if qtype == dns.TypeDS {
+			// Must be from the parent side. (RFC 6840 4.4)
+			return !hasType(bitmap, dns.TypeSOA) || name == "."
+		}
+		return !isDelegation(bitmap)
+	}
+
+	if len(nsec3s) > 0 {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				return noType(n.TypeBitMap)
+			}
+		}
+		ce, optOut, ok := nsec3ClosestEncloser(name, nsec3s)
+		if !ok {
+			return false
+		}
+		if qtype == dns.TypeDS && optOut {
+			return true // RFC 5155 8.6
+		}
+		wc := wildcardOf(ce)
+		for _, n := range nsec3s {
+			if n.Match(wc) {
+				return noType(n.TypeBitMap) // RFC 5155 8.7
+			}
+		}
+		return false
+	}
+
+	for _, n := range nsecs {
+		if equalName(n.Hdr.Name, name) {
+			return noType(n.TypeBitMap)
+		}
+	}
+	for _, n := range nsecs {
+		if !NSECCovers(n, name) {
+			continue
+		}
+		// Empty non-terminal.
+		if dns.IsSubDomain(name, n.NextDomain) {
+			return true
+		}
+		// Wildcard no data.
+		wc := wildcardOf(closestEncloser(name, n))
+		for _, w := range nsecs {
+			if equalName(w.Hdr.Name, wc) {
+				return noType(w.TypeBitMap)
+			}
+		}
+	}
+	return false
+}
+
+// ProveInsecureDelegation reports whether the records prove that name is a
+// delegation without DS. The records must be validated by the caller.
+func ProveInsecureDelegation(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	name = dns.CanonicalName(name)
+	insecure := func(bitmap []uint16) bool {
+		return isDelegation(bitmap) && !hasType(bitmap, dns.TypeDS)
+	}
+	if len(nsec3s) > 0 {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				return insecure(n.TypeBitMap)
+			}
+		}
+		_, optOut, ok := nsec3ClosestEncloser(name, nsec3s)
+		return ok && optOut
+	}
+	for _, n := range nsecs {
+		if equalName(n.Hdr.Name, name) {
+			return insecure(n.TypeBitMap)
+		}
+	}
+	return false
+}
+
+// ProveWildcardAnswer reports whether the records prove that name does not
+// exist, so the answer expanded from the wildcard at ce is correct.
+// (RFC 4035 5.3.4, RFC 5155 8.8)
+func ProveWildcardAnswer(name, ce string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	name = dns.CanonicalName(name)
+	if len(nsec3s) > 0 {
+		nc := nextCloser(ce, name)
+		for _, n := range nsec3s {
+			if nsec3Covers(n, nc) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, n := range nsecs {
+		if NSECCovers(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// DenialRecords picks the NSEC and NSEC3 records in rrs.
+func DenialRecords(rrs []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// NSEC3OptOut reports whether the next closer name of name is covered by
+// an opt-out NSEC3. If so, name may be under an insecure delegation and
+// the denial can not be proved secure. (RFC 5155 9.2)
+func NSEC3OptOut(name string, nsec3s []*dns.NSEC3) bool {
+	_, optOut, ok := nsec3ClosestEncloser(dns.CanonicalName(name), nsec3s)
+	return ok && optOut
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"crypto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t testing.TB, zone string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	require.NoError(t, err)
+	return k, priv.(crypto.Signer)
+}
+
+func sign(t testing.TB, k *dns.DNSKEY, priv crypto.Signer, rrs []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		Algorithm:   k.Algorithm,
+		Labels:      uint8(dns.CountLabel(h.Name)),
+		OrigTtl:     h.Ttl,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      k.KeyTag(),
+		SignerName:  k.Hdr.Name,
+	}
+	if strings.HasPrefix(h.Name, "*.") {
+		sig.Labels--
+	}
+	require.NoError(t, sig.Sign(priv, rrs))
+	return sig
+}
+
+func mustRR(t testing.TB, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func Test_VerifyRRSet(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	k, priv := newKey(t, "example.", 257)
+	other, _ := newKey(t, "example.", 257)
+	rrs := []dns.RR{mustRR(t, "www.example. 300 IN A 1.2.3.4")}
+
+	set := &RRSet{Name: "www.example.", Type: dns.TypeA, RRs: rrs}
+	_, err := VerifyRRSet(set, []*dns.DNSKEY{k}, now)
+	r.Equal(dns.ExtendedErrorCodeRRSIGsMissing, err.(*Error).Code)
+
+	set.Sigs = []*dns.RRSIG{sign(t, k, priv, rrs, now.Add(-time.Hour), now.Add(time.Hour))}
+	sig, err := VerifyRRSet(set, []*dns.DNSKEY{k}, now)
+	r.NoError(err)
+	r.Equal(uint32(300), SigTTL(set, sig, now))
+	_, ok := IsWildcardExpansion(sig)
+	r.False(ok)
+
+	_, err = VerifyRRSet(set, []*dns.DNSKEY{other}, now)
+	r.Equal(dns.ExtendedErrorCodeDNSKEYMissing, err.(*Error).Code)
+	_, err = VerifyRRSet(set, []*dns.DNSKEY{k}, now.Add(time.Hour*2))
+	r.Equal(dns.ExtendedErrorCodeSignatureExpired, err.(*Error).Code)
+	_, err = VerifyRRSet(set, []*dns.DNSKEY{k}, now.Add(-time.Hour*2))
+	r.Equal(dns.ExtendedErrorCodeSignatureNotYetValid, err.(*Error).Code)
+
+	tampered := &RRSet{Name: set.Name, Type: set.Type, RRs: []dns.RR{mustRR(t, "www.example. 300 IN A 1.2.3.5")}, Sigs: set.Sigs}
+	_, err = VerifyRRSet(tampered, []*dns.DNSKEY{k}, now)
+	r.Equal(dns.ExtendedErrorCodeDNSBogus, err.(*Error).Code)
+
+	// Wildcard.
+	wrrs := []dns.RR{mustRR(t, "*.w.example. 300 IN A 1.2.3.4")}
+	wsig := sign(t, k, priv, wrrs, now.Add(-time.Hour), now.Add(time.Hour))
+	expanded := mustRR(t, "a.w.example. 300 IN A 1.2.3.4")
+	wsig.Hdr.Name = "a.w.example."
+	sig, err = VerifyRRSet(&RRSet{Name: "a.w.example.", Type: dns.TypeA, RRs: []dns.RR{expanded}, Sigs: []*dns.RRSIG{wsig}}, []*dns.DNSKEY{k}, now)
+	r.NoError(err)
+	ce, ok := IsWildcardExpansion(sig)
+	r.True(ok)
+	r.Equal("w.example.", ce)
+
+	// DS
+	ds := k.ToDS(dns.SHA256)
+	r.Equal([]*dns.DNSKEY{k}, MatchDS([]dns.RR{k, other}, []*dns.DS{ds}))
+	r.True(HasSupportedDS([]*dns.DS{ds}))
+	ds.Algorithm = 200
+	r.False(HasSupportedDS([]*dns.DS{ds}))
+}
+
+func Test_SplitRRSets(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	k, priv := newKey(t, "example.", 257)
+	a := mustRR(t, "www.example. 300 IN A 1.2.3.4")
+	b := mustRR(t, "WWW.example. 300 IN A 1.2.3.5")
+	c := mustRR(t, "www.example. 300 IN AAAA ::1")
+	sig := sign(t, k, priv, []dns.RR{a, b}, now, now.Add(time.Hour))
+	sets := SplitRRSets([]dns.RR{a, c, sig, b, mustRR(t, "x.example. 300 IN RRSIG A 13 2 300 20300101000000 20000101000000 1 example. AAAA")})
+	r.Len(sets, 2)
+	r.Equal([]dns.RR{a, b}, sets[0].RRs)
+	r.Equal([]*dns.RRSIG{sig}, sets[0].Sigs)
+	r.Empty(sets[1].Sigs)
+}
+
+// testZone is example. with:
+// a. (A), c. (A), *.w. (A), sub. (delegation), x.y. (A, y is an empty non-terminal).
+var testZone = map[string][]uint16{
+	"example.":     {dns.TypeSOA, dns.TypeNS},
+	"a.example.":   {dns.TypeA},
+	"c.example.":   {dns.TypeA},
+	"*.w.example.": {dns.TypeA},
+	"sub.example.": {dns.TypeNS},
+	"x.y.example.": {dns.TypeA},
+}
+
+func sortedNames(names []string) []string {
+	slices.SortFunc(names, CanonicalCompare)
+	return names
+}
+
+func buildNSECs(zone map[string][]uint16) []*dns.NSEC {
+	var names []string
+	for n := range zone {
+		names = append(names, n)
+	}
+	names = sortedNames(names)
+	var out []*dns.NSEC
+	for i, n := range names {
+		types := append(slices.Clone(zone[n]), dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(types)
+		out = append(out, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: n, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: types,
+		})
+	}
+	return out
+}
+
+func buildNSEC3s(zone map[string][]uint16, apex string, optOut bool) []*dns.NSEC3 {
+	all := make(map[string][]uint16)
+	for n, types := range zone {
+		if optOut && slices.Equal(types, []uint16{dns.TypeNS}) {
+			continue // Insecure delegations are opted out.
+		}
+		all[n] = types
+		// Empty non-terminals.
+		for p := n; p != apex; {
+			i, _ := dns.NextLabel(p, 0)
+			p = p[i:]
+			if _, ok := all[p]; !ok {
+				if _, ok := zone[p]; !ok {
+					all[p] = nil
+				}
+			}
+		}
+	}
+	type h struct {
+		hash  string
+		types []uint16
+	}
+	var hs []h
+	for n, types := range all {
+		hs = append(hs, h{hash: dns.HashName(n, dns.SHA1, 0, ""), types: types})
+	}
+	slices.SortFunc(hs, func(a, b h) int { return strings.Compare(a.hash, b.hash) })
+	var out []*dns.NSEC3
+	for i, x := range hs {
+		var flags uint8
+		if optOut {
+			flags = 1
+		}
+		types := slices.Clone(x.types)
+		if len(types) > 0 {
+			types = append(types, dns.TypeRRSIG)
+			slices.Sort(types)
+		}
+		out = append(out, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: x.hash + "." + apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: hs[(i+1)%len(hs)].hash,
+			HashLength: 20,
+			TypeBitMap: types,
+		})
+	}
+	return out
+}
+
+func Test_CanonicalCompare(t *testing.T) {
+	r := require.New(t)
+	got := sortedNames(slices.Clone([]string{"z.example.", "example.", "*.z.example.", "Z.a.example.", "a.example.", "zABC.a.EXAMPLE.", "yljkjljk.a.example."}))
+	r.Equal([]string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}, got)
+}
+
+func Test_DenialNSEC(t *testing.T) {
+	r := require.New(t)
+	nsecs := buildNSECs(testZone)
+
+	r.True(ProveNXDomain("b.example.", nsecs, nil))
+	r.True(ProveNXDomain("zzz.example.", nsecs, nil)) // Covered by the last nsec.
+	r.False(ProveNXDomain("a.example.", nsecs, nil))
+	r.False(ProveNXDomain("y.example.", nsecs, nil)) // Empty non-terminal.
+	r.False(ProveNXDomain("q.w.example.", nsecs, nil))
+	r.False(ProveNXDomain("foo.sub.example.", nsecs, nil))
+	r.False(ProveNXDomain("b.example.", nil, nil))
+
+	r.True(ProveNoData("a.example.", dns.TypeAAAA, nsecs, nil))
+	r.False(ProveNoData("a.example.", dns.TypeA, nsecs, nil))
+	r.True(ProveNoData("y.example.", dns.TypeA, nsecs, nil))
+	r.True(ProveNoData("q.w.example.", dns.TypeAAAA, nsecs, nil))
+	r.False(ProveNoData("q.w.example.", dns.TypeA, nsecs, nil))
+	r.False(ProveNoData("sub.example.", dns.TypeA, nsecs, nil)) // Parent side.
+	r.True(ProveNoData("sub.example.", dns.TypeDS, nsecs, nil))
+	r.False(ProveNoData("example.", dns.TypeDS, nsecs, nil)) // Child side.
+
+	r.True(ProveWildcardAnswer("q.w.example.", "w.example.", nsecs, nil))
+	r.False(ProveWildcardAnswer("a.example.", "example.", nsecs, nil))
+
+	r.True(ProveInsecureDelegation("sub.example.", nsecs, nil))
+	r.False(ProveInsecureDelegation("a.example.", nsecs, nil))
+
+	ce, ok := ClosestEncloser("q.w.example.", nsecs, nil)
+	r.True(ok)
+	r.Equal("w.example.", ce)
+	_, ok = ClosestEncloser("y.example.", nsecs, nil)
+	r.False(ok)
+}
+
+func Test_DenialNSEC3(t *testing.T) {
+	r := require.New(t)
+	nsec3s := buildNSEC3s(testZone, "example.", false)
+
+	r.True(ProveNXDomain("b.example.", nil, nsec3s))
+	r.False(ProveNXDomain("a.example.", nil, nsec3s))
+	r.False(ProveNXDomain("y.example.", nil, nsec3s))
+	r.False(ProveNXDomain("q.w.example.", nil, nsec3s))
+	r.False(ProveNXDomain("foo.sub.example.", nil, nsec3s)) // Below a zone cut.
+
+	r.True(ProveNoData("a.example.", dns.TypeAAAA, nil, nsec3s))
+	r.False(ProveNoData("a.example.", dns.TypeA, nil, nsec3s))
+	r.True(ProveNoData("y.example.", dns.TypeA, nil, nsec3s))
+	r.True(ProveNoData("q.w.example.", dns.TypeAAAA, nil, nsec3s))
+	r.False(ProveNoData("q.w.example.", dns.TypeA, nil, nsec3s))
+	r.True(ProveNoData("sub.example.", dns.TypeDS, nil, nsec3s))
+
+	r.True(ProveWildcardAnswer("q.w.example.", "w.example.", nil, nsec3s))
+	r.True(ProveInsecureDelegation("sub.example.", nil, nsec3s))
+	r.False(ProveInsecureDelegation("a.example.", nil, nsec3s))
+	r.False(NSEC3OptOut("b.example.", nsec3s))
+	r.False(NSEC3IterationsTooHigh(nsec3s))
+
+	ce, ok := ClosestEncloser("q.w.example.", nil, nsec3s)
+	r.True(ok)
+	r.Equal("w.example.", ce)
+
+	// Opt-out
+	nsec3s = buildNSEC3s(testZone, "example.", true)
+	r.True(ProveInsecureDelegation("sub.example.", nil, nsec3s))
+	r.True(ProveNoData("sub.example.", dns.TypeDS, nil, nsec3s))
+	r.True(NSEC3OptOut("b.example.", nsec3s))
+}
+
+func Test_TrustAnchors(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	k1, p1 := newKey(t, ".", 257)
+	k2, p2 := newKey(t, ".", 257)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	newTA := func() *TrustAnchors {
+		ta, err := NewTrustAnchors([]string{k1.ToDS(dns.SHA256).String()}, TrustAnchorsOpts{StateFile: stateFile})
+		r.NoError(err)
+		return ta
+	}
+	newSet := func(at time.Time, keys ...any) *RRSet {
+		set := &RRSet{Name: ".", Type: dns.TypeDNSKEY}
+		for i := 0; i < len(keys); i += 2 {
+			set.RRs = append(set.RRs, keys[i].(*dns.DNSKEY))
+		}
+		for i := 0; i < len(keys); i += 2 {
+			set.Sigs = append(set.Sigs, sign(t, keys[i].(*dns.DNSKEY), keys[i+1].(crypto.Signer), set.RRs, at.Add(-time.Hour), at.Add(time.Hour)))
+		}
+		return set
+	}
+	state := func(ta *TrustAnchors, k *dns.DNSKEY) string {
+		for _, s := range ta.States() {
+			if s.key != nil && keyID(s.key) == keyID(k) {
+				return s.State
+			}
+		}
+		return ""
+	}
+
+	ta := newTA()
+	zone, ok := ta.Closest("www.example.")
+	r.True(ok)
+	r.Equal(".", zone)
+
+	// k2 is published and signed by k1.
+	_, _, err := ta.VerifyDNSKEYs(newSet(now, k1, p1, k2, p2), now)
+	r.NoError(err)
+	r.Equal(KeyValid, state(ta, k1))
+	r.Equal(KeyAddPend, state(ta, k2))
+
+	// Not trusted before the hold-down time.
+	_, _, err = ta.VerifyDNSKEYs(newSet(now, k2, p2), now)
+	r.Error(err)
+	later := now.Add(DefaultHoldDown + time.Hour)
+	_, _, err = ta.VerifyDNSKEYs(newSet(later, k1, p1, k2, p2), later)
+	r.NoError(err)
+	r.Equal(KeyValid, state(ta, k2))
+
+	// k1 is revoked.
+	revoked := *k1
+	revoked.Flags |= dns.REVOKE
+	_, _, err = ta.VerifyDNSKEYs(newSet(later, &revoked, p1, k2, p2), later)
+	r.NoError(err)
+	r.Equal(KeyRevoked, state(ta, k1))
+
+	// States are persisted.
+	ta = newTA()
+	r.Equal(KeyRevoked, state(ta, k1))
+	r.Equal(KeyValid, state(ta, k2))
+	_, _, err = ta.VerifyDNSKEYs(newSet(later, k1, p1), later)
+	r.Error(err, "revoked key must not be trusted even it matches the ds")
+	_, _, err = ta.VerifyDNSKEYs(newSet(later, k2, p2), later)
+	r.NoError(err)
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootAnchors are the root KSK DS records. (KSK-2017 and KSK-2024)
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+var RootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RFC 5011 key states.
+const (
+	KeyAddPend = "AddPend"
+	KeyValid   = "Valid"
+	KeyMissing = "Missing"
+	KeyRevoked = "Revoked"
+)
+
+// DefaultHoldDown is the add and remove hold-down time. (RFC 5011 2.4.1)
+const DefaultHoldDown = time.Hour * 24 * 30
+
+// TrustAnchors holds configured trust anchors and maintains their
+// keys by RFC 5011 automated updates.
+// It is safe for concurrent use.
+type TrustAnchors struct {
+	stateFile string
+	holdDown  time.Duration
+
+	m       sync.Mutex
+	anchors map[string]*anchor // zone name
+}
+
+type anchor struct {
+	ds   []*dns.DS
+	keys map[string]*KeyState // key id
+}
+
+// KeyState is the RFC 5011 state of a trust anchor key.
+type KeyState struct {
+	Zone      string    `json:"zone"`
+	Key       string    `json:"key"` // DNSKEY in presentation format.
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	key *dns.DNSKEY
+}
+
+type TrustAnchorsOpts struct {
+	// StateFile stores the RFC 5011 key states. If empty, states are
+	// kept in memory only.
+	StateFile string
+
+	// HoldDown is the RFC 5011 hold-down time. Default is DefaultHoldDown.
+	HoldDown time.Duration
+}
+
+// NewTrustAnchors creates TrustAnchors from DS or DNSKEY records in
+// the presentation format. Key states in opts.StateFile will be loaded.
+func NewTrustAnchors(rrs []string, opts TrustAnchorsOpts) (*TrustAnchors, error) {
+	if opts.HoldDown <= 0 {
+		opts.HoldDown = DefaultHoldDown
+	}
+	ta := &TrustAnchors{
+		stateFile: opts.StateFile,
+		holdDown:  opts.HoldDown,
+		anchors:   make(map[string]*anchor),
+	}
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %s, %w", s, err)
+		}
+		if rr == nil {
+			continue
+		}
+		a := ta.anchorLocked(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.DS:
+			a.ds = append(a.ds, rr)
+		case *dns.DNSKEY:
+			a.keys[keyID(rr)] = &KeyState{Zone: dns.CanonicalName(rr.Hdr.Name), Key: rr.String(), State: KeyValid, key: rr}
+		default:
+			return nil, fmt.Errorf("trust anchor must be a DS or DNSKEY record, got %s", dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	if len(ta.anchors) == 0 {
+		return nil, errors.New("no trust anchor")
+	}
+	if len(ta.stateFile) > 0 {
+		if err := ta.load(); err != nil {
+			return nil, err
+		}
+	}
+	return ta, nil
+}
+
+// ReadTrustAnchors reads DS or DNSKEY records from a zone file.
+func ReadTrustAnchors(r io.Reader) ([]string, error) {
+	var out []string
+	zp := dns.NewZoneParser(r, ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		out = append(out, rr.String())
+	}
+	return out, zp.Err()
+}
+
+func (ta *TrustAnchors) anchorLocked(zone string) *anchor {
+	zone = dns.CanonicalName(zone)
+	a := ta.anchors[zone]
+	if a == nil {
+		a = &anchor{keys: make(map[string]*KeyState)}
+		ta.anchors[zone] = a
+	}
+	return a
+}
+
+// keyID identifies a key regardless of its revoke bit.
+func keyID(k *dns.DNSKEY) string {
+	return fmt.Sprintf("%s %d %d %s", dns.CanonicalName(k.Hdr.Name), k.Flags&^dns.REVOKE, k.Algorithm, k.PublicKey)
+}
+
+// Closest returns the trust anchor zone that is the closest ancestor of name.
+func (ta *TrustAnchors) Closest(name string) (string, bool) {
+	ta.m.Lock()
+	defer ta.m.Unlock()
+	best := ""
+	for zone := range ta.anchors {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	return best, len(best) > 0
+}
+
+// IsAnchor reports whether zone has a trust anchor.
+func (ta *TrustAnchors) IsAnchor(zone string) bool {
+	ta.m.Lock()
+	defer ta.m.Unlock()
+	_, ok := ta.anchors[dns.CanonicalName(zone)]
+	return ok
+}
+
+// States returns the key states of all anchors.
+func (ta *TrustAnchors) States() []KeyState {
+	ta.m.Lock()
+	defer ta.m.Unlock()
+	return ta.statesLocked()
+}
+
+func (ta *TrustAnchors) statesLocked() []KeyState {
+	var out []KeyState
+	for _, a := range ta.anchors {
+		for _, s := range a.keys {
+			out = append(out, *s)
+		}
+	}
+	return out
+}
+
+// trustedLocked returns the trusted keys in set.
+func (a *anchor) trustedLocked(set *RRSet) []*dns.DNSKEY {
+	var out []*dns.DNSKEY
+	for _, k := range MatchDS(set.RRs, a.ds) {
+		if s := a.keys[keyID(k)]; s != nil && s.State == KeyRevoked {
+			continue
+		}
+		out = append(out, k)
+	}
+	for _, rr := range set.RRs {
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok || k.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		if s := a.keys[keyID(k)]; s != nil && (s.State == KeyValid || s.State == KeyMissing) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// VerifyDNSKEYs verifies the DNSKEY RRSet of a trust anchor zone. On
+// success, the RFC 5011 key states are updated.
+func (ta *TrustAnchors) VerifyDNSKEYs(set *RRSet, now time.Time) ([]*dns.DNSKEY, *dns.RRSIG, error) {
+	ta.m.Lock()
+	defer ta.m.Unlock()
+	a := ta.anchors[set.Name]
+	if a == nil {
+		return nil, nil, errorf(dns.ExtendedErrorCodeDNSKEYMissing, "%s has no trust anchor", set.Name)
+	}
+	keys, sig, err := VerifyDNSKEYs(set, a.trustedLocked(set), now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ta.updateLocked(a, set, now) && len(ta.stateFile) > 0 {
+		if err := ta.saveLocked(); err != nil {
+			return nil, nil, fmt.Errorf("failed to save trust anchor state, %w", err)
+		}
+	}
+	return keys, sig, nil
+}
+
+// updateLocked runs the RFC 5011 state machine with a validated DNSKEY
+// RRSet. It reports whether states were changed.
+func (ta *TrustAnchors) updateLocked(a *anchor, set *RRSet, now time.Time) bool {
+	changed := false
+	trusted := make(map[string]struct{})
+	for _, k := range MatchDS(set.RRs, a.ds) {
+		trusted[keyID(k)] = struct{}{}
+	}
+
+	seen := make(map[string]struct{})
+	for _, rr := range set.RRs {
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok || k.Flags&dns.SEP == 0 {
+			continue
+		}
+		id := keyID(k)
+		seen[id] = struct{}{}
+		s := a.keys[id]
+		if k.Flags&dns.REVOKE != 0 {
+			if s != nil && s.State != KeyRevoked && selfSigned(set, k) {
+				s.State, s.FirstSeen, s.LastSeen = KeyRevoked, now, now
+				changed = true
+			}
+			continue
+		}
+		if s == nil {
+			s = &KeyState{Zone: set.Name, Key: k.String(), State: KeyAddPend, FirstSeen: now, key: k}
+			if _, ok := trusted[id]; ok {
+				s.State = KeyValid // Configured by DS.
+			}
+			a.keys[id] = s
+			changed = true
+		}
+		switch s.State {
+		case KeyAddPend:
+			if now.Sub(s.FirstSeen) >= ta.holdDown {
+				s.State = KeyValid
+				changed = true
+			}
+		case KeyMissing:
+			s.State = KeyValid
+			changed = true
+		}
+		if now.Sub(s.LastSeen) > time.Hour {
+			s.LastSeen = now
+			changed = true
+		}
+	}
+
+	for id, s := range a.keys {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		switch s.State {
+		case KeyValid:
+			s.State = KeyMissing
+			changed = true
+		case KeyAddPend:
+			delete(a.keys, id)
+			changed = true
+		case KeyRevoked:
+			if now.Sub(s.FirstSeen) >= ta.holdDown {
+				delete(a.keys, id) // Removed.
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// selfSigned reports whether set is signed by the (revoked) key k.
+func selfSigned(set *RRSet, k *dns.DNSKEY) bool {
+	for _, sig := range set.Sigs {
+		if sig.KeyTag == k.KeyTag() && sig.Algorithm == k.Algorithm && sig.Verify(k, set.RRs) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (ta *TrustAnchors) load() error {
+	b, err := os.ReadFile(ta.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read trust anchor state, %w", err)
+	}
+	var states []KeyState
+	if err := json.Unmarshal(b, &states); err != nil {
+		return fmt.Errorf("invalid trust anchor state file, %w", err)
+	}
+	for _, s := range states {
+		rr, err := dns.NewRR(s.Key)
+		if err != nil {
+			return fmt.Errorf("invalid key in trust anchor state file, %w", err)
+		}
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return fmt.Errorf("invalid key in trust anchor state file, %s", s.Key)
+		}
+		zone := dns.CanonicalName(k.Hdr.Name)
+		if _, ok := ta.anchors[zone]; !ok {
+			continue // Anchor was removed from the config.
+		}
+		s.key = k
+		ta.anchorLocked(zone).keys[keyID(k)] = &s
+	}
+	return nil
+}
+
+func (ta *TrustAnchors) saveLocked() error {
+	b, err := json.MarshalIndent(ta.statesLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ta.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ta.stateFile)
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import "github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+
+// ValidatedKey is the query_context key of the *Validated that a
+// validator stores for secure responses.
+var ValidatedKey = query_context.RegKey()
+
+// Validated holds the verified records of a secure response. Caches
+// can use them to synthesize answers. (RFC 8198)
+// The Sigs of each RRSet only contain the signature that verified it.
+type Validated struct {
+	SOA       *RRSet   // The SOA from the authority section. May be nil.
+	Denial    []*RRSet // NSEC and NSEC3 sets from the authority section.
+	Wildcards []*RRSet // Answer sets that were expanded from wildcards.
+}
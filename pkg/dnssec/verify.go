@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnssec implements DNSSEC validation helpers. e.g. RRSet signature
+// verification, authenticated denial of existence and trust anchor
+// maintenance.
+package dnssec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Error is a validation failure. Code is an Extended DNS Error
+// info code (RFC 8914).
+type Error struct {
+	Code uint16
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorf(code uint16, format string, a ...any) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// IsSupportedAlgorithm reports whether signatures of alg can be verified.
+func IsSupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// IsSupportedDigest reports whether DS digest type t is supported.
+func IsSupportedDigest(t uint8) bool {
+	switch t {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// RRSet is a set of records that have the same owner name, type and
+// class, and the signatures that cover it.
+type RRSet struct {
+	Name string // In canonical form.
+	Type uint16
+	RRs  []dns.RR
+	Sigs []*dns.RRSIG
+}
+
+// TTL returns the minimum ttl of the records.
+func (s *RRSet) TTL() uint32 {
+	ttl := ^uint32(0)
+	for _, rr := range s.RRs {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl
+}
+
+// SplitRRSets groups rrs into RRSets in order of their first appearance.
+// RRSIGs are attached to the RRSets they cover. RRSIGs that cover
+// nothing are dropped. OPT records are ignored.
+func SplitRRSets(rrs []dns.RR) []*RRSet {
+	type k struct {
+		name string
+		t    uint16
+	}
+	var sets []*RRSet
+	m := make(map[k]*RRSet)
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.OPT:
+			continue
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+			continue
+		}
+		key := k{name: dns.CanonicalName(h.Name), t: h.Rrtype}
+		s := m[key]
+		if s == nil {
+			s = &RRSet{Name: key.name, Type: key.t}
+			m[key] = s
+			sets = append(sets, s)
+		}
+		s.RRs = append(s.RRs, rr)
+	}
+	for _, sig := range sigs {
+		if s := m[k{name: dns.CanonicalName(sig.Hdr.Name), t: sig.TypeCovered}]; s != nil {
+			s.Sigs = append(s.Sigs, sig)
+		}
+	}
+	return sets
+}
+
+// IsWildcardExpansion reports whether sig was made for a wildcard that
+// was expanded to owner name. If so, it returns the wildcard's closest
+// encloser (the wildcard name without the leading "*.").
+func IsWildcardExpansion(sig *dns.RRSIG) (string, bool) {
+	name := dns.CanonicalName(sig.Hdr.Name)
+	n := dns.CountLabel(name)
+	if int(sig.Labels) >= n {
+		return "", false
+	}
+	idx := dns.Split(name)
+	return name[idx[n-int(sig.Labels)]:], true
+}
+
+// VerifyRRSet verifies the signatures of set with keys. It succeeds if one of the
+// signatures is valid at now. The signature is returned.
+// keys must be validated and have the same owner name.
+func VerifyRRSet(set *RRSet, keys []*dns.DNSKEY, now time.Time) (*dns.RRSIG, error) {
+	if len(set.Sigs) == 0 {
+		return nil, errorf(dns.ExtendedErrorCodeRRSIGsMissing, "no rrsig for %s %s", set.Name, dns.TypeToString[set.Type])
+	}
+	var err error
+	for _, sig := range set.Sigs {
+		if int(sig.Labels) > dns.CountLabel(set.Name) {
+			err = errorf(dns.ExtendedErrorCodeDNSBogus, "invalid rrsig labels for %s", set.Name)
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int64(sig.Inception)-now.Unix() > 0 && err == nil {
+				err = errorf(dns.ExtendedErrorCodeSignatureNotYetValid, "rrsig of %s %s is not yet valid", set.Name, dns.TypeToString[set.Type])
+			} else {
+				err = errorf(dns.ExtendedErrorCodeSignatureExpired, "rrsig of %s %s is expired", set.Name, dns.TypeToString[set.Type])
+			}
+			continue
+		}
+		found := false
+		for _, k := range keys {
+			if k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag || !strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			found = true
+			if k.Flags&dns.REVOKE != 0 && set.Type != dns.TypeDNSKEY {
+				continue
+			}
+			if sig.Verify(k, set.RRs) == nil {
+				return sig, nil
+			}
+		}
+		if !found {
+			if err == nil {
+				err = errorf(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey %d for rrsig of %s %s", sig.KeyTag, set.Name, dns.TypeToString[set.Type])
+			}
+			continue
+		}
+		err = errorf(dns.ExtendedErrorCodeDNSBogus, "invalid rrsig of %s %s", set.Name, dns.TypeToString[set.Type])
+	}
+	return nil, err
+}
+
+// SigTTL returns the ttl that set can be cached after it was verified by sig.
+// RFC 4035 5.3.3.
+func SigTTL(set *RRSet, sig *dns.RRSIG, now time.Time) uint32 {
+	ttl := min(set.TTL(), sig.OrigTtl)
+	if d := int64(sig.Expiration) - now.Unix(); d < int64(ttl) {
+		ttl = uint32(max(d, 0))
+	}
+	return ttl
+}
+
+// MatchDS returns the keys in set that match one of the supported ds records.
+// Keys without the zone key flag are ignored.
+func MatchDS(keys []dns.RR, dss []*dns.DS) []*dns.DNSKEY {
+	var out []*dns.DNSKEY
+	for _, rr := range keys {
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok || k.Flags&dns.ZONE == 0 || k.Flags&dns.REVOKE != 0 || !IsSupportedAlgorithm(k.Algorithm) {
+			continue
+		}
+		tag := k.KeyTag()
+		for _, ds := range dss {
+			if ds.KeyTag != tag || ds.Algorithm != k.Algorithm || !IsSupportedDigest(ds.DigestType) {
+				continue
+			}
+			if d := k.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+				out = append(out, k)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// HasSupportedDS reports whether there is any ds record with a supported
+// algorithm and digest type. If not, the zone should be treated as
+// insecure. (RFC 4035 5.2)
+func HasSupportedDS(dss []*dns.DS) bool {
+	for _, ds := range dss {
+		if IsSupportedAlgorithm(ds.Algorithm) && IsSupportedDigest(ds.DigestType) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyDNSKEYs verifies a DNSKEY RRSet with trusted keys (e.g. keys
+// that match the parent DS). On success, it returns the zone keys in set.
+func VerifyDNSKEYs(set *RRSet, trusted []*dns.DNSKEY, now time.Time) ([]*dns.DNSKEY, *dns.RRSIG, error) {
+	if set.Type != dns.TypeDNSKEY {
+		return nil, nil, errorf(dns.ExtendedErrorCodeDNSBogus, "not a dnskey rrset")
+	}
+	if len(trusted) == 0 {
+		return nil, nil, errorf(dns.ExtendedErrorCodeDNSKEYMissing, "no trusted dnskey for %s", set.Name)
+	}
+	sig, err := VerifyRRSet(set, trusted, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range set.RRs {
+		if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.ZONE != 0 {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, errorf(dns.ExtendedErrorCodeNoZoneKeyBitSet, "no zone key for %s", set.Name)
+	}
+	return keys, sig, nil
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Block sizes of the RFC 8467 4.1 block-length padding policy.
+const (
+	PaddingQueryBlockSize = 128
+	PaddingRespBlockSize  = 468
+)
+
+// HasPadding returns true if opt contains an EDNS0 padding option.
+// opt can be nil.
+func HasPadding(opt *dns.OPT) bool {
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// RemovePadding removes all EDNS0 padding options from opt.
+func RemovePadding(opt *dns.OPT) {
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			opts = append(opts, o)
+		}
+	}
+	opt.Option = opts
+}
+
+// PadMsg adds an EDNS0 padding option (RFC 7830) to m's OPT, so the wire
+// length of m is a multiple of blockSize. Existing padding options will be replaced.
+// It returns false and leaves m without padding if m has no OPT or the
+// padded msg would exceed dns.MaxMsgSize.
+// Note: The msg should not be modified after it was padded.
+func PadMsg(m *dns.Msg, blockSize int) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	RemovePadding(opt)
+
+	p := new(dns.EDNS0_PADDING)
+	opt.Option = append(opt.Option, p)
+	l := m.Len() // Includes the option header.
+	n := (blockSize - l%blockSize) % blockSize
+	if l+n > dns.MaxMsgSize {
+		opt.Option = opt.Option[:len(opt.Option)-1]
+		return false
+	}
+	p.Padding = make([]byte, n)
+	return true
+}
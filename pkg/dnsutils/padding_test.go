@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadMsg(t *testing.T) {
+	r := require.New(t)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	r.False(PadMsg(m, PaddingQueryBlockSize), "msg without opt should not be padded")
+
+	for _, name := range []string{"a.", "example.com.", "a-very-long-label-for-padding-test.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(1232, false)
+		for _, bs := range [...]int{PaddingQueryBlockSize, PaddingRespBlockSize} {
+			r.True(PadMsg(m, bs))
+			b, err := m.Pack()
+			r.NoError(err)
+			r.Zero(len(b)%bs, "name %s, block size %d, got len %d", name, bs, len(b))
+			r.True(HasPadding(m.IsEdns0()))
+
+			// Padding twice replaces the old one.
+			r.True(PadMsg(m, bs))
+			b2, err := m.Pack()
+			r.NoError(err)
+			r.Equal(len(b), len(b2))
+		}
+	}
+
+	// Compressed msg.
+	m = new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	m.Compress = true
+	for i := 0; i < 5; i++ {
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: []byte{1, 2, 3, byte(i)}})
+	}
+	m.SetEdns0(1232, false)
+	r.True(PadMsg(m, PaddingRespBlockSize))
+	b, err := m.Pack()
+	r.NoError(err)
+	r.Zero(len(b) % PaddingRespBlockSize)
+
+	RemovePadding(m.IsEdns0())
+	r.False(HasPadding(m.IsEdns0()))
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lru
+
+// sketchDepth is the number of rows of the count-min sketch.
+const sketchDepth = 4
+
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+// countMinSketch estimates the access frequency of hashes with 4-bit
+// counters. All counters are halved after every 10*width increments, so
+// old popularity fades away.
+type countMinSketch struct {
+	rows      [sketchDepth][]uint64 // 16 counters per word.
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(width int) *countMinSketch {
+	w := 16
+	for w < width {
+		w <<= 1
+	}
+	s := &countMinSketch{mask: uint64(w - 1), resetAt: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint64, w/16)
+	}
+	return s
+}
+
+func (s *countMinSketch) index(h uint64, row int) (word int, shift uint) {
+	x := (h + sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	x ^= x >> 32
+	idx := x & s.mask
+	return int(idx >> 4), uint(idx&15) * 4
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	added := false
+	for i := range s.rows {
+		word, shift := s.index(h, i)
+		if (s.rows[i][word]>>shift)&0xf < 0xf {
+			s.rows[i][word] += 1 << shift
+			added = true
+		}
+	}
+	if added {
+		s.additions++
+		if s.additions >= s.resetAt {
+			s.reset()
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(h uint64) uint8 {
+	f := uint8(0xf)
+	for i := range s.rows {
+		word, shift := s.index(h, i)
+		f = min(f, uint8((s.rows[i][word]>>shift)&0xf))
+	}
+	return f
+}
+
+// reset halves all counters.
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = (s.rows[i][j] >> 1) & 0x7777777777777777
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lru
+
+import (
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/list"
+)
+
+type Hashable interface {
+	comparable
+	Sum() uint64
+}
+
+const (
+	segWindow = iota
+	segProbation
+	segProtected
+)
+
+// TinyLFU is a W-TinyLFU cache. New entries go into a small LRU window.
+// Entries leaving the window are only admitted into the main SLRU if they
+// are accessed more often than the entry that would be evicted, so a
+// scan of one-time keys can not flush popular entries.
+// It is bounded by the number of entries and, optionally, the total cost
+// of entries (e.g. memory size).
+type TinyLFU[K Hashable, V any] struct {
+	maxCost  int
+	mainLen  int // Limits of probation + protected.
+	mainCost int
+	onEvict  func(key K, v V)
+
+	sketch *countMinSketch
+	segs   [3]segment[K, V]
+	m      map[K]*list.Elem[*tinyEntry[K, V]]
+}
+
+type tinyEntry[K Hashable, V any] struct {
+	key  K
+	v    V
+	cost int
+	seg  int
+}
+
+type segment[K Hashable, V any] struct {
+	l       *list.List[*tinyEntry[K, V]]
+	maxLen  int // Not used by the probation.
+	maxCost int
+	cost    int
+}
+
+func (s *segment[K, V]) over(maxCost int) bool {
+	return s.l.Len() > s.maxLen || maxCost > 0 && s.cost > s.maxCost
+}
+
+// NewTinyLFU returns a TinyLFU that holds at most maxSize entries. If maxCost > 0,
+// the total cost of entries is also limited.
+func NewTinyLFU[K Hashable, V any](maxSize, maxCost int, onEvict func(key K, v V)) *TinyLFU[K, V] {
+	if maxSize <= 0 {
+		panic(fmt.Sprintf("TinyLFU: invalid max size: %d", maxSize))
+	}
+
+	// 1% window. The protected is 80% of the main.
+	windowLen, windowCost := max(maxSize/100, 1), max(maxCost/100, 1)
+	mainLen, mainCost := maxSize-windowLen, maxCost-windowCost
+	q := &TinyLFU[K, V]{
+		maxCost:  maxCost,
+		mainLen:  mainLen,
+		mainCost: mainCost,
+		onEvict:  onEvict,
+		sketch:   newCountMinSketch(maxSize),
+		m:        make(map[K]*list.Elem[*tinyEntry[K, V]]),
+	}
+	q.segs[segWindow] = segment[K, V]{maxLen: windowLen, maxCost: windowCost}
+	q.segs[segProtected] = segment[K, V]{maxLen: mainLen * 8 / 10, maxCost: mainCost * 8 / 10}
+	q.initLists()
+	return q
+}
+
+func (q *TinyLFU[K, V]) initLists() {
+	for i := range q.segs {
+		q.segs[i].l = list.New[*tinyEntry[K, V]]()
+		q.segs[i].cost = 0
+	}
+}
+
+// Add adds or updates the entry of key. cost is ignored if the TinyLFU
+// has no max cost.
+func (q *TinyLFU[K, V]) Add(key K, v V, cost int) {
+	if q.maxCost <= 0 {
+		cost = 0
+	}
+	if e, ok := q.m[key]; ok { // update existed key
+		te := e.Value
+		q.segs[te.seg].cost += cost - te.cost
+		te.v, te.cost = v, cost
+		q.access(e)
+		q.evictMain()
+		return
+	}
+
+	q.sketch.increment(key.Sum())
+	e := list.NewElem(&tinyEntry[K, V]{key: key, v: v, cost: cost, seg: segWindow})
+	q.m[key] = e
+	q.push(e, segWindow)
+	q.shrinkWindow()
+}
+
+// shrinkWindow moves entries from the window to the main until the window
+// is within its limits. The window always keeps its newest entry if it
+// fits in the main, even if the window cost is less than the entry cost.
+// Otherwise, new entries would face the admission before they could be
+// accessed again and be rejected. The main makes room for it.
+func (q *TinyLFU[K, V]) shrinkWindow() {
+	w := &q.segs[segWindow]
+	for w.l.Len() > 0 && w.over(q.maxCost) {
+		if w.l.Len() == 1 && w.l.Front().Value.cost <= q.mainCost {
+			break
+		}
+		q.admit(q.pop(w.l.Front()))
+	}
+	for q.maxCost > 0 && q.Cost() > q.maxCost {
+		victim := q.mainVictim()
+		if victim == nil {
+			break
+		}
+		q.evict(q.pop(victim))
+	}
+}
+
+// admit moves the candidate from the window to the main probation if it
+// is more popular than the main victims. Otherwise, the candidate is evicted.
+func (q *TinyLFU[K, V]) admit(e *list.Elem[*tinyEntry[K, V]]) {
+	c := e.Value
+	if q.mainLen <= 0 || q.maxCost > 0 && c.cost > q.mainCost {
+		q.evict(e)
+		return
+	}
+	cf := q.sketch.estimate(c.key.Sum())
+	for q.mainOver(1, c.cost) {
+		victim := q.mainVictim()
+		if cf <= q.sketch.estimate(victim.Value.key.Sum()) {
+			q.evict(e)
+			return
+		}
+		q.evict(q.pop(victim))
+	}
+	q.push(e, segProbation)
+}
+
+// mainOver reports whether the main would be over its limits after
+// adding n entries with cost.
+func (q *TinyLFU[K, V]) mainOver(n, cost int) bool {
+	p, pt := &q.segs[segProbation], &q.segs[segProtected]
+	return p.l.Len()+pt.l.Len()+n > q.mainLen || q.maxCost > 0 && p.cost+pt.cost+cost > q.mainCost
+}
+
+// mainVictim returns the lru entry of the probation, or of the protected
+// if the probation is empty.
+func (q *TinyLFU[K, V]) mainVictim() *list.Elem[*tinyEntry[K, V]] {
+	if e := q.segs[segProbation].l.Front(); e != nil {
+		return e
+	}
+	return q.segs[segProtected].l.Front()
+}
+
+// evictMain evicts main entries until it is within its limits.
+func (q *TinyLFU[K, V]) evictMain() {
+	for q.mainOver(0, 0) {
+		victim := q.mainVictim()
+		if victim == nil {
+			break
+		}
+		q.evict(q.pop(victim))
+	}
+	q.shrinkWindow()
+}
+
+// access moves e to the mru position of its segment. Probation entries
+// are promoted to the protected.
+func (q *TinyLFU[K, V]) access(e *list.Elem[*tinyEntry[K, V]]) {
+	seg := e.Value.seg
+	q.pop(e)
+	if seg == segProbation {
+		seg = segProtected
+	}
+	q.push(e, seg)
+	pt := &q.segs[segProtected]
+	for pt.l.Len() > 0 && pt.over(q.maxCost) {
+		q.push(q.pop(pt.l.Front()), segProbation)
+	}
+}
+
+func (q *TinyLFU[K, V]) push(e *list.Elem[*tinyEntry[K, V]], seg int) {
+	e.Value.seg = seg
+	q.segs[seg].cost += e.Value.cost
+	q.segs[seg].l.PushBack(e)
+}
+
+func (q *TinyLFU[K, V]) pop(e *list.Elem[*tinyEntry[K, V]]) *list.Elem[*tinyEntry[K, V]] {
+	s := &q.segs[e.Value.seg]
+	s.cost -= e.Value.cost
+	return s.l.PopElem(e)
+}
+
+// evict removes a popped e from the map.
+func (q *TinyLFU[K, V]) evict(e *list.Elem[*tinyEntry[K, V]]) {
+	delete(q.m, e.Value.key)
+	if q.onEvict != nil {
+		q.onEvict(e.Value.key, e.Value.v)
+	}
+}
+
+func (q *TinyLFU[K, V]) Del(key K) {
+	if e := q.m[key]; e != nil {
+		q.evict(q.pop(e))
+	}
+}
+
+func (q *TinyLFU[K, V]) Clean(f func(key K, v V) (remove bool)) (removed int) {
+	for i := range q.segs {
+		e := q.segs[i].l.Front()
+		for e != nil {
+			next := e.Next() // Delete e will clean its pointers. Save it first.
+			if f(e.Value.key, e.Value.v) {
+				q.evict(q.pop(e))
+				removed++
+			}
+			e = next
+		}
+	}
+	return removed
+}
+
+func (q *TinyLFU[K, V]) Flush() {
+	q.initLists()
+	q.m = make(map[K]*list.Elem[*tinyEntry[K, V]])
+}
+
+// Get returns the value of key. It also records the access of key.
+func (q *TinyLFU[K, V]) Get(key K) (v V, ok bool) {
+	q.sketch.increment(key.Sum())
+	e, ok := q.m[key]
+	if !ok {
+		return
+	}
+	q.access(e)
+	return e.Value.v, true
+}
+
+func (q *TinyLFU[K, V]) Len() int {
+	return len(q.m)
+}
+
+// Cost returns the total cost of entries. It is 0 if the TinyLFU has no
+// max cost.
+func (q *TinyLFU[K, V]) Cost() int {
+	return q.segs[segWindow].cost + q.segs[segProbation].cost + q.segs[segProtected].cost
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lru
+
+import (
+	"testing"
+)
+
+type testKey int
+
+func (k testKey) Sum() uint64 {
+	return uint64(k)
+}
+
+func Test_TinyLFU(t *testing.T) {
+	var q *TinyLFU[testKey, int]
+	checkLen := func(want int) {
+		t.Helper()
+		n := 0
+		for _, s := range q.segs {
+			n += s.l.Len()
+		}
+		if n != len(q.m) {
+			t.Fatalf("possible mem leak: list len %v != len(q.m) %v", n, len(q.m))
+		}
+		if want != q.Len() {
+			t.Fatalf("want %v, got %v", want, q.Len())
+		}
+	}
+	mustGet := func(keys ...int) {
+		t.Helper()
+		for _, key := range keys {
+			gotV, ok := q.Get(testKey(key))
+			if !ok || gotV != key {
+				t.Fatalf("want %v, got %v", key, gotV)
+			}
+		}
+	}
+
+	// test add
+	q = NewTinyLFU[testKey, int](100, 0, nil)
+	for _, k := range []int{1, 1, 1, 2, 3} {
+		q.Add(testKey(k), k, 0)
+	}
+	checkLen(3)
+	mustGet(1, 2, 3)
+
+	// test del and clean
+	q.Del(2)
+	q.Del(9999)
+	checkLen(2)
+	if n := q.Clean(func(key testKey, v int) bool { return key == 1 }); n != 1 {
+		t.Fatalf("q.Clean want cleaned = 1, got %v", n)
+	}
+	checkLen(1)
+	mustGet(3)
+	q.Flush()
+	checkLen(0)
+
+	// test add overflow
+	evicted := 0
+	q = NewTinyLFU[testKey, int](100, 0, func(key testKey, v int) { evicted++ })
+	for i := 0; i < 1000; i++ {
+		q.Add(testKey(i), i, 0)
+	}
+	checkLen(100)
+	if evicted != 900 {
+		t.Fatalf("want 900 evicted, got %v", evicted)
+	}
+
+	// test cost
+	q = NewTinyLFU[testKey, int](100, 1000, nil)
+	for i := 0; i < 1000; i++ {
+		q.Add(testKey(i), i, 30)
+		if c := q.Cost(); c > 1000 {
+			t.Fatalf("cost overflow: %v", c)
+		}
+	}
+	q.Add(testKey(999), 999, 30) // Make sure it exists.
+	q.Add(testKey(999), 999, 2000)
+	if _, ok := q.Get(999); ok || q.Cost() > 1000 {
+		t.Fatalf("too large entry was not evicted, cost %v", q.Cost())
+	}
+
+	// The window cost (1%) is less than one entry. New entries stay in
+	// the window until the next one is added.
+	q = NewTinyLFU[testKey, int](100, 1000, nil)
+	for i := 0; i < 100; i++ {
+		q.Add(testKey(i), i, 30)
+		mustGet(i)
+	}
+	q.Add(1000, 1000, 30)
+	mustGet(1000, 1000)
+	q.Add(1001, 1001, 30) // 1000 is more popular than the main victim.
+	mustGet(1000, 1001)
+	if c := q.Cost(); c > 1000 {
+		t.Fatalf("cost overflow: %v", c)
+	}
+}
+
+// Test_TinyLFU_Scan checks that popular entries survive scans that
+// would flush a lru.
+func Test_TinyLFU_Scan(t *testing.T) {
+	const size = 100
+	q := NewTinyLFU[testKey, int](size, 0, nil)
+	l := NewLRU[testKey, int](size, nil)
+	var qHit, lHit int
+	scan := 1000
+	for round := 0; round < 50; round++ {
+		for hot := 0; hot < 80; hot++ {
+			k := testKey(hot)
+			if _, ok := q.Get(k); ok {
+				qHit++
+			} else {
+				q.Add(k, hot, 0)
+			}
+			if _, ok := l.Get(k); ok {
+				lHit++
+			} else {
+				l.Add(k, hot)
+			}
+			for i := 0; i < 2; i++ { // One-time keys.
+				scan++
+				q.Add(testKey(scan), scan, 0)
+				l.Add(testKey(scan), scan)
+			}
+		}
+	}
+	if lHit != 0 {
+		t.Fatalf("want lru hits 0, got %v", lHit)
+	}
+	if qHit < 50*80/2 {
+		t.Fatalf("too few TinyLFU hits: %v", qHit)
+	}
+}
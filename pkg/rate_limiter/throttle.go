@@ -0,0 +1,95 @@
+package rate_limiter
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Throttle limits the number of concurrent calls and the rate of calls.
+// Unlike Limiter, it is a single (not per-client) limiter.
+type Throttle struct {
+	sem chan struct{} // nil if no concurrency limit
+	rl  *rate.Limiter // nil if no rate limit
+}
+
+// NewThrottle creates a Throttle. maxConcurrent <= 0 means no concurrency limit.
+// limit <= 0 means no rate limit. If burst <= 0, it will be the ceil of limit.
+func NewThrottle(maxConcurrent int, limit rate.Limit, burst int) *Throttle {
+	t := new(Throttle)
+	if maxConcurrent > 0 {
+		t.sem = make(chan struct{}, maxConcurrent)
+	}
+	if limit > 0 {
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(float64(limit))))
+		}
+		t.rl = rate.NewLimiter(limit, burst)
+	}
+	return t
+}
+
+// Acquire waits at most maxWait (or until ctx is done) for the permission
+// of a call. If maxWait <= 0, it does not wait.
+// If ok, caller must call release after the call is done.
+func (t *Throttle) Acquire(ctx context.Context, maxWait time.Duration) (release func(), ok bool) {
+	deadline := time.Now().Add(max(maxWait, 0))
+	if ctxDdl, hasDdl := ctx.Deadline(); hasDdl && ctxDdl.Before(deadline) {
+		deadline = ctxDdl
+	}
+
+	if t.sem != nil && !acquireSem(ctx, t.sem, time.Until(deadline)) {
+		return nil, false
+	}
+	release = func() {
+		if t.sem != nil {
+			<-t.sem
+		}
+	}
+
+	if t.rl != nil {
+		now := time.Now()
+		rsv := t.rl.ReserveN(now, 1)
+		delay := rsv.DelayFrom(now)
+		if !rsv.OK() || (delay > 0 && now.Add(delay).After(deadline)) {
+			rsv.CancelAt(now)
+			release()
+			return nil, false
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				rsv.Cancel()
+				release()
+				return nil, false
+			}
+		}
+	}
+	return release, true
+}
+
+func acquireSem(ctx context.Context, sem chan struct{}, maxWait time.Duration) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if maxWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
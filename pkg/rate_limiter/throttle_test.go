@@ -0,0 +1,56 @@
+package rate_limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	// concurrency limit
+	th := NewThrottle(1, 0, 0)
+	release, ok := th.Acquire(ctx, 0)
+	r.True(ok)
+	_, ok = th.Acquire(ctx, 0)
+	r.False(ok, "no waiting")
+	_, ok = th.Acquire(ctx, time.Millisecond*10)
+	r.False(ok, "wait timeout")
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		release()
+	}()
+	release, ok = th.Acquire(ctx, time.Second)
+	r.True(ok, "released while waiting")
+	release()
+
+	// rate limit
+	th = NewThrottle(0, 10, 1)
+	release, ok = th.Acquire(ctx, 0)
+	r.True(ok)
+	release()
+	_, ok = th.Acquire(ctx, 0)
+	r.False(ok, "no token")
+	start := time.Now()
+	release, ok = th.Acquire(ctx, time.Second)
+	r.True(ok, "wait for the next token")
+	r.Greater(time.Since(start), time.Millisecond*50)
+	release()
+
+	// ctx deadline is shorter than max wait.
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	_, ok = th.Acquire(ctx, time.Second)
+	r.False(ok)
+
+	// no limit
+	th = NewThrottle(0, 0, 0)
+	for i := 0; i < 100; i++ {
+		_, ok := th.Acquire(context.Background(), 0)
+		r.True(ok)
+	}
+}
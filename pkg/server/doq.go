@@ -105,8 +105,9 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 						return
 					}
 					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
+						ClientAddr:    clientAddr,
+						ServerName:    c.ConnectionState().TLS.ServerName,
+						FromEncrypted: true,
 					}
 
 					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
@@ -38,6 +38,10 @@ type HttpHandlerOpts struct {
 	// e.g. "X-Forwarded-For".
 	GetSrcIPFromHeader string
 
+	// BehindTLSProxy indicates the handler is behind a tls-terminating
+	// reverse proxy, so requests without tls are from an encrypted transport.
+	BehindTLSProxy bool
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
@@ -47,6 +51,7 @@ type HttpHandler struct {
 	dnsHandler  Handler
 	logger      *zap.Logger
 	srcIPHeader string
+	tlsProxy    bool
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -55,6 +60,7 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh := new(HttpHandler)
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
+	hh.tlsProxy = opts.BehindTLSProxy
 	hh.logger = opts.Logger
 	if hh.logger == nil {
 		hh.logger = nopLogger
@@ -95,7 +101,8 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	queryMeta := QueryMeta{
-		ClientAddr: clientAddr,
+		ClientAddr:    clientAddr,
+		FromEncrypted: req.TLS != nil || h.tlsProxy,
 	}
 	if u := req.URL; u != nil {
 		queryMeta.UrlPath = u.Path
@@ -22,6 +22,10 @@ type Handler interface {
 type QueryMeta struct {
 	FromUDP bool
 
+	// FromEncrypted indicates the query is from an encrypted transport
+	// (DoT, DoH, DoQ). Responses will be padded if the query was padded.
+	FromEncrypted bool
+
 	// Optional
 	ClientAddr netip.Addr
 	ServerName string
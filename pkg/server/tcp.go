@@ -90,7 +90,8 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 
 				// Try to get server name from tls conn.
 				var serverName string
-				if tlsConn, ok := c.(*tls.Conn); ok {
+				tlsConn, fromTLS := c.(*tls.Conn)
+				if fromTLS {
 					serverName = tlsConn.ConnectionState().ServerName
 				}
 
@@ -101,7 +102,7 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 					if ok {
 						clientAddr = ta.AddrPort().Addr()
 					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, FromEncrypted: fromTLS}, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
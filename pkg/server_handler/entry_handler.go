@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
@@ -43,11 +44,6 @@ var (
 	queryForwardEDNS0Option = map[uint16]struct{}{
 		dns.EDNS0SUBNET: {},
 	}
-
-	// options that useless for downstream
-	respRemoveEDNS0Option = map[uint16]struct{}{
-		dns.EDNS0PADDING: {},
-	}
 )
 
 type EntryHandlerOpts struct {
@@ -118,7 +114,14 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 
 	// add respOpt back to resp
 	if respOpt := qCtx.RespOpt(); respOpt != nil {
+		dnsutils.RemovePadding(respOpt)
 		resp.Extra = append(resp.Extra, respOpt)
+
+		// RFC 8467 4.1. Pad the response only if the query was padded.
+		// Plain udp/tcp responses are never padded.
+		if serverMeta.FromEncrypted && dnsutils.HasPadding(qCtx.ClientOpt()) {
+			dnsutils.PadMsg(resp, dnsutils.PaddingRespBlockSize)
+		}
 	}
 
 	if serverMeta.FromUDP {
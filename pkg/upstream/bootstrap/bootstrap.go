@@ -23,13 +23,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
@@ -38,43 +37,85 @@ const (
 	minimumUpdateInterval = time.Minute * 5
 	retryInterval         = time.Second * 2
 	queryTimeout          = time.Second * 5
+	serverQueryTimeout    = time.Second * 2
+)
+
+// Bootstrap versions.
+const (
+	Ver4         = 4
+	Ver6         = 6
+	VerDualStack = 46
 )
 
 var (
 	errNoAddrInResp = errors.New("resp does not have ip address")
 )
 
+// Resolver is a dns server that Bootstrap sends queries to.
+// upstream.Upstream implements this interface.
+type Resolver interface {
+	ExchangeContext(ctx context.Context, q []byte) (*[]byte, error)
+}
+
+type Opts struct {
+	// Servers are the bootstrap servers. They are queried in order.
+	// If one failed, the next one will be used. Required.
+	Servers []Resolver
+
+	// Ver is the bootstrap version. One of 0 (default equals 4), 4, 6 and
+	// 46 (dual-stack, both A and AAAA).
+	Ver int
+
+	// CacheFile is the file that the last-known addresses will be persisted to.
+	// If set, the last-known addresses will be loaded on start. So the upstream
+	// can work even if the bootstrap servers are unavailable after a restart.
+	// Optional.
+	CacheFile string
+
+	// Logger must not be nil.
+	Logger *zap.Logger
+}
+
 func New(
 	host string,
 	port uint16,
-	bootstrapServer netip.AddrPort,
-	bootstrapVer int, // 0,4,6
-	logger *zap.Logger, // not nil
+	opts Opts,
 ) (*Bootstrap, error) {
 	dp := new(Bootstrap)
 	dp.fqdn = dns.Fqdn(host)
 	dp.port = port
-	if !bootstrapServer.IsValid() {
-		return nil, errors.New("invalid bootstrap server address")
+	if len(opts.Servers) == 0 {
+		return nil, errors.New("no bootstrap server")
 	}
-	dp.bootstrap = net.UDPAddrFromAddrPort(bootstrapServer)
-	qt, ok := bootstrapVer2Qt(bootstrapVer)
+	dp.servers = opts.Servers
+	qts, ok := bootstrapVer2Qts(opts.Ver)
 	if !ok {
-		return nil, fmt.Errorf("invalid bootstrap version %d", bootstrapVer)
+		return nil, fmt.Errorf("invalid bootstrap version %d", opts.Ver)
 	}
-	dp.qt = qt
-	dp.logger = logger
-
+	dp.qts = qts
+	dp.logger = opts.Logger
+	dp.cacheFile = opts.CacheFile
 	dp.readyNotify = make(chan struct{})
+
+	if len(dp.cacheFile) > 0 {
+		addrs, err := loadCache(dp.cacheFile, dp.fqdn)
+		if err != nil {
+			dp.logger.Warn("failed to load bootstrap cache", zap.String("file", dp.cacheFile), zap.Error(err))
+		} else if len(addrs) > 0 {
+			dp.setAddrs(addrs)
+			dp.logger.Debug("bootstrap addr loaded from cache", zap.String("fqdn", dp.fqdn), zap.Any("addrs", addrs))
+		}
+	}
 	return dp, nil
 }
 
 type Bootstrap struct {
 	fqdn      string
 	port      uint16
-	bootstrap *net.UDPAddr
-	qt        uint16      // dns.TypeA or dns.TypeAAAA
+	servers   []Resolver
+	qts       []uint16    // dns.TypeA and/or dns.TypeAAAA
 	logger    *zap.Logger // not nil
+	cacheFile string
 
 	updating   atomic.Bool
 	nextUpdate time.Time
@@ -82,22 +123,26 @@ type Bootstrap struct {
 	readyNotify chan struct{}
 	m           sync.Mutex
 	ready       bool
-	addrStr     string
+	addrs       []netip.AddrPort
 }
 
-func (sp *Bootstrap) GetAddrPortStr(ctx context.Context) (string, error) {
+// GetAddrs returns the addresses of the host. If the bootstrap is not ready yet,
+// it blocks until the first update is done or ctx is done.
+// If the latest update failed, the last-known addresses will be returned.
+// Caller must not modify the returned slice.
+func (sp *Bootstrap) GetAddrs(ctx context.Context) ([]netip.AddrPort, error) {
 	sp.tryUpdate()
 
 	select {
 	case <-ctx.Done():
-		return "", context.Cause(ctx)
+		return nil, context.Cause(ctx)
 	case <-sp.readyNotify:
 	}
 
 	sp.m.Lock()
-	addr := sp.addrStr
+	addrs := sp.addrs
 	sp.m.Unlock()
-	return addr, nil
+	return addrs, nil
 }
 
 func (sp *Bootstrap) tryUpdate() {
@@ -108,7 +153,7 @@ func (sp *Bootstrap) tryUpdate() {
 				ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
 				defer cancel()
 				start := time.Now()
-				addr, ttl, err := sp.updateAddr(ctx)
+				addrs, ttl, err := sp.updateAddr(ctx)
 				if err != nil {
 					sp.logger.Check(zap.WarnLevel, "failed to update bootstrap addr").Write(
 						zap.String("fqdn", sp.fqdn),
@@ -122,7 +167,7 @@ func (sp *Bootstrap) tryUpdate() {
 					}
 					sp.logger.Check(zap.DebugLevel, "bootstrap addr updated").Write(
 						zap.String("fqdn", sp.fqdn),
-						zap.Stringer("addr", addr),
+						zap.Any("addrs", addrs),
 						zap.Duration("ttl", updateInterval),
 						zap.Duration("elapse", time.Since(start)),
 					)
@@ -135,114 +180,151 @@ func (sp *Bootstrap) tryUpdate() {
 	}
 }
 
-func (sp *Bootstrap) updateAddr(ctx context.Context) (netip.Addr, uint32, error) {
-	addr, ttl, err := sp.resolve(ctx, sp.qt)
-	if err != nil {
-		return netip.Addr{}, 0, err
+func (sp *Bootstrap) setAddrs(addrs []netip.Addr) []netip.AddrPort {
+	aps := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		aps = append(aps, netip.AddrPortFrom(addr, sp.port))
 	}
-
-	addrPort := netip.AddrPortFrom(addr, sp.port).String()
 	sp.m.Lock()
-	sp.addrStr = addrPort
+	sp.addrs = aps
 	if !sp.ready {
 		sp.ready = true
 		close(sp.readyNotify)
 	}
 	sp.m.Unlock()
-	return addr, ttl, nil
+	return aps
+}
+
+func (sp *Bootstrap) updateAddr(ctx context.Context) ([]netip.AddrPort, uint32, error) {
+	var errs []error
+	for i, s := range sp.servers {
+		addrs, ttl, err := sp.resolveAll(ctx, s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server #%d, %w", i, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		aps := sp.setAddrs(addrs)
+		if len(sp.cacheFile) > 0 {
+			if err := saveCache(sp.cacheFile, sp.fqdn, addrs); err != nil {
+				sp.logger.Warn("failed to save bootstrap cache", zap.String("file", sp.cacheFile), zap.Error(err))
+			}
+		}
+		return aps, ttl, nil
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+// resolveAll resolves all sp.qts concurrently from server s.
+// It returns all addresses and the minimal ttl.
+func (sp *Bootstrap) resolveAll(ctx context.Context, s Resolver) ([]netip.Addr, uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverQueryTimeout)
+	defer cancel()
+
+	type res struct {
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	resC := make(chan res, len(sp.qts))
+	for _, qt := range sp.qts {
+		qt := qt
+		go func() {
+			addrs, ttl, err := sp.resolve(ctx, s, qt)
+			resC <- res{addrs: addrs, ttl: ttl, err: err}
+		}()
+	}
+
+	var (
+		addrs  []netip.Addr
+		minTTL uint32
+		errs   []error
+	)
+	for range sp.qts {
+		r := <-resC
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if len(addrs) == 0 || r.ttl < minTTL {
+			minTTL = r.ttl
+		}
+		addrs = append(addrs, r.addrs...)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	return addrs, minTTL, nil
 }
 
-func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32, error) {
+func (sp *Bootstrap) resolve(ctx context.Context, s Resolver, qt uint16) ([]netip.Addr, uint32, error) {
 	const edns0UdpSize = 1200
 
 	q := new(dns.Msg)
 	q.SetQuestion(sp.fqdn, qt)
 	q.SetEdns0(edns0UdpSize, false)
-
-	c, err := net.DialUDP("udp", nil, sp.bootstrap)
+	qb, err := q.Pack()
 	if err != nil {
-		return netip.Addr{}, 0, err
+		return nil, 0, err
 	}
-	defer c.Close()
 
-	writeErrC := make(chan error, 1)
-	type res struct {
-		resp *dns.Msg
-		err  error
+	rb, err := s.ExchangeContext(ctx, qb)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp := new(dns.Msg)
+	err = resp.Unpack(*rb)
+	pool.ReleaseBuf(rb)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid resp, %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("resp rcode %s", dns.RcodeToString[resp.Rcode])
 	}
-	readResC := make(chan res, 1)
-
-	cancelWrite := make(chan struct{})
-	defer close(cancelWrite)
-	go func() {
-		if _, err := dnsutils.WriteMsgToUDP(c, q); err != nil {
-			writeErrC <- err
-			return
-		}
 
-		retryTicker := time.NewTicker(time.Second)
-		defer retryTicker.Stop()
-		for {
-			select {
-			case <-cancelWrite:
-				return
-			case <-retryTicker.C:
-				if _, err := dnsutils.WriteMsgToUDP(c, q); err != nil {
-					writeErrC <- err
-					return
-				}
-			}
+	var addrs []netip.Addr
+	var minTTL uint32
+	for _, v := range resp.Answer {
+		var ip []byte
+		var ttl uint32
+		switch rr := v.(type) {
+		case *dns.A:
+			ip = rr.A
+			ttl = rr.Hdr.Ttl
+		case *dns.AAAA:
+			ip = rr.AAAA
+			ttl = rr.Hdr.Ttl
+		default:
+			continue
 		}
-	}()
-
-	go func() {
-		m, _, err := dnsutils.ReadMsgFromUDP(c, edns0UdpSize)
-		readResC <- res{resp: m, err: err}
-	}()
-
-	select {
-	case <-ctx.Done():
-		return netip.Addr{}, 0, context.Cause(ctx)
-	case err := <-writeErrC:
-		return netip.Addr{}, 0, fmt.Errorf("failed to write query, %w", err)
-	case r := <-readResC:
-		resp := r.resp
-		err := r.err
-		if err != nil {
-			return netip.Addr{}, 0, fmt.Errorf("failed to read resp, %w", err)
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
 		}
-
-		for _, v := range resp.Answer {
-			var ip net.IP
-			var ttl uint32
-			switch rr := v.(type) {
-			case *dns.A:
-				ip = rr.A
-				ttl = rr.Hdr.Ttl
-			case *dns.AAAA:
-				ip = rr.AAAA
-				ttl = rr.Hdr.Ttl
-			default:
-				continue
-			}
-			addr, ok := netip.AddrFromSlice(ip)
-			if ok {
-				return addr, ttl, nil
-			}
+		if len(addrs) == 0 || ttl < minTTL {
+			minTTL = ttl
 		}
+		addrs = append(addrs, addr.Unmap())
+	}
 
-		// No ip addr in resp.
-		return netip.Addr{}, 0, errNoAddrInResp
+	if len(addrs) == 0 {
+		return nil, 0, errNoAddrInResp
 	}
+	return addrs, minTTL, nil
 }
 
-func bootstrapVer2Qt(ver int) (uint16, bool) {
+func bootstrapVer2Qts(ver int) ([]uint16, bool) {
 	switch ver {
-	case 0, 4:
-		return dns.TypeA, true
-	case 6:
-		return dns.TypeAAAA, true
+	case 0, Ver4:
+		return []uint16{dns.TypeA}, true
+	case Ver6:
+		return []uint16{dns.TypeAAAA}, true
+	case VerDualStack:
+		return []uint16{dns.TypeAAAA, dns.TypeA}, true
 	default:
-		return 0, false
+		return nil, false
 	}
 }
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeResolver struct {
+	err  error
+	a    string
+	aaaa string
+}
+
+func (f *fakeResolver) ExchangeContext(_ context.Context, qb []byte) (*[]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(qb); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Class: dns.ClassINET, Ttl: 300}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		if len(f.a) > 0 {
+			hdr.Rrtype = dns.TypeA
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: netip.MustParseAddr(f.a).AsSlice()})
+		}
+	case dns.TypeAAAA:
+		if len(f.aaaa) > 0 {
+			hdr.Rrtype = dns.TypeAAAA
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: netip.MustParseAddr(f.aaaa).AsSlice()})
+		}
+	}
+	return pool.PackBuffer(r)
+}
+
+func getAddrs(t *testing.T, bs *Bootstrap) []netip.AddrPort {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	aps, err := bs.GetAddrs(ctx)
+	require.NoError(t, err)
+	return aps
+}
+
+func Test_Bootstrap(t *testing.T) {
+	failed := &fakeResolver{err: errors.New("failed")}
+	ok := &fakeResolver{a: "1.1.1.1", aaaa: "2001:db8::1"}
+
+	// Failover and dual-stack.
+	bs, err := New("example.com", 853, Opts{
+		Servers: []Resolver{failed, ok},
+		Ver:     VerDualStack,
+		Logger:  zap.NewNop(),
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:853"),
+		netip.MustParseAddrPort("[2001:db8::1]:853"),
+	}, getAddrs(t, bs))
+
+	// Ipv6 only.
+	bs, err = New("example.com", 853, Opts{Servers: []Resolver{ok}, Ver: Ver6, Logger: zap.NewNop()})
+	require.NoError(t, err)
+	require.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("[2001:db8::1]:853")}, getAddrs(t, bs))
+
+	_, err = New("example.com", 853, Opts{Servers: []Resolver{ok}, Ver: 5, Logger: zap.NewNop()})
+	require.Error(t, err)
+}
+
+func Test_Bootstrap_cacheFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "bootstrap_cache.json")
+	ok := &fakeResolver{a: "1.1.1.1"}
+	bs, err := New("example.com", 853, Opts{Servers: []Resolver{ok}, CacheFile: f, Logger: zap.NewNop()})
+	require.NoError(t, err)
+	want := []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:853")}
+	require.Equal(t, want, getAddrs(t, bs))
+
+	// "Restart" with broken bootstrap servers. Last-known addrs should be used.
+	failed := &fakeResolver{err: errors.New("failed")}
+	bs, err = New("example.com", 853, Opts{Servers: []Resolver{failed}, CacheFile: f, Logger: zap.NewNop()})
+	require.NoError(t, err)
+	require.Equal(t, want, getAddrs(t, bs))
+}
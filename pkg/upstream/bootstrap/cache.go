@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The cache file is a json object: {"fqdn": {"addrs": ["ip"], "updated": "time"}}.
+// One file can be shared by multiple Bootstraps.
+
+type cacheEntry struct {
+	Addrs   []netip.Addr `json:"addrs"`
+	Updated time.Time    `json:"updated"`
+}
+
+var cacheFileLocks sync.Map // file path -> *sync.Mutex
+
+func lockCacheFile(file string) func() {
+	v, _ := cacheFileLocks.LoadOrStore(file, new(sync.Mutex))
+	m := v.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+func readCacheFile(file string) (map[string]cacheEntry, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return make(map[string]cacheEntry), nil
+		}
+		return nil, err
+	}
+	m := make(map[string]cacheEntry)
+	if len(b) == 0 {
+		return m, nil
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func loadCache(file, fqdn string) ([]netip.Addr, error) {
+	unlock := lockCacheFile(file)
+	defer unlock()
+	m, err := readCacheFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return m[fqdn].Addrs, nil
+}
+
+func saveCache(file, fqdn string, addrs []netip.Addr) error {
+	unlock := lockCacheFile(file)
+	defer unlock()
+	m, err := readCacheFile(file)
+	if err != nil {
+		// Broken file, overwrite it.
+		m = make(map[string]cacheEntry)
+	}
+	m[fqdn] = cacheEntry{Addrs: addrs, Updated: time.Now()}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it, so the cache file
+	// won't be broken if we crashed.
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
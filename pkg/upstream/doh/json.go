@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	urlpkg "net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Json messages are much larger than wire messages.
+const jsonMaxBodySize = 256 * 1024
+
+// jsonMsg is the "application/dns-json" response. Field names
+// follow the google and cloudflare public dns api.
+type jsonMsg struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer"`
+	Authority  []jsonRR       `json:"Authority"`
+	Additional []jsonRR       `json:"Additional"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+var errNoQuestion = errors.New("query has no question")
+
+// newJSONQuery translates q to json api url query parameters.
+func newJSONQuery(q *dns.Msg) (urlpkg.Values, error) {
+	if len(q.Question) != 1 {
+		return nil, errNoQuestion
+	}
+	question := q.Question[0]
+	v := make(urlpkg.Values)
+	v.Set("name", question.Name)
+	v.Set("type", strconv.Itoa(int(question.Qtype)))
+	if q.CheckingDisabled {
+		v.Set("cd", "1")
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		if opt.Do() {
+			v.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ipNet := net.IPNet{IP: ecs.Address, Mask: net.CIDRMask(int(ecs.SourceNetmask), len(ecs.Address)*8)}
+				v.Set("edns_client_subnet", ipNet.String())
+			}
+		}
+	}
+	return v, nil
+}
+
+// unmarshalJSONResp translates a json api response b to a dns.Msg.
+// q is the query. Its id, question and edns0 will be used in the response.
+func unmarshalJSONResp(b []byte, q *dns.Msg) (*dns.Msg, error) {
+	jm := new(jsonMsg)
+	if err := json.Unmarshal(b, jm); err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Rcode = jm.Status
+	r.Truncated = jm.TC
+	r.RecursionDesired = jm.RD
+	r.RecursionAvailable = jm.RA
+	r.AuthenticatedData = jm.AD
+	r.CheckingDisabled = jm.CD
+
+	var err error
+	if r.Answer, err = jsonRRsToRRs(jm.Answer); err != nil {
+		return nil, fmt.Errorf("invalid answer section, %w", err)
+	}
+	if r.Ns, err = jsonRRsToRRs(jm.Authority); err != nil {
+		return nil, fmt.Errorf("invalid authority section, %w", err)
+	}
+	if r.Extra, err = jsonRRsToRRs(jm.Additional); err != nil {
+		return nil, fmt.Errorf("invalid additional section, %w", err)
+	}
+	if qOpt := q.IsEdns0(); qOpt != nil {
+		r.SetEdns0(qOpt.UDPSize(), qOpt.Do())
+	}
+	return r, nil
+}
+
+func jsonRRsToRRs(jrs []jsonRR) ([]dns.RR, error) {
+	if len(jrs) == 0 {
+		return nil, nil
+	}
+	rrs := make([]dns.RR, 0, len(jrs))
+	for _, jr := range jrs {
+		if jr.Type == dns.TypeOPT {
+			continue
+		}
+		rr, err := jsonRRToRR(jr)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func jsonRRToRR(jr jsonRR) (dns.RR, error) {
+	typ, ok := dns.TypeToString[jr.Type]
+	if !ok {
+		typ = "TYPE" + strconv.Itoa(int(jr.Type))
+	}
+	s := dns.Fqdn(jr.Name) + " " + strconv.FormatUint(uint64(jr.TTL), 10) + " IN " + typ + " " + jr.Data
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse record [%s], %w", s, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty record [%s]", s)
+	}
+	return rr, nil
+}
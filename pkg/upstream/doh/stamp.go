@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	stampPrefix      = "sdns://"
+	stampProtoDoH    = 0x02
+	stampPropsLength = 8
+)
+
+var errStampTooShort = errors.New("stamp is too short")
+
+// Stamp is a parsed DoH DNS stamp.
+// See: https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	// Props is the informal properties about the resolver.
+	Props uint64
+	// Addr is the IP address of the server. Port is optional.
+	// Can be empty, in which case Hostname should be resolved.
+	Addr string
+	// Hashes are SHA256 digests of the TBS certificates in the chain.
+	Hashes [][]byte
+	// Hostname is the server host name. Port is optional.
+	Hostname string
+	// Path is the absolute URI path.
+	Path string
+	// Bootstrap is the optional ip addresses of recommended resolvers.
+	Bootstrap []string
+}
+
+// IsStamp reports whether s is a DNS stamp.
+func IsStamp(s string) bool {
+	return strings.HasPrefix(s, stampPrefix)
+}
+
+// URL returns the DoH url of the stamp.
+func (s *Stamp) URL() string {
+	return "https://" + s.Hostname + s.Path
+}
+
+// ParseStamp parses a "sdns://" DoH stamp.
+func ParseStamp(s string) (*Stamp, error) {
+	if !IsStamp(s) {
+		return nil, fmt.Errorf("missing %s prefix", stampPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(stampPrefix):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding, %w", err)
+	}
+	if len(b) < 1+stampPropsLength {
+		return nil, errStampTooShort
+	}
+	if b[0] != stampProtoDoH {
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x, only DoH is supported", b[0])
+	}
+	st := new(Stamp)
+	st.Props = binary.LittleEndian.Uint64(b[1:])
+	b = b[1+stampPropsLength:]
+
+	addr, b, err := readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr, %w", err)
+	}
+	st.Addr = trimAddrBrackets(string(addr))
+	if st.Hashes, b, err = readVLP(b); err != nil {
+		return nil, fmt.Errorf("invalid hashes, %w", err)
+	}
+	hostname, b, err := readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostname, %w", err)
+	}
+	if len(hostname) == 0 {
+		return nil, errors.New("missing hostname")
+	}
+	st.Hostname = string(hostname)
+	path, b, err := readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path, %w", err)
+	}
+	st.Path = string(path)
+	if len(b) > 0 {
+		bs, _, err := readVLP(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap, %w", err)
+		}
+		for _, a := range bs {
+			st.Bootstrap = append(st.Bootstrap, string(a))
+		}
+	}
+	return st, nil
+}
+
+// readLP reads a length-prefixed value.
+func readLP(b []byte) ([]byte, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, errStampTooShort
+	}
+	l := int(b[0])
+	if len(b) < 1+l {
+		return nil, nil, errStampTooShort
+	}
+	return b[1 : 1+l], b[1+l:], nil
+}
+
+// readVLP reads a variable length set of length-prefixed values.
+// The 0x80 bit of the length indicates that more values follow.
+func readVLP(b []byte) ([][]byte, []byte, error) {
+	var vs [][]byte
+	for {
+		if len(b) < 1 {
+			return nil, nil, errStampTooShort
+		}
+		more := b[0]&0x80 != 0
+		l := int(b[0] &^ 0x80)
+		if len(b) < 1+l {
+			return nil, nil, errStampTooShort
+		}
+		if l > 0 {
+			vs = append(vs, b[1:1+l])
+		}
+		b = b[1+l:]
+		if !more {
+			return vs, b, nil
+		}
+	}
+}
+
+// trimAddrBrackets removes brackets from an ipv6 address without port.
+func trimAddrBrackets(s string) string {
+	if len(s) > 2 && s[0] == '[' && s[len(s)-1] == ']' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
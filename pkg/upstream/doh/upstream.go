@@ -20,13 +20,16 @@
 package doh
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	urlpkg "net/url"
+	"strings"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
@@ -40,31 +43,95 @@ const (
 	defaultDoHTimeout = time.Second * 6
 )
 
+const (
+	// FormatWire is the RFC 8484 "application/dns-message" format.
+	FormatWire = "wire"
+	// FormatJSON is the "application/dns-json" format.
+	FormatJSON = "json"
+)
+
 var nopLogger = zap.NewNop()
 
+// Opt contains optional options for Upstream.
+type Opt struct {
+	// Method is the http method that will be used. One of GET and POST.
+	// Default is GET, which is more cache-friendly.
+	// JSON format only supports GET.
+	Method string
+
+	// Header contains extra headers that will be sent with every request.
+	Header http.Header
+
+	// Format is the message format. One of FormatWire (default) and FormatJSON.
+	Format string
+
+	Logger *zap.Logger
+}
+
 // Upstream is a DNS-over-HTTPS (RFC 8484) upstream.
+// It also supports the JSON API (application/dns-json).
 type Upstream struct {
 	rt          http.RoundTripper
 	logger      *zap.Logger // non-nil
+	method      string
+	json        bool
 	urlTemplate *urlpkg.URL
 	reqTemplate *http.Request
 }
 
-func NewUpstream(endPoint string, rt http.RoundTripper, logger *zap.Logger) (*Upstream, error) {
-	req, err := http.NewRequest(http.MethodGet, endPoint, nil)
+func NewUpstream(endPoint string, rt http.RoundTripper, opt Opt) (*Upstream, error) {
+	method := strings.ToUpper(opt.Method)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported http method %s", opt.Method)
+	}
+
+	var json bool
+	switch opt.Format {
+	case "", FormatWire:
+	case FormatJSON:
+		if method != http.MethodGet {
+			return nil, errors.New("json format only supports GET method")
+		}
+		json = true
+	default:
+		return nil, fmt.Errorf("unsupported format %s", opt.Format)
+	}
+
+	req, err := http.NewRequest(method, endPoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse http request, %w", err)
 	}
 
-	req.Header["Accept"] = []string{"application/dns-message"}
-	req.Header["User-Agent"] = nil // Don't let go http send a default user agent header.
+	for k, vs := range opt.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if json {
+		req.Header["Accept"] = []string{"application/dns-json"}
+	} else {
+		req.Header["Accept"] = []string{"application/dns-message"}
+	}
+	if method == http.MethodPost {
+		req.Header["Content-Type"] = []string{"application/dns-message"}
+	}
+	if len(req.Header.Get("User-Agent")) == 0 {
+		req.Header["User-Agent"] = nil // Don't let go http send a default user agent header.
+	}
 
+	logger := opt.Logger
 	if logger == nil {
 		logger = nopLogger
 	}
 	return &Upstream{
 		rt:          rt,
 		logger:      logger,
+		method:      method,
+		json:        json,
 		urlTemplate: req.URL,
 		reqTemplate: req,
 	}, nil
@@ -75,28 +142,31 @@ var (
 )
 
 func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
-	bp := pool.GetBuf(len(q))
-	defer pool.ReleaseBuf(bp)
-	wire := *bp
-	copy(wire, q)
-
-	// In order to maximize HTTP cache friendliness, DoH clients using media
-	// formats that include the ID field from the DNS message header, such
-	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
-	// request.
-	// https://tools.ietf.org/html/rfc8484#section-4.1
-	wire[0] = 0
-	wire[1] = 0
-
-	queryLen := 4 + base64.RawURLEncoding.EncodedLen(len(wire))
-	queryBuf := make([]byte, queryLen)
-
-	p := 0
-	p += copy(queryBuf, "dns=")
-
-	// Padding characters for base64url MUST NOT be included.
-	// See: https://tools.ietf.org/html/rfc8484#section-6.
-	base64.RawURLEncoding.Encode(queryBuf[p:], wire)
+	var (
+		rawQuery string
+		body     []byte
+		jsonQ    *dns.Msg
+	)
+	switch {
+	case u.json:
+		jsonQ = new(dns.Msg)
+		if err := jsonQ.Unpack(q); err != nil {
+			return nil, fmt.Errorf("invalid query, %w", err)
+		}
+		v, err := newJSONQuery(jsonQ)
+		if err != nil {
+			return nil, err
+		}
+		rawQuery = v.Encode()
+	case u.method == http.MethodPost:
+		body = make([]byte, len(q))
+		copy(body, q)
+		// See newWireQueryString.
+		body[0] = 0
+		body[1] = 0
+	default:
+		rawQuery = newWireQueryString(q)
+	}
 
 	type res struct {
 		r   *[]byte
@@ -111,7 +181,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, erro
 		// reduces the connection reuse efficiency.
 		ctx, cancel := context.WithTimeout(context.Background(), defaultDoHTimeout)
 		defer cancel()
-		r, err := u.exchange(ctx, utils.BytesToStringUnsafe(queryBuf))
+		r, err := u.exchange(ctx, rawQuery, body, jsonQ)
 		if err != nil {
 			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
 		}
@@ -131,11 +201,45 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, erro
 	}
 }
 
-func (u *Upstream) exchange(ctx context.Context, dnsQuery string) (*[]byte, error) {
+// newWireQueryString encodes q into a RFC 8484 GET query string.
+func newWireQueryString(q []byte) string {
+	bp := pool.GetBuf(len(q))
+	defer pool.ReleaseBuf(bp)
+	wire := *bp
+	copy(wire, q)
+
+	// In order to maximize HTTP cache friendliness, DoH clients using media
+	// formats that include the ID field from the DNS message header, such
+	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
+	// request.
+	// https://tools.ietf.org/html/rfc8484#section-4.1
+	wire[0] = 0
+	wire[1] = 0
+
+	queryLen := 4 + base64.RawURLEncoding.EncodedLen(len(wire))
+	queryBuf := make([]byte, queryLen)
+
+	p := 0
+	p += copy(queryBuf, "dns=")
+
+	// Padding characters for base64url MUST NOT be included.
+	// See: https://tools.ietf.org/html/rfc8484#section-6.
+	base64.RawURLEncoding.Encode(queryBuf[p:], wire)
+	return utils.BytesToStringUnsafe(queryBuf)
+}
+
+func (u *Upstream) exchange(ctx context.Context, rawQuery string, body []byte, jsonQ *dns.Msg) (*[]byte, error) {
 	req := u.reqTemplate.WithContext(ctx)
 	req.URL = new(urlpkg.URL)
 	*req.URL = *u.urlTemplate
-	req.URL.RawQuery = dnsQuery
+	req.URL.RawQuery = rawQuery
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+	}
 	resp, err := u.rt.RoundTrip(req)
 	if err != nil {
 		return nil, fmt.Errorf("http request failed: %w", err)
@@ -153,10 +257,23 @@ func (u *Upstream) exchange(ctx context.Context, dnsQuery string) (*[]byte, erro
 
 	bb := bufPool4k.Get()
 	defer bufPool4k.Release(bb)
-	_, err = bb.ReadFrom(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	limit := int64(dns.MaxMsgSize)
+	if jsonQ != nil {
+		limit = jsonMaxBodySize
+	}
+	_, err = bb.ReadFrom(io.LimitReader(resp.Body, limit))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read http body: %w", err)
 	}
+
+	if jsonQ != nil {
+		r, err := unmarshalJSONResp(bb.Bytes(), jsonQ)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json response, %w", err)
+		}
+		return pool.PackBuffer(r)
+	}
+
 	if bb.Len() < dnsutils.DnsHeaderLen {
 		return nil, dnsutils.ErrPayloadTooSmall
 	}
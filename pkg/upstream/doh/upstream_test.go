@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func testHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Test") != "v" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.URL.Query().Has("name") { // json
+			jm := jsonMsg{
+				RD:       true,
+				RA:       true,
+				Question: []jsonQuestion{{Name: req.URL.Query().Get("name"), Type: dns.TypeA}},
+				Answer: []jsonRR{
+					{Name: "example.com.", Type: dns.TypeCNAME, TTL: 10, Data: "a.example.com."},
+					{Name: "a.example.com.", Type: dns.TypeA, TTL: 20, Data: "1.2.3.4"},
+				},
+			}
+			w.Header().Set("Content-Type", "application/dns-json")
+			_ = json.NewEncoder(w).Encode(jm)
+			return
+		}
+
+		var b []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			b, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			b, err = io.ReadAll(req.Body)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 20},
+			A:   []byte{1, 2, 3, 4},
+		})
+		rb, err := r.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(rb)
+	}
+}
+
+func Test_Upstream(t *testing.T) {
+	s := httptest.NewServer(testHandler(t))
+	defer s.Close()
+
+	for _, opt := range []Opt{
+		{Method: http.MethodGet},
+		{Method: http.MethodPost},
+		{Format: FormatJSON},
+	} {
+		opt.Header = http.Header{"X-Test": []string{"v"}}
+		u, err := NewUpstream(s.URL+"/dns-query", http.DefaultTransport, opt)
+		require.NoError(t, err)
+
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = 1234
+		qb, err := q.Pack()
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		rb, err := u.ExchangeContext(ctx, qb)
+		cancel()
+		require.NoError(t, err, "opt %+v", opt)
+		r := new(dns.Msg)
+		require.NoError(t, r.Unpack(*rb))
+		pool.ReleaseBuf(rb)
+
+		require.Equal(t, q.Id, r.Id)
+		require.Equal(t, q.Question, r.Question)
+		require.NotEmpty(t, r.Answer)
+		a, ok := r.Answer[len(r.Answer)-1].(*dns.A)
+		require.True(t, ok)
+		require.Equal(t, "1.2.3.4", a.A.String())
+	}
+
+	_, err := NewUpstream(s.URL, http.DefaultTransport, Opt{Method: http.MethodPost, Format: FormatJSON})
+	require.Error(t, err)
+}
+
+func Test_newJSONQuery(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	q.CheckingDisabled = true
+	q.SetEdns0(1232, true)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       []byte{1, 2, 3, 0},
+	})
+	v, err := newJSONQuery(q)
+	require.NoError(t, err)
+	require.Equal(t, "example.com.", v.Get("name"))
+	require.Equal(t, "28", v.Get("type"))
+	require.Equal(t, "1", v.Get("cd"))
+	require.Equal(t, "1", v.Get("do"))
+	require.Equal(t, "1.2.3.0/24", v.Get("edns_client_subnet"))
+}
+
+func Test_ParseStamp(t *testing.T) {
+	st, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	require.NoError(t, err)
+	require.Equal(t, "1.0.0.1", st.Addr)
+	require.Equal(t, "dns.cloudflare.com", st.Hostname)
+	require.Equal(t, "/dns-query", st.Path)
+	require.Equal(t, "https://dns.cloudflare.com/dns-query", st.URL())
+
+	// DNSCrypt stamp
+	_, err = ParseStamp("sdns://AQcAAAAAAAAABzEuMi4zLjQ")
+	require.Error(t, err)
+	_, err = ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEA")
+	require.Error(t, err)
+}
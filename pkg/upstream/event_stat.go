@@ -29,6 +29,9 @@ type Event int
 const (
 	EventConnOpen Event = iota
 	EventConnClose
+	EventRespMismatch     // A udp response was dropped because its question mismatched the query.
+	EventPipelineDetected // The auto probe found that the server supports query pipelining.
+	EventReuseDetected    // The auto probe found that the server may not support query pipelining.
 )
 
 type EventObserver interface {
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Connection Attempt Delay. See RFC 8305 5.
+const happyEyeballsDelay = time.Millisecond * 250
+
+var errNoAddr = errors.New("no address to dial")
+
+// interleaveAddrs reorders addrs so that ipv6 and ipv4 addresses
+// alternate, starting with ipv6. See RFC 8305 4.
+func interleaveAddrs(addrs []netip.AddrPort) []netip.AddrPort {
+	var v6, v4 []netip.AddrPort
+	for _, ap := range addrs {
+		if ap.Addr().Is4() {
+			v4 = append(v4, ap)
+		} else {
+			v6 = append(v6, ap)
+		}
+	}
+	if len(v6) == 0 || len(v4) == 0 {
+		return addrs
+	}
+	out := make([]netip.AddrPort, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// raceDial dials addrs in the happy eyeballs (RFC 8305) manner. Attempts are
+// started one by one with happyEyeballsDelay between them, or immediately
+// after the previous one failed. The first established connection is returned
+// and all others are closed by closeFn.
+func raceDial[T any](
+	ctx context.Context,
+	addrs []netip.AddrPort,
+	dial func(ctx context.Context, ap netip.AddrPort) (T, error),
+	closeFn func(T),
+) (T, error) {
+	var zero T
+	if len(addrs) == 0 {
+		return zero, errNoAddr
+	}
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+	addrs = interleaveAddrs(addrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		c   T
+		err error
+	}
+	resC := make(chan res, len(addrs)) // never blocks
+	started := 0
+	startNext := func() {
+		ap := addrs[started]
+		started++
+		go func() {
+			c, err := dial(ctx, ap)
+			resC <- res{c: c, err: err}
+		}()
+	}
+	// closeLate closes connections that are established after we returned.
+	closeLate := func(pending int) {
+		go func() {
+			for ; pending > 0; pending-- {
+				if r := <-resC; r.err == nil {
+					closeFn(r.c)
+				}
+			}
+		}()
+	}
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	startNext()
+	pending := 1
+	var errs []error
+	for {
+		select {
+		case <-timer.C:
+			if started < len(addrs) {
+				startNext()
+				pending++
+				timer.Reset(happyEyeballsDelay)
+			}
+		case r := <-resC:
+			pending--
+			if r.err == nil {
+				closeLate(pending)
+				return r.c, nil
+			}
+			errs = append(errs, r.err)
+			if started < len(addrs) {
+				startNext()
+				pending++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(happyEyeballsDelay)
+			} else if pending == 0 {
+				return zero, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			closeLate(pending)
+			return zero, context.Cause(ctx)
+		}
+	}
+}
+
+func closeConn(c net.Conn) {
+	c.Close()
+}
+
+func closeQuicConn[T quic.Connection](c T) {
+	c.CloseWithError(0, "")
+}
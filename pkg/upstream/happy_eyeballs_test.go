@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_interleaveAddrs(t *testing.T) {
+	a4 := netip.MustParseAddrPort("1.1.1.1:53")
+	b4 := netip.MustParseAddrPort("1.1.1.2:53")
+	a6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	require.Equal(t,
+		[]netip.AddrPort{a6, a4, b4},
+		interleaveAddrs([]netip.AddrPort{a4, b4, a6}),
+	)
+}
+
+func Test_raceDial(t *testing.T) {
+	a6 := netip.MustParseAddrPort("[2001:db8::1]:53")  // slow
+	a4 := netip.MustParseAddrPort("1.1.1.1:53")        // fast
+	bad := netip.MustParseAddrPort("[2001:db8::2]:53") // fails
+
+	var closed atomic.Int32
+	dial := func(ctx context.Context, ap netip.AddrPort) (netip.AddrPort, error) {
+		switch ap {
+		case a6:
+			select {
+			case <-time.After(time.Second):
+				return ap, nil
+			case <-ctx.Done():
+				return netip.AddrPort{}, ctx.Err()
+			}
+		case bad:
+			return netip.AddrPort{}, errors.New("failed")
+		default:
+			return ap, nil
+		}
+	}
+	closeFn := func(netip.AddrPort) { closed.Add(1) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// a6 is tried first. a4 should win after the attempt delay.
+	start := time.Now()
+	c, err := raceDial(ctx, []netip.AddrPort{a6, a4}, dial, closeFn)
+	require.NoError(t, err)
+	require.Equal(t, a4, c)
+	require.Less(t, time.Since(start), time.Millisecond*900)
+
+	// A failed attempt starts the next one immediately.
+	start = time.Now()
+	c, err = raceDial(ctx, []netip.AddrPort{bad, a4}, dial, closeFn)
+	require.NoError(t, err)
+	require.Equal(t, a4, c)
+	require.Less(t, time.Since(start), happyEyeballsDelay)
+
+	_, err = raceDial(ctx, []netip.AddrPort{bad}, dial, closeFn)
+	require.Error(t, err)
+	require.Zero(t, closed.Load())
+}
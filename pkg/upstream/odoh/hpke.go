@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A minimal implementation of HPKE (RFC 9180) base mode.
+// Only the algorithms that are used by ODoH deployments are supported:
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM, AES-256-GCM,
+// ChaCha20Poly1305.
+
+const (
+	kemX25519HKDFSHA256 uint16 = 0x0020
+	kdfHKDFSHA256       uint16 = 0x0001
+	aeadAES128GCM       uint16 = 0x0001
+	aeadAES256GCM       uint16 = 0x0002
+	aeadChaCha20Poly    uint16 = 0x0003
+
+	hpkeModeBase = 0x00
+
+	// Nh of HKDF-SHA256.
+	kdfNh = 32
+	// Nsecret of DHKEM(X25519, HKDF-SHA256).
+	kemNsecret = 32
+	// Nn of all supported aead.
+	aeadNn = 12
+)
+
+var errUnsupportedSuite = errors.New("unsupported hpke cipher suite")
+
+type hpkeSuite struct {
+	kemID  uint16
+	kdfID  uint16
+	aeadID uint16
+}
+
+func (s hpkeSuite) check() error {
+	if s.kemID != kemX25519HKDFSHA256 || s.kdfID != kdfHKDFSHA256 {
+		return errUnsupportedSuite
+	}
+	switch s.aeadID {
+	case aeadAES128GCM, aeadAES256GCM, aeadChaCha20Poly:
+		return nil
+	default:
+		return errUnsupportedSuite
+	}
+}
+
+// aeadNk returns the key length of the aead.
+func (s hpkeSuite) aeadNk() int {
+	switch s.aeadID {
+	case aeadAES128GCM:
+		return 16
+	default:
+		return 32
+	}
+}
+
+func (s hpkeSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s.aeadID {
+	case aeadAES128GCM, aeadAES256GCM:
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	case aeadChaCha20Poly:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, errUnsupportedSuite
+	}
+}
+
+func (s hpkeSuite) kemSuiteID() []byte {
+	return binary.BigEndian.AppendUint16([]byte("KEM"), s.kemID)
+}
+
+func (s hpkeSuite) hpkeSuiteID() []byte {
+	b := []byte("HPKE")
+	b = binary.BigEndian.AppendUint16(b, s.kemID)
+	b = binary.BigEndian.AppendUint16(b, s.kdfID)
+	b = binary.BigEndian.AppendUint16(b, s.aeadID)
+	return b
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	labeledIKM = append(labeledIKM, "HPKE-v1"...)
+	labeledIKM = append(labeledIKM, suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	labeledInfo := make([]byte, 0, 2+7+len(suiteID)+len(label)+len(info))
+	labeledInfo = binary.BigEndian.AppendUint16(labeledInfo, uint16(l))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return expand(prk, labeledInfo, l)
+}
+
+// expand is the plain HKDF-SHA256 Expand.
+func expand(prk, info []byte, l int) []byte {
+	out := make([]byte, l)
+	if _, err := hkdf.Expand(sha256.New, prk, info).Read(out); err != nil {
+		panic(fmt.Sprintf("hkdf expand: %s", err)) // only if l is too large
+	}
+	return out
+}
+
+// extract is the plain HKDF-SHA256 Extract.
+func extract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+func (s hpkeSuite) extractAndExpand(dh, kemContext []byte) []byte {
+	suiteID := s.kemSuiteID()
+	eaePRK := labeledExtract(suiteID, nil, "eae_prk", dh)
+	return labeledExpand(suiteID, eaePRK, "shared_secret", kemContext, kemNsecret)
+}
+
+// hpkeContext is a base mode hpke context that can seal (or open)
+// exactly one message. This is all ODoH needs.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	suite          hpkeSuite
+}
+
+func (s hpkeSuite) keySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	suiteID := s.hpkeSuiteID()
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	ksContext := make([]byte, 0, 1+len(pskIDHash)+len(infoHash))
+	ksContext = append(ksContext, hpkeModeBase)
+	ksContext = append(ksContext, pskIDHash...)
+	ksContext = append(ksContext, infoHash...)
+
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(suiteID, secret, "key", ksContext, s.aeadNk())
+	aead, err := s.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", ksContext, aeadNn),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", ksContext, kdfNh),
+		suite:          s,
+	}, nil
+}
+
+// setupBaseS encapsulates a shared secret to the receiver public key pkR.
+// It returns the encapsulated key and the sender context.
+func (s hpkeSuite) setupBaseS(pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+	pk, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	kemContext := append(append([]byte(nil), enc...), pkR...)
+	ctx, err := s.keySchedule(s.extractAndExpand(dh, kemContext), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// setupBaseR decapsulates the shared secret from enc with the receiver private key skR.
+func (s hpkeSuite) setupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte(nil), enc...), skR.PublicKey().Bytes()...)
+	return s.keySchedule(s.extractAndExpand(dh, kemContext), info)
+}
+
+// seal encrypts the first (and only) message of the context.
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, pt, aad)
+}
+
+// open decrypts the first (and only) message of the context.
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ct, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(c.suite.hpkeSuiteID(), c.exporterSecret, "sec", exporterContext, l)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9180 A.1.1. Base Setup Information, DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+func Test_hpke_rfc9180Vector(t *testing.T) {
+	s := hpkeSuite{kemID: kemX25519HKDFSHA256, kdfID: kdfHKDFSHA256, aeadID: aeadAES128GCM}
+	info := mustHex("4f6465206f6e2061204772656369616e2055726e")
+	skR, err := ecdh.X25519().NewPrivateKey(mustHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	require.NoError(t, err)
+	require.Equal(t, mustHex("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d"), skR.PublicKey().Bytes())
+	enc := mustHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+
+	ctx, err := s.setupBaseR(enc, skR, info)
+	require.NoError(t, err)
+	require.Equal(t, mustHex("56d890e5accaaf011cff4b7d"), ctx.baseNonce)
+	require.Equal(t, mustHex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"), ctx.exporterSecret)
+
+	pt, err := ctx.open(
+		mustHex("436f756e742d30"),
+		mustHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "Beauty is truth, truth beauty", string(pt))
+}
+
+func Test_hpke_roundTrip(t *testing.T) {
+	for _, aeadID := range []uint16{aeadAES128GCM, aeadAES256GCM, aeadChaCha20Poly} {
+		s := hpkeSuite{kemID: kemX25519HKDFSHA256, kdfID: kdfHKDFSHA256, aeadID: aeadID}
+		skR, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		enc, sCtx, err := s.setupBaseS(skR.PublicKey().Bytes(), []byte("info"))
+		require.NoError(t, err)
+		rCtx, err := s.setupBaseR(enc, skR, []byte("info"))
+		require.NoError(t, err)
+
+		ct := sCtx.seal([]byte("aad"), []byte("msg"))
+		pt, err := rCtx.open([]byte("aad"), ct)
+		require.NoError(t, err)
+		require.Equal(t, "msg", string(pt))
+		require.Equal(t, sCtx.export([]byte("e"), 16), rCtx.export([]byte("e"), 16))
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ODoH message types and labels. See RFC 9230.
+const (
+	configVersion = 0x0001
+
+	msgTypeQuery    uint8 = 0x01
+	msgTypeResponse uint8 = 0x02
+
+	labelQuery    = "odoh query"
+	labelResponse = "odoh response"
+	labelKeyID    = "odoh key id"
+	labelKey      = "odoh key"
+	labelNonce    = "odoh nonce"
+)
+
+var (
+	errShortBuffer   = errors.New("buffer is too short")
+	errNoValidConfig = errors.New("no supported odoh config")
+)
+
+// config is an ObliviousDoHConfigContents.
+type config struct {
+	suite     hpkeSuite
+	publicKey []byte
+	raw       []byte // serialized ObliviousDoHConfigContents
+	keyID     []byte
+}
+
+func (c *config) marshal() []byte {
+	b := make([]byte, 0, 8+len(c.publicKey))
+	b = binary.BigEndian.AppendUint16(b, c.suite.kemID)
+	b = binary.BigEndian.AppendUint16(b, c.suite.kdfID)
+	b = binary.BigEndian.AppendUint16(b, c.suite.aeadID)
+	b = appendU16Bytes(b, c.publicKey)
+	return b
+}
+
+// parseConfigs parses ObliviousDoHConfigs and returns the first
+// config that is supported.
+func parseConfigs(b []byte) (*config, error) {
+	cs, rest, err := readU16Bytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after configs")
+	}
+	for len(cs) > 0 {
+		if len(cs) < 2 {
+			return nil, errShortBuffer
+		}
+		version := binary.BigEndian.Uint16(cs)
+		var contents []byte
+		contents, cs, err = readU16Bytes(cs[2:])
+		if err != nil {
+			return nil, err
+		}
+		if version != configVersion {
+			continue
+		}
+		c, err := parseConfigContents(contents)
+		if err != nil {
+			continue
+		}
+		return c, nil
+	}
+	return nil, errNoValidConfig
+}
+
+func parseConfigContents(b []byte) (*config, error) {
+	if len(b) < 6 {
+		return nil, errShortBuffer
+	}
+	c := &config{
+		suite: hpkeSuite{
+			kemID:  binary.BigEndian.Uint16(b),
+			kdfID:  binary.BigEndian.Uint16(b[2:]),
+			aeadID: binary.BigEndian.Uint16(b[4:]),
+		},
+	}
+	if err := c.suite.check(); err != nil {
+		return nil, err
+	}
+	pk, rest, err := readU16Bytes(b[6:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after config contents")
+	}
+	c.publicKey = pk
+	c.raw = b
+	c.keyID = expand(extract(nil, b), []byte(labelKeyID), kdfNh)
+	return c, nil
+}
+
+// marshalConfigs wraps c into a ObliviousDoHConfigs.
+func marshalConfigs(c *config) []byte {
+	contents := c.marshal()
+	b := make([]byte, 0, 6+len(contents))
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(contents)))
+	b = binary.BigEndian.AppendUint16(b, configVersion)
+	b = appendU16Bytes(b, contents)
+	return b
+}
+
+// message is an ObliviousDoHMessage.
+type message struct {
+	typ              uint8
+	keyID            []byte
+	encryptedMessage []byte
+}
+
+func (m *message) marshal() []byte {
+	b := make([]byte, 0, 5+len(m.keyID)+len(m.encryptedMessage))
+	b = append(b, m.typ)
+	b = appendU16Bytes(b, m.keyID)
+	b = appendU16Bytes(b, m.encryptedMessage)
+	return b
+}
+
+func (m *message) aad() []byte {
+	b := make([]byte, 0, 3+len(m.keyID))
+	b = append(b, m.typ)
+	b = appendU16Bytes(b, m.keyID)
+	return b
+}
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 1 {
+		return nil, errShortBuffer
+	}
+	m := &message{typ: b[0]}
+	var err error
+	if m.keyID, b, err = readU16Bytes(b[1:]); err != nil {
+		return nil, err
+	}
+	if m.encryptedMessage, b, err = readU16Bytes(b); err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing data after message")
+	}
+	return m, nil
+}
+
+// marshalPlaintext builds an ObliviousDoHMessagePlaintext.
+func marshalPlaintext(dnsMsg []byte, paddingLen int) []byte {
+	b := make([]byte, 0, 4+len(dnsMsg)+paddingLen)
+	b = appendU16Bytes(b, dnsMsg)
+	b = binary.BigEndian.AppendUint16(b, uint16(paddingLen))
+	b = append(b, make([]byte, paddingLen)...)
+	return b
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	dnsMsg, b, err := readU16Bytes(b)
+	if err != nil {
+		return nil, err
+	}
+	padding, b, err := readU16Bytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("trailing data after plaintext")
+	}
+	for _, p := range padding {
+		if p != 0 {
+			return nil, errors.New("non-zero padding")
+		}
+	}
+	return dnsMsg, nil
+}
+
+// queryContext holds the state that is needed to decrypt the response.
+type queryContext struct {
+	hpke           *hpkeContext
+	encryptedQuery []byte
+}
+
+// encryptQuery encrypts the dns query q with c.
+func encryptQuery(c *config, q []byte) (*message, *queryContext, error) {
+	enc, hc, err := c.suite.setupBaseS(c.publicKey, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &message{typ: msgTypeQuery, keyID: c.keyID}
+	ct := hc.seal(m.aad(), marshalPlaintext(q, 0))
+	m.encryptedMessage = append(enc, ct...)
+	return m, &queryContext{hpke: hc, encryptedQuery: m.encryptedMessage}, nil
+}
+
+// responseKeyAndNonce derives the response aead key and nonce. See RFC 9230 6.4.
+func (qc *queryContext) responseKeyAndNonce(responseNonce []byte) ([]byte, []byte) {
+	nk := qc.hpke.suite.aeadNk()
+	secret := qc.hpke.export([]byte(labelResponse), nk)
+	salt := make([]byte, 0, len(qc.encryptedQuery)+len(responseNonce))
+	salt = append(salt, qc.encryptedQuery...)
+	salt = append(salt, responseNonce...)
+	prk := extract(salt, secret)
+	return expand(prk, []byte(labelKey), nk), expand(prk, []byte(labelNonce), aeadNn)
+}
+
+// decryptQuery decrypts the dns query from m with the config private key skR.
+// It is the target side of encryptQuery.
+func decryptQuery(c *config, skR *ecdh.PrivateKey, m *message) ([]byte, *queryContext, error) {
+	if m.typ != msgTypeQuery {
+		return nil, nil, fmt.Errorf("unexpected message type %d", m.typ)
+	}
+	if !bytes.Equal(m.keyID, c.keyID) {
+		return nil, nil, errors.New("key id mismatched")
+	}
+	encLen := len(skR.PublicKey().Bytes())
+	if len(m.encryptedMessage) < encLen {
+		return nil, nil, errShortBuffer
+	}
+	hc, err := c.suite.setupBaseR(m.encryptedMessage[:encLen], skR, []byte(labelQuery))
+	if err != nil {
+		return nil, nil, err
+	}
+	pt, err := hc.open(m.aad(), m.encryptedMessage[encLen:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt query, %w", err)
+	}
+	q, err := parsePlaintext(pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, &queryContext{hpke: hc, encryptedQuery: m.encryptedMessage}, nil
+}
+
+// decryptResponse decrypts the dns response from m.
+func (qc *queryContext) decryptResponse(m *message) ([]byte, error) {
+	if m.typ != msgTypeResponse {
+		return nil, fmt.Errorf("unexpected message type %d", m.typ)
+	}
+	key, nonce := qc.responseKeyAndNonce(m.keyID)
+	aead, err := qc.hpke.suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, nonce, m.encryptedMessage, m.aad())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt response, %w", err)
+	}
+	return parsePlaintext(pt)
+}
+
+// encryptResponse encrypts the dns response r. It is the target side
+// of decryptResponse.
+func (qc *queryContext) encryptResponse(r []byte) (*message, error) {
+	nonceLen := qc.hpke.suite.aeadNk()
+	if nonceLen < aeadNn {
+		nonceLen = aeadNn
+	}
+	responseNonce := make([]byte, nonceLen)
+	if _, err := rand.Read(responseNonce); err != nil {
+		return nil, err
+	}
+	key, nonce := qc.responseKeyAndNonce(responseNonce)
+	aead, err := qc.hpke.suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	m := &message{typ: msgTypeResponse, keyID: responseNonce}
+	m.encryptedMessage = aead.Seal(nil, nonce, marshalPlaintext(r, 0), m.aad())
+	return m, nil
+}
+
+func appendU16Bytes(b []byte, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func readU16Bytes(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errShortBuffer
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, errShortBuffer
+	}
+	return b[2 : 2+l], b[2+l:], nil
+}
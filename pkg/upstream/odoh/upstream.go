@@ -0,0 +1,398 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTimeout = time.Second * 6
+
+	configWellKnownPath = "/.well-known/odohconfigs"
+	contentType         = "application/oblivious-dns-message"
+
+	defaultConfigTTL    = time.Hour
+	minConfigTTL        = time.Minute
+	maxConfigTTL        = time.Hour * 24
+	configRetryInterval = time.Second * 5
+	maxConfigSize       = 16 * 1024
+)
+
+var nopLogger = zap.NewNop()
+
+// errKeyMismatch indicates that the target cannot decrypt the query. Most likely
+// the target has rotated its key.
+var errKeyMismatch = errors.New("target rejected the query key")
+
+type Opt struct {
+	// Relay is the url of the oblivious relay. Required.
+	Relay string
+
+	// RelayRoundTripper is used to send queries to the relay. Required.
+	RelayRoundTripper http.RoundTripper
+
+	// ConfigRoundTripper is used to fetch the odoh configs from the target
+	// directly, e.g. through a proxy. If it is nil, configs are fetched
+	// through the relay (a GET request with the same targethost and
+	// the well-known targetpath), so the target never sees the address
+	// of this client. This is not standard. RFC 9230 relays only forward
+	// POST requests.
+	ConfigRoundTripper http.RoundTripper
+
+	// FallbackRoundTripper is used to fetch the odoh configs from the
+	// target directly if the relay rejects the GET request. It is only
+	// used if ConfigRoundTripper is nil. If it is nil, there is no fallback.
+	FallbackRoundTripper http.RoundTripper
+
+	Logger *zap.Logger
+}
+
+// Upstream is an Oblivious DoH (RFC 9230) upstream.
+// The target config is fetched from its well-known path, cached
+// by its Cache-Control max-age and rotated when the target rejects
+// the key. See Opt.ConfigRoundTripper for how configs are fetched.
+type Upstream struct {
+	relayRT   http.RoundTripper
+	configRT  http.RoundTripper
+	logger    *zap.Logger // non-nil
+	relayURL  *urlpkg.URL
+	configURL string
+
+	fallbackRT  http.RoundTripper // maybe nil
+	fallbackURL string
+
+	fetchM     sync.Mutex // serializes config fetching
+	refreshing atomic.Bool
+
+	cm       sync.Mutex
+	c        *config // maybe nil
+	cExpires time.Time
+}
+
+// NewUpstream creates an odoh upstream. target is the target url, e.g. https://odoh.example/dns-query.
+func NewUpstream(target string, opt Opt) (*Upstream, error) {
+	if opt.RelayRoundTripper == nil {
+		return nil, errors.New("missing relay round tripper")
+	}
+	targetURL, err := urlpkg.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target url, %w", err)
+	}
+	if len(targetURL.Host) == 0 {
+		return nil, errors.New("missing target host")
+	}
+	if len(opt.Relay) == 0 {
+		return nil, errors.New("missing relay")
+	}
+	relayURL, err := urlpkg.Parse(opt.Relay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay url, %w", err)
+	}
+	if relayURL.Scheme != "https" && relayURL.Scheme != "http" {
+		return nil, fmt.Errorf("invalid relay url scheme %s", relayURL.Scheme)
+	}
+
+	targetPath := targetURL.Path
+	if len(targetPath) == 0 {
+		targetPath = "/dns-query"
+	}
+	q := relayURL.Query()
+	q.Set("targethost", targetURL.Host)
+	q.Set("targetpath", targetPath)
+	queryURL := *relayURL
+	queryURL.RawQuery = q.Encode()
+
+	directURL := urlpkg.URL{Scheme: "https", Host: targetURL.Host, Path: configWellKnownPath}
+	if targetURL.Scheme == "http" { // for testing
+		directURL.Scheme = "http"
+	}
+	configRT := opt.ConfigRoundTripper
+	configURL := directURL
+	var fallbackRT http.RoundTripper
+	if configRT == nil {
+		configRT = opt.RelayRoundTripper
+		q.Set("targetpath", configWellKnownPath)
+		configURL = *relayURL
+		configURL.RawQuery = q.Encode()
+		fallbackRT = opt.FallbackRoundTripper
+	}
+
+	logger := opt.Logger
+	if logger == nil {
+		logger = nopLogger
+	}
+	return &Upstream{
+		relayRT:   opt.RelayRoundTripper,
+		configRT:  configRT,
+		logger:    logger,
+		relayURL:  &queryURL,
+		configURL: configURL.String(),
+
+		fallbackRT:  fallbackRT,
+		fallbackURL: directURL.String(),
+	}, nil
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	wire := make([]byte, len(q))
+	copy(wire, q)
+	// Same as DoH, use a DNS ID of 0 in every DNS request.
+	wire[0] = 0
+	wire[1] = 0
+
+	type res struct {
+		r   *[]byte
+		err error
+	}
+	resChan := make(chan res, 1)
+	go func() {
+		// See doh.Upstream.
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+		r, err := u.exchange(ctx, wire)
+		if errors.Is(err, errKeyMismatch) {
+			r, err = u.exchange(ctx, wire)
+		}
+		if err != nil {
+			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
+		}
+		resChan <- res{r: r, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-resChan:
+		r := res.r
+		err := res.err
+		if r != nil {
+			binary.BigEndian.PutUint16(*r, binary.BigEndian.Uint16(q))
+		}
+		return r, err
+	}
+}
+
+func (u *Upstream) exchange(ctx context.Context, q []byte) (*[]byte, error) {
+	c, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get odoh config, %w", err)
+	}
+	m, qc, err := encryptQuery(c, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt query, %w", err)
+	}
+	body := m.marshal()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.relayURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{contentType}
+	req.Header["Accept"] = []string{contentType}
+	req.Header["User-Agent"] = nil
+	resp, err := u.relayRT.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			u.invalidateConfig(c)
+			return nil, errKeyMismatch
+		}
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("bad http status codes %d with body [%s]", resp.StatusCode, body1k)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	rm, err := parseMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid odoh message, %w", err)
+	}
+	r, err := qc.decryptResponse(rm)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(r))
+	copy(*payload, r)
+	return payload, nil
+}
+
+// getConfig returns the cached config. If it is expired, it will be
+// refreshed in background and the old one is still used.
+func (u *Upstream) getConfig(ctx context.Context) (*config, error) {
+	u.cm.Lock()
+	c, expires := u.c, u.cExpires
+	u.cm.Unlock()
+
+	if c != nil {
+		if time.Now().After(expires) {
+			u.refreshConfigAsync()
+		}
+		return c, nil
+	}
+
+	u.fetchM.Lock()
+	defer u.fetchM.Unlock()
+	u.cm.Lock()
+	c = u.c
+	u.cm.Unlock()
+	if c != nil { // fetched by others
+		return c, nil
+	}
+	return u.fetchConfig(ctx)
+}
+
+func (u *Upstream) refreshConfigAsync() {
+	if !u.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer u.refreshing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+		u.fetchM.Lock()
+		defer u.fetchM.Unlock()
+		if _, err := u.fetchConfig(ctx); err != nil {
+			u.logger.Check(zap.WarnLevel, "failed to refresh odoh config").Write(zap.Error(err))
+			// Keep using the old config. Retry later.
+			u.cm.Lock()
+			u.cExpires = time.Now().Add(configRetryInterval)
+			u.cm.Unlock()
+		}
+	}()
+}
+
+// invalidateConfig removes c from the cache.
+func (u *Upstream) invalidateConfig(c *config) {
+	u.cm.Lock()
+	if u.c == c {
+		u.c = nil
+	}
+	u.cm.Unlock()
+}
+
+// statusError is a non-200 http status code.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("bad http status codes %d", int(e))
+}
+
+// fetchConfig fetches and caches a new config. Caller must hold fetchM.
+// If the relay rejects the request, it fetches from the target directly
+// with fallbackRT.
+func (u *Upstream) fetchConfig(ctx context.Context) (*config, error) {
+	url := u.configURL
+	c, ttl, err := getConfig(ctx, u.configRT, url)
+	var se statusError
+	if errors.As(err, &se) && u.fallbackRT != nil {
+		u.logger.Check(zap.DebugLevel, "relay rejected the odoh config request, fetching it from the target").Write(zap.Error(err))
+		url = u.fallbackURL
+		c, ttl, err = getConfig(ctx, u.fallbackRT, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u.cm.Lock()
+	u.c = c
+	u.cExpires = time.Now().Add(ttl)
+	u.cm.Unlock()
+	u.logger.Check(zap.DebugLevel, "odoh config updated").Write(
+		zap.String("url", url),
+		zap.Uint16("aead", c.suite.aeadID),
+		zap.Duration("ttl", ttl),
+	)
+	return c, nil
+}
+
+// getConfig gets the configs from url.
+func getConfig(ctx context.Context, rt http.RoundTripper, url string) (*config, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header["User-Agent"] = nil
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, statusError(resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read http body: %w", err)
+	}
+	c, err := parseConfigs(b)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid odoh configs, %w", err)
+	}
+	return c, parseMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// parseMaxAge parses the max-age directive from a Cache-Control header.
+// The result is clamped to [minConfigTTL, maxConfigTTL].
+func parseMaxAge(cc string) time.Duration {
+	ttl := defaultConfigTTL
+	for _, d := range strings.Split(cc, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(k, "max-age") {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil {
+			ttl = time.Duration(n) * time.Second
+		}
+	}
+	if ttl < minConfigTTL {
+		ttl = minConfigTTL
+	}
+	if ttl > maxConfigTTL {
+		ttl = maxConfigTTL
+	}
+	return ttl
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// testTarget is a stand-in odoh target.
+type testTarget struct {
+	t           *testing.T
+	m           sync.Mutex
+	sk          *ecdh.PrivateKey
+	c           *config
+	configFetch atomic.Int32
+	direct      atomic.Int32 // Requests that were not forwarded by testRelay.
+}
+
+func newTestTarget(t *testing.T) *testTarget {
+	tt := &testTarget{t: t}
+	tt.rotate()
+	return tt
+}
+
+func (tt *testTarget) rotate() {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(tt.t, err)
+	c := &config{
+		suite:     hpkeSuite{kemID: kemX25519HKDFSHA256, kdfID: kdfHKDFSHA256, aeadID: aeadAES128GCM},
+		publicKey: sk.PublicKey().Bytes(),
+	}
+	c, err = parseConfigContents(c.marshal())
+	require.NoError(tt.t, err)
+	tt.m.Lock()
+	tt.sk, tt.c = sk, c
+	tt.m.Unlock()
+}
+
+func (tt *testTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tt.m.Lock()
+	sk, c := tt.sk, tt.c
+	tt.m.Unlock()
+
+	if req.Header.Get("Via") != testRelayVia {
+		tt.direct.Add(1)
+	}
+	switch req.URL.Path {
+	case configWellKnownPath:
+		tt.configFetch.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write(marshalConfigs(c))
+	case "/dns-query":
+		b, _ := io.ReadAll(req.Body)
+		m, err := parseMessage(b)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		qb, qc, err := decryptQuery(c, sk, m)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(qb); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 20},
+			A:   []byte{1, 2, 3, 4},
+		})
+		rb, _ := r.Pack()
+		rm, err := qc.encryptResponse(rb)
+		require.NoError(tt.t, err)
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(rm.marshal())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+const testRelayVia = "1.1 test-relay"
+
+// testRelay is a stand-in odoh relay. It forwards queries and config
+// requests to the target over plain http.
+func testRelay(w http.ResponseWriter, req *http.Request) {
+	target := "http://" + req.URL.Query().Get("targethost") + req.URL.Query().Get("targetpath")
+	var fReq *http.Request
+	switch {
+	case req.Method == http.MethodPost && req.Header.Get("Content-Type") == contentType:
+		b, _ := io.ReadAll(req.Body)
+		fReq, _ = http.NewRequest(http.MethodPost, target, bytes.NewReader(b))
+		fReq.Header.Set("Content-Type", contentType)
+	case req.Method == http.MethodGet && req.URL.Query().Get("targetpath") == configWellKnownPath:
+		fReq, _ = http.NewRequest(http.MethodGet, target, nil)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fReq.Header.Set("Via", testRelayVia)
+	resp, err := http.DefaultClient.Do(fReq)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if cc := resp.Header.Get("Cache-Control"); len(cc) > 0 {
+		w.Header().Set("Cache-Control", cc)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func Test_Upstream(t *testing.T) {
+	target := newTestTarget(t)
+	ts := httptest.NewServer(target)
+	defer ts.Close()
+	rs := httptest.NewServer(http.HandlerFunc(testRelay))
+	defer rs.Close()
+
+	u, err := NewUpstream(ts.URL+"/dns-query", Opt{
+		Relay:             rs.URL + "/proxy",
+		RelayRoundTripper: http.DefaultTransport,
+	})
+	require.NoError(t, err)
+
+	exchange := func() {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Id = 4321
+		qb, err := q.Pack()
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		rb, err := u.ExchangeContext(ctx, qb)
+		require.NoError(t, err)
+		defer pool.ReleaseBuf(rb)
+		r := new(dns.Msg)
+		require.NoError(t, r.Unpack(*rb))
+		require.Equal(t, q.Id, r.Id)
+		require.Len(t, r.Answer, 1)
+	}
+
+	exchange()
+	exchange()
+	require.Equal(t, int32(1), target.configFetch.Load(), "config should be cached")
+
+	// Target rotates its key. The upstream should fetch the new config and retry.
+	target.rotate()
+	exchange()
+	require.Equal(t, int32(2), target.configFetch.Load())
+	require.Zero(t, target.direct.Load(), "target should never see a direct connection")
+
+	// Configs are fetched directly with ConfigRoundTripper (e.g. a proxy).
+	u, err = NewUpstream(ts.URL+"/dns-query", Opt{
+		Relay:              rs.URL + "/proxy",
+		RelayRoundTripper:  http.DefaultTransport,
+		ConfigRoundTripper: http.DefaultTransport,
+	})
+	require.NoError(t, err)
+	exchange()
+	require.Equal(t, int32(3), target.configFetch.Load())
+	require.Equal(t, int32(1), target.direct.Load())
+
+	// A standard relay rejects GET requests. Configs are fetched from
+	// the target directly with FallbackRoundTripper.
+	rs2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		testRelay(w, req)
+	}))
+	defer rs2.Close()
+	u, err = NewUpstream(ts.URL+"/dns-query", Opt{
+		Relay:                rs2.URL + "/proxy",
+		RelayRoundTripper:    http.DefaultTransport,
+		FallbackRoundTripper: http.DefaultTransport,
+	})
+	require.NoError(t, err)
+	exchange()
+	require.Equal(t, int32(4), target.configFetch.Load())
+	require.Equal(t, int32(2), target.direct.Load())
+}
+
+func Test_parseMaxAge(t *testing.T) {
+	require.Equal(t, time.Hour*2, parseMaxAge("public, max-age=7200"))
+	require.Equal(t, minConfigTTL, parseMaxAge("max-age=1"))
+	require.Equal(t, maxConfigTTL, parseMaxAge("max-age=99999999"))
+	require.Equal(t, defaultConfigTTL, parseMaxAge(""))
+}
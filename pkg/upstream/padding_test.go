@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type queryRecorder struct {
+	q chan *dns.Msg
+}
+
+func (h *queryRecorder) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	if q.Question[0].Name == "example.com." { // Ignore pipeline probes.
+		h.q <- q.Copy()
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	w.WriteMsg(r)
+}
+
+func Test_queryPadding(t *testing.T) {
+	for scheme, f := range m {
+		t.Run(scheme, func(t *testing.T) {
+			r := require.New(t)
+			h := &queryRecorder{q: make(chan *dns.Msg, 1)}
+			addr, shutdown := f(t, h)
+			defer shutdown()
+
+			u, err := NewUpstream(scheme+"://"+addr, Opt{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+			r.NoError(err)
+			defer u.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			b, err := pool.PackBuffer(q)
+			r.NoError(err)
+			defer pool.ReleaseBuf(b)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := u.ExchangeContext(ctx, *b)
+			r.NoError(err)
+			pool.ReleaseBuf(resp)
+
+			received := <-h.q
+			if scheme == "tls" {
+				r.True(dnsutils.HasPadding(received.IsEdns0()))
+				r.Zero(received.Len() % dnsutils.PaddingQueryBlockSize)
+			} else {
+				r.Nil(received.IsEdns0(), "plain dns query should not be padded")
+			}
+		})
+	}
+}
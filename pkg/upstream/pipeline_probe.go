@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Query modes of TCP, DoT upstream. See Opt.PipelineMode.
+const (
+	PipelineModeAuto     = "auto"
+	PipelineModePipeline = "pipeline"
+	PipelineModeReuse    = "reuse"
+)
+
+const (
+	pipelineProbeTimeout       = time.Second * 5
+	pipelineProbeRetryInterval = time.Minute
+)
+
+// ProbePipeline checks whether the server on the other side of c supports
+// RFC 7766 query pipelining. c must be a tcp or tls connection.
+// It sends a query with an uncached random name, then a query for the root NS
+// which is likely cached. If the later one is answered first, the server
+// processes queries concurrently.
+// A false result doesn't mean the server doesn't support pipelining. But it is
+// not worth it anyway.
+func ProbePipeline(ctx context.Context, c transport.NetConn) (bool, error) {
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	names := [...]string{fmt.Sprintf("%016x.com.", rand.Uint64()), "."}
+	for i, name := range names {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeNS)
+		q.Id = uint16(i)
+		if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+			return false, fmt.Errorf("failed to write probe query #%d, %w", i, err)
+		}
+	}
+	for i := range names {
+		r, _, err := dnsutils.ReadMsgFromTCP(c)
+		if err != nil {
+			return false, fmt.Errorf("failed to read probe response #%d, %w", i, err)
+		}
+		if r.Id != uint16(i) {
+			return true, nil // out-of-order
+		}
+	}
+	return false, nil
+}
+
+// autoPipelineTransport sends queries with connection reuse until
+// a background probe detects that the server supports pipelining.
+type autoPipelineTransport struct {
+	reuse       *transport.ReuseConnTransport
+	newPipeline func() *transport.PipelineTransport
+	dial        func(ctx context.Context) (transport.NetConn, error)
+	logger      *zap.Logger
+	eo          EventObserver
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	pipeline atomic.Pointer[transport.PipelineTransport]
+
+	m         sync.Mutex
+	closed    bool
+	probing   bool
+	probed    bool
+	nextProbe time.Time
+}
+
+func (t *autoPipelineTransport) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	if p := t.pipeline.Load(); p != nil {
+		return p.ExchangeContext(ctx, m)
+	}
+	t.tryProbe()
+	return t.reuse.ExchangeContext(ctx, m)
+}
+
+func (t *autoPipelineTransport) tryProbe() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed || t.probed || t.probing || time.Now().Before(t.nextProbe) {
+		return
+	}
+	t.probing = true
+	go t.probe()
+}
+
+func (t *autoPipelineTransport) probe() {
+	ctx, cancel := context.WithTimeout(t.ctx, pipelineProbeTimeout)
+	defer cancel()
+	supported, err := t.doProbe(ctx)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.probing = false
+	if t.closed {
+		return
+	}
+	if err != nil {
+		t.nextProbe = time.Now().Add(pipelineProbeRetryInterval)
+		t.logger.Warn("pipeline probe failed, will retry later", zap.Error(err))
+		return
+	}
+	t.probed = true
+	if supported {
+		t.pipeline.Store(t.newPipeline())
+		t.eo.OnEvent(EventPipelineDetected)
+		t.logger.Info("server supports query pipelining, switched to pipeline mode")
+	} else {
+		t.eo.OnEvent(EventReuseDetected)
+		t.logger.Info("server may not support query pipelining, using connection reuse mode")
+	}
+}
+
+func (t *autoPipelineTransport) doProbe(ctx context.Context) (bool, error) {
+	c, err := t.dial(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to dial probe connection, %w", err)
+	}
+	defer c.Close()
+	return ProbePipeline(ctx, c)
+}
+
+func (t *autoPipelineTransport) Close() error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+	t.cancel()
+	t.reuse.Close()
+	if p := t.pipeline.Load(); p != nil {
+		p.Close()
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newPipelineTestServer starts a tcp server that handles queries concurrently.
+// Queries except the root are answered with a delay.
+func newPipelineTestServer(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var wm sync.Mutex
+				for {
+					q, _, err := dnsutils.ReadMsgFromTCP(c)
+					if err != nil {
+						return
+					}
+					go func() {
+						if q.Question[0].Name != "." {
+							time.Sleep(time.Millisecond * 50)
+						}
+						r := new(dns.Msg)
+						r.SetReply(q)
+						wm.Lock()
+						defer wm.Unlock()
+						dnsutils.WriteMsgToTCP(c, r)
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+type eventRecorder struct {
+	m  sync.Mutex
+	es []Event
+}
+
+func (r *eventRecorder) OnEvent(e Event) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.es = append(r.es, e)
+}
+
+func (r *eventRecorder) has(e Event) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, re := range r.es {
+		if re == e {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_ProbePipeline(t *testing.T) {
+	r := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	c, err := net.Dial("tcp", newPipelineTestServer(t))
+	r.NoError(err)
+	defer c.Close()
+	supported, err := ProbePipeline(ctx, c)
+	r.NoError(err)
+	r.True(supported)
+
+	// miekg/dns handles queries from one tcp connection one by one.
+	addr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+	c2, err := net.Dial("tcp", addr)
+	r.NoError(err)
+	defer c2.Close()
+	supported, err = ProbePipeline(ctx, c2)
+	r.NoError(err)
+	r.False(supported)
+}
+
+func Test_autoPipeline(t *testing.T) {
+	serialAddr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+
+	tests := []struct {
+		name      string
+		addr      string
+		wantEvent Event
+	}{
+		{name: "pipeline", addr: newPipelineTestServer(t), wantEvent: EventPipelineDetected},
+		{name: "reuse", addr: serialAddr, wantEvent: EventReuseDetected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+			er := new(eventRecorder)
+			u, err := NewUpstream("tcp://"+tt.addr, Opt{EventObserver: er})
+			r.NoError(err)
+			defer u.Close()
+			at, ok := u.(*autoPipelineTransport)
+			r.True(ok)
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			b, err := q.Pack()
+			r.NoError(err)
+			for i := 0; i < 3; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				resp, err := u.ExchangeContext(ctx, b)
+				cancel()
+				r.NoError(err)
+				pool.ReleaseBuf(resp)
+			}
+			r.Eventually(func() bool { return er.has(tt.wantEvent) }, time.Second*3, time.Millisecond*10)
+			r.Equal(tt.wantEvent == EventPipelineDetected, at.pipeline.Load() != nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := u.ExchangeContext(ctx, b)
+			r.NoError(err)
+			pool.ReleaseBuf(resp)
+		})
+	}
+
+	_, err := NewUpstream("tcp://127.0.0.1", Opt{PipelineMode: "invalid"})
+	require.Error(t, err)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTPConnect is a http proxy client that uses CONNECT method.
+type HTTPConnect struct {
+	addr string
+	auth *Auth
+	dial DialFunc
+}
+
+// NewHTTPConnect creates a HTTPConnect. s has the format of
+// [http://][username:password@]host:port.
+func NewHTTPConnect(s string, dial DialFunc) (*HTTPConnect, error) {
+	if dial == nil {
+		return nil, errNoDialer
+	}
+	addr, auth, err := parseProxyAddr(s, "http")
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPConnect{addr: addr, auth: auth, dial: dial}, nil
+}
+
+// DialContext connects to addr via the proxy. network must be tcp.
+func (h *HTTPConnect) DialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	c, err := h.dial(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	done := withContextDeadline(ctx, c)
+	defer done()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.auth.Username + ":" + h.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("failed to write connect request, %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connect response, %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy connect failed, %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn is a net.Conn with some data already buffered in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
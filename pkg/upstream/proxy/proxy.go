@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package proxy implements socks5 (with UDP ASSOCIATE) and http CONNECT
+// proxy clients for upstreams.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialFunc dials to the proxy server.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Auth is the username and password of the proxy server.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// parseProxyAddr parses s with format [scheme://][username:password@]host:port.
+// It returns the host:port and the optional auth.
+func parseProxyAddr(s string, scheme string) (string, *Auth, error) {
+	if !strings.Contains(s, "://") {
+		s = scheme + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Scheme != scheme {
+		return "", nil, fmt.Errorf("invalid scheme %s, want %s", u.Scheme, scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", nil, fmt.Errorf("invalid proxy addr, %w", err)
+	}
+	var auth *Auth
+	if u.User != nil {
+		p, _ := u.User.Password()
+		auth = &Auth{Username: u.User.Username(), Password: p}
+	}
+	return u.Host, auth, nil
+}
+
+var errNoDialer = errors.New("nil dial func")
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContextDeadline applies the ctx deadline and cancellation to c
+// until the returned func is called.
+func withContextDeadline(ctx context.Context, c net.Conn) (done func()) {
+	if d, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(d)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.SetDeadline(aLongTimeAgo)
+	})
+	return func() {
+		stop()
+		_ = c.SetDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testDialer = &net.Dialer{}
+
+// startTCPEcho starts a tcp echo server.
+func startTCPEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startUDPEcho starts a udp echo server.
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			_, _ = c.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr)
+}
+
+// startSocks5Server starts a minimal socks5 server that requires
+// username "u" and password "p".
+func startSocks5Server(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveSocks5(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, 512)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{socks5Version, socks5AuthPassword})
+	// auth
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	user := make([]byte, b[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, b[:1])
+	pass := make([]byte, b[0])
+	io.ReadFull(c, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		c.Write([]byte{socks5PasswordAuthVersion, 1})
+		return
+	}
+	c.Write([]byte{socks5PasswordAuthVersion, 0})
+
+	// request
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	cmd := b[1]
+	var host string
+	switch b[3] {
+	case socks5AtypIPv4:
+		io.ReadFull(c, b[:4])
+		host = netip.AddrFrom4([4]byte(b[:4])).String()
+	case socks5AtypDomain:
+		io.ReadFull(c, b[:1])
+		d := make([]byte, b[0])
+		io.ReadFull(c, d)
+		host = string(d)
+	default:
+		return
+	}
+	io.ReadFull(c, b[:2])
+	port := binary.BigEndian.Uint16(b)
+
+	switch cmd {
+	case socks5CmdConnect:
+		rc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			c.Write([]byte{socks5Version, 5, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer rc.Close()
+		c.Write([]byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(rc, c)
+		io.Copy(c, rc)
+	case socks5CmdUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		rp := relay.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		// Reply with an unspecified address to test the fallback.
+		c.Write([]byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, byte(rp >> 8), byte(rp)})
+		go serveSocks5UDPRelay(relay)
+		io.Copy(io.Discard, c)
+	}
+}
+
+func serveSocks5UDPRelay(relay *net.UDPConn) {
+	b := make([]byte, 1500)
+	var client netip.AddrPort
+	for {
+		n, from, err := relay.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return
+		}
+		if !client.IsValid() || from == client {
+			client = from
+			dst, payload, ok := parseSocks5UDPAddr(b[3:n])
+			if !ok {
+				continue
+			}
+			relay.WriteToUDPAddrPort(payload, dst)
+		} else {
+			p := []byte{0, 0, 0}
+			p, _ = appendSocks5Addr(p, from.Addr().String(), from.Port())
+			p = append(p, b[:n]...)
+			relay.WriteToUDPAddrPort(p, client)
+		}
+	}
+}
+
+// startHTTPProxy starts a http CONNECT proxy that requires basic auth u:p.
+func startHTTPProxy(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				if u, p, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || u != "u" || p != "p" {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer rc.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testTCPEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second * 3))
+	_, err := c.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+}
+
+func Test_Socks5(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	proxyAddr := startSocks5Server(t)
+
+	s, err := NewSocks5("socks5://u:p@"+proxyAddr, testDialer.DialContext)
+	require.NoError(t, err)
+
+	// CONNECT
+	c, err := s.DialContext(ctx, "tcp", startTCPEcho(t))
+	require.NoError(t, err)
+	testTCPEcho(t, c)
+
+	// UDP ASSOCIATE
+	echo := startUDPEcho(t)
+	uc, err := s.DialUDP(ctx, echo)
+	require.NoError(t, err)
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(time.Second * 3))
+	_, err = uc.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 16)
+	n, err := uc.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b[:n]))
+
+	// Bad auth
+	s, err = NewSocks5("u:x@"+proxyAddr, testDialer.DialContext)
+	require.NoError(t, err)
+	_, err = s.DialContext(ctx, "tcp", "127.0.0.1:1")
+	require.Error(t, err)
+}
+
+func Test_HTTPConnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	proxyAddr := startHTTPProxy(t)
+
+	h, err := NewHTTPConnect("http://u:p@"+proxyAddr, testDialer.DialContext)
+	require.NoError(t, err)
+	c, err := h.DialContext(ctx, "tcp", startTCPEcho(t))
+	require.NoError(t, err)
+	testTCPEcho(t, c)
+
+	h, err = NewHTTPConnect(proxyAddr, testDialer.DialContext)
+	require.NoError(t, err)
+	_, err = h.DialContext(ctx, "tcp", startTCPEcho(t))
+	require.Error(t, err)
+}
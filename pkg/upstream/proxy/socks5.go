@@ -0,0 +1,432 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+)
+
+// See RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5PasswordAuthVersion = 0x01
+
+	// max udp header: rsv(2) frag(1) atyp(1) addr(1+255) port(2)
+	socks5MaxUDPHeaderLen = 262
+)
+
+var errSocks5BadVersion = errors.New("bad socks version")
+
+// Socks5 is a socks5 proxy client. It supports CONNECT and UDP ASSOCIATE.
+type Socks5 struct {
+	addr string
+	auth *Auth
+	dial DialFunc
+}
+
+// NewSocks5 creates a Socks5. s has the format of
+// [socks5://][username:password@]host:port.
+func NewSocks5(s string, dial DialFunc) (*Socks5, error) {
+	if dial == nil {
+		return nil, errNoDialer
+	}
+	addr, auth, err := parseProxyAddr(s, "socks5")
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil && (len(auth.Username) > 255 || len(auth.Password) > 255) {
+		return nil, errors.New("socks5 username or password is too long")
+	}
+	return &Socks5{addr: addr, auth: auth, dial: dial}, nil
+}
+
+// DialContext connects to addr via the proxy. network must be tcp.
+func (s *Socks5) DialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port, %w", err)
+	}
+
+	c, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	done := withContextDeadline(ctx, c)
+	defer done()
+
+	if err := s.handshake(c); err != nil {
+		return nil, err
+	}
+	if _, err := s.request(c, socks5CmdConnect, host, uint16(port)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListenPacket creates a UDP association. The returned UDPConn
+// can send packets to any address via WriteTo.
+func (s *Socks5) ListenPacket(ctx context.Context) (*UDPConn, error) {
+	return s.associate(ctx, nil)
+}
+
+// DialUDP creates a UDP association. The returned UDPConn's
+// Read and Write exchange packets with raddr.
+func (s *Socks5) DialUDP(ctx context.Context, raddr *net.UDPAddr) (*UDPConn, error) {
+	if raddr == nil {
+		return nil, errors.New("nil remote addr")
+	}
+	return s.associate(ctx, raddr)
+}
+
+func (s *Socks5) associate(ctx context.Context, raddr *net.UDPAddr) (_ *UDPConn, err error) {
+	ctrl, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ctrl.Close()
+		}
+	}()
+	done := withContextDeadline(ctx, ctrl)
+	if err := s.handshake(ctrl); err != nil {
+		done()
+		return nil, err
+	}
+	// We don't know our address that the proxy will see. Use zeros.
+	relay, err := s.request(ctrl, socks5CmdUDPAssociate, "0.0.0.0", 0)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	if relay.Addr().IsUnspecified() { // Relay is on the proxy server.
+		if ra, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay = netip.AddrPortFrom(ra.AddrPort().Addr(), relay.Port())
+		}
+	}
+
+	c, err := s.dial(ctx, "udp", relay.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial udp relay, %w", err)
+	}
+	uc := &UDPConn{ctrl: ctrl, c: c, raddr: raddr}
+	// The association terminates when the control connection terminates.
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		uc.Close()
+	}()
+	return uc, nil
+}
+
+func (s *Socks5) handshake(c net.Conn) error {
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if s.auth != nil {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return errSocks5BadVersion
+	}
+	switch b[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if s.auth == nil {
+			return errors.New("socks5 server requires password auth")
+		}
+		req := make([]byte, 0, 3+len(s.auth.Username)+len(s.auth.Password))
+		req = append(req, socks5PasswordAuthVersion, byte(len(s.auth.Username)))
+		req = append(req, s.auth.Username...)
+		req = append(req, byte(len(s.auth.Password)))
+		req = append(req, s.auth.Password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("socks5 auth failed")
+		}
+		return nil
+	case socks5AuthNoAccept:
+		return errors.New("socks5 server has no acceptable auth method")
+	default:
+		return fmt.Errorf("unsupported socks5 auth method %d", b[1])
+	}
+}
+
+// request sends a socks5 request and returns the BND.ADDR and BND.PORT of the reply.
+// If the reply address is a domain, the returned addr is invalid.
+func (s *Socks5) request(c net.Conn, cmd byte, host string, port uint16) (netip.AddrPort, error) {
+	req := []byte{socks5Version, cmd, 0}
+	req, err := appendSocks5Addr(req, host, port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := c.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b[0] != socks5Version {
+		return netip.AddrPort{}, errSocks5BadVersion
+	}
+	if b[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 request failed, reply code %d", b[1])
+	}
+	var addr netip.Addr
+	switch b[3] {
+	case socks5AtypIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom4([4]byte(ip))
+	case socks5AtypIPv6:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr = netip.AddrFrom16([16]byte(ip)).Unmap()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.CopyN(io.Discard, c, int64(l[0])); err != nil {
+			return netip.AddrPort{}, err
+		}
+	default:
+		return netip.AddrPort{}, fmt.Errorf("invalid socks5 address type %d", b[3])
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(p)), nil
+}
+
+func appendSocks5Addr(b []byte, host string, port uint16) ([]byte, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			b = append(b, socks5AtypIPv4)
+		} else {
+			b = append(b, socks5AtypIPv6)
+		}
+		b = append(b, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("domain is too long")
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// UDPConn is a socks5 UDP association. It implements net.PacketConn and net.Conn.
+// Read and Write are only available if it has a remote address (created by Socks5.DialUDP).
+type UDPConn struct {
+	ctrl  net.Conn     // tcp control connection
+	c     net.Conn     // udp socket to the relay
+	raddr *net.UDPAddr // maybe nil
+
+	closeOnce sync.Once
+}
+
+var (
+	_ net.PacketConn = (*UDPConn)(nil)
+	_ net.Conn       = (*UDPConn)(nil)
+)
+
+// ReadFrom reads a packet and removes its socks5 udp header.
+// Fragmented packets are dropped.
+func (u *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := pool.GetBuf(len(b) + socks5MaxUDPHeaderLen)
+	defer pool.ReleaseBuf(buf)
+	for {
+		n, err := u.c.Read(*buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		p := (*buf)[:n]
+		if len(p) < 4 || p[2] != 0 { // short or fragmented
+			continue
+		}
+		ap, payload, ok := parseSocks5UDPAddr(p[3:])
+		if !ok {
+			continue
+		}
+		return copy(b, payload), net.UDPAddrFromAddrPort(ap), nil
+	}
+}
+
+func parseSocks5UDPAddr(b []byte) (netip.AddrPort, []byte, bool) {
+	var addr netip.Addr
+	switch b[0] {
+	case socks5AtypIPv4:
+		if len(b) < 1+4+2 {
+			return netip.AddrPort{}, nil, false
+		}
+		addr = netip.AddrFrom4([4]byte(b[1:5]))
+		b = b[5:]
+	case socks5AtypIPv6:
+		if len(b) < 1+16+2 {
+			return netip.AddrPort{}, nil, false
+		}
+		addr = netip.AddrFrom16([16]byte(b[1:17])).Unmap()
+		b = b[17:]
+	default: // We never send packets to domains.
+		return netip.AddrPort{}, nil, false
+	}
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(b)), b[2:], true
+}
+
+// WriteTo adds a socks5 udp header to b and sends it to the relay.
+// addr must be a *net.UDPAddr.
+func (u *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported addr type %T", addr)
+	}
+	ap := ua.AddrPort()
+
+	buf := pool.GetBuf(len(b) + socks5MaxUDPHeaderLen)
+	defer pool.ReleaseBuf(buf)
+	p := append((*buf)[:0], 0, 0, 0)
+	p, err := appendSocks5Addr(p, ap.Addr().String(), ap.Port())
+	if err != nil {
+		return 0, err
+	}
+	p = append(p, b...)
+	if _, err := u.c.Write(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+var errNoRemoteAddr = errors.New("udp conn has no remote address")
+
+// Read reads a packet from its remote address. Packets from other
+// addresses are dropped.
+func (u *UDPConn) Read(b []byte) (int, error) {
+	if u.raddr == nil {
+		return 0, errNoRemoteAddr
+	}
+	for {
+		n, addr, err := u.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.(*net.UDPAddr).AddrPort() == u.raddr.AddrPort() {
+			return n, nil
+		}
+	}
+}
+
+// Write writes a packet to its remote address.
+func (u *UDPConn) Write(b []byte) (int, error) {
+	if u.raddr == nil {
+		return 0, errNoRemoteAddr
+	}
+	return u.WriteTo(b, u.raddr)
+}
+
+// Close closes the udp socket and terminates the association.
+func (u *UDPConn) Close() error {
+	u.closeOnce.Do(func() {
+		u.ctrl.Close()
+		u.c.Close()
+	})
+	return nil
+}
+
+func (u *UDPConn) LocalAddr() net.Addr {
+	return u.c.LocalAddr()
+}
+
+// RemoteAddr returns the remote address. It is nil if
+// u was created by Socks5.ListenPacket.
+func (u *UDPConn) RemoteAddr() net.Addr {
+	if u.raddr == nil {
+		return nil
+	}
+	return u.raddr
+}
+
+func (u *UDPConn) SetDeadline(t time.Time) error {
+	return u.c.SetDeadline(t)
+}
+
+func (u *UDPConn) SetReadDeadline(t time.Time) error {
+	return u.c.SetReadDeadline(t)
+}
+
+func (u *UDPConn) SetWriteDeadline(t time.Time) error {
+	return u.c.SetWriteDeadline(t)
+}
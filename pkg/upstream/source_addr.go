@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// sourceAddrPicker picks local source addresses for outbound connections.
+// It rotates through the addresses and the prefix (a random address of it
+// on every pick) of the same family as the remote address.
+type sourceAddrPicker struct {
+	v4, v6 []netip.Addr
+	prefix netip.Prefix // maybe invalid
+	next   atomic.Uint32
+}
+
+// newSourceAddrPicker returns nil if there is no addr and the prefix is invalid.
+func newSourceAddrPicker(addrs []netip.Addr, prefix netip.Prefix) *sourceAddrPicker {
+	if len(addrs) == 0 && !prefix.IsValid() {
+		return nil
+	}
+	p := &sourceAddrPicker{prefix: prefix.Masked()}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			p.v4 = append(p.v4, addr)
+		} else {
+			p.v6 = append(p.v6, addr)
+		}
+	}
+	return p
+}
+
+// pick picks a source address of the same family as remote.
+// ok is false if there is no candidate. Caller should let the system pick one.
+func (p *sourceAddrPicker) pick(remote netip.Addr) (_ netip.Addr, ok bool) {
+	remote = remote.Unmap()
+	var addrs []netip.Addr
+	usePrefix := p.prefix.IsValid()
+	switch {
+	case !remote.IsValid():
+		return netip.Addr{}, false
+	case remote.Is4():
+		addrs = p.v4
+		usePrefix = usePrefix && p.prefix.Addr().Is4()
+	default:
+		addrs = p.v6
+		usePrefix = usePrefix && p.prefix.Addr().Is6()
+	}
+
+	n := len(addrs)
+	if usePrefix {
+		n++
+	}
+	if n == 0 {
+		return netip.Addr{}, false
+	}
+	i := int(p.next.Add(1) % uint32(n))
+	if i < len(addrs) {
+		return addrs[i], true
+	}
+	return randomAddrInPrefix(p.prefix), true
+}
+
+// localAddr returns a net.Addr for net.Dialer.LocalAddr. It returns nil
+// if there is no candidate. If the host of address is a domain, the family
+// of network ("tcp4", "udp6", etc.) is used.
+func (p *sourceAddrPicker) localAddr(network, address string) net.Addr {
+	var remote netip.Addr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		remote, _ = netip.ParseAddr(host)
+	}
+	if !remote.IsValid() {
+		switch network {
+		case "tcp4", "udp4":
+			remote = netip.IPv4Unspecified()
+		case "tcp6", "udp6":
+			remote = netip.IPv6Unspecified()
+		}
+	}
+	addr, ok := p.pick(remote)
+	if !ok {
+		return nil
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))
+	default:
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))
+	}
+}
+
+// dial dials address with d and a source address picked by p. If the host
+// of address is a domain, it is resolved first, and each resolved address
+// is dialed with a source address of its family.
+func (p *sourceAddrPicker) dial(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		dd := *d
+		dd.LocalAddr = p.localAddr(network, address)
+		return dd.DialContext(ctx, network, address)
+	}
+
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4", "udp4":
+		ipNetwork = "ip4"
+	case "tcp6", "udp6":
+		ipNetwork = "ip6"
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		c, err := p.dial(ctx, d, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// randomAddrInPrefix returns a random address in the masked prefix p.
+func randomAddrInPrefix(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits() / 8; i < len(b); i++ {
+		r := byte(rand.Uint32())
+		if i == p.Bits()/8 {
+			mask := byte(0xff) >> (p.Bits() % 8) // host bits
+			b[i] = b[i]&^mask | r&mask
+		} else {
+			b[i] = r
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sourceAddrPicker(t *testing.T) {
+	r := require.New(t)
+	r.Nil(newSourceAddrPicker(nil, netip.Prefix{}))
+
+	a1, a2 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	a6 := netip.MustParseAddr("2001:db8::1")
+	prefix := netip.MustParsePrefix("2001:db8:1::/64")
+	p := newSourceAddrPicker([]netip.Addr{a1, a2, a6}, prefix)
+
+	v4 := netip.MustParseAddr("1.1.1.1")
+	picked := map[netip.Addr]bool{}
+	for i := 0; i < 4; i++ {
+		addr, ok := p.pick(v4)
+		r.True(ok)
+		picked[addr] = true
+	}
+	r.Equal(map[netip.Addr]bool{a1: true, a2: true}, picked, "v4 remote uses v4 addrs only")
+
+	v6 := netip.MustParseAddr("2606:4700::1111")
+	var fromPrefix int
+	for i := 0; i < 4; i++ {
+		addr, ok := p.pick(v6)
+		r.True(ok)
+		r.True(addr.Is6())
+		if addr != a6 {
+			r.True(prefix.Contains(addr))
+			fromPrefix++
+		}
+	}
+	r.Equal(2, fromPrefix)
+
+	// No v6 candidate.
+	p = newSourceAddrPicker([]netip.Addr{a1}, netip.Prefix{})
+	_, ok := p.pick(v6)
+	r.False(ok)
+	r.Nil(p.localAddr("tcp", "[2606:4700::1111]:53"))
+	r.Equal("192.0.2.1:0", p.localAddr("udp", "1.1.1.1:53").String())
+
+	// Domains use the family of the network.
+	p = newSourceAddrPicker([]netip.Addr{a1, a6}, netip.Prefix{})
+	_, ok = p.pick(netip.Addr{})
+	r.False(ok)
+	r.Nil(p.localAddr("tcp", "dns.example:53"))
+	r.Equal("192.0.2.1:0", p.localAddr("tcp4", "dns.example:53").String())
+	r.Equal("[2001:db8::1]:0", p.localAddr("udp6", "dns.example:53").String())
+
+	for _, s := range []string{"10.0.0.0/8", "10.1.2.3/32", "2001:db8::/61", "2001:db8::/128"} {
+		prefix := netip.MustParsePrefix(s)
+		for i := 0; i < 32; i++ {
+			r.True(prefix.Contains(randomAddrInPrefix(prefix)))
+		}
+	}
+}
+
+func Test_sourceAddrPicker_dialDomain(t *testing.T) {
+	r := require.New(t)
+	// Whole 127.0.0.0/8 is local on linux.
+	if c, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 is not available")
+	} else {
+		c.Close()
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	r.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// The v6 source must not be used for the v4 address of localhost.
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p := newSourceAddrPicker([]netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("2001:db8::1")}, netip.Prefix{})
+	for i := 0; i < 4; i++ {
+		c, err := p.dial(context.Background(), new(net.Dialer), "tcp", net.JoinHostPort("localhost", port))
+		r.NoError(err)
+		r.Equal("127.0.0.2", c.LocalAddr().(*net.TCPAddr).IP.String())
+		c.Close()
+	}
+}
+
+type remoteAddrRecorder struct {
+	m     sync.Mutex
+	addrs map[netip.Addr]struct{}
+}
+
+func (h *remoteAddrRecorder) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	ap, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	h.m.Lock()
+	h.addrs[ap.Addr()] = struct{}{}
+	h.m.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	w.WriteMsg(r)
+}
+
+func Test_upstreamLocalAddr(t *testing.T) {
+	// Whole 127.0.0.0/8 is local on linux.
+	if c, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 is not available")
+	} else {
+		c.Close()
+	}
+
+	local := []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")}
+	for scheme, f := range map[string]newTestServerFunc{"udp": newUDPTestServer, "tcp": newTCPTestServer} {
+		t.Run(scheme, func(t *testing.T) {
+			r := require.New(t)
+			h := &remoteAddrRecorder{addrs: make(map[netip.Addr]struct{})}
+			addr, shutdown := f(t, h)
+			defer shutdown()
+
+			// Reuse mode and a short idle timeout, so each query opens a new connection.
+			u, err := NewUpstream(scheme+"://"+addr, Opt{LocalAddr: local, PipelineMode: PipelineModeReuse})
+			r.NoError(err)
+			defer u.Close()
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			b, err := q.Pack()
+			r.NoError(err)
+			for i := 0; i < 4; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				resp, err := u.ExchangeContext(ctx, b)
+				cancel()
+				r.NoError(err)
+				pool.ReleaseBuf(resp)
+				if scheme == "udp" {
+					// Force a new udp socket.
+					u.Close()
+					u, err = NewUpstream(scheme+"://"+addr, Opt{LocalAddr: local})
+					r.NoError(err)
+				}
+			}
+			h.m.Lock()
+			defer h.m.Unlock()
+			for a := range h.addrs {
+				r.Contains(local, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultResolvConfPath = "/etc/resolv.conf"
+
+	// Defaults and limits of resolv.conf(5).
+	resolvConfDefaultTimeout  = time.Second * 5
+	resolvConfMaxTimeout      = time.Second * 30
+	resolvConfDefaultAttempts = 2
+	resolvConfMaxAttempts     = 5
+	resolvConfMaxNameservers  = 3
+)
+
+var (
+	// systemWatchInterval is the interval to check resolv.conf changes.
+	systemWatchInterval = time.Second * 5
+
+	// systemCloseDelay is the delay to close upstreams of the replaced
+	// resolv.conf, so ongoing queries can finish.
+	systemCloseDelay = time.Minute
+)
+
+// ResolvConf is the parsed resolv.conf(5).
+type ResolvConf struct {
+	Nameservers []netip.Addr
+	Search      []string // fqdn
+	Timeout     time.Duration
+	Attempts    int
+	Rotate      bool
+}
+
+// ParseResolvConf parses resolv.conf(5) from r.
+// Unknown keywords and options are ignored. As glibc does, if there is
+// no valid nameserver, the local server (127.0.0.1) will be used.
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	rc := &ResolvConf{
+		Timeout:  resolvConfDefaultTimeout,
+		Attempts: resolvConfDefaultAttempts,
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fs := strings.Fields(line)
+		if len(fs) == 0 {
+			continue
+		}
+		switch fs[0] {
+		case "nameserver":
+			if len(fs) < 2 || len(rc.Nameservers) >= resolvConfMaxNameservers {
+				continue
+			}
+			addr, err := netip.ParseAddr(fs[1])
+			if err != nil {
+				continue
+			}
+			rc.Nameservers = append(rc.Nameservers, addr)
+		case "search", "domain": // The last one wins.
+			rc.Search = rc.Search[:0]
+			for _, d := range fs[1:] {
+				rc.Search = append(rc.Search, dns.Fqdn(d))
+			}
+		case "options":
+			for _, o := range fs[1:] {
+				k, v, _ := strings.Cut(o, ":")
+				switch k {
+				case "timeout":
+					if n, err := strconv.Atoi(v); err == nil && n > 0 {
+						rc.Timeout = min(time.Duration(n)*time.Second, resolvConfMaxTimeout)
+					}
+				case "attempts":
+					if n, err := strconv.Atoi(v); err == nil && n > 0 {
+						rc.Attempts = min(n, resolvConfMaxAttempts)
+					}
+				case "rotate":
+					rc.Rotate = true
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(rc.Nameservers) == 0 {
+		rc.Nameservers = []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	}
+	return rc, nil
+}
+
+func (rc *ResolvConf) equal(o *ResolvConf) bool {
+	return slices.Equal(rc.Nameservers, o.Nameservers) &&
+		slices.Equal(rc.Search, o.Search) &&
+		rc.Timeout == o.Timeout &&
+		rc.Attempts == o.Attempts &&
+		rc.Rotate == o.Rotate
+}
+
+func loadResolvConf(path string) (*ResolvConf, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, err := ParseResolvConf(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, fi, nil
+}
+
+type systemState struct {
+	rc *ResolvConf
+	us []Upstream
+}
+
+func (s *systemState) close() {
+	for _, u := range s.us {
+		u.Close()
+	}
+}
+
+// systemUpstream sends queries to the nameservers in resolv.conf.
+// It watches the file and rebuilds its nameservers if the file changed.
+// Note: Queries from the forwarder are always fully qualified. So
+// search domains are parsed but won't be applied.
+type systemUpstream struct {
+	path   string
+	newNS  func(addr netip.Addr) (Upstream, error)
+	logger *zap.Logger
+
+	state   atomic.Pointer[systemState]
+	next    atomic.Uint32 // for rotate
+	lastMod time.Time
+	size    int64
+
+	m           sync.Mutex // protects state swapping and closed
+	closed      bool
+	closeNotify chan struct{}
+}
+
+func newSystemUpstream(path string, newNS func(addr netip.Addr) (Upstream, error), logger *zap.Logger) (*systemUpstream, error) {
+	if len(path) == 0 {
+		path = defaultResolvConfPath
+	}
+	u := &systemUpstream{
+		path:        path,
+		newNS:       newNS,
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+	}
+	rc, fi, err := loadResolvConf(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s, %w", path, err)
+	}
+	s, err := u.newState(rc)
+	if err != nil {
+		return nil, err
+	}
+	u.state.Store(s)
+	u.lastMod, u.size = fi.ModTime(), fi.Size()
+	logger.Info("system nameservers loaded", zap.String("file", path), zap.Any("conf", rc))
+
+	go u.watch()
+	return u, nil
+}
+
+func (u *systemUpstream) newState(rc *ResolvConf) (*systemState, error) {
+	s := &systemState{rc: rc}
+	for _, addr := range rc.Nameservers {
+		nu, err := u.newNS(addr)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to init nameserver %s, %w", addr, err)
+		}
+		s.us = append(s.us, nu)
+	}
+	return s, nil
+}
+
+func (u *systemUpstream) watch() {
+	ticker := time.NewTicker(systemWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.closeNotify:
+			return
+		case <-ticker.C:
+			if err := u.reloadIfChanged(); err != nil {
+				u.logger.Warn("failed to reload system nameservers", zap.String("file", u.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the file if its mod time or size has changed.
+// Only watch goroutine can call it.
+func (u *systemUpstream) reloadIfChanged() error {
+	fi, err := os.Stat(u.path) // Follows symlinks.
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(u.lastMod) && fi.Size() == u.size {
+		return nil
+	}
+	rc, fi, err := loadResolvConf(u.path)
+	if err != nil {
+		return err
+	}
+	u.lastMod, u.size = fi.ModTime(), fi.Size()
+
+	old := u.state.Load()
+	if rc.equal(old.rc) {
+		return nil
+	}
+	s, err := u.newState(rc)
+	if err != nil {
+		return err
+	}
+	u.m.Lock()
+	if u.closed {
+		u.m.Unlock()
+		s.close()
+		return nil
+	}
+	u.state.Store(s)
+	u.m.Unlock()
+	time.AfterFunc(systemCloseDelay, old.close)
+	u.logger.Info("system nameservers reloaded", zap.String("file", u.path), zap.Any("conf", rc))
+	return nil
+}
+
+// ExchangeContext sends m to nameservers in order (or rotated) with the
+// timeout and attempts in resolv.conf. SERVFAIL and REFUSED responses
+// are returned only if there is no better one.
+func (u *systemUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	s := u.state.Load()
+	start := 0
+	if s.rc.Rotate {
+		start = int(u.next.Add(1))
+	}
+
+	var lastResp *[]byte
+	var lastErr error
+	for a := 0; a < s.rc.Attempts; a++ {
+		for i := range s.us {
+			nu := s.us[(start+i)%len(s.us)]
+			attemptCtx, cancel := context.WithTimeout(ctx, s.rc.Timeout)
+			r, err := nu.ExchangeContext(attemptCtx, m)
+			cancel()
+			if err != nil {
+				lastErr = err
+				if ctx.Err() != nil {
+					break
+				}
+				continue
+			}
+			if rcode := (*r)[3] & 0x0f; rcode != dns.RcodeServerFailure && rcode != dns.RcodeRefused {
+				if lastResp != nil {
+					pool.ReleaseBuf(lastResp)
+				}
+				return r, nil
+			}
+			if lastResp != nil {
+				pool.ReleaseBuf(lastResp)
+			}
+			lastResp = r
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no nameserver")
+	}
+	return nil, lastErr
+}
+
+func (u *systemUpstream) Close() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if !u.closed {
+		u.closed = true
+		close(u.closeNotify)
+		u.state.Load().close()
+	}
+	return nil
+}
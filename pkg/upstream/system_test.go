@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func Test_ParseResolvConf(t *testing.T) {
+	r := require.New(t)
+	rc, err := ParseResolvConf(strings.NewReader(`
+# comment
+domain local
+search example.com lan ; comment
+nameserver 192.168.1.1
+nameserver fe80::1%eth0
+nameserver invalid
+nameserver 8.8.8.8
+nameserver 8.8.4.4
+options ndots:2 timeout:1 attempts:10 rotate
+`))
+	r.NoError(err)
+	r.Equal([]netip.Addr{
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("fe80::1%eth0"),
+		netip.MustParseAddr("8.8.8.8"),
+	}, rc.Nameservers)
+	r.Equal([]string{"example.com.", "lan."}, rc.Search)
+	r.Equal(time.Second, rc.Timeout)
+	r.Equal(resolvConfMaxAttempts, rc.Attempts)
+	r.True(rc.Rotate)
+
+	rc, err = ParseResolvConf(strings.NewReader(""))
+	r.NoError(err)
+	r.Equal([]netip.Addr{netip.MustParseAddr("127.0.0.1")}, rc.Nameservers)
+	r.Equal(resolvConfDefaultTimeout, rc.Timeout)
+	r.Equal(resolvConfDefaultAttempts, rc.Attempts)
+	r.False(rc.Rotate)
+}
+
+type rcodeServer int
+
+func (s rcodeServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetRcode(q, int(s))
+	w.WriteMsg(r)
+}
+
+func Test_systemUpstream(t *testing.T) {
+	r := require.New(t)
+	oldInterval := systemWatchInterval
+	systemWatchInterval = time.Millisecond * 10
+	defer func() { systemWatchInterval = oldInterval }()
+
+	// Nameservers in the file are mapped to local test servers.
+	servFail, shutdown := newUDPTestServer(t, rcodeServer(dns.RcodeServerFailure))
+	defer shutdown()
+	nxDomain, shutdown := newUDPTestServer(t, rcodeServer(dns.RcodeNameError))
+	defer shutdown()
+	servers := map[string]string{"127.0.0.1": servFail, "127.0.0.2": nxDomain}
+	newNS := func(addr netip.Addr) (Upstream, error) {
+		return NewUpstream(servers[addr.String()], Opt{})
+	}
+
+	p := filepath.Join(t.TempDir(), "resolv.conf")
+	r.NoError(os.WriteFile(p, []byte("nameserver 127.0.0.1\n"), 0644))
+	u, err := newSystemUpstream(p, newNS, zap.NewNop())
+	r.NoError(err)
+	defer u.Close()
+
+	exchangeRcode := func() int {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		b, err := q.Pack()
+		r.NoError(err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		resp, err := u.ExchangeContext(ctx, b)
+		r.NoError(err)
+		defer pool.ReleaseBuf(resp)
+		m := new(dns.Msg)
+		r.NoError(m.Unpack(*resp))
+		return m.Rcode
+	}
+	r.Equal(dns.RcodeServerFailure, exchangeRcode())
+
+	// The next nameserver will be used if the first one failed.
+	r.NoError(os.WriteFile(p, []byte("nameserver 127.0.0.1\nnameserver 127.0.0.2\noptions attempts:1\n"), 0644))
+	r.Eventually(func() bool { return len(u.state.Load().rc.Nameservers) == 2 }, time.Second, time.Millisecond*10)
+	r.Equal(dns.RcodeNameError, exchangeRcode())
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SPKIPinMismatchError is returned by the tls handshake if none of the
+// checked peer certificates matches the configured SPKI pins.
+type SPKIPinMismatchError struct {
+	ServerName string
+	Got        []string // base64 encoded pins of the checked peer certificates.
+}
+
+func (e *SPKIPinMismatchError) Error() string {
+	return fmt.Sprintf("spki pin mismatch for server %s, peer chain pins %v", e.ServerName, e.Got)
+}
+
+// SPKIPin returns the base64 encoded sha256 digest of the certificate's
+// SubjectPublicKeyInfo. The format is the same as the "pin-sha256" of HPKP (RFC 7469).
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// ParseSPKIPins parses pins. A pin is a base64 encoded sha256 digest of
+// the SubjectPublicKeyInfo, with an optional "sha256/" prefix.
+func ParseSPKIPins(pins []string) ([][sha256.Size]byte, error) {
+	out := make([][sha256.Size]byte, 0, len(pins))
+	for _, s := range pins {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %s, %w", s, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %s, want a %d bytes sha256 digest, got %d bytes", s, sha256.Size, len(b))
+		}
+		out = append(out, [sha256.Size]byte(b))
+	}
+	return out, nil
+}
+
+// NewSPKIPinVerifier returns a func for tls.Config.VerifyConnection.
+// The connection is accepted if any certificate in the verified chains
+// matches any of the pins. If the verification is skipped (InsecureSkipVerify),
+// only the leaf certificate is checked, because other certificates sent by
+// the peer are not proven to be related to it. Otherwise, a
+// *SPKIPinMismatchError will be returned and onMismatch will be called
+// (if it is not nil).
+// Pin checks are in addition to the normal certificate verification.
+func NewSPKIPinVerifier(pins []string, onMismatch func(err *SPKIPinMismatchError)) (func(cs tls.ConnectionState) error, error) {
+	if len(pins) == 0 {
+		return nil, errors.New("no pin")
+	}
+	digests, err := ParseSPKIPins(pins)
+	if err != nil {
+		return nil, err
+	}
+	return func(cs tls.ConnectionState) error {
+		certs := pinCandidates(cs)
+		for _, cert := range certs {
+			h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, d := range digests {
+				if h == d {
+					return nil
+				}
+			}
+		}
+		got := make([]string, 0, len(certs))
+		for _, cert := range certs {
+			got = append(got, SPKIPin(cert))
+		}
+		err := &SPKIPinMismatchError{ServerName: cs.ServerName, Got: got}
+		if onMismatch != nil {
+			onMismatch(err)
+		}
+		return err
+	}, nil
+}
+
+// pinCandidates returns the certificates that can be matched with pins.
+// They are the certificates in the verified chains, or the leaf if the
+// chain was not verified.
+func pinCandidates(cs tls.ConnectionState) []*x509.Certificate {
+	if len(cs.VerifiedChains) == 0 {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		return cs.PeerCertificates[:1]
+	}
+	var certs []*x509.Certificate
+	seen := make(map[*x509.Certificate]struct{})
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if _, ok := seen[cert]; !ok {
+				seen[cert] = struct{}{}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newDoTTestServerWithConfig(t testing.TB, tlsConfig *tls.Config) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	s := dns.Server{
+		Net:           "tcp-tls",
+		Listener:      l,
+		TLSConfig:     tlsConfig,
+		Handler:       &vServer{},
+		MaxTCPQueries: -1,
+	}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return l.Addr().String()
+}
+
+func Test_SPKIPin(t *testing.T) {
+	r := require.New(t)
+	serverCert, err := utils.GenerateCertificate("test")
+	r.NoError(err)
+	otherCert, err := utils.GenerateCertificate("other")
+	r.NoError(err)
+
+	serverPin := SPKIPin(serverCert.Leaf)
+	otherPin := SPKIPin(otherCert.Leaf)
+	addr := newDoTTestServerWithConfig(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	newUpstream := func(pins []string, onMismatch func(*SPKIPinMismatchError)) Upstream {
+		verify, err := NewSPKIPinVerifier(pins, onMismatch)
+		r.NoError(err)
+		u, err := NewUpstream("tls://"+addr, Opt{
+			IdleTimeout: time.Second,
+			TLSConfig:   &tls.Config{InsecureSkipVerify: true, VerifyConnection: verify},
+		})
+		r.NoError(err)
+		t.Cleanup(func() { u.Close() })
+		return u
+	}
+
+	// Any pin in the set matches.
+	r.NoError(testUpstream(newUpstream([]string{otherPin, "sha256/" + serverPin}, nil)))
+
+	var mismatch atomic.Int32
+	u := newUpstream([]string{otherPin}, func(e *SPKIPinMismatchError) {
+		mismatch.Add(1)
+		r.Equal([]string{serverPin}, e.Got)
+	})
+	r.Error(testUpstream(u))
+	r.NotZero(mismatch.Load())
+
+	// A pinned cert that is added to an unrelated chain does not match.
+	badChainCert := serverCert
+	badChainCert.Certificate = append(append([][]byte(nil), serverCert.Certificate...), otherCert.Certificate...)
+	badAddr := newDoTTestServerWithConfig(t, &tls.Config{Certificates: []tls.Certificate{badChainCert}})
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCert.Leaf)
+	for _, tlsConfig := range []*tls.Config{
+		{InsecureSkipVerify: true},
+		{ServerName: "test", RootCAs: rootCAs},
+	} {
+		verify, err := NewSPKIPinVerifier([]string{otherPin}, nil)
+		r.NoError(err)
+		tlsConfig.VerifyConnection = verify
+		u, err := NewUpstream("tls://"+badAddr, Opt{IdleTimeout: time.Second, TLSConfig: tlsConfig})
+		r.NoError(err)
+		t.Cleanup(func() { u.Close() })
+		r.Error(testUpstream(u))
+	}
+
+	// Certs in the verified chain match.
+	verify, err := NewSPKIPinVerifier([]string{serverPin}, nil)
+	r.NoError(err)
+	u, err = NewUpstream("tls://"+badAddr, Opt{
+		IdleTimeout: time.Second,
+		TLSConfig:   &tls.Config{ServerName: "test", RootCAs: rootCAs, VerifyConnection: verify},
+	})
+	r.NoError(err)
+	t.Cleanup(func() { u.Close() })
+	r.NoError(testUpstream(u))
+
+	_, err = NewSPKIPinVerifier([]string{"invalid"}, nil)
+	r.Error(err)
+	_, err = NewSPKIPinVerifier([]string{"AAAA"}, nil) // too short
+	r.Error(err)
+}
+
+func Test_MutualTLS(t *testing.T) {
+	r := require.New(t)
+	serverCert, err := utils.GenerateCertificate("test")
+	r.NoError(err)
+	clientCert, err := utils.GenerateCertificate("client")
+	r.NoError(err)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCert.Leaf)
+
+	addr := newDoTTestServerWithConfig(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		// The test cert is for server auth only. Check the client cert by hand.
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !cs.PeerCertificates[0].Equal(clientCert.Leaf) {
+				return errors.New("unexpected client cert")
+			}
+			return nil
+		},
+	})
+
+	newUpstream := func(certs []tls.Certificate) Upstream {
+		u, err := NewUpstream("tls://"+addr, Opt{
+			IdleTimeout: time.Second,
+			TLSConfig: &tls.Config{
+				ServerName:   "test",
+				RootCAs:      rootCAs,
+				Certificates: certs,
+			},
+		})
+		r.NoError(err)
+		t.Cleanup(func() { u.Close() })
+		return u
+	}
+
+	r.NoError(testUpstream(newUpstream([]tls.Certificate{clientCert})))
+	r.Error(testUpstream(newUpstream(nil)))
+}
@@ -47,6 +47,10 @@ type TraditionalDnsConn struct {
 	idleTimeout time.Duration
 	maxCq       int
 
+	validateQuestion bool
+	randomizeCase    bool
+	onMismatch       func()
+
 	closeOnce   sync.Once
 	closeNotify chan struct{}
 	closed      atomic.Bool // atomic, for fast check
@@ -75,6 +79,19 @@ type TraditionalDnsConnOpts struct {
 	// MaxConcurrentQuery limits the number of maximum concurrent queries
 	// in the connection. Default is defaultTdcMaxConcurrentQuery.
 	MaxConcurrentQuery int
+
+	// ValidateQuestion drops responses whose question does not
+	// match the query's (name, type and class).
+	ValidateQuestion bool
+
+	// RandomizeCase enables DNS 0x20. The qname case of each query is
+	// randomized and the response must echo the exact case. The original
+	// case will be restored in the response. It implies ValidateQuestion.
+	RandomizeCase bool
+
+	// OnMismatch will be called when a response is dropped by
+	// the question validation. Optional.
+	OnMismatch func()
 }
 
 func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
@@ -83,6 +100,10 @@ func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
 		isTcp:       opt.WithLengthHeader,
 		closeNotify: make(chan struct{}),
 		queue:       make(map[uint32]chan *[]byte),
+
+		validateQuestion: opt.ValidateQuestion || opt.RandomizeCase,
+		randomizeCase:    opt.RandomizeCase,
+		onMismatch:       opt.OnMismatch,
 	}
 	setDefaultGZ(&dc.idleTimeout, opt.IdleTimeout, defaultIdleTimeout)
 	setDefaultGZ(&dc.maxCq, opt.MaxConcurrentQuery, defaultTdcMaxConcurrentQuery)
@@ -99,6 +120,13 @@ func (dc *TraditionalDnsConn) exchange(ctx context.Context, q []byte) (*[]byte,
 	default:
 	}
 
+	orgQ := q
+	if dc.randomizeCase {
+		rq := randomizeCase(q)
+		defer pool.ReleaseBuf(rq)
+		q = *rq
+	}
+
 	assignedQid, respChan := dc.addQueueC()
 	if respChan == nil {
 		return nil, ErrTDCTooManyQueries
@@ -143,6 +171,17 @@ wait:
 		}
 		goto wait
 	case r := <-respChan:
+		if dc.validateQuestion && !questionMatch(q, *r, dc.randomizeCase) {
+			// Might be a spoofed or a late response. Drop it and keep waiting.
+			pool.ReleaseBuf(r)
+			if dc.onMismatch != nil {
+				dc.onMismatch()
+			}
+			goto wait
+		}
+		if dc.randomizeCase {
+			restoreCase(orgQ, *r)
+		}
 		orgId := binary.BigEndian.Uint16(q)
 		binary.BigEndian.PutUint16(*r, orgId)
 		return r, nil
@@ -244,7 +283,7 @@ func (dc *TraditionalDnsConn) queueLen() int {
 // It returns a nil c if queue has too many queries.
 // Caller must call deleteQueueC to release the qid in queue.
 func (dc *TraditionalDnsConn) addQueueC() (qid uint16, c chan *[]byte) {
-	c = make(chan *[]byte)
+	c = make(chan *[]byte, 1) // Buffered, so a dropped (mismatched) resp won't block the next one.
 	dc.queueMu.Lock()
 	for i := 0; i < 100; i++ {
 		qid = dc.nextQid
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// questionEnd returns the end offset of the only question in msg m.
+// ok is false if m does not have exactly one valid question.
+// Note: Compression pointers are not allowed in the question.
+func questionEnd(m []byte) (end int, ok bool) {
+	if len(m) < dnsHeaderLen || binary.BigEndian.Uint16(m[4:]) != 1 {
+		return 0, false
+	}
+	off := dnsHeaderLen
+	for {
+		if off >= len(m) {
+			return 0, false
+		}
+		l := int(m[off])
+		if l == 0 {
+			off++
+			break
+		}
+		if l&0xC0 != 0 {
+			return 0, false
+		}
+		off += 1 + l
+	}
+	off += 4 // qtype and qclass
+	if off > len(m) {
+		return 0, false
+	}
+	return off, true
+}
+
+// questionMatch reports whether the question in response r matches
+// the question in query q. Names are compared case-insensitively,
+// unless exactCase is true (DNS 0x20).
+// If q does not have exactly one question, questionMatch always returns true.
+func questionMatch(q, r []byte, exactCase bool) bool {
+	qEnd, ok := questionEnd(q)
+	if !ok {
+		return true
+	}
+	rEnd, ok := questionEnd(r)
+	if !ok || rEnd != qEnd {
+		return false
+	}
+	qq, rq := q[dnsHeaderLen:qEnd], r[dnsHeaderLen:rEnd]
+	if exactCase {
+		return string(qq) == string(rq)
+	}
+	for i := range qq {
+		if toLower(qq[i]) != toLower(rq[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// randomizeCase returns a copy of query q with the case of the qname
+// randomized as DNS 0x20 (draft-vixie-dnsext-dns0x20) describes.
+func randomizeCase(q []byte) *[]byte {
+	b := copyMsg(q)
+	end, ok := questionEnd(*b)
+	if !ok {
+		return b
+	}
+	name := (*b)[dnsHeaderLen : end-4] // Label length bytes (<= 63) are never letters.
+	var bits uint64
+	for i, c := range name {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if isLetter(c) && bits&(1<<(i%64)) != 0 {
+			name[i] = c ^ 0x20
+		}
+	}
+	return b
+}
+
+// restoreCase copies the qname of the original query q to response r.
+// r must have a matched question. See questionMatch.
+func restoreCase(q, r []byte) {
+	if end, ok := questionEnd(q); ok {
+		copy(r[dnsHeaderLen:end], q[dnsHeaderLen:end])
+	}
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func toLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 0x20
+	}
+	return c
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package transport
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func packQuestion(t *testing.T, name string, typ uint16) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, typ)
+	b, err := m.Pack()
+	require.NoError(t, err)
+	return b
+}
+
+func Test_questionMatch(t *testing.T) {
+	r := require.New(t)
+	q := packQuestion(t, "example.com.", dns.TypeA)
+	r.True(questionMatch(q, packQuestion(t, "example.com.", dns.TypeA), true))
+	r.True(questionMatch(q, packQuestion(t, "ExAmple.com.", dns.TypeA), false))
+	r.False(questionMatch(q, packQuestion(t, "ExAmple.com.", dns.TypeA), true))
+	r.False(questionMatch(q, packQuestion(t, "example.org.", dns.TypeA), false))
+	r.False(questionMatch(q, packQuestion(t, "example.com.", dns.TypeAAAA), false))
+	r.False(questionMatch(q, q[:dnsHeaderLen], false))
+
+	for i := 0; i < 16; i++ {
+		name := "a-long-name-with-many-letters-to-be-randomized.example.com."
+		q := packQuestion(t, name, dns.TypeA)
+		rq := randomizeCase(q)
+		r.True(questionMatch(q, *rq, false))
+		m := new(dns.Msg)
+		r.NoError(m.Unpack(*rq))
+		r.True(strings.EqualFold(name, m.Question[0].Name))
+		restoreCase(q, *rq)
+		r.Equal(q, *rq)
+		pool.ReleaseBuf(rq)
+	}
+}
+
+func Test_dnsConn_questionValidation(t *testing.T) {
+	for _, randomizeCase := range [...]bool{false, true} {
+		r := require.New(t)
+		sc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		r.NoError(err)
+		defer sc.Close()
+
+		// The server sends a spoofed response before the real one.
+		var caseEchoed atomic.Bool
+		go func() {
+			b := make([]byte, 4096)
+			for {
+				n, addr, err := sc.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				q := new(dns.Msg)
+				if err := q.Unpack(b[:n]); err != nil {
+					continue
+				}
+				spoofed := new(dns.Msg)
+				spoofed.SetQuestion("spoofed.", dns.TypeA)
+				spoofed.Id = q.Id
+				spoofed.Response = true
+				sb, _ := spoofed.Pack()
+				sc.WriteTo(sb, addr)
+
+				caseEchoed.Store(q.Question[0].Name != "example.com.")
+				resp := new(dns.Msg)
+				resp.SetReply(q)
+				rb, _ := resp.Pack()
+				sc.WriteTo(rb, addr)
+			}
+		}()
+
+		c, err := net.Dial("udp", sc.LocalAddr().String())
+		r.NoError(err)
+		var mismatched atomic.Int32
+		dc := NewDnsConn(TraditionalDnsConnOpts{
+			ValidateQuestion: true,
+			RandomizeCase:    randomizeCase,
+			OnMismatch:       func() { mismatched.Add(1) },
+		}, c)
+		defer dc.Close()
+
+		q := packQuestion(t, "example.com.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		resp, err := dc.exchange(ctx, q)
+		r.NoError(err)
+		m := new(dns.Msg)
+		r.NoError(m.Unpack(*resp))
+		pool.ReleaseBuf(resp)
+		r.Equal("example.com.", m.Question[0].Name, "case should be restored")
+		r.EqualValues(1, mismatched.Load())
+		if !randomizeCase {
+			r.False(caseEchoed.Load())
+		}
+	}
+}
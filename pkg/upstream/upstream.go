@@ -34,24 +34,26 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/proxy"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/proxy"
 )
 
 const (
 	tlsHandshakeTimeout = time.Second * 3
 
-	// Maximum number of concurrent queries in one pipeline connection.
+	// Default maximum number of concurrent queries in one pipeline connection.
 	// See RFC 7766 7. Response Reordering.
-	// TODO: Make this configurable?
 	pipelineConcurrentLimit = 64
 )
 
@@ -77,10 +79,15 @@ type Opt struct {
 	DialAddr string
 
 	// Socks5 specifies the socks5 proxy server that the upstream
-	// will connect though.
-	// Not implemented for udp based protocols (aka. dns over udp, http3, quic).
+	// will connect though. Format: [socks5://][username:password@]host:port.
+	// UDP based protocols (aka. dns over udp, http3, quic) use UDP ASSOCIATE.
 	Socks5 string
 
+	// HTTPProxy specifies the http proxy server that the upstream
+	// will connect though via CONNECT method. Format: [http://][username:password@]host:port.
+	// Not available for udp based protocols (aka. dns over udp, http3, quic).
+	HTTPProxy string
+
 	// SoMark sets the socket SO_MARK option in unix system.
 	SoMark int
 
@@ -94,23 +101,83 @@ type Opt struct {
 	// EnablePipeline enables query pipelining support as RFC 7766 6.2.1.1 suggested.
 	// Available for TCP, DoT upstream.
 	// Note: There is no fallback. Make sure the server supports it.
+	// It is the same as PipelineMode "pipeline".
 	EnablePipeline bool
 
+	// PipelineMode specifies how TCP, DoT upstream sends queries.
+	// "auto" (default): Queries are sent with connection reuse (RFC 1035),
+	// and the server is probed on the first query. If it answers out of
+	// order, pipelining will be used. The result is reported as
+	// EventPipelineDetected or EventReuseDetected.
+	// "pipeline": Always uses query pipelining.
+	// "reuse": Always uses connection reuse.
+	PipelineMode string
+
+	// PipelineMaxConcurrent limits the number of concurrent queries in one
+	// pipeline connection. Default is 64.
+	PipelineMaxConcurrent int
+
+	// Enable0x20 enables DNS 0x20 (qname case randomization) for UDP upstream.
+	// Responses that do not echo the exact case will be dropped.
+	// Note: Make sure the server preserves the qname case.
+	Enable0x20 bool
+
+	// SkipQuestionValidation disables the response question validation
+	// of UDP upstream. By default, UDP responses that mismatch the query
+	// question (name, type, class) are dropped and reported as EventRespMismatch.
+	SkipQuestionValidation bool
+
 	// EnableHTTP3 will use HTTP/3 protocol to connect a DoH upstream. (aka DoH3).
 	// Note: There is no fallback. Make sure the server supports it.
 	EnableHTTP3 bool
 
-	// Bootstrap specifies a plain dns server to solve the
-	// upstream server domain address.
-	// It must be an IP address. Port is optional.
-	Bootstrap string
+	// HTTPMethod specifies the http method of DoH requests. GET (default) or POST.
+	HTTPMethod string
+
+	// HTTPHeader specifies extra http headers of DoH requests.
+	HTTPHeader http.Header
+
+	// DoHFormat specifies the DoH message format. "wire" (default) or "json".
+	DoHFormat string
+
+	// ODoHRelay specifies the oblivious relay url of an ODoH upstream. e.g. https://relay.example/proxy.
+	// Queries are sent to this relay. If Socks5 or HTTPProxy is set, configs
+	// are fetched from the target through the proxy. Otherwise, they are
+	// fetched with a GET of /.well-known/odohconfigs through the relay. This
+	// is not standard, RFC 9230 relays only forward POST requests. If the
+	// relay rejects it, configs are fetched from the target directly.
+	ODoHRelay string
 
-	// Bootstrap version. One of 0 (default equals 4), 4, 6.
-	// TODO: Support dual-stack.
+	// Bootstrap specifies dns servers to solve the upstream server domain address.
+	// They are used in order. If one fails, the next one will be used.
+	// A server can be an IP address with optional port (plain dns), or an url
+	// with an IP address host (e.g. tls://1.1.1.1, https://1.1.1.1/dns-query).
+	Bootstrap []string
+
+	// Bootstrap version. One of 0 (default equals 4), 4, 6 and 46 (dual-stack).
+	// If multiple addresses are resolved, connections are established in
+	// the happy eyeballs manner.
 	BootstrapVer int
 
+	// BootstrapCacheFile specifies a file that the last-known bootstrap
+	// addresses will be persisted to. If bootstrap servers are unavailable,
+	// the last-known addresses will be used, even after restarts.
+	BootstrapCacheFile string
+
+	// LocalAddr specifies the local source addresses of outbound connections.
+	// If multiple addresses are given, they are used in rotation per connection.
+	// Only addresses of the same family as the server address are used.
+	LocalAddr []netip.Addr
+
+	// LocalPrefix specifies a prefix of local source addresses. A random
+	// address in it will be used per connection (with IP_FREEBIND on linux,
+	// so the prefix should be routed to this host). Rotated with LocalAddr.
+	LocalPrefix netip.Prefix
+
 	// TLSConfig specifies the tls.Config that the TLS client will use.
-	// Available for DoT, DoH, DoQ upstream.
+	// Available for DoT, DoH, DoQ and ODoH upstream.
+	// For ODoH upstream, it applies to the relay. The target config is
+	// fetched with RootCAs and InsecureSkipVerify of TLSConfig only.
 	TLSConfig *tls.Config
 
 	// Logger specifies the logger that the upstream will use.
@@ -123,12 +190,15 @@ type Opt struct {
 
 // NewUpstream creates a upstream.
 // addr has the format of: [protocol://]host[:port][/path].
-// Supported protocol: udp/tcp/tls/https/quic. Default protocol is udp.
+// Supported protocol: udp/tcp/tls/https/quic/odoh/system. Default protocol is udp.
+// addr can also be a DoH DNS stamp (sdns://).
+// "system://[/path/to/resolv.conf]" follows the nameservers in resolv.conf
+// (default is /etc/resolv.conf). The file is watched and reloaded on changes.
 //
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
 //   - h3: Automatically set opt.EnableHTTP3 to true.
-func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
+func NewUpstream(addr string, opt Opt) (Upstream, error) {
 	if opt.Logger == nil {
 		opt.Logger = mlog.Nop()
 	}
@@ -136,6 +206,111 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		opt.EventObserver = nopEO{}
 	}
 
+	if len(opt.Bootstrap) == 0 {
+		return newUpstream(addr, opt, nil)
+	}
+	bootstrapServers, err := newBootstrapServers(opt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap, %w", err)
+	}
+	u, err := newUpstream(addr, opt, bootstrapServers)
+	if err != nil {
+		for _, bu := range bootstrapServers {
+			bu.Close()
+		}
+		return nil, err
+	}
+	closers := []io.Closer{u}
+	for _, bu := range bootstrapServers {
+		closers = append(closers, bu)
+	}
+	return &upstreamWithClose{u: u, closers: closers}, nil
+}
+
+// SupportsHTTPProxy reports whether the upstream of addr can connect
+// through Opt.HTTPProxy. UDP based protocols (udp, quic, http3) can not.
+func SupportsHTTPProxy(addr string, enableHTTP3 bool) bool {
+	if doh.IsStamp(addr) {
+		st, err := doh.ParseStamp(addr)
+		if err != nil {
+			return false
+		}
+		addr = st.URL()
+	}
+	if !strings.Contains(addr, "://") {
+		return false // udp
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "tcp", "tcp+pipeline", "tls", "tls+pipeline":
+		return true
+	case "https", "odoh":
+		return !enableHTTP3
+	default:
+		return false
+	}
+}
+
+// newBootstrapServers creates upstreams for opt.Bootstrap.
+// Bootstrap servers must be IP addresses.
+func newBootstrapServers(opt Opt) (_ []Upstream, err error) {
+	var us []Upstream
+	defer func() {
+		if err != nil {
+			for _, u := range us {
+				u.Close()
+			}
+		}
+	}()
+	for _, s := range opt.Bootstrap {
+		if !strings.Contains(s, "://") {
+			ap, err := parseBootstrapAp(s)
+			if err != nil {
+				return nil, err
+			}
+			s = "udp://" + ap.String()
+		} else {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+				return nil, fmt.Errorf("bootstrap server %s host must be an ip address", s)
+			}
+		}
+		u, err := NewUpstream(s, Opt{
+			Socks5:       opt.Socks5,
+			SoMark:       opt.SoMark,
+			BindToDevice: opt.BindToDevice,
+			LocalAddr:    opt.LocalAddr,
+			LocalPrefix:  opt.LocalPrefix,
+			TLSConfig:    &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(4)},
+			Logger:       opt.Logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init bootstrap server %s, %w", s, err)
+		}
+		us = append(us, u)
+	}
+	return us, nil
+}
+
+func newUpstream(addr string, opt Opt, bootstrapServers []Upstream) (up Upstream, err error) {
+	// DoH stamp. Its addr will be used as DialAddr.
+	if doh.IsStamp(addr) {
+		st, err := doh.ParseStamp(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns stamp, %w", err)
+		}
+		addr = st.URL()
+		if len(opt.DialAddr) == 0 {
+			opt.DialAddr = st.Addr
+		}
+	}
+
 	// parse protocol and server addr
 	if !strings.Contains(addr, "://") {
 		addr = "udp://" + addr
@@ -155,78 +330,145 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		opt.EnableHTTP3 = true
 	}
 
+	if opt.EnablePipeline {
+		opt.PipelineMode = PipelineModePipeline
+	}
+	switch opt.PipelineMode {
+	case "", PipelineModeAuto, PipelineModePipeline, PipelineModeReuse:
+	default:
+		return nil, fmt.Errorf("invalid pipeline mode %s", opt.PipelineMode)
+	}
+
+	// RFC 8467: Queries sent over encrypted transports are padded.
+	// JSON queries of DoH cannot carry EDNS0 options.
+	switch addrURL.Scheme {
+	case "tls", "https", "odoh", "quic", "doq":
+		if !(addrURL.Scheme == "https" && opt.DoHFormat == doh.FormatJSON) {
+			defer func() {
+				if err == nil {
+					up = &paddingUpstream{u: up}
+				}
+			}()
+		}
+	}
+
 	// If host is a ipv6 without port, it will be in []. This will cause err when
 	// split and join address and port. Try to remove brackets now.
 	addrUrlHost := tryTrimIpv6Brackets(addrURL.Host)
 
+	srcPicker := newSourceAddrPicker(opt.LocalAddr, opt.LocalPrefix)
+	sockOpts := socketOpts{
+		so_mark:        opt.SoMark,
+		bind_to_device: opt.BindToDevice,
+		freebind:       opt.LocalPrefix.IsValid(),
+	}
 	dialer := &net.Dialer{
-		Control: getSocketControlFunc(socketOpts{
-			so_mark:        opt.SoMark,
-			bind_to_device: opt.BindToDevice,
-		}),
+		Control: getSocketControlFunc(sockOpts),
+	}
+	// dialContext dials with a source address picked from opt.LocalAddr
+	// and opt.LocalPrefix (if configured).
+	dialContext := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if srcPicker == nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return srcPicker.dial(ctx, dialer, network, address)
 	}
 
-	var bootstrapAp netip.AddrPort
-	if s := opt.Bootstrap; len(s) > 0 {
-		bootstrapAp, err = parseBootstrapAp(s)
+	// Proxies. If enabled, upstream server domain will be resolved by the proxy.
+	if len(opt.Socks5) > 0 && len(opt.HTTPProxy) > 0 {
+		return nil, errors.New("socks5 and http proxy cannot be used at the same time")
+	}
+	var socks5 *proxy.Socks5
+	var proxyDialer proxy.DialFunc // for tcp connections
+	if s := opt.Socks5; len(s) > 0 {
+		socks5, err = proxy.NewSocks5(s, dialContext)
 		if err != nil {
-			return nil, fmt.Errorf("invalid bootstrap, %w", err)
+			return nil, fmt.Errorf("invalid socks5 proxy, %w", err)
+		}
+		proxyDialer = socks5.DialContext
+	}
+	if s := opt.HTTPProxy; len(s) > 0 {
+		hp, err := proxy.NewHTTPConnect(s, dialContext)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy, %w", err)
+		}
+		proxyDialer = hp.DialContext
+	}
+	checkUdpProxy := func() error {
+		if len(opt.HTTPProxy) > 0 {
+			return errors.New("http proxy does not support udp based protocols")
 		}
+		return nil
 	}
 
-	newUdpAddrResolveFunc := func(defaultPort uint16) (func(ctx context.Context) (*net.UDPAddr, error), error) {
-		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
+	newBootstrap := func(host string, port uint16) (*bootstrap.Bootstrap, error) {
+		servers := make([]bootstrap.Resolver, 0, len(bootstrapServers))
+		for _, u := range bootstrapServers {
+			servers = append(servers, u)
+		}
+		return bootstrap.New(host, port, bootstrap.Opts{
+			Servers:   servers,
+			Ver:       opt.BootstrapVer,
+			CacheFile: opt.BootstrapCacheFile,
+			Logger:    opt.Logger,
+		})
+	}
+
+	// newUdpAddrsResolveFunc returns a func that resolves the server addresses.
+	newUdpAddrsResolveFunc := func(urlHost, dialAddr string, defaultPort uint16) (func(ctx context.Context) ([]netip.AddrPort, error), error) {
+		host, port, err := parseDialAddr(urlHost, dialAddr, defaultPort)
 		if err != nil {
 			return nil, err
 		}
 
 		if addr, err := netip.ParseAddr(host); err == nil { // host is an ip.
-			ua := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
-			return func(ctx context.Context) (*net.UDPAddr, error) {
-				return ua, nil
+			aps := []netip.AddrPort{netip.AddrPortFrom(addr, port)}
+			return func(ctx context.Context) ([]netip.AddrPort, error) {
+				return aps, nil
 			}, nil
 		} else { // Not an ip, assuming it's a domain name.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapServers) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := newBootstrap(host, port)
 				if err != nil {
 					return nil, err
 				}
 
-				return func(ctx context.Context) (*net.UDPAddr, error) {
-					s, err := bs.GetAddrPortStr(ctx)
+				return func(ctx context.Context) ([]netip.AddrPort, error) {
+					aps, err := bs.GetAddrs(ctx)
 					if err != nil {
 						return nil, fmt.Errorf("bootstrap failed, %w", err)
 					}
-					return net.ResolveUDPAddr("udp", s)
+					return aps, nil
 				}, nil
 			} else {
 				// Bootstrap disabled.
-				dialAddr := joinPort(host, port)
-				return func(ctx context.Context) (*net.UDPAddr, error) {
-					return net.ResolveUDPAddr("udp", dialAddr)
+				return func(ctx context.Context) ([]netip.AddrPort, error) {
+					addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+					if err != nil {
+						return nil, err
+					}
+					aps := make([]netip.AddrPort, 0, len(addrs))
+					for _, addr := range addrs {
+						aps = append(aps, netip.AddrPortFrom(addr.Unmap(), port))
+					}
+					return aps, nil
 				}, nil
 			}
 		}
 	}
 
-	newTcpDialer := func(dialAddrMustBeIp bool, defaultPort uint16) (func(ctx context.Context) (net.Conn, error), error) {
-		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
+	newTcpDialer := func(urlHost, dialAddr string, dialAddrMustBeIp bool, defaultPort uint16) (func(ctx context.Context) (net.Conn, error), error) {
+		host, port, err := parseDialAddr(urlHost, dialAddr, defaultPort)
 		if err != nil {
 			return nil, err
 		}
 
-		// Socks5 enabled.
-		if s5Addr := opt.Socks5; len(s5Addr) > 0 {
-			socks5Dialer, err := proxy.SOCKS5("tcp", s5Addr, nil, dialer)
-			if err != nil {
-				return nil, fmt.Errorf("failed to init socks5 dialer: %w", err)
-			}
-
-			contextDialer := socks5Dialer.(proxy.ContextDialer)
+		// Proxy enabled.
+		if proxyDialer != nil {
 			dialAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 			return func(ctx context.Context) (net.Conn, error) {
-				return contextDialer.DialContext(ctx, "tcp", dialAddr)
+				return proxyDialer(ctx, "tcp", dialAddr)
 			}, nil
 		}
 
@@ -234,58 +476,252 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			// Host is an ip addr. No need to resolve it.
 			dialAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 			return func(ctx context.Context) (net.Conn, error) {
-				return dialer.DialContext(ctx, "tcp", dialAddr)
+				return dialContext(ctx, "tcp", dialAddr)
 			}, nil
 		} else {
 			if dialAddrMustBeIp {
 				return nil, errors.New("addr must be an ip address")
 			}
 			// Host is not an ip addr, assuming it is a domain.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapServers) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := newBootstrap(host, port)
 				if err != nil {
 					return nil, err
 				}
 
 				return func(ctx context.Context) (net.Conn, error) {
-					dialAddr, err := bs.GetAddrPortStr(ctx)
+					aps, err := bs.GetAddrs(ctx)
 					if err != nil {
 						return nil, fmt.Errorf("bootstrap failed, %w", err)
 					}
-					return dialer.DialContext(ctx, "tcp", dialAddr)
+					return raceDial(ctx, aps, func(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
+						return dialContext(ctx, "tcp", ap.String())
+					}, closeConn)
 				}, nil
 			} else {
 				// Bootstrap disabled.
 				dialAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 				return func(ctx context.Context) (net.Conn, error) {
-					return dialer.DialContext(ctx, "tcp", dialAddr)
+					return dialContext(ctx, "tcp", dialAddr)
 				}, nil
 			}
 		}
 	}
 
 	closeIfFuncErr := func(c io.Closer) {
-		if err != nil {
+		if err != nil && c != nil {
 			c.Close()
 		}
 	}
 
+	// newQuicDialFunc returns a func that dials quic connections. If socks5 is enabled,
+	// each connection has its own udp association. If source addresses are
+	// configured, each connection has its own udp socket. Otherwise, all connections
+	// share one udp socket. The returned io.Closer maybe nil.
+	newQuicDialFunc := func(srk *quic.StatelessResetKey) (quicDialFunc, io.Closer, error) {
+		lc := net.ListenConfig{Control: getSocketControlFunc(sockOpts)}
+		if socks5 != nil || srcPicker != nil {
+			listenPacket := func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
+				if socks5 != nil {
+					pc, err := socks5.ListenPacket(ctx)
+					if err != nil {
+						return nil, fmt.Errorf("failed to init socks5 udp association, %w", err)
+					}
+					return pc, nil
+				}
+				var laddr string
+				if la := srcPicker.localAddr("udp", addr.String()); la != nil {
+					laddr = la.String()
+				}
+				return lc.ListenPacket(ctx, "udp", laddr)
+			}
+			return func(ctx context.Context, addr net.Addr, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				pc, err := listenPacket(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				t := &quic.Transport{Conn: pc, StatelessResetKey: srk}
+				ec, err := t.DialEarly(ctx, addr, tlsCfg, cfg)
+				if err != nil {
+					t.Close()
+					pc.Close()
+					return nil, err
+				}
+				go func() {
+					<-ec.Context().Done()
+					t.Close()
+					pc.Close()
+				}()
+				return ec, nil
+			}, nil, nil
+		}
+
+		conn, err := lc.ListenPacket(context.Background(), "udp", "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
+		}
+		t := &quic.Transport{
+			Conn:              conn,
+			StatelessResetKey: srk,
+		}
+		return t.DialEarly, t, nil
+	}
+
+	// newHTTPRoundTripper creates a http round tripper that always dials to urlHost (or dialAddr).
+	// The returned io.Closer maybe nil.
+	newHTTPRoundTripper := func(urlHost, dialAddr string, tlsConfig *tls.Config) (http.RoundTripper, io.Closer, error) {
+		const defaultPort = 443
+
+		idleConnTimeout := time.Second * 30
+		if opt.IdleTimeout > 0 {
+			idleConnTimeout = opt.IdleTimeout
+		}
+
+		var t http.RoundTripper
+		var addonCloser io.Closer
+		if opt.EnableHTTP3 {
+			if err := checkUdpProxy(); err != nil {
+				return nil, nil, err
+			}
+			udpBootstrap, err := newUdpAddrsResolveFunc(urlHost, dialAddr, defaultPort)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
+			}
+
+			dialQuic, closer, err := newQuicDialFunc(nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			quicConfig := newDefaultClientQuicConfig()
+			quicConfig.MaxIdleTimeout = idleConnTimeout
+
+			addonCloser = closer
+			t = &http3.RoundTripper{
+				TLSClientConfig: tlsConfig,
+				QUICConfig:      quicConfig,
+				Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+					aps, err := udpBootstrap(ctx)
+					if err != nil {
+						return nil, err
+					}
+					return raceDial(ctx, aps, func(ctx context.Context, ap netip.AddrPort) (quic.EarlyConnection, error) {
+						return dialQuic(ctx, net.UDPAddrFromAddrPort(ap), tlsCfg, cfg)
+					}, closeQuicConn)
+				},
+				MaxResponseHeaderBytes: 4 * 1024,
+			}
+		} else {
+			tcpDialer, err := newTcpDialer(urlHost, dialAddr, false, defaultPort)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to init tcp dialer, %w", err)
+			}
+			t1 := &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
+					c, err := tcpDialer(ctx)
+					c = wrapConn(c, opt.EventObserver)
+					return c, err
+				},
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: tlsHandshakeTimeout,
+				IdleConnTimeout:     idleConnTimeout,
+
+				// Following opts are for http/1 only.
+				// MaxConnsPerHost:     2,
+				// MaxIdleConnsPerHost: 2,
+			}
+
+			t2, err := http2.ConfigureTransports(t1)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+			}
+			t2.MaxHeaderListSize = 4 * 1024
+			t2.MaxReadFrameSize = 16 * 1024
+			t2.ReadIdleTimeout = time.Second * 30
+			t2.PingTimeout = time.Second * 5
+			t = t1
+		}
+		return t, addonCloser, nil
+	}
+
+	// newStreamTransport creates a transport for tcp/tls connections with opt.PipelineMode.
+	newStreamTransport := func(dialNetConn func(ctx context.Context) (transport.NetConn, error), idleTimeout time.Duration) Upstream {
+		maxConcurrent := opt.PipelineMaxConcurrent
+		if maxConcurrent <= 0 {
+			maxConcurrent = pipelineConcurrentLimit
+		}
+		newPipeline := func() *transport.PipelineTransport {
+			to := transport.TraditionalDnsConnOpts{
+				WithLengthHeader:   true,
+				IdleTimeout:        idleTimeout,
+				MaxConcurrentQuery: maxConcurrent,
+			}
+			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
+				c, err := dialNetConn(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return transport.NewDnsConn(to, c), nil
+			}
+			return transport.NewPipelineTransport(transport.PipelineOpts{
+				DialContext:                    dialDnsConn,
+				MaxConcurrentQueryWhileDialing: maxConcurrent,
+				Logger:                         opt.Logger,
+			})
+		}
+		newReuse := func() *transport.ReuseConnTransport {
+			return transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialNetConn, IdleTimeout: idleTimeout})
+		}
+
+		switch opt.PipelineMode {
+		case PipelineModePipeline:
+			return newPipeline()
+		case PipelineModeReuse:
+			return newReuse()
+		default:
+			ctx, cancel := context.WithCancel(context.Background())
+			return &autoPipelineTransport{
+				reuse:       newReuse(),
+				newPipeline: newPipeline,
+				dial:        dialNetConn,
+				logger:      opt.Logger,
+				eo:          opt.EventObserver,
+				ctx:         ctx,
+				cancel:      cancel,
+			}
+		}
+	}
+
 	switch addrURL.Scheme {
 	case "", "udp":
 		const defaultPort = 53
 		const maxConcurrentQueryPreConn = 4096 // Protocol limit is 65535.
+		if err := checkUdpProxy(); err != nil {
+			return nil, err
+		}
 		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := netip.ParseAddr(host); err != nil {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
 			return nil, fmt.Errorf("addr must be an ip address, %w", err)
 		}
 		dialAddr := joinPort(host, port)
+		ua := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+		tcpDialer, err := newTcpDialer(addrUrlHost, opt.DialAddr, true, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
+		}
 
 		dialUdpPipeline := func(ctx context.Context) (transport.DnsConn, error) {
-			c, err := dialer.DialContext(ctx, "udp", dialAddr)
+			var c net.Conn
+			var err error
+			if socks5 != nil {
+				c, err = socks5.DialUDP(ctx, ua)
+			} else {
+				c, err = dialContext(ctx, "udp", dialAddr)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -293,11 +729,14 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				WithLengthHeader:   false,
 				IdleTimeout:        time.Minute * 5,
 				MaxConcurrentQuery: maxConcurrentQueryPreConn,
+				ValidateQuestion:   !opt.SkipQuestionValidation,
+				RandomizeCase:      opt.Enable0x20,
+				OnMismatch:         func() { opt.EventObserver.OnEvent(EventRespMismatch) },
 			}
 			return transport.NewDnsConn(to, wrapConn(c, opt.EventObserver)), nil
 		}
 		dialTcpNetConn := func(ctx context.Context) (transport.NetConn, error) {
-			c, err := dialer.DialContext(ctx, "tcp", dialAddr)
+			c, err := tcpDialer(ctx)
 			if err != nil {
 				return nil, err
 			}
@@ -314,7 +753,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		}, nil
 	case "tcp":
 		const defaultPort = 53
-		tcpDialer, err := newTcpDialer(true, defaultPort)
+		tcpDialer, err := newTcpDialer(addrUrlHost, opt.DialAddr, true, defaultPort)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
 		}
@@ -330,26 +769,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			}
 			return wrapConn(c, opt.EventObserver), nil
 		}
-		if opt.EnablePipeline {
-			to := transport.TraditionalDnsConnOpts{
-				WithLengthHeader:   true,
-				IdleTimeout:        idleTimeout,
-				MaxConcurrentQuery: pipelineConcurrentLimit,
-			}
-			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-				c, err := dialNetConn(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return transport.NewDnsConn(to, c), nil
-			}
-			return transport.NewPipelineTransport(transport.PipelineOpts{
-				DialContext:                    dialDnsConn,
-				MaxConcurrentQueryWhileDialing: pipelineConcurrentLimit,
-				Logger:                         opt.Logger,
-			}), nil
-		}
-		return transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialNetConn, IdleTimeout: idleTimeout}), nil
+		return newStreamTransport(dialNetConn, idleTimeout), nil
 	case "tls":
 		const defaultPort = 853
 		tlsConfig := opt.TLSConfig.Clone()
@@ -360,7 +780,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			tlsConfig.ServerName = tryRemovePort(addrUrlHost)
 		}
 
-		tcpDialer, err := newTcpDialer(false, defaultPort)
+		tcpDialer, err := newTcpDialer(addrUrlHost, opt.DialAddr, false, defaultPort)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
 		}
@@ -379,107 +799,96 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			return wrapConn(tlsConn, opt.EventObserver), nil
 		}
 
-		if opt.EnablePipeline {
-			to := transport.TraditionalDnsConnOpts{
-				WithLengthHeader:   true,
-				IdleTimeout:        opt.IdleTimeout,
-				MaxConcurrentQuery: pipelineConcurrentLimit,
-			}
-			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-				c, err := dialNetConn(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return transport.NewDnsConn(to, c), nil
-			}
-			return transport.NewPipelineTransport(transport.PipelineOpts{
-				DialContext:                    dialDnsConn,
-				MaxConcurrentQueryWhileDialing: pipelineConcurrentLimit,
-				Logger:                         opt.Logger,
-			}), nil
-		}
-		return transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialNetConn}), nil
+		return newStreamTransport(dialNetConn, opt.IdleTimeout), nil
 	case "https":
 		const defaultPort = 443
 
-		idleConnTimeout := time.Second * 30
-		if opt.IdleTimeout > 0 {
-			idleConnTimeout = opt.IdleTimeout
+		t, addonCloser, err := newHTTPRoundTripper(addrUrlHost, opt.DialAddr, opt.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer closeIfFuncErr(addonCloser)
+
+		u, err := doh.NewUpstream(addrURL.String(), t, doh.Opt{
+			Method: opt.HTTPMethod,
+			Header: opt.HTTPHeader,
+			Format: opt.DoHFormat,
+			Logger: opt.Logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create doh upstream, %w", err)
 		}
 
-		var t http.RoundTripper
-		var addonCloser io.Closer
-		if opt.EnableHTTP3 {
-			udpBootstrap, err := newUdpAddrResolveFunc(defaultPort)
-			if err != nil {
-				return nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
-			}
-
-			lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-			conn, err := lc.ListenPacket(context.Background(), "udp", "")
-			if err != nil {
-				return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
-			}
-			quicTransport := &quic.Transport{
-				Conn: conn,
-			}
-			quicConfig := newDefaultClientQuicConfig()
-			quicConfig.MaxIdleTimeout = idleConnTimeout
+		return &upstreamWithClose{
+			u:       u,
+			closers: []io.Closer{addonCloser},
+		}, nil
+	case "odoh":
+		if len(opt.ODoHRelay) == 0 {
+			return nil, errors.New("odoh relay is required")
+		}
+		relayURL, err := url.Parse(opt.ODoHRelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid odoh relay, %w", err)
+		}
 
-			defer closeIfFuncErr(quicTransport)
-			addonCloser = quicTransport
-			t = &http3.RoundTripper{
-				TLSClientConfig: opt.TLSConfig,
-				QUICConfig:      quicConfig,
-				Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-					ua, err := udpBootstrap(ctx)
-					if err != nil {
-						return nil, err
-					}
-					return quicTransport.DialEarly(ctx, ua, tlsCfg, cfg)
-				},
-				MaxResponseHeaderBytes: 4 * 1024,
-			}
+		// Queries are sent to the relay. DialAddr is the relay's address.
+		relayRT, relayCloser, err := newHTTPRoundTripper(tryTrimIpv6Brackets(relayURL.Host), opt.DialAddr, opt.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer closeIfFuncErr(relayCloser)
+		// Configs are fetched through the proxy if there is one. Otherwise,
+		// they are fetched through the relay, because a direct connection
+		// would reveal our address to the target. A direct connection is
+		// only the fallback for relays that reject it.
+		// Server name, pins and client certs are for the relay.
+		configTLSConfig := &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+		if opt.TLSConfig != nil {
+			configTLSConfig.RootCAs = opt.TLSConfig.RootCAs
+			configTLSConfig.InsecureSkipVerify = opt.TLSConfig.InsecureSkipVerify
+		}
+		targetRT, configCloser, err := newHTTPRoundTripper(addrUrlHost, "", configTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer closeIfFuncErr(configCloser)
+		var configRT, fallbackRT http.RoundTripper
+		if len(opt.Socks5) > 0 || len(opt.HTTPProxy) > 0 {
+			configRT = targetRT
 		} else {
-			tcpDialer, err := newTcpDialer(false, defaultPort)
-			if err != nil {
-				return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
-			}
-			t1 := &http.Transport{
-				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
-					c, err := tcpDialer(ctx)
-					c = wrapConn(c, opt.EventObserver)
-					return c, err
-				},
-				TLSClientConfig:     opt.TLSConfig,
-				TLSHandshakeTimeout: tlsHandshakeTimeout,
-				IdleConnTimeout:     idleConnTimeout,
-
-				// Following opts are for http/1 only.
-				// MaxConnsPerHost:     2,
-				// MaxIdleConnsPerHost: 2,
-			}
-
-			t2, err := http2.ConfigureTransports(t1)
-			if err != nil {
-				return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
-			}
-			t2.MaxHeaderListSize = 4 * 1024
-			t2.MaxReadFrameSize = 16 * 1024
-			t2.ReadIdleTimeout = time.Second * 30
-			t2.PingTimeout = time.Second * 5
-			t = t1
+			fallbackRT = targetRT
 		}
 
-		u, err := doh.NewUpstream(addrURL.String(), t, opt.Logger)
+		targetURL := *addrURL
+		targetURL.Scheme = "https"
+		u, err := odoh.NewUpstream(targetURL.String(), odoh.Opt{
+			Relay:                opt.ODoHRelay,
+			RelayRoundTripper:    relayRT,
+			ConfigRoundTripper:   configRT,
+			FallbackRoundTripper: fallbackRT,
+			Logger:               opt.Logger,
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to create doh upstream, %w", err)
+			return nil, fmt.Errorf("failed to create odoh upstream, %w", err)
 		}
-
-		return &dohWithClose{
-			u:      u,
-			closer: addonCloser,
+		return &upstreamWithClose{
+			u:       u,
+			closers: []io.Closer{relayCloser, configCloser},
 		}, nil
+	case "system":
+		if len(addrURL.Host) > 0 {
+			return nil, errors.New("system upstream format is system://[/path/to/resolv.conf]")
+		}
+		nsOpt := opt
+		nsOpt.DialAddr = ""
+		nsOpt.Bootstrap = nil
+		newNS := func(addr netip.Addr) (Upstream, error) {
+			// Escape the zone of link-local ipv6 addresses for url.
+			s := strings.ReplaceAll(netip.AddrPortFrom(addr, 53).String(), "%", "%25")
+			return newUpstream("udp://"+s, nsOpt, nil)
+		}
+		return newSystemUpstream(addrURL.Path, newNS, opt.Logger)
 	case "quic", "doq":
 		const defaultPort = 853
 		tlsConfig := opt.TLSConfig.Clone()
@@ -499,7 +908,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		quicConfig.MaxIncomingStreams = -1
 		quicConfig.MaxIncomingUniStreams = -1
 
-		udpBootstrap, err := newUdpAddrResolveFunc(defaultPort)
+		udpBootstrap, err := newUdpAddrsResolveFunc(addrUrlHost, opt.DialAddr, defaultPort)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
 		}
@@ -509,45 +918,49 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			opt.Logger.Warn("failed to init quic stateless reset key, it will be disabled", zap.Error(err))
 		}
 
-		lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-		uc, err := lc.ListenPacket(context.Background(), "udp", "")
+		dialQuic, closer, err := newQuicDialFunc((*quic.StatelessResetKey)(srk))
 		if err != nil {
-			return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
-		}
-
-		t := &quic.Transport{
-			Conn:              uc,
-			StatelessResetKey: (*quic.StatelessResetKey)(srk),
+			return nil, err
 		}
 
 		dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-			ua, err := udpBootstrap(ctx)
+			aps, err := udpBootstrap(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("bootstrap failed, %w", err)
 			}
 
-			// This is a workaround to
-			// 1. recover from strange 0rtt rejected err.
-			// 2. avoid NextConnection might block forever.
-			// TODO: Remove this workaround.
-			var c quic.Connection
-			ec, err := t.DialEarly(ctx, ua, tlsConfig, quicConfig)
-			if err != nil {
-				return nil, err
-			}
-			c, err = ec.NextConnection(ctx)
+			c, err := raceDial(ctx, aps, func(ctx context.Context, ap netip.AddrPort) (quic.Connection, error) {
+				// This is a workaround to
+				// 1. recover from strange 0rtt rejected err.
+				// 2. avoid NextConnection might block forever.
+				// TODO: Remove this workaround.
+				ec, err := dialQuic(ctx, net.UDPAddrFromAddrPort(ap), tlsConfig, quicConfig)
+				if err != nil {
+					return nil, err
+				}
+				c, err := ec.NextConnection(ctx)
+				if err != nil {
+					ec.CloseWithError(0, "")
+					return nil, err
+				}
+				return c, nil
+			}, closeQuicConn)
 			if err != nil {
 				return nil, err
 			}
 			return transport.NewQuicDnsConn(c), nil
 		}
 
-		return transport.NewPipelineTransport(transport.PipelineOpts{
+		t := transport.NewPipelineTransport(transport.PipelineOpts{
 			DialContext: dialDnsConn,
 			// Quic rfc recommendation is 100. Some implications use 65535.
 			MaxConcurrentQueryWhileDialing: 90,
 			Logger:                         opt.Logger,
-		}), nil
+		})
+		return &upstreamWithClose{
+			u:       t,
+			closers: []io.Closer{t, closer},
+		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
@@ -576,18 +989,56 @@ func (u *udpWithFallback) Close() error {
 	return nil
 }
 
-type dohWithClose struct {
-	u      *doh.Upstream
-	closer io.Closer // maybe nil
+// paddingUpstream pads queries with the RFC 8467 block-length policy
+// before sending them to u.
+type paddingUpstream struct {
+	u Upstream
+}
+
+func (u *paddingUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, fmt.Errorf("failed to unpack query, %w", err)
+	}
+	if q.IsEdns0() == nil {
+		q.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	if !dnsutils.PadMsg(q, dnsutils.PaddingQueryBlockSize) {
+		return u.u.ExchangeContext(ctx, m)
+	}
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack padded query, %w", err)
+	}
+	defer pool.ReleaseBuf(b)
+	return u.u.ExchangeContext(ctx, *b)
 }
 
-func (u *dohWithClose) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+func (u *paddingUpstream) Close() error {
+	return u.u.Close()
+}
+
+type quicDialFunc func(ctx context.Context, addr net.Addr, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
+
+type exchanger interface {
+	ExchangeContext(ctx context.Context, m []byte) (*[]byte, error)
+}
+
+// upstreamWithClose is an upstream with its transport closers.
+type upstreamWithClose struct {
+	u       exchanger
+	closers []io.Closer // elems maybe nil
+}
+
+func (u *upstreamWithClose) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	return u.u.ExchangeContext(ctx, m)
 }
 
-func (u *dohWithClose) Close() error {
-	if u.closer != nil {
-		return u.closer.Close()
+func (u *upstreamWithClose) Close() error {
+	for _, c := range u.closers {
+		if c != nil {
+			_ = c.Close()
+		}
 	}
 	return nil
 }
@@ -231,3 +231,27 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_SupportsHTTPProxy(t *testing.T) {
+	tests := []struct {
+		addr  string
+		http3 bool
+		want  bool
+	}{
+		{"8.8.8.8", false, false},
+		{"udp://8.8.8.8", false, false},
+		{"tcp://8.8.8.8", false, true},
+		{"tcp+pipeline://8.8.8.8", false, true},
+		{"tls://dns.google", false, true},
+		{"https://dns.google/dns-query", false, true},
+		{"https://dns.google/dns-query", true, false},
+		{"h3://dns.google/dns-query", false, false},
+		{"quic://dns.adguard.com", false, false},
+		{"doq://dns.adguard.com", false, false},
+	}
+	for _, tt := range tests {
+		if got := SupportsHTTPProxy(tt.addr, tt.http3); got != tt.want {
+			t.Errorf("SupportsHTTPProxy(%s, %v) = %v, want %v", tt.addr, tt.http3, got, tt.want)
+		}
+	}
+}
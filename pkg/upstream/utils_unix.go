@@ -50,6 +50,15 @@ func getSocketControlFunc(opts socketOpts) func(string, string, syscall.RawConn)
 				}
 			}
 
+			// IP_FREEBIND, also works on ipv6 sockets.
+			if opts.freebind {
+				sysCallErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+				if sysCallErr != nil {
+					sysCallErr = os.NewSyscallError("failed to set IP_FREEBIND", sysCallErr)
+					return
+				}
+			}
+
 		}); err != nil {
 			return err
 		}
@@ -52,6 +52,9 @@ var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
 
 type DomainSet struct {
 	mg []domain.Matcher[struct{}]
+
+	args *Args
+	sets []data_provider.DomainMatcherProvider
 }
 
 func (d *DomainSet) GetDomainMatcher() domain.Matcher[struct{}] {
@@ -60,7 +63,7 @@ func (d *DomainSet) GetDomainMatcher() domain.Matcher[struct{}] {
 
 // NewDomainSet inits a DomainSet from given args.
 func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
-	ds := &DomainSet{}
+	ds := &DomainSet{args: args}
 
 	m := domain.NewDomainMixMatcher()
 	if err := LoadExpsAndFiles(args.Exps, args.Files, m); err != nil {
@@ -77,10 +80,49 @@ func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
 		}
 		m := provider.GetDomainMatcher()
 		ds.mg = append(ds.mg, m)
+		ds.sets = append(ds.sets, provider)
 	}
 	return ds, nil
 }
 
+// Exps returns all expressions of this set, including the ones in
+// files and sub sets. Files are read again, so it returns their
+// latest content.
+func (d *DomainSet) Exps() ([]string, error) {
+	exps := append([]string(nil), d.args.Exps...)
+	for i, f := range d.args.Files {
+		var l expList
+		if err := LoadFile(f, &l); err != nil {
+			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
+		}
+		exps = append(exps, l...)
+	}
+	for i, p := range d.sets {
+		sub, ok := p.(*DomainSet)
+		if !ok {
+			return nil, fmt.Errorf("set #%d %s is not a domain_set", i, d.args.Sets[i])
+		}
+		subExps, err := sub.Exps()
+		if err != nil {
+			return nil, err
+		}
+		exps = append(exps, subExps...)
+	}
+	return exps, nil
+}
+
+// expList collects expressions. It matches nothing.
+type expList []string
+
+func (l *expList) Match(string) (struct{}, bool) {
+	return struct{}{}, false
+}
+
+func (l *expList) Add(exp string, _ struct{}) error {
+	*l = append(*l, exp)
+	return nil
+}
+
 func LoadExpsAndFiles(exps []string, fs []string, m *domain.MixMatcher[struct{}]) error {
 	if err := LoadExps(exps, m); err != nil {
 		return err
@@ -109,7 +151,7 @@ func LoadFiles(fs []string, m *domain.MixMatcher[struct{}]) error {
 	return nil
 }
 
-func LoadFile(f string, m *domain.MixMatcher[struct{}]) error {
+func LoadFile(f string, m domain.WriteableMatcher[struct{}]) error {
 	if len(f) > 0 {
 		b, err := os.ReadFile(f)
 		if err != nil {
@@ -44,7 +44,9 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/arbitrary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/black_hole"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/conditional_forward"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/debug_print"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnssec_validator"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/drop_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_handler"
@@ -56,6 +58,7 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/nftset"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/recursor"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
@@ -65,6 +68,7 @@ import (
 
 	// executable and matcher
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/vars"
 
 	// server
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/http_server"
@@ -0,0 +1,441 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+type synthType int
+
+const (
+	synthNone synthType = iota
+	synthNXDomain
+	synthNoData
+	synthWildcard
+)
+
+// aggressiveCache keeps validated NSEC and NSEC3 records and the wildcards
+// they prove. It synthesizes answers for the names they cover. (RFC 8198)
+type aggressiveCache struct {
+	size int
+
+	m     sync.Mutex
+	zones map[string]*signedZone
+	n     int // Number of entries in zones.
+}
+
+type signedZone struct {
+	soa       *rrEntry
+	nsecs     []*rrEntry // Sorted by owner name in canonical order.
+	nsec3s    []*rrEntry // Sorted by owner hash.
+	wildcards map[wildcardKey]*rrEntry
+}
+
+type wildcardKey struct {
+	name  string
+	qtype uint16
+}
+
+// rrEntry is an RRSet and its signature.
+type rrEntry struct {
+	name   string // Canonical owner name. For NSEC3, the lower case hash.
+	rrs    []dns.RR
+	expire time.Time
+}
+
+func newAggressiveCache(size int) *aggressiveCache {
+	return &aggressiveCache{size: size, zones: make(map[string]*signedZone)}
+}
+
+func newRREntry(name string, set *dnssec.RRSet, ttl uint32, now time.Time) *rrEntry {
+	e := &rrEntry{name: name, expire: now.Add(time.Duration(ttl) * time.Second)}
+	for _, rr := range set.RRs {
+		e.rrs = append(e.rrs, dns.Copy(rr))
+	}
+	for _, sig := range set.Sigs {
+		e.rrs = append(e.rrs, dns.Copy(sig))
+	}
+	return e
+}
+
+// copyRRs returns a copy of e's records with the ttl that remains at now.
+// If name is not empty, the owner name is changed to name.
+func (e *rrEntry) copyRRs(name string, now time.Time) []dns.RR {
+	ttl := uint32(e.expire.Sub(now) / time.Second)
+	rrs := make([]dns.RR, 0, len(e.rrs))
+	for _, rr := range e.rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		if len(name) > 0 {
+			rr.Header().Name = name
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (c *aggressiveCache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.n
+}
+
+func (c *aggressiveCache) Flush() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.zones = make(map[string]*signedZone)
+	c.n = 0
+}
+
+// store saves the records in v. The NSEC ttl is limited by the SOA ttl
+// and minimum. (RFC 9077)
+func (c *aggressiveCache) store(v *dnssec.Validated, now time.Time) {
+	negTTL := ^uint32(0)
+	if v.SOA != nil {
+		if soa, ok := v.SOA.RRs[0].(*dns.SOA); ok {
+			negTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	ttlOf := func(set *dnssec.RRSet) uint32 {
+		return min(dnssec.SigTTL(set, set.Sigs[0], now), negTTL)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if v.SOA != nil && len(v.Denial) > 0 {
+		if ttl := ttlOf(v.SOA); ttl > 0 && c.reserveLocked(now) {
+			z := c.zoneLocked(v.SOA.Sigs[0].SignerName)
+			if z.soa == nil {
+				c.n++
+			}
+			z.soa = newRREntry(v.SOA.Name, v.SOA, ttl, now)
+		}
+	}
+	for _, set := range v.Denial {
+		ttl := ttlOf(set)
+		if ttl == 0 || !c.reserveLocked(now) {
+			continue
+		}
+		z := c.zoneLocked(set.Sigs[0].SignerName)
+		var added bool
+		switch set.Type {
+		case dns.TypeNSEC:
+			z.nsecs, added = insertEntry(z.nsecs, newRREntry(set.Name, set, ttl, now), dnssec.CanonicalCompare)
+		case dns.TypeNSEC3:
+			hash, _, _ := strings.Cut(set.Name, ".")
+			z.nsec3s, added = insertEntry(z.nsec3s, newRREntry(hash, set, ttl, now), strings.Compare)
+		}
+		if added {
+			c.n++
+		}
+	}
+	for _, set := range v.Wildcards {
+		ce, ok := dnssec.IsWildcardExpansion(set.Sigs[0])
+		ttl := dnssec.SigTTL(set, set.Sigs[0], now)
+		if !ok || ttl == 0 || !c.reserveLocked(now) {
+			continue
+		}
+		z := c.zoneLocked(set.Sigs[0].SignerName)
+		k := wildcardKey{name: wildcardOf(ce), qtype: set.Type}
+		if z.wildcards[k] == nil {
+			c.n++
+		}
+		e := newRREntry(k.name, set, ttl, now)
+		for _, rr := range e.rrs {
+			rr.Header().Name = k.name
+		}
+		z.wildcards[k] = e
+	}
+}
+
+func (c *aggressiveCache) zoneLocked(name string) *signedZone {
+	name = dns.CanonicalName(name)
+	z := c.zones[name]
+	if z == nil {
+		z = &signedZone{wildcards: make(map[wildcardKey]*rrEntry)}
+		c.zones[name] = z
+	}
+	return z
+}
+
+// reserveLocked reports whether there is room for a new entry. If the cache
+// is full, expired entries are removed.
+func (c *aggressiveCache) reserveLocked(now time.Time) bool {
+	if c.n < c.size {
+		return true
+	}
+	expired := func(e *rrEntry) bool { return now.After(e.expire) }
+	n := 0
+	for name, z := range c.zones {
+		if z.soa != nil && expired(z.soa) {
+			z.soa = nil
+		}
+		z.nsecs = slices.DeleteFunc(z.nsecs, expired)
+		z.nsec3s = slices.DeleteFunc(z.nsec3s, expired)
+		maps.DeleteFunc(z.wildcards, func(_ wildcardKey, e *rrEntry) bool { return expired(e) })
+		zn := len(z.nsecs) + len(z.nsec3s) + len(z.wildcards)
+		if z.soa != nil {
+			zn++
+		}
+		if zn == 0 {
+			delete(c.zones, name)
+		}
+		n += zn
+	}
+	c.n = n
+	return c.n < c.size
+}
+
+// insertEntry inserts e into sorted s. It replaces the entry that
+// has the same name. It reports whether s grew.
+func insertEntry(s []*rrEntry, e *rrEntry, cmp func(a, b string) int) ([]*rrEntry, bool) {
+	i, found := slices.BinarySearchFunc(s, e.name, func(x *rrEntry, name string) int { return cmp(x.name, name) })
+	if found {
+		s[i] = e
+		return s, false
+	}
+	return slices.Insert(s, i, e), true
+}
+
+// floorEntry returns the entry that has the name, or the entry before the
+// name. The last entry is before all names that are smaller than the first
+// one because the chain wraps around. It returns nil if the entry is expired.
+func floorEntry(s []*rrEntry, name string, cmp func(a, b string) int, now time.Time) *rrEntry {
+	if len(s) == 0 {
+		return nil
+	}
+	i, found := slices.BinarySearchFunc(s, name, func(x *rrEntry, name string) int { return cmp(x.name, name) })
+	var e *rrEntry
+	switch {
+	case found:
+		e = s[i]
+	case i == 0:
+		e = s[len(s)-1]
+	default:
+		e = s[i-1]
+	}
+	if now.After(e.expire) {
+		return nil
+	}
+	return e
+}
+
+// synthesize returns the answer and authority sections for the question
+// if the cached records can prove it. Records are copied.
+func (c *aggressiveCache) synthesize(question dns.Question, now time.Time) (synthType, []dns.RR, []dns.RR) {
+	name := dns.CanonicalName(question.Name)
+	qtype := question.Qtype
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Find the closest zone. DS is in the parent zone.
+	zoneName := name
+	if qtype == dns.TypeDS && name != "." {
+		zoneName = parentName(name)
+	}
+	var z *signedZone
+	for {
+		if z = c.zones[zoneName]; z != nil || zoneName == "." {
+			break
+		}
+		zoneName = parentName(zoneName)
+	}
+	if z == nil {
+		return synthNone, nil, nil
+	}
+
+	// Names that may be covered or matched. They are the name, its
+	// ancestors and their wildcards in the zone.
+	var names []string
+	for n := name; ; n = parentName(n) {
+		names = append(names, n, wildcardOf(n))
+		if n == zoneName {
+			break
+		}
+	}
+
+	var entries []*rrEntry
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	addEntry := func(e *rrEntry) {
+		if e != nil && !slices.Contains(entries, e) {
+			entries = append(entries, e)
+		}
+	}
+	if len(z.nsec3s) > 0 {
+		p, ok := z.nsec3s[0].rrs[0].(*dns.NSEC3)
+		if !ok || p.Iterations > dnssec.MaxNSEC3Iterations {
+			return synthNone, nil, nil
+		}
+		for _, n := range names {
+			h := strings.ToLower(dns.HashName(n, p.Hash, p.Iterations, p.Salt))
+			addEntry(floorEntry(z.nsec3s, h, strings.Compare, now))
+		}
+		for _, e := range entries {
+			nsec3s = append(nsec3s, e.rrs[0].(*dns.NSEC3))
+		}
+		// The name may be under an insecure delegation.
+		if dnssec.NSEC3OptOut(name, nsec3s) {
+			return synthNone, nil, nil
+		}
+	} else {
+		for _, n := range names {
+			addEntry(floorEntry(z.nsecs, n, dnssec.CanonicalCompare, now))
+		}
+		for _, e := range entries {
+			nsecs = append(nsecs, e.rrs[0].(*dns.NSEC))
+		}
+	}
+	if len(entries) == 0 {
+		return synthNone, nil, nil
+	}
+
+	ce, nxName := dnssec.ClosestEncloser(name, nsecs, nsec3s)
+	// proof returns the records that match or cover the related names.
+	proof := func(related ...string) []dns.RR {
+		var rrs []dns.RR
+		for i, e := range entries {
+			for _, n := range related {
+				if len(nsec3s) > 0 && nsec3s[i].Cover(n) ||
+					len(nsecs) > 0 && (strings.EqualFold(nsecs[i].Hdr.Name, n) || dnssec.NSECCovers(nsecs[i], n)) {
+					rrs = append(rrs, e.copyRRs("", now)...)
+					break
+				}
+			}
+		}
+		return rrs
+	}
+	negative := func(t synthType) (synthType, []dns.RR, []dns.RR) {
+		if z.soa == nil || now.After(z.soa.expire) {
+			return synthNone, nil, nil
+		}
+		related := []string{name}
+		if nxName {
+			related = append(related, ce, nextCloser(ce, name), wildcardOf(ce))
+		}
+		return t, nil, append(z.soa.copyRRs("", now), proof(related...)...)
+	}
+
+	switch {
+	case dnssec.ProveNoData(name, qtype, nsecs, nsec3s):
+		return negative(synthNoData)
+	case dnssec.ProveNXDomain(name, nsecs, nsec3s):
+		return negative(synthNXDomain)
+	case nxName:
+		w := z.wildcards[wildcardKey{name: wildcardOf(ce), qtype: qtype}]
+		if w == nil || now.After(w.expire) || !dnssec.ProveWildcardAnswer(name, ce, nsecs, nsec3s) {
+			break
+		}
+		related := name
+		if len(nsec3s) > 0 {
+			related = nextCloser(ce, name)
+		}
+		return synthWildcard, w.copyRRs(question.Name, now), proof(related)
+	}
+	return synthNone, nil, nil
+}
+
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// nextCloser returns the name that is one label longer than ce towards name.
+func nextCloser(ce, name string) string {
+	idx := dns.Split(name)
+	n := dns.CountLabel(ce) + 1
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+// storeValidated saves the records that were verified by a validator
+// into the aggressive cache.
+func (c *Cache) storeValidated(qCtx *query_context.Context) {
+	if c.nsec == nil {
+		return
+	}
+	if v, ok := qCtx.GetValue(dnssec.ValidatedKey); ok {
+		c.nsec.store(v.(*dnssec.Validated), time.Now())
+	}
+}
+
+// synthesize builds a response from the aggressive cache. It returns nil
+// if the cache can not prove the answer.
+func (c *Cache) synthesize(qCtx *query_context.Context) *dns.Msg {
+	q := qCtx.Q()
+	t, answer, ns := c.nsec.synthesize(qCtx.QQuestion(), time.Now())
+	var rcode int
+	switch t {
+	case synthNXDomain:
+		c.nxdomainSynthTotal.Inc()
+		rcode = dns.RcodeNameError
+	case synthNoData:
+		c.nodataSynthTotal.Inc()
+	case synthWildcard:
+		c.wildcardSynthTotal.Inc()
+	default:
+		return nil
+	}
+
+	clientOpt := qCtx.ClientOpt()
+	clientDO := clientOpt != nil && clientOpt.Do()
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	r.RecursionAvailable = true
+	// RFC 6840 5.8
+	r.AuthenticatedData = clientDO || q.AuthenticatedData
+	r.Answer = answer
+	r.Ns = ns
+	if !clientDO {
+		r.Answer = slices.DeleteFunc(r.Answer, isDNSSECRR)
+		r.Ns = slices.DeleteFunc(r.Ns, isDNSSECRR)
+	}
+	return r
+}
+
+func isDNSSECRR(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
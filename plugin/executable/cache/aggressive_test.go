@@ -0,0 +1,247 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// Records are not really signed. The cache trusts the validator.
+func fakeSet(t *testing.T, zone string, labels int, rrs ...string) *dnssec.RRSet {
+	var set *dnssec.RRSet
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		if set == nil {
+			set = &dnssec.RRSet{Name: dns.CanonicalName(rr.Header().Name), Type: rr.Header().Rrtype}
+		}
+		set.RRs = append(set.RRs, rr)
+	}
+	h := set.RRs[0].Header()
+	if labels < 0 {
+		labels = dns.CountLabel(h.Name)
+	}
+	set.Sigs = []*dns.RRSIG{{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      uint8(labels),
+		OrigTtl:     h.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		SignerName:  zone,
+	}}
+	return set
+}
+
+func Test_aggressiveCache_NSEC(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	c := newAggressiveCache(1024)
+	soa := fakeSet(t, "example.", -1, "example. 3600 IN SOA ns. admin. 1 3600 600 86400 300")
+	nsec := func(s string) *dnssec.RRSet { return fakeSet(t, "example.", -1, s) }
+
+	c.store(&dnssec.Validated{
+		SOA: soa,
+		Denial: []*dnssec.RRSet{
+			nsec("example. 3600 IN NSEC a.example. SOA NS RRSIG NSEC DNSKEY"),
+			nsec("a.example. 3600 IN NSEC *.w.example. A RRSIG NSEC"),
+		},
+	}, now)
+	r.Equal(3, c.Len())
+
+	q := func(name string, qtype uint16) (synthType, []dns.RR, []dns.RR) {
+		return c.synthesize(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, now)
+	}
+
+	st, answer, ns := q("b.example.", dns.TypeA)
+	r.Equal(synthNXDomain, st)
+	r.Empty(answer)
+	r.Len(ns, 6) // SOA, two NSECs and their sigs.
+	for _, rr := range ns {
+		r.LessOrEqual(rr.Header().Ttl, uint32(300)) // Limited by SOA minimum.
+	}
+
+	st, _, ns = q("A.example.", dns.TypeAAAA)
+	r.Equal(synthNoData, st)
+	r.Len(ns, 4)
+
+	st, _, _ = q("a.example.", dns.TypeA)
+	r.Equal(synthNone, st)
+
+	st, _, _ = q("zzz.example.", dns.TypeA) // Not covered by cached records.
+	r.Equal(synthNone, st)
+
+	st, _, _ = q("x.w.example.", dns.TypeA) // No wildcard.
+	r.Equal(synthNone, st)
+
+	// Wildcard answer.
+	c.store(&dnssec.Validated{
+		Denial:    []*dnssec.RRSet{nsec("*.w.example. 3600 IN NSEC z.example. A RRSIG NSEC")},
+		Wildcards: []*dnssec.RRSet{fakeSet(t, "example.", 2, "y.w.example. 600 IN A 1.2.3.4")},
+	}, now)
+	st, answer, ns = q("x.w.example.", dns.TypeA)
+	r.Equal(synthWildcard, st)
+	r.Len(answer, 2)
+	r.Equal("x.w.example.", answer[0].Header().Name)
+	r.Equal("x.w.example.", answer[1].Header().Name)
+	r.Equal(uint8(2), answer[1].(*dns.RRSIG).Labels)
+	r.Len(ns, 2)
+
+	st, _, _ = q("x.w.example.", dns.TypeAAAA) // Wildcard no data.
+	r.Equal(synthNoData, st)
+
+	// Expired.
+	st, _, _ = c.synthesize(dns.Question{Name: "b.example.", Qtype: dns.TypeA}, now.Add(time.Hour))
+	r.Equal(synthNone, st)
+
+	c.Flush()
+	r.Equal(0, c.Len())
+}
+
+func Test_aggressiveCache_NSEC3(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	nsec3s := func(flags int) []*dnssec.RRSet {
+		hash := func(name string) string { return strings.ToLower(dns.HashName(name, dns.SHA1, 1, "AB")) }
+		types := map[string]string{
+			hash("example."):   "SOA NS RRSIG DNSKEY NSEC3PARAM",
+			hash("a.example."): "A RRSIG",
+		}
+		var hashes []string
+		for h := range types {
+			hashes = append(hashes, h)
+		}
+		slices.Sort(hashes)
+		var sets []*dnssec.RRSet
+		for i, h := range hashes {
+			next := strings.ToUpper(hashes[(i+1)%len(hashes)])
+			sets = append(sets, fakeSet(t, "example.", -1,
+				fmt.Sprintf("%s.example. 3600 IN NSEC3 1 %d 1 AB %s %s", h, flags, next, types[h])))
+		}
+		return sets
+	}
+	soa := fakeSet(t, "example.", -1, "example. 3600 IN SOA ns. admin. 1 3600 600 86400 300")
+
+	c := newAggressiveCache(1024)
+	c.store(&dnssec.Validated{SOA: soa, Denial: nsec3s(0)}, now)
+	st, _, ns := c.synthesize(dns.Question{Name: "b.example.", Qtype: dns.TypeA}, now)
+	r.Equal(synthNXDomain, st)
+	r.Len(ns, 4) // SOA and the apex NSEC3 that covers both the next closer and the wildcard.
+	st, _, _ = c.synthesize(dns.Question{Name: "a.example.", Qtype: dns.TypeAAAA}, now)
+	r.Equal(synthNoData, st)
+
+	c = newAggressiveCache(1024)
+	c.store(&dnssec.Validated{SOA: soa, Denial: nsec3s(1)}, now)
+	st, _, _ = c.synthesize(dns.Question{Name: "b.example.", Qtype: dns.TypeA}, now)
+	r.Equal(synthNone, st) // Opt-out.
+}
+
+func Test_aggressiveCache_Size(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	c := newAggressiveCache(2)
+	soa := fakeSet(t, "example.", -1, "example. 3600 IN SOA ns. admin. 1 3600 600 86400 300")
+	c.store(&dnssec.Validated{SOA: soa, Denial: []*dnssec.RRSet{
+		fakeSet(t, "example.", -1, "a.example. 60 IN NSEC c.example. A RRSIG NSEC"),
+		fakeSet(t, "example.", -1, "c.example. 60 IN NSEC e.example. A RRSIG NSEC"),
+	}}, now)
+	r.Equal(2, c.Len())
+
+	// Expired records are removed for new ones.
+	c.store(&dnssec.Validated{SOA: soa, Denial: []*dnssec.RRSet{
+		fakeSet(t, "example.", -1, "e.example. 60 IN NSEC g.example. A RRSIG NSEC"),
+	}}, now.Add(time.Minute*2))
+	r.Equal(2, c.Len())
+}
+
+type validatedResp struct {
+	v *dnssec.Validated
+	r *dns.Msg
+	n int
+}
+
+func (e *validatedResp) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if qCtx.R() != nil {
+		return nil
+	}
+	e.n++
+	qCtx.SetResponse(e.r.Copy())
+	qCtx.StoreValue(dnssec.ValidatedKey, e.v)
+	return nil
+}
+
+func Test_cachePlugin_AggressiveNSEC(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, &Args{AggressiveNSEC: true})
+	defer c.Close()
+
+	soa := fakeSet(t, "example.", -1, "example. 3600 IN SOA ns. admin. 1 3600 600 86400 300")
+	denial := []*dnssec.RRSet{
+		fakeSet(t, "example.", -1, "example. 3600 IN NSEC a.example. SOA NS RRSIG NSEC DNSKEY"),
+		fakeSet(t, "example.", -1, "a.example. 3600 IN NSEC *.w.example. A RRSIG NSEC"),
+	}
+	resp := new(dns.Msg)
+	resp.SetQuestion("b.example.", dns.TypeA)
+	resp.Rcode = dns.RcodeNameError
+	up := &validatedResp{v: &dnssec.Validated{SOA: soa, Denial: denial}, r: resp}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+
+	exec := func(name string, do bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.SetEdns0(1232, do)
+		qCtx := query_context.NewContext(q)
+		r.NoError(c.Exec(context.Background(), qCtx, next))
+		return qCtx.R()
+	}
+
+	exec("b.example.", false)
+	r.Equal(1, up.n)
+
+	m := exec("c.example.", true)
+	r.Equal(1, up.n)
+	r.Equal(dns.RcodeNameError, m.Rcode)
+	r.True(m.AuthenticatedData)
+	r.Len(m.Ns, 6)
+
+	m = exec("d.example.", false)
+	r.Equal(dns.RcodeNameError, m.Rcode)
+	r.False(m.AuthenticatedData)
+	r.Len(m.Ns, 1) // SOA only.
+
+	exec("zzz.example.", false)
+	r.Equal(2, up.n)
+	m2 := new(dto.Metric)
+	r.NoError(c.nxdomainSynthTotal.Write(m2))
+	r.Equal(float64(2), m2.GetCounter().GetValue())
+}
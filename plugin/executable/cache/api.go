@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTopN = 10
+
+// entryInfo is the json form of a cached response.
+type entryInfo struct {
+	Partition  string   `json:"partition,omitempty"` // Empty for the default partition.
+	Qname      string   `json:"qname"`
+	Qtype      string   `json:"qtype"`
+	Flags      []string `json:"flags,omitempty"`  // Query flags in the key. e.g. "do".
+	Subnet     string   `json:"subnet,omitempty"` // Scope of an ECS response.
+	Failure    bool     `json:"failure,omitempty"`
+	Rcode      string   `json:"rcode"`
+	TTL        int      `json:"ttl"`  // Seconds left before the response expires.
+	Lazy       bool     `json:"lazy"` // Expired, but can be served by lazy cache.
+	Hits       uint32   `json:"hits"`
+	Prefetched bool     `json:"prefetched"`
+	Answer     []string `json:"answer"`
+	Ns         []string `json:"ns,omitempty"`
+	Extra      []string `json:"extra,omitempty"`
+}
+
+// parseKey returns the key flags and the qname of k.
+func parseKey(k key) (flags byte, qname string, ok bool) {
+	if len(k) < 4 || len(k) != 4+int(k[3]) {
+		return 0, "", false
+	}
+	return k[0], dns.CanonicalName(string(k[4:])), true
+}
+
+// itemQtype returns the qtype of v. v is an item or a subnet container.
+func itemQtype(v *item) (uint16, bool) {
+	r := v.resp
+	if r == nil && len(v.subnets) > 0 {
+		r = v.subnets[0].item.resp
+	}
+	if r == nil || len(r.Question) != 1 {
+		return 0, false
+	}
+	return r.Question[0].Qtype, true
+}
+
+// entryMatcher reports whether the entry of qname and qtype is selected.
+type entryMatcher func(qname string, qtype uint16) bool
+
+// matchKey parses k and v and calls m.
+func matchKey(k key, v *item, m entryMatcher) bool {
+	_, qname, ok := parseKey(k)
+	if !ok {
+		return false
+	}
+	qtype, ok := itemQtype(v)
+	return ok && m(qname, qtype)
+}
+
+// entries returns the infos of matched entries.
+func (c *Cache) entries(m entryMatcher) []entryInfo {
+	now := time.Now()
+	out := make([]entryInfo, 0)
+	for _, b := range c.allBackends() {
+		_ = b.backend.Range(func(k key, v *item, cacheExpirationTime time.Time) error {
+			if now.After(cacheExpirationTime) || !matchKey(k, v, m) {
+				return nil
+			}
+			flags, qname, _ := parseKey(k)
+			if v.resp != nil {
+				out = append(out, newEntryInfo(b.name, qname, flags, "", v, now))
+				return nil
+			}
+			for _, s := range v.subnets {
+				if now.Before(s.cacheExpire) {
+					out = append(out, newEntryInfo(b.name, qname, flags, s.subnet.String(), s.item, now))
+				}
+			}
+			return nil
+		})
+	}
+	return out
+}
+
+func newEntryInfo(partition, qname string, flags byte, subnet string, v *item, now time.Time) entryInfo {
+	info := entryInfo{
+		Partition:  partition,
+		Qname:      qname,
+		Subnet:     subnet,
+		Failure:    flags&failureBit != 0,
+		Rcode:      dns.RcodeToString[v.resp.Rcode],
+		TTL:        max(int(v.expirationTime.Sub(now).Seconds()), 0),
+		Lazy:       !now.Before(v.expirationTime),
+		Hits:       v.hits.Load(),
+		Prefetched: v.prefetched.Load(),
+		Answer:     rrStrings(v.resp.Answer),
+		Ns:         rrStrings(v.resp.Ns),
+		Extra:      rrStrings(v.resp.Extra),
+	}
+	if len(v.resp.Question) == 1 {
+		info.Qtype = dns.Type(v.resp.Question[0].Qtype).String()
+	}
+	for _, f := range [...]struct {
+		bit  byte
+		name string
+	}{{adBit, "ad"}, {cdBit, "cd"}, {doBit, "do"}} {
+		if flags&f.bit != 0 {
+			info.Flags = append(info.Flags, f.name)
+		}
+	}
+	return info
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	s := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+// delete removes matched entries, including all their flag, subnet
+// and failure variants. It returns the number of removed keys.
+func (c *Cache) delete(m entryMatcher) int {
+	n := 0
+	for _, b := range c.allBackends() {
+		n += b.backend.Clean(func(k key, v *item, _ time.Time) bool {
+			return matchKey(k, v, m)
+		})
+	}
+	return n
+}
+
+// top returns the n most hit entries.
+func (c *Cache) top(n int) []entryInfo {
+	all := c.entries(func(string, uint16) bool { return true })
+	slices.SortFunc(all, func(a, b entryInfo) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	return all[:min(n, len(all))]
+}
+
+// nameMatcher returns a matcher for qname and an optional qtype.
+func nameMatcher(qname, qtype string) (entryMatcher, error) {
+	if len(qname) == 0 {
+		return nil, fmt.Errorf("missing qname")
+	}
+	qname = dns.CanonicalName(qname)
+	if len(qtype) == 0 {
+		return func(name string, _ uint16) bool { return name == qname }, nil
+	}
+	t, err := parseQtype(qtype)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string, typ uint16) bool { return name == qname && typ == t }, nil
+}
+
+func parseQtype(s string) (uint16, error) {
+	if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	t, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid qtype %s", s)
+	}
+	return uint16(t), nil
+}
+
+// purgeMatcher returns a matcher for names under the domain suffix or
+// names that match the regexp.
+func purgeMatcher(suffix, exp string) (entryMatcher, error) {
+	switch {
+	case len(suffix) > 0 && len(exp) > 0:
+		return nil, fmt.Errorf("suffix and regexp are exclusive")
+	case len(suffix) > 0:
+		suffix = dns.CanonicalName(suffix)
+		return func(name string, _ uint16) bool { return dns.IsSubDomain(suffix, name) }, nil
+	case len(exp) > 0:
+		re, err := regexp.Compile(exp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp, %w", err)
+		}
+		return func(name string, _ uint16) bool { return re.MatchString(name) }, nil
+	default:
+		return nil, fmt.Errorf("missing suffix or regexp")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (c *Cache) handleLookup(w http.ResponseWriter, req *http.Request) {
+	m, err := nameMatcher(req.URL.Query().Get("qname"), req.URL.Query().Get("qtype"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, c.entries(m))
+}
+
+func (c *Cache) handleDelete(w http.ResponseWriter, req *http.Request) {
+	m, err := nameMatcher(req.URL.Query().Get("qname"), req.URL.Query().Get("qtype"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"deleted": c.delete(m)})
+}
+
+func (c *Cache) handlePurge(w http.ResponseWriter, req *http.Request) {
+	m, err := purgeMatcher(req.URL.Query().Get("suffix"), req.URL.Query().Get("regexp"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"deleted": c.delete(m)})
+}
+
+func (c *Cache) handleTop(w http.ResponseWriter, req *http.Request) {
+	n := defaultTopN
+	if s := req.URL.Query().Get("n"); len(s) > 0 {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = i
+	}
+	writeJSON(w, c.top(n))
+}
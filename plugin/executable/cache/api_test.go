@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cachePlugin_Api(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, &Args{})
+	defer c.Close()
+
+	up := &countingUpstream{ttl: 300}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(name string, qtype uint16) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		r.NoError(c.Exec(context.Background(), query_context.NewContext(q), next))
+	}
+	for i := 0; i < 3; i++ {
+		exec("a.example.", dns.TypeA)
+	}
+	exec("A.example.", dns.TypeAAAA)
+	exec("b.example.", dns.TypeA)
+	exec("b.example.", dns.TypeA)
+	exec("c.test.", dns.TypeA)
+
+	api := c.Api()
+	do := func(method, target string, v any) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		if w.Code == http.StatusOK && v != nil {
+			r.NoError(json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Code
+	}
+
+	var entries []entryInfo
+	r.Equal(http.StatusOK, do(http.MethodGet, "/entries?qname=a.example", &entries))
+	r.Len(entries, 2)
+	r.Equal(http.StatusOK, do(http.MethodGet, "/entries?qname=a.example&qtype=a", &entries))
+	r.Len(entries, 1)
+	e := entries[0]
+	r.Equal("a.example.", e.Qname)
+	r.Equal("A", e.Qtype)
+	r.Equal("NOERROR", e.Rcode)
+	r.Equal(uint32(2), e.Hits)
+	r.False(e.Lazy)
+	r.InDelta(300, e.TTL, 1)
+	r.Len(e.Answer, 1)
+	r.Equal(http.StatusBadRequest, do(http.MethodGet, "/entries", nil))
+	r.Equal(http.StatusBadRequest, do(http.MethodGet, "/entries?qname=a.example&qtype=x", nil))
+
+	r.Equal(http.StatusOK, do(http.MethodGet, "/top?n=2", &entries))
+	r.Len(entries, 2)
+	r.Equal("a.example.", entries[0].Qname)
+	r.Equal("b.example.", entries[1].Qname)
+
+	var res map[string]int
+	r.Equal(http.StatusOK, do(http.MethodDelete, "/entries?qname=a.example&qtype=AAAA", &res))
+	r.Equal(1, res["deleted"])
+	r.Equal(http.StatusOK, do(http.MethodGet, "/entries?qname=a.example", &entries))
+	r.Len(entries, 1)
+
+	r.Equal(http.StatusOK, do(http.MethodPost, "/purge?regexp=^c\\.", &res))
+	r.Equal(1, res["deleted"])
+	r.Equal(http.StatusOK, do(http.MethodPost, "/purge?suffix=example", &res))
+	r.Equal(2, res["deleted"])
+	r.Equal(0, c.backend.Len())
+	r.Equal(http.StatusBadRequest, do(http.MethodPost, "/purge", nil))
+	r.Equal(http.StatusBadRequest, do(http.MethodPost, "/purge?regexp=(", nil))
+
+	exec("a.example.", dns.TypeA)
+	r.Equal(int32(5), up.n.Load()) // Queried again after purge.
+}
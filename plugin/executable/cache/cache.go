@@ -59,6 +59,8 @@ func init() {
 const (
 	defaultLazyUpdateTimeout = time.Second * 5
 	expiredMsgTtl            = 5
+	defaultStaleTTL          = 30               // RFC 8767 4
+	staleRecheckTimer        = time.Second * 30 // RFC 8767 5
 
 	minimumChangesToDump   = 1024
 	dumpHeader             = "mosdns_cache_v2"
@@ -73,39 +75,168 @@ type Args struct {
 	LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
 	DumpFile     string `yaml:"dump_file"`
 	DumpInterval int    `yaml:"dump_interval"`
+
+	// ServeStale enables serve-stale. (RFC 8767) Expired responses are kept
+	// for StaleMaxAge seconds (default 86400). They are only used if the
+	// upstream fails or does not respond in StaleClientTimeout milliseconds
+	// (default 1800). Stale responses have an EDE 3 (Stale Answer) or 19
+	// (Stale NXDOMAIN Answer). It replaces the lazy cache. After a refresh
+	// failed, stale responses are used without querying the upstream for
+	// 30 seconds.
+	ServeStale         bool `yaml:"serve_stale"`
+	StaleMaxAge        int  `yaml:"stale_max_age"`
+	StaleClientTimeout int  `yaml:"stale_client_timeout"`
+	// StaleTTL is the ttl of stale responses. Default is 30 with
+	// serve_stale, and 5 with lazy_cache_ttl.
+	StaleTTL int `yaml:"stale_ttl"`
+
+	// Warmup replays queries in files through the warmup entry when
+	// the plugin starts.
+	Warmup WarmupArgs `yaml:"warmup"`
+
+	// Partitions split the cache, so one cache can be shared by sequences
+	// that produce different responses for the same query. Queries that
+	// match no partition use the default partition.
+	Partitions []PartitionArgs `yaml:"partitions"`
+
+	// MaxMemory limits the estimated memory size of cached responses
+	// in bytes. 0 means no limit. Responses are evicted by W-TinyLFU.
+	MaxMemory int `yaml:"max_memory"`
+
+	// DiskFile enables a persistent on-disk cache. Responses are written
+	// to it incrementally in the background, and size and max_memory only limit the
+	// in-memory hot tier. The file is fsynced every DiskSyncInterval
+	// seconds (default 1).
+	DiskFile         string `yaml:"disk_file"`
+	DiskSyncInterval int    `yaml:"disk_sync_interval"`
+
+	// Negative (NXDOMAIN and NODATA) responses are cached for
+	// min(SOA TTL, SOA MINIMUM), limited by NegativeMinTTL and NegativeMaxTTL.
+	// (RFC 2308) Default max is 3600.
+	// Responses without an SOA are cached for NegativeNoSOATTL.
+	// Default is 0, not cached.
+	NegativeMinTTL   int `yaml:"negative_min_ttl"`
+	NegativeMaxTTL   int `yaml:"negative_max_ttl"`
+	NegativeNoSOATTL int `yaml:"negative_no_soa_ttl"`
+
+	// ServfailTTL is the ttl of cached SERVFAIL responses. (RFC 9520)
+	// Default is 5. A negative value disables it.
+	ServfailTTL int `yaml:"servfail_ttl"`
+
+	// MaxSubnetsPerName is the maximum number of ECS scoped responses
+	// that are cached for a name. Default is 64.
+	MaxSubnetsPerName int `yaml:"max_subnets_per_name"`
+
+	// AggressiveNSEC enables synthesizing NXDOMAIN, NODATA and wildcard
+	// answers from DNSSEC validated NSEC/NSEC3 records. (RFC 8198)
+	// It requires a dnssec_validator after the cache.
+	AggressiveNSEC bool `yaml:"aggressive_nsec"`
+
+	// Prefetch refreshes an item in the background when it has been hit
+	// PrefetchThreshold times (default 3) and is in the last PrefetchPercent
+	// (default 10) of its ttl. At most PrefetchConcurrency (default 4)
+	// prefetches run at the same time.
+	Prefetch            bool `yaml:"prefetch"`
+	PrefetchThreshold   int  `yaml:"prefetch_threshold"`
+	PrefetchPercent     int  `yaml:"prefetch_percent"`
+	PrefetchConcurrency int  `yaml:"prefetch_concurrency"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultUnsignNum(&a.Size, 1024)
 	utils.SetDefaultUnsignNum(&a.DumpInterval, 600)
+	utils.SetDefaultUnsignNum(&a.DiskSyncInterval, 1)
+	utils.SetDefaultUnsignNum(&a.StaleMaxAge, 86400)
+	utils.SetDefaultUnsignNum(&a.Warmup.Concurrency, 4)
+	utils.SetDefaultUnsignNum(&a.Warmup.QPS, 100)
+	utils.SetDefaultUnsignNum(&a.StaleClientTimeout, 1800)
+	if a.StaleTTL <= 0 {
+		a.StaleTTL = expiredMsgTtl
+		if a.ServeStale {
+			a.StaleTTL = defaultStaleTTL
+		}
+	}
+	utils.SetDefaultUnsignNum(&a.MaxSubnetsPerName, 64)
+	utils.SetDefaultUnsignNum(&a.NegativeMaxTTL, 3600)
+	utils.SetDefaultUnsignNum(&a.PrefetchThreshold, 3)
+	utils.SetDefaultUnsignNum(&a.PrefetchPercent, 10)
+	utils.SetDefaultUnsignNum(&a.PrefetchConcurrency, 4)
+	if a.ServfailTTL == 0 {
+		a.ServfailTTL = 5
+	}
 }
 
 type Cache struct {
 	args *Args
 
 	logger       *zap.Logger
-	backend      *cache.Cache[key, *item]
+	metricsTag   string
+	backend      *cache.Cache[key, *item] // The default partition.
+	partitions   []*partition
+	partitionKey uint32           // qCtx key of the selected partition.
+	nsec         *aggressiveCache // May be nil.
+	prefetch     *prefetcher      // May be nil.
+	subnetMu     sync.Mutex       // Serializes scoped response updates.
 	lazyUpdateSF singleflight.Group
+	staleRecheck *cache.Cache[key, struct{}] // Keys that failed a stale refresh recently. Nil if serve-stale is disabled.
 	closeOnce    sync.Once
 	closeNotify  chan struct{}
 	updatedKey   atomic.Uint64
-
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	dumpLoaded   bool // The dump file is only written after it was loaded.
+
+	queryTotal    prometheus.Counter
+	hitTotal      prometheus.Counter
+	lazyHitTotal  prometheus.Counter
+	staleHitTotal prometheus.Counter
+	size          prometheus.GaugeFunc
+	memory        prometheus.GaugeFunc
+
+	nxdomainHitTotal prometheus.Counter
+	nodataHitTotal   prometheus.Counter
+	servfailHitTotal prometheus.Counter
+
+	nxdomainSynthTotal prometheus.Counter
+	nodataSynthTotal   prometheus.Counter
+	wildcardSynthTotal prometheus.Counter
+	nsecSize           prometheus.GaugeFunc
+
+	prefetchIssuedTotal prometheus.Counter
+	prefetchWastedTotal prometheus.Counter
+	prefetchHitTotal    prometheus.Counter
+
+	warmupQueryTotal   prometheus.Counter
+	warmupFailedTotal  prometheus.Counter
+	warmupSkippedTotal prometheus.Counter
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
+	c, err := NewCache(args.(*Args), Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
 	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.initPartitions(sequence.NewBQ(bp.M(), bp.L())); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("failed to init partitions, %w", err)
+	}
+	var warmupEntry sequence.Executable
+	if w := c.args.Warmup; len(w.Files) > 0 {
+		warmupEntry = sequence.ToExecutable(bp.M().GetPlugin(w.Entry))
+		if warmupEntry == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("can not find warmup entry executable %q", w.Entry)
+		}
+	}
 
 	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
 		return nil, fmt.Errorf("failed to register metrics, %w", err)
 	}
 	bp.RegAPI(c.Api())
+	if warmupEntry != nil {
+		c.startWarmup(warmupEntry)
+	}
 	return c, nil
 }
 
@@ -121,7 +252,7 @@ func quickSetupCache(bq sequence.BQ, s string) (any, error) {
 		size = i
 	}
 	// Don't register metrics in quick setup.
-	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()}), nil
+	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()})
 }
 
 type Opts struct {
@@ -129,7 +260,9 @@ type Opts struct {
 	MetricsTag string
 }
 
-func NewCache(args *Args, opts Opts) *Cache {
+// NewCache creates a cache. It returns an error if the disk file
+// can not be opened.
+func NewCache(args *Args, opts Opts) (*Cache, error) {
 	args.init()
 
 	logger := opts.Logger
@@ -137,13 +270,34 @@ func NewCache(args *Args, opts Opts) *Cache {
 		logger = zap.NewNop()
 	}
 
-	backend := cache.New[key, *item](cache.Opts{Size: args.Size})
+	backendOpts := cache.Opts{Size: args.Size, MaxCost: args.MaxMemory, Policy: cache.PolicyTinyLFU}
+	var backend *cache.Cache[key, *item]
+	if len(args.DiskFile) > 0 {
+		disk, err := newDiskBackend(args.DiskFile, time.Duration(args.DiskSyncInterval)*time.Second, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk file, %w", err)
+		}
+		backend = cache.NewWithBackend[key, *item](backendOpts, disk)
+	} else {
+		backend = cache.New[key, *item](backendOpts)
+	}
+	var nsec *aggressiveCache
+	if args.AggressiveNSEC {
+		nsec = newAggressiveCache(args.Size)
+	}
+	var staleRecheck *cache.Cache[key, struct{}]
+	if args.ServeStale {
+		staleRecheck = cache.New[key, struct{}](cache.Opts{Size: args.Size})
+	}
 	lb := map[string]string{"tag": opts.MetricsTag}
 	p := &Cache{
-		args:        args,
-		logger:      logger,
-		backend:     backend,
-		closeNotify: make(chan struct{}),
+		args:         args,
+		logger:       logger,
+		metricsTag:   opts.MetricsTag,
+		backend:      backend,
+		nsec:         nsec,
+		staleRecheck: staleRecheck,
+		closeNotify:  make(chan struct{}),
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -160,6 +314,26 @@ func NewCache(args *Args, opts Opts) *Cache {
 			Help:        "The total number of queries that hit the expired cache",
 			ConstLabels: lb,
 		}),
+		staleHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "stale_hit_total",
+			Help:        "The total number of stale responses served after upstream failures",
+			ConstLabels: lb,
+		}),
+		nxdomainHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "nxdomain_hit_total",
+			Help:        "The total number of queries that hit cached NXDOMAIN responses",
+			ConstLabels: lb,
+		}),
+		nodataHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "nodata_hit_total",
+			Help:        "The total number of queries that hit cached NODATA responses",
+			ConstLabels: lb,
+		}),
+		servfailHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "servfail_hit_total",
+			Help:        "The total number of queries that hit cached SERVFAIL responses",
+			ConstLabels: lb,
+		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name:        "size_current",
 			Help:        "Current cache size in records",
@@ -167,22 +341,100 @@ func NewCache(args *Args, opts Opts) *Cache {
 		}, func() float64 {
 			return float64(backend.Len())
 		}),
+		memory: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "memory_bytes_current",
+			Help:        "Estimated memory size of cached responses in bytes. Only tracked with max_memory",
+			ConstLabels: lb,
+		}, func() float64 {
+			return float64(backend.Cost())
+		}),
+		nxdomainSynthTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "nsec_nxdomain_total",
+			Help:        "The total number of NXDOMAIN responses synthesized from NSEC/NSEC3 records",
+			ConstLabels: lb,
+		}),
+		nodataSynthTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "nsec_nodata_total",
+			Help:        "The total number of NODATA responses synthesized from NSEC/NSEC3 records",
+			ConstLabels: lb,
+		}),
+		wildcardSynthTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "nsec_wildcard_total",
+			Help:        "The total number of wildcard answers synthesized from NSEC/NSEC3 records",
+			ConstLabels: lb,
+		}),
+		nsecSize: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "nsec_size_current",
+			Help:        "Current number of NSEC/NSEC3, SOA and wildcard records in the aggressive cache",
+			ConstLabels: lb,
+		}, func() float64 {
+			if nsec == nil {
+				return 0
+			}
+			return float64(nsec.Len())
+		}),
+		prefetchIssuedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_issued_total",
+			Help:        "The total number of issued prefetches",
+			ConstLabels: lb,
+		}),
+		prefetchWastedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_wasted_total",
+			Help:        "The total number of prefetched responses that expired without a hit",
+			ConstLabels: lb,
+		}),
+		prefetchHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_hit_total",
+			Help:        "The total number of queries that hit prefetched responses",
+			ConstLabels: lb,
+		}),
+		warmupQueryTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "warmup_query_total",
+			Help:        "The total number of warmup queries that got responses",
+			ConstLabels: lb,
+		}),
+		warmupFailedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "warmup_failed_total",
+			Help:        "The total number of failed warmup queries",
+			ConstLabels: lb,
+		}),
+		warmupSkippedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "warmup_skipped_total",
+			Help:        "The total number of warmup queries that were already cached",
+			ConstLabels: lb,
+		}),
 	}
 
-	if err := p.loadDump(); err != nil {
-		p.logger.Error("failed to load cache dump", zap.Error(err))
+	if len(args.Partitions) == 0 { // Otherwise, it is called by initPartitions.
+		p.initDump()
+	}
+	if args.Prefetch {
+		p.prefetch = newPrefetcher(p, args)
+		p.prefetch.start()
 	}
-	p.startDumpLoop()
 
-	return p
+	return p, nil
 }
 
 func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.size} {
+	for _, collector := range [...]prometheus.Collector{
+		c.queryTotal, c.hitTotal, c.lazyHitTotal, c.staleHitTotal, c.size, c.memory,
+		c.nxdomainHitTotal, c.nodataHitTotal, c.servfailHitTotal,
+		c.nxdomainSynthTotal, c.nodataSynthTotal, c.wildcardSynthTotal, c.nsecSize,
+		c.prefetchIssuedTotal, c.prefetchWastedTotal, c.prefetchHitTotal,
+		c.warmupQueryTotal, c.warmupFailedTotal, c.warmupSkippedTotal,
+	} {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
 	}
+	for _, p := range c.partitions {
+		for _, collector := range [...]prometheus.Collector{p.queryTotal, p.hitTotal, p.size, p.memory} {
+			if err := r.Register(collector); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -194,33 +446,150 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 	if len(msgKey) == 0 { // skip cache
 		return next.ExecNext(ctx, qCtx)
 	}
+	p, err := c.selectPartition(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		p.queryTotal.Inc()
+	}
 
-	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	cachedResp, cachedItem, lazyHit := c.lookup(msgKey, qCtx)
+	if cachedItem != nil {
+		hits := cachedItem.hits.Add(1)
+		if !lazyHit && c.prefetch != nil {
+			c.prefetch.hit(msgKey, cachedItem, hits, qCtx, next)
+		}
+	}
+	if lazyHit && c.args.ServeStale {
+		return c.execStale(ctx, msgKey, cachedResp, qCtx, next)
+	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
 		c.doLazyUpdate(msgKey, qCtx, next)
+		setStaleEDE(qCtx, cachedResp)
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
+		if p != nil {
+			p.hitTotal.Inc()
+		}
+		switch {
+		case cachedResp.Rcode == dns.RcodeServerFailure:
+			c.servfailHitTotal.Inc()
+		case cachedResp.Rcode == dns.RcodeNameError:
+			c.nxdomainHitTotal.Inc()
+		case isNegative(cachedResp):
+			c.nodataHitTotal.Inc()
+		}
 		cachedResp.Id = q.Id // change msg id
 		qCtx.SetResponse(cachedResp)
+	} else if c.nsec != nil && p == nil && !q.CheckingDisabled {
+		if cachedResp = c.synthesize(qCtx); cachedResp != nil {
+			qCtx.SetResponse(cachedResp)
+		}
 	}
 
-	err := next.ExecNext(ctx, qCtx)
+	err = next.ExecNext(ctx, qCtx)
 
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
-		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-		c.updatedKey.Add(1)
+		c.save(msgKey, qCtx)
 	}
 	return err
 }
 
+// lookup returns the cached response for the query and its item.
+// A cached SERVFAIL is only used if there is no other response.
+// Returned bool indicates whether this response is hit by lazy cache.
+func (c *Cache) lookup(msgKey string, qCtx *query_context.Context) (*dns.Msg, *item, bool) {
+	v, ecs, scope := c.lookupItem(msgKey, qCtx)
+	r, lazyHit := getRespFromItem(v, c.args.LazyCacheTTL > 0 || c.args.ServeStale, c.args.StaleTTL)
+	if lazyHit && c.args.ServeStale && time.Since(v.expirationTime) > time.Duration(c.args.StaleMaxAge)*time.Second {
+		r, lazyHit = nil, false // Too old.
+	}
+	if r != nil {
+		if ecs != nil {
+			setRespECS(r, ecs, scope)
+		}
+		return r, v, lazyHit
+	}
+	v, _, _ = c.backendOf(qCtx).Get(failureKey(msgKey))
+	if r, _ = getRespFromItem(v, false, 0); r == nil {
+		return nil, nil, false
+	}
+	return r, v, false
+}
+
+// lookupItem returns the item for the query. If the query has an ECS,
+// the item for its subnet is preferred. (RFC 7871 7.3.1)
+// If the response should have an ECS, ecs is the query ECS and scope is
+// the scope prefix length of the item.
+func (c *Cache) lookupItem(msgKey string, qCtx *query_context.Context) (v *item, ecs *dns.EDNS0_SUBNET, scope int) {
+	backend := c.backendOf(qCtx)
+	ecs, subnet, hasECS := clientSubnet(qCtx.QOpt())
+	if !hasECS || subnet.Bits() == 0 {
+		v, _, _ = backend.Get(key(msgKey))
+		return v, nil, 0
+	}
+	v, scope = getSubnetItem(msgKey, subnet, backend)
+	if v == nil {
+		v, _, _ = backend.Get(key(msgKey))
+		scope = 0
+	}
+	return v, ecs, scope
+}
+
+// save saves the response of qCtx. Responses that have an ECS scope are
+// saved for their subnets.
+func (c *Cache) save(msgKey string, qCtx *query_context.Context) {
+	backend := c.backend
+	if p := c.partitionOf(qCtx); p != nil {
+		backend = p.backend
+	} else {
+		defer c.storeValidated(qCtx)
+	}
+	r := qCtx.R()
+	ecs, subnet, hasECS := clientSubnet(qCtx.QOpt())
+	if !hasECS || subnet.Bits() == 0 || r.Rcode == dns.RcodeServerFailure {
+		saveRespToCache(msgKey, r, backend, c.args)
+		c.updatedKey.Add(1)
+		return
+	}
+	scope, ok := responseScope(ecs, subnet, qCtx.UpstreamOpt())
+	if !ok {
+		return
+	}
+	if scope == 0 {
+		saveRespToCache(msgKey, r, backend, c.args)
+		c.updatedKey.Add(1)
+		return
+	}
+	v, cacheExpire, ok := newItem(r, c.args)
+	if !ok {
+		return
+	}
+	scoped, _ := subnet.Addr().Prefix(scope)
+	c.subnetMu.Lock()
+	storeSubnetItem(msgKey, scoped, v, cacheExpire, backend, c.args.MaxSubnetsPerName)
+	c.subnetMu.Unlock()
+}
+
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
 // It has an inner singleflight.Group to de-duplicate same msgKey.
+// lazyUpdateKey returns the singleflight key of the update of msgKey.
+// Partitions do not share updates.
+func (c *Cache) lazyUpdateKey(msgKey string, qCtx *query_context.Context) string {
+	if p := c.partitionOf(qCtx); p != nil {
+		return msgKey + "\x00" + p.name
+	}
+	return msgKey
+}
+
 func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
 	qCtxCopy := qCtx.Copy()
+	sfKey := c.lazyUpdateKey(msgKey, qCtx)
 	lazyUpdateFunc := func() (any, error) {
-		defer c.lazyUpdateSF.Forget(msgKey)
+		defer c.lazyUpdateSF.Forget(sfKey)
 		qCtx := qCtxCopy
 
 		c.logger.Debug("start lazy cache update", qCtx.InfoField())
@@ -232,15 +601,13 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 			c.logger.Warn("failed to update lazy cache", qCtx.InfoField(), zap.Error(err))
 		}
 
-		r := qCtx.R()
-		if r != nil {
-			saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-			c.updatedKey.Add(1)
+		if qCtx.R() != nil {
+			c.save(msgKey, qCtx)
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
 		return nil, nil
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+	c.lazyUpdateSF.DoChan(sfKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 func (c *Cache) Close() error {
@@ -250,7 +617,19 @@ func (c *Cache) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeNotify)
 	})
-	return c.backend.Close()
+	if c.staleRecheck != nil {
+		c.staleRecheck.Close()
+	}
+	return errors.Join(c.closePartitions(), c.backend.Close())
+}
+
+// initDump loads the dump file and starts the dump loop.
+func (c *Cache) initDump() {
+	if err := c.loadDump(); err != nil {
+		c.logger.Error("failed to load cache dump", zap.Error(err))
+	}
+	c.dumpLoaded = true
+	c.startDumpLoop()
 }
 
 func (c *Cache) loadDump() error {
@@ -299,7 +678,7 @@ func (c *Cache) startDumpLoop() {
 }
 
 func (c *Cache) dumpCache() error {
-	if len(c.args.DumpFile) == 0 {
+	if len(c.args.DumpFile) == 0 || !c.dumpLoaded {
 		return nil
 	}
 
@@ -320,7 +699,12 @@ func (c *Cache) dumpCache() error {
 func (c *Cache) Api() *chi.Mux {
 	r := chi.NewRouter()
 	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
-		c.backend.Flush()
+		for _, b := range c.allBackends() {
+			b.backend.Flush()
+		}
+		if c.nsec != nil {
+			c.nsec.Flush()
+		}
 	})
 	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("content-type", "application/octet-stream")
@@ -337,76 +721,139 @@ func (c *Cache) Api() *chi.Mux {
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	r.Get("/entries", c.handleLookup)
+	r.Delete("/entries", c.handleDelete)
+	r.Post("/purge", c.handlePurge)
+	r.Get("/top", c.handleTop)
 	return r
 }
 
 func (c *Cache) writeDump(w io.Writer) (int, error) {
-	en := 0
+	dw := NewDumpWriter(w)
+	now := time.Now()
+	for _, b := range c.allBackends() {
+		rangeFunc := func(k key, v *item, cacheExpirationTime time.Time) error {
+			if cacheExpirationTime.Before(now) || v.resp == nil { // Scoped responses are not dumped.
+				return nil
+			}
+			msg, err := v.resp.Pack()
+			if err != nil {
+				return fmt.Errorf("failed to pack msg, %w", err)
+			}
+			return dw.Write(&CachedEntry{
+				Key:                 []byte(k),
+				CacheExpirationTime: cacheExpirationTime.Unix(),
+				MsgExpirationTime:   v.expirationTime.Unix(),
+				Msg:                 msg,
+				Partition:           b.name,
+			})
+		}
+		if err := b.backend.Range(rangeFunc); err != nil {
+			return dw.Entries(), err
+		}
+	}
+	err := dw.Close()
+	return dw.Entries(), err
+}
+
+// DumpWriter writes entries in the cache dump format.
+type DumpWriter struct {
+	gw    *gzip.Writer
+	block *CacheDumpBlock
+	en    int
+}
 
+// NewDumpWriter returns a DumpWriter that writes to w. Caller must call
+// DumpWriter.Close to flush the dump.
+func NewDumpWriter(w io.Writer) *DumpWriter {
 	gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
 	gw.Name = dumpHeader
+	return &DumpWriter{gw: gw, block: new(CacheDumpBlock)}
+}
 
-	block := new(CacheDumpBlock)
-	writeBlock := func() error {
-		b, err := proto.Marshal(block)
-		if err != nil {
-			return fmt.Errorf("failed to marshal protobuf, %w", err)
-		}
+// Write adds e to the dump.
+func (dw *DumpWriter) Write(e *CachedEntry) error {
+	dw.block.Entries = append(dw.block.Entries, e)
 
-		l := make([]byte, 8)
-		binary.BigEndian.PutUint64(l, uint64(len(b)))
-		_, err = gw.Write(l)
-		if err != nil {
-			return fmt.Errorf("failed to write header, %w", err)
-		}
-		_, err = gw.Write(b)
-		if err != nil {
-			return fmt.Errorf("failed to write data, %w", err)
-		}
-
-		en += len(block.GetEntries())
-		block.Reset()
-		return nil
+	// Block is big enough for a write operation.
+	if len(dw.block.Entries) >= dumpBlockSize {
+		return dw.writeBlock()
 	}
+	return nil
+}
 
-	now := time.Now()
-	rangeFunc := func(k key, v *item, cacheExpirationTime time.Time) error {
-		if cacheExpirationTime.Before(now) {
-			return nil
-		}
-		msg, err := v.resp.Pack()
-		if err != nil {
-			return fmt.Errorf("failed to pack msg, %w", err)
-		}
-		e := &CachedEntry{
-			Key:                 []byte(k),
-			CacheExpirationTime: cacheExpirationTime.Unix(),
-			MsgExpirationTime:   v.expirationTime.Unix(),
-			Msg:                 msg,
-		}
-		block.Entries = append(block.Entries, e)
+// Entries returns the number of written entries.
+func (dw *DumpWriter) Entries() int {
+	return dw.en
+}
 
-		// Block is big enough for a write operation.
-		if len(block.Entries) >= dumpBlockSize {
-			return writeBlock()
+// Close writes buffered entries and closes the gzip stream. It does not
+// close the underlying io.Writer.
+func (dw *DumpWriter) Close() error {
+	if len(dw.block.GetEntries()) > 0 {
+		if err := dw.writeBlock(); err != nil {
+			return err
 		}
-		return nil
 	}
-	if err := c.backend.Range(rangeFunc); err != nil {
-		return en, err
+	return dw.gw.Close()
+}
+
+func (dw *DumpWriter) writeBlock() error {
+	b, err := proto.Marshal(dw.block)
+	if err != nil {
+		return fmt.Errorf("failed to marshal protobuf, %w", err)
 	}
 
-	if len(block.GetEntries()) > 0 {
-		if err := writeBlock(); err != nil {
-			return en, err
-		}
+	l := make([]byte, 8)
+	binary.BigEndian.PutUint64(l, uint64(len(b)))
+	_, err = dw.gw.Write(l)
+	if err != nil {
+		return fmt.Errorf("failed to write header, %w", err)
 	}
-	return en, gw.Close()
+	_, err = dw.gw.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write data, %w", err)
+	}
+
+	dw.en += len(dw.block.GetEntries())
+	dw.block.Reset()
+	return nil
 }
 
 // readDump reads dumped data from r. It returns the number of bytes read,
 // number of entries read and any error encountered.
+// Entries of partitions that no longer exist are dropped.
 func (c *Cache) readDump(r io.Reader) (int, error) {
+	backends := make(map[string]*cache.Cache[key, *item])
+	for _, b := range c.allBackends() {
+		backends[b.name] = b.backend
+	}
+	return ReadDump(r, func(entry *CachedEntry) error {
+		backend := backends[entry.GetPartition()]
+		if backend == nil {
+			return nil
+		}
+		cacheExpTime := time.Unix(entry.GetCacheExpirationTime(), 0)
+		msgExpTime := time.Unix(entry.GetMsgExpirationTime(), 0)
+		storedTime := time.Unix(entry.GetMsgStoredTime(), 0)
+		resp := new(dns.Msg)
+		if err := resp.Unpack(entry.GetMsg()); err != nil {
+			return fmt.Errorf("failed to decode dns msg, %w", err)
+		}
+
+		i := &item{
+			resp:           resp,
+			storedTime:     storedTime,
+			expirationTime: msgExpTime,
+		}
+		backend.Store(key(entry.GetKey()), i, cacheExpTime)
+		return nil
+	})
+}
+
+// ReadDump calls f through all entries of the cache dump in r.
+// It returns the number of entries read and any error encountered.
+func ReadDump(r io.Reader, f func(entry *CachedEntry) error) (int, error) {
 	en := 0
 	gr, err := gzip.NewReader(r)
 	if err != nil {
@@ -446,20 +893,9 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 
 		en += len(block.GetEntries())
 		for _, entry := range block.GetEntries() {
-			cacheExpTime := time.Unix(entry.GetCacheExpirationTime(), 0)
-			msgExpTime := time.Unix(entry.GetMsgExpirationTime(), 0)
-			storedTime := time.Unix(entry.GetMsgStoredTime(), 0)
-			resp := new(dns.Msg)
-			if err := resp.Unpack(entry.GetMsg()); err != nil {
-				return fmt.Errorf("failed to decode dns msg, %w", err)
-			}
-
-			i := &item{
-				resp:           resp,
-				storedTime:     storedTime,
-				expirationTime: msgExpTime,
+			if err := f(entry); err != nil {
+				return err
 			}
-			c.backend.Store(key(entry.GetKey()), i, cacheExpTime)
 		}
 		return nil
 	}
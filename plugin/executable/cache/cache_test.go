@@ -21,14 +21,33 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 )
 
+// newTestCache calls NewCache and fails t on error.
+func newTestCache(t testing.TB, args *Args) *Cache {
+	t.Helper()
+	c, err := NewCache(args, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 func Test_cachePlugin_Dump(t *testing.T) {
-	c := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	c := newTestCache(t, &Args{Size: 16 * dumpBlockSize}) // Big enough to create dump fragments.
 
 	resp := new(dns.Msg)
 	resp.SetQuestion("test.", dns.TypeA)
@@ -60,3 +79,121 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_diskBackend(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "cache")
+	b, err := newDiskBackend(path, 0, zap.NewNop())
+	r.NoError(err)
+
+	newItem := func(name string) *item {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return &item{resp: m, expirationTime: time.Now().Add(time.Hour)}
+	}
+	exp := time.Now().Add(time.Hour)
+	b.writeMu.Lock() // Hold the writer, so items stay in the queue.
+	b.Store("a", newItem("a."), exp)
+	b.Store("b", newItem("b."), exp)
+	b.Store("c", newItem("c."), exp)
+	v, _, ok := b.Get("a") // Pending items are served.
+	r.True(ok)
+	r.Equal("a.", v.resp.Question[0].Name)
+	var pending []key // Pending items are listed by Range.
+	r.NoError(b.Range(func(k key, _ *item, _ time.Time) error {
+		pending = append(pending, k)
+		return nil
+	}))
+	r.ElementsMatch([]key{"a", "b", "c"}, pending)
+	b.writeMu.Unlock()
+	b.Delete("b")
+	_, _, ok = b.Get("b")
+	r.False(ok)
+
+	r.NoError(b.Close()) // Pending items are written.
+	b, err = newDiskBackend(path, 0, zap.NewNop())
+	r.NoError(err)
+	defer b.Close()
+	for k, want := range map[key]bool{"a": true, "b": false, "c": true} {
+		_, _, ok := b.Get(k)
+		r.Equal(want, ok, k)
+	}
+	b.Flush()
+	r.Equal(0, b.Len())
+}
+
+func Test_cachePlugin_Disk(t *testing.T) {
+	diskFile := filepath.Join(t.TempDir(), "cache")
+	up := &countingUpstream{ttl: 300}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(c *Cache, name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		if err := c.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.R() == nil || len(qCtx.R().Answer) != 1 {
+			t.Fatal("invalid response")
+		}
+	}
+
+	c := newTestCache(t, &Args{DiskFile: diskFile})
+	for i := 0; i < 4096; i++ { // More than the memory size.
+		exec(c, strconv.Itoa(i)+".")
+	}
+	if l := c.backend.MemLen(); l > 1024 {
+		t.Fatalf("memory tier overflow: %d", l)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart. Responses are served from the disk.
+	c = newTestCache(t, &Args{DiskFile: diskFile})
+	defer c.Close()
+	if l := c.backend.Len(); l != 4096 {
+		t.Fatalf("want 4096 entries on disk, got %d", l)
+	}
+	for i := 0; i < 4096; i++ {
+		exec(c, strconv.Itoa(i)+".")
+	}
+	if n := up.n.Load(); n != 4096 {
+		t.Fatalf("want 4096 upstream queries, got %d", n)
+	}
+}
+
+func Test_cachePlugin_DiskOpenErr(t *testing.T) {
+	_, err := NewCache(&Args{DiskFile: t.TempDir()}, Opts{}) // A dir is not a valid disk file.
+	require.Error(t, err)
+}
+
+func Test_cachePlugin_DiskDelete(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(t.TempDir(), "cache")
+	disk, err := newDiskBackend(path, 0, zap.NewNop())
+	r.NoError(err)
+	c := newTestCache(t, &Args{})
+	c.backend = cache.NewWithBackend[key, *item](cache.Opts{Size: 1024}, disk)
+
+	up := &countingUpstream{ttl: 300}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r.NoError(c.Exec(context.Background(), query_context.NewContext(q), next))
+	}
+
+	// Delete right after store, while the disk write may be pending.
+	exec("a.example.")
+	exec("b.example.")
+	w := httptest.NewRecorder()
+	c.Api().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/entries?qname=a.example", nil))
+	r.Equal(http.StatusOK, w.Code)
+	r.NoError(c.Close())
+
+	disk, err = newDiskBackend(path, 0, zap.NewNop())
+	r.NoError(err)
+	defer disk.Close()
+	r.Equal(1, disk.Len(), "deleted entry came back")
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"errors"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/diskkv"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ cache.Backend[key, *item] = (*diskBackend)(nil)
+
+// diskWriteQueueSize is the maximum number of items that are waiting to
+// be written to the disk. New items are dropped if the queue is full.
+const diskWriteQueueSize = 4096
+
+// diskBackend stores items in a diskkv.DB. Values are CachedEntry
+// protobufs without the key.
+// Items are written by a background goroutine, so stores on the query
+// path never wait for the disk. Pending items are still served by Get.
+// Scoped responses (subnet containers) are kept in memory only.
+type diskBackend struct {
+	db     *diskkv.DB
+	logger *zap.Logger
+
+	writeMu sync.Mutex // Held while writing to db. Serializes writes with Delete and Flush.
+	mu      sync.Mutex
+	pending map[key]pendingItem
+	queue   chan key // Keys in pending.
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	writerDone  chan struct{}
+}
+
+type pendingItem struct {
+	v                   *item
+	cacheExpirationTime time.Time
+}
+
+func newDiskBackend(path string, syncInterval time.Duration, logger *zap.Logger) (*diskBackend, error) {
+	b := &diskBackend{
+		logger:      logger,
+		pending:     make(map[key]pendingItem),
+		queue:       make(chan key, diskWriteQueueSize),
+		closeNotify: make(chan struct{}),
+		writerDone:  make(chan struct{}),
+	}
+	db, err := diskkv.Open(path, diskkv.Opts{
+		SyncInterval:   syncInterval,
+		OnCompactError: func(err error) { b.logErr("failed to compact disk cache", err) },
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.db = db
+	go b.writeLoop()
+	return b, nil
+}
+
+func (b *diskBackend) logErr(msg string, err error) {
+	if err != nil && !errors.Is(err, diskkv.ErrClosed) {
+		b.logger.Warn(msg, zap.Error(err))
+	}
+}
+
+func (b *diskBackend) Get(k key) (*item, time.Time, bool) {
+	b.mu.Lock()
+	p, ok := b.pending[k]
+	b.mu.Unlock()
+	if ok {
+		if time.Now().After(p.cacheExpirationTime) {
+			return nil, time.Time{}, false
+		}
+		return p.v, p.cacheExpirationTime, true
+	}
+
+	val, cacheExpirationTime, ok, err := b.db.Get(string(k))
+	if err != nil {
+		b.logErr("failed to read disk cache", err)
+		return nil, time.Time{}, false
+	}
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	v, err := decodeDiskItem(val)
+	if err != nil {
+		b.logErr("failed to decode disk cache", err)
+		return nil, time.Time{}, false
+	}
+	return v, cacheExpirationTime, true
+}
+
+// Store queues v. It does not block.
+func (b *diskBackend) Store(k key, v *item, cacheExpirationTime time.Time) {
+	if v.resp == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, queued := b.pending[k]; !queued {
+		select {
+		case b.queue <- k:
+		default:
+			return // Queue is full. The item is still in the memory tier.
+		}
+	}
+	b.pending[k] = pendingItem{v: v, cacheExpirationTime: cacheExpirationTime}
+}
+
+func (b *diskBackend) writeLoop() {
+	defer close(b.writerDone)
+	for {
+		select {
+		case k := <-b.queue:
+			b.write(k)
+		case <-b.closeNotify:
+			for { // Write the remaining items.
+				select {
+				case k := <-b.queue:
+					b.write(k)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes the pending item of k, if it was not deleted or flushed.
+func (b *diskBackend) write(k key) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	b.mu.Lock()
+	p, ok := b.pending[k]
+	delete(b.pending, k)
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	v, cacheExpirationTime := p.v, p.cacheExpirationTime
+
+	msg, err := v.resp.Pack()
+	if err != nil {
+		b.logErr("failed to pack msg", err)
+		return
+	}
+	val, err := proto.Marshal(&CachedEntry{
+		Msg:                 msg,
+		CacheExpirationTime: cacheExpirationTime.Unix(),
+		MsgExpirationTime:   v.expirationTime.Unix(),
+		MsgStoredTime:       v.storedTime.Unix(),
+	})
+	if err != nil {
+		b.logErr("failed to marshal protobuf", err)
+		return
+	}
+	b.logErr("failed to write disk cache", b.db.Put(string(k), val, cacheExpirationTime))
+}
+
+func decodeDiskItem(val []byte) (*item, error) {
+	e := new(CachedEntry)
+	if err := proto.Unmarshal(val, e); err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(e.GetMsg()); err != nil {
+		return nil, err
+	}
+	return &item{
+		resp:           resp,
+		storedTime:     time.Unix(e.GetMsgStoredTime(), 0),
+		expirationTime: time.Unix(e.GetMsgExpirationTime(), 0),
+	}, nil
+}
+
+func (b *diskBackend) Delete(k key) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	b.mu.Lock()
+	delete(b.pending, k)
+	b.mu.Unlock()
+	b.logErr("failed to delete disk cache", b.db.Delete(string(k)))
+}
+
+// Range calls f on items in the db and pending items. Pending items
+// shadow the db, as in Get.
+func (b *diskBackend) Range(f func(k key, v *item, cacheExpirationTime time.Time) error) error {
+	b.mu.Lock()
+	pending := maps.Clone(b.pending)
+	b.mu.Unlock()
+
+	err := b.db.Range(func(k string, val []byte, cacheExpirationTime time.Time) error {
+		if _, ok := pending[key(k)]; ok {
+			return nil
+		}
+		v, err := decodeDiskItem(val)
+		if err != nil {
+			b.logErr("failed to decode disk cache", err)
+			return nil
+		}
+		return f(key(k), v, cacheExpirationTime)
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for k, p := range pending {
+		if now.After(p.cacheExpirationTime) {
+			continue
+		}
+		if err := f(k, p.v, p.cacheExpirationTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *diskBackend) Len() int {
+	return b.db.Len()
+}
+
+func (b *diskBackend) Flush() {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	b.mu.Lock()
+	clear(b.pending)
+	b.mu.Unlock()
+	b.logErr("failed to flush disk cache", b.db.Flush())
+}
+
+// Close writes pending items and closes the db.
+func (b *diskBackend) Close() error {
+	b.closeOnce.Do(func() { close(b.closeNotify) })
+	<-b.writerDone
+	return b.db.Close()
+}
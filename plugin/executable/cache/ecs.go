@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+// subnetItem is a response that is valid for the clients in subnet.
+type subnetItem struct {
+	subnet      netip.Prefix // Masked to the scope prefix length.
+	item        *item
+	cacheExpire time.Time
+}
+
+// clientSubnet returns the ecs in opt and the masked subnet in it.
+// ok is false if opt has no valid ecs.
+func clientSubnet(opt *dns.OPT) (ecs *dns.EDNS0_SUBNET, subnet netip.Prefix, ok bool) {
+	if opt == nil {
+		return nil, netip.Prefix{}, false
+	}
+	for _, o := range opt.Option {
+		if e, isECS := o.(*dns.EDNS0_SUBNET); isECS {
+			subnet, ok = ecsPrefix(e, e.SourceNetmask)
+			return e, subnet, ok
+		}
+	}
+	return nil, netip.Prefix{}, false
+}
+
+// ecsPrefix returns the address in ecs masked to bits.
+func ecsPrefix(ecs *dns.EDNS0_SUBNET, bits uint8) (netip.Prefix, bool) {
+	var addr netip.Addr
+	switch ecs.Family {
+	case 1:
+		ip := ecs.Address.To4()
+		if ip == nil {
+			return netip.Prefix{}, false
+		}
+		addr, _ = netip.AddrFromSlice(ip)
+	case 2:
+		ip := ecs.Address.To16()
+		if ip == nil {
+			return netip.Prefix{}, false
+		}
+		addr, _ = netip.AddrFromSlice(ip)
+	default:
+		return netip.Prefix{}, false
+	}
+	p, err := addr.Prefix(int(bits))
+	return p, err == nil
+}
+
+// responseScope returns the scope prefix length of the response to a query
+// that has qECS. (RFC 7871 7.3.1) ok is false if the response ecs does not
+// match the query and the response should not be cached.
+func responseScope(qECS *dns.EDNS0_SUBNET, subnet netip.Prefix, respOpt *dns.OPT) (scope int, ok bool) {
+	if respOpt == nil {
+		return 0, true
+	}
+	for _, o := range respOpt.Option {
+		e, isECS := o.(*dns.EDNS0_SUBNET)
+		if !isECS {
+			continue
+		}
+		if e.Family != qECS.Family || e.SourceNetmask != qECS.SourceNetmask {
+			return 0, false
+		}
+		if p, valid := ecsPrefix(e, e.SourceNetmask); !valid || p != subnet {
+			return 0, false
+		}
+		// A scope that is longer than the source is treated as the source.
+		return min(int(e.SourceScope), subnet.Bits()), true
+	}
+	// No ecs in the response. It is for all clients.
+	return 0, true
+}
+
+// subnetKey returns the key of the entry that holds the scoped responses
+// of msgKey.
+func subnetKey(msgKey string) key {
+	return derivedKey(msgKey, subnetBit)
+}
+
+// getSubnetItem returns the item of the longest subnet that contains the
+// client subnet and is not longer than it, and the length of that subnet.
+func getSubnetItem(msgKey string, subnet netip.Prefix, backend *cache.Cache[key, *item]) (*item, int) {
+	v, _, _ := backend.Get(subnetKey(msgKey))
+	if v == nil {
+		return nil, 0
+	}
+	var best *subnetItem
+	now := time.Now()
+	for i := range v.subnets {
+		s := &v.subnets[i]
+		if s.cacheExpire.Before(now) || s.subnet.Bits() > subnet.Bits() || !s.subnet.Contains(subnet.Addr()) {
+			continue
+		}
+		if best == nil || s.subnet.Bits() > best.subnet.Bits() {
+			best = s
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return best.item, best.subnet.Bits()
+}
+
+// storeSubnetItem adds v to the scoped responses of msgKey. Each name
+// has at most maxSubnets responses. Expired ones and the ones that expire
+// first are removed. Caller must serialize calls for the same msgKey.
+func storeSubnetItem(msgKey string, subnet netip.Prefix, v *item, cacheExpire time.Time, backend *cache.Cache[key, *item], maxSubnets int) {
+	k := subnetKey(msgKey)
+	now := time.Now()
+	var subnets []subnetItem
+	if old, _, _ := backend.Get(k); old != nil {
+		subnets = make([]subnetItem, 0, len(old.subnets)+1)
+		for _, s := range old.subnets {
+			if s.subnet != subnet && s.cacheExpire.After(now) {
+				subnets = append(subnets, s)
+			}
+		}
+	}
+	for len(subnets) >= maxSubnets && len(subnets) > 0 {
+		first := 0
+		for i := range subnets {
+			if subnets[i].cacheExpire.Before(subnets[first].cacheExpire) {
+				first = i
+			}
+		}
+		subnets = append(subnets[:first], subnets[first+1:]...)
+	}
+	subnets = append(subnets, subnetItem{subnet: subnet, item: v, cacheExpire: cacheExpire})
+
+	containerExpire := cacheExpire
+	for _, s := range subnets {
+		if s.cacheExpire.After(containerExpire) {
+			containerExpire = s.cacheExpire
+		}
+	}
+	backend.Store(k, &item{subnets: subnets}, containerExpire)
+}
+
+// setRespECS adds an ecs that has the scope to r, so it will be sent
+// back to the client if the query ecs was forwarded.
+func setRespECS(r *dns.Msg, qECS *dns.EDNS0_SUBNET, scope int) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(dns.MinMsgSize, false)
+		opt = r.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        qECS.Family,
+		SourceNetmask: qECS.SourceNetmask,
+		SourceScope:   uint8(scope),
+		Address:       append(net.IP(nil), qECS.Address...),
+	})
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// scopedUpstream answers with the ecs scope returned by scope. The answer
+// is the address of the query subnet.
+type scopedUpstream struct {
+	scope func(subnet netip.Prefix) int // Negative means no ecs.
+	n     int
+}
+
+func (u *scopedUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if qCtx.R() != nil {
+		return nil
+	}
+	u.n++
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4zero,
+	})
+	ecs, subnet, ok := clientSubnet(qCtx.QOpt())
+	if ok {
+		r.Answer[0].(*dns.A).A = subnet.Addr().AsSlice()
+		if scope := u.scope(subnet); scope >= 0 {
+			r.SetEdns0(1232, false)
+			e := *ecs
+			e.SourceScope = uint8(scope)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &e)
+		}
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_ECS(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, &Args{MaxSubnetsPerName: 2})
+	defer c.Close()
+
+	up := &scopedUpstream{scope: func(subnet netip.Prefix) int { return 24 }}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(name, subnet string) (string, *dns.EDNS0_SUBNET) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		if len(subnet) > 0 {
+			p := netip.MustParsePrefix(subnet)
+			family := uint16(1)
+			if p.Addr().Is6() {
+				family = 2
+			}
+			qCtx.QOpt().Option = append(qCtx.QOpt().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        family,
+				SourceNetmask: uint8(p.Bits()),
+				Address:       p.Addr().AsSlice(),
+			})
+		}
+		r.NoError(c.Exec(context.Background(), qCtx, next))
+		var ecs *dns.EDNS0_SUBNET
+		if opt := qCtx.UpstreamOpt(); opt != nil {
+			ecs, _, _ = clientSubnet(opt)
+		}
+		return qCtx.R().Answer[0].(*dns.A).A.String(), ecs
+	}
+
+	// Scoped responses.
+	a, _ := exec("a.", "1.2.3.4/24")
+	r.Equal("1.2.3.0", a)
+	a, ecs := exec("a.", "1.2.3.99/24")
+	r.Equal("1.2.3.0", a)
+	r.Equal(1, up.n)
+	r.Equal(uint8(24), ecs.SourceScope)
+	a, _ = exec("a.", "1.2.4.1/24")
+	r.Equal("1.2.4.0", a)
+	r.Equal(2, up.n)
+
+	// Scope is shorter than the source.
+	up.scope = func(netip.Prefix) int { return 16 }
+	a, _ = exec("b.", "5.6.7.8/24")
+	r.Equal("5.6.7.0", a)
+	a, ecs = exec("b.", "5.6.9.1/24")
+	r.Equal("5.6.7.0", a)
+	r.Equal(uint8(16), ecs.SourceScope)
+	r.Equal(3, up.n)
+	exec("b.", "5.6.9.1/8") // The source is shorter than the scope.
+	r.Equal(4, up.n)
+
+	// Scope 0 is for all clients.
+	up.scope = func(netip.Prefix) int { return 0 }
+	exec("c.", "9.9.9.9/24")
+	a, ecs = exec("c.", "8.8.8.8/24")
+	r.Equal("9.9.9.0", a)
+	r.Equal(uint8(0), ecs.SourceScope)
+	exec("c.", "")
+	r.Equal(5, up.n)
+
+	// Queries without ecs and responses without ecs.
+	up.scope = func(netip.Prefix) int { return -1 }
+	a, _ = exec("d.", "")
+	r.Equal("0.0.0.0", a)
+	a, _ = exec("d.", "7.7.7.7/24")
+	r.Equal("0.0.0.0", a) // Fall back to scope 0.
+	r.Equal(6, up.n)
+
+	// Per name limit.
+	up.scope = func(netip.Prefix) int { return 24 }
+	exec("a.", "1.2.5.1/24")
+	q := new(dns.Msg)
+	q.SetQuestion("a.", dns.TypeA)
+	v, _, _ := c.backend.Get(subnetKey(getMsgKey(q)))
+	r.Len(v.subnets, 2)
+}
+
+func Test_responseScope(t *testing.T) {
+	r := require.New(t)
+	qECS := &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, Address: net.ParseIP("1.2.3.4")}
+	_, subnet, ok := clientSubnet(&dns.OPT{Option: []dns.EDNS0{qECS}})
+	r.True(ok)
+	r.Equal(netip.MustParsePrefix("1.2.3.0/24"), subnet)
+
+	resp := func(e *dns.EDNS0_SUBNET) *dns.OPT { return &dns.OPT{Option: []dns.EDNS0{e}} }
+	scope, ok := responseScope(qECS, subnet, resp(&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, SourceScope: 32, Address: net.ParseIP("1.2.3.0")}))
+	r.True(ok)
+	r.Equal(24, scope)
+	_, ok = responseScope(qECS, subnet, resp(&dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("1.2.4.0")}))
+	r.False(ok)
+	scope, ok = responseScope(qECS, subnet, nil)
+	r.True(ok)
+	r.Equal(0, scope)
+}
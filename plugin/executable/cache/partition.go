@@ -0,0 +1,246 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type PartitionArgs struct {
+	// Name is used in metrics and api outputs. It must be unique.
+	Name string `yaml:"name"`
+	// Matches are sequence matchers. e.g. "mark 1", "var tenant a",
+	// "client_ip $tenant_ips", "string_exp server_name eq a.example",
+	// "string_exp url_path eq /a".
+	// A query belongs to the first partition whose matches all match.
+	Matches []string `yaml:"matches"`
+	// Size is the maximum number of entries. Default is the cache size.
+	Size int `yaml:"size"`
+	// MaxMemory limits the estimated memory size of entries in bytes.
+	MaxMemory int `yaml:"max_memory"`
+}
+
+// partition holds the entries of the queries that it matches. Queries
+// in different partitions never share responses. Partitions are dumped
+// with their names, but they are not saved to disk_file, and they do not
+// feed the aggressive NSEC cache.
+type partition struct {
+	name     string
+	matchers []sequence.Matcher
+	backend  *cache.Cache[key, *item]
+
+	anonymousMatchers []sequence.Matcher // Built by newMatcher. Closed with the partition.
+
+	queryTotal prometheus.Counter
+	hitTotal   prometheus.Counter
+	size       prometheus.GaugeFunc
+	memory     prometheus.GaugeFunc
+}
+
+// initPartitions builds the partitions in args. Queries that match
+// no partition use the default one, which is c.backend.
+func (c *Cache) initPartitions(bq sequence.BQ) error {
+	if len(c.args.Partitions) == 0 {
+		return nil
+	}
+	c.partitionKey = query_context.RegKey()
+	names := make(map[string]struct{})
+	for i, pa := range c.args.Partitions {
+		if len(pa.Name) == 0 {
+			return fmt.Errorf("partition #%d has no name", i)
+		}
+		if _, dup := names[pa.Name]; dup {
+			return fmt.Errorf("duplicated partition %s", pa.Name)
+		}
+		names[pa.Name] = struct{}{}
+		if len(pa.Matches) == 0 {
+			return fmt.Errorf("partition %s has no matches", pa.Name)
+		}
+
+		p := &partition{name: pa.Name}
+		for _, s := range pa.Matches {
+			m, err := p.newMatcher(bq, s)
+			if err != nil {
+				return fmt.Errorf("invalid match %q of partition %s, %w", s, pa.Name, err)
+			}
+			p.matchers = append(p.matchers, m)
+		}
+		size := pa.Size
+		if size <= 0 {
+			size = c.args.Size
+		}
+		p.backend = cache.New[key, *item](cache.Opts{Size: size, MaxCost: pa.MaxMemory, Policy: cache.PolicyTinyLFU})
+
+		lb := map[string]string{"tag": c.metricsTag, "partition": pa.Name}
+		p.queryTotal = prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "partition_query_total",
+			Help:        "The total number of processed queries of a partition",
+			ConstLabels: lb,
+		})
+		p.hitTotal = prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "partition_hit_total",
+			Help:        "The total number of queries that hit the cache of a partition",
+			ConstLabels: lb,
+		})
+		p.size = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "partition_size_current",
+			Help:        "Current cache size of a partition in records",
+			ConstLabels: lb,
+		}, func() float64 {
+			return float64(p.backend.Len())
+		})
+		p.memory = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "partition_memory_bytes_current",
+			Help:        "Estimated memory size of cached responses of a partition in bytes. Only tracked with max_memory",
+			ConstLabels: lb,
+		}, func() float64 {
+			return float64(p.backend.Cost())
+		})
+		c.partitions = append(c.partitions, p)
+	}
+	c.initDump() // The dump has entries of partitions.
+	return nil
+}
+
+// newMatcher builds a matcher from s. The format is the same as
+// the matches of a sequence rule: "[!]type args" or "[!]$tag [args]".
+func (p *partition) newMatcher(bq sequence.BQ, s string) (sequence.Matcher, error) {
+	s = strings.TrimSpace(s)
+	s, reverse := strings.CutPrefix(s, "!")
+	typ, args, _ := strings.Cut(strings.TrimSpace(s), " ")
+	args = strings.TrimSpace(args)
+
+	var m sequence.Matcher
+	if tag, ok := strings.CutPrefix(typ, "$"); ok {
+		m, _ = bq.M().GetPlugin(tag).(sequence.Matcher)
+		if m == nil {
+			return nil, fmt.Errorf("can not find matcher %s", tag)
+		}
+		if qc, ok := m.(sequence.QuickConfigurableMatch); ok {
+			v, err := qc.QuickConfigureMatch(args)
+			if err != nil {
+				return nil, fmt.Errorf("fail to configure plugin %s, %w", tag, err)
+			}
+			m = v
+		}
+	} else {
+		f := sequence.GetMatchQuickSetup(typ)
+		if f == nil {
+			return nil, fmt.Errorf("invalid matcher type %s", typ)
+		}
+		v, err := f(bq, args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init matcher, %w", err)
+		}
+		p.anonymousMatchers = append(p.anonymousMatchers, v)
+		m = v
+	}
+	if reverse {
+		return reverseMatcher{m: m}, nil
+	}
+	return m, nil
+}
+
+type reverseMatcher struct {
+	m sequence.Matcher
+}
+
+func (r reverseMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := r.m.Match(ctx, qCtx)
+	return !ok, err
+}
+
+// selectPartition finds the partition of qCtx and records it in qCtx, so
+// background updates of copied contexts use the same partition.
+// It returns nil for the default partition.
+func (c *Cache) selectPartition(ctx context.Context, qCtx *query_context.Context) (*partition, error) {
+next:
+	for _, p := range c.partitions {
+		for _, m := range p.matchers {
+			ok, err := m.Match(ctx, qCtx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to match partition %s, %w", p.name, err)
+			}
+			if !ok {
+				continue next
+			}
+		}
+		qCtx.StoreValue(c.partitionKey, p)
+		return p, nil
+	}
+	return nil, nil
+}
+
+// partitionOf returns the partition recorded by selectPartition, or nil
+// for the default partition.
+func (c *Cache) partitionOf(qCtx *query_context.Context) *partition {
+	if len(c.partitions) == 0 {
+		return nil
+	}
+	v, _ := qCtx.GetValue(c.partitionKey)
+	p, _ := v.(*partition)
+	return p
+}
+
+// backendOf returns the backend of the partition of qCtx.
+func (c *Cache) backendOf(qCtx *query_context.Context) *cache.Cache[key, *item] {
+	if p := c.partitionOf(qCtx); p != nil {
+		return p.backend
+	}
+	return c.backend
+}
+
+// partitionBackend is a backend and the name of its partition.
+// The default partition has an empty name.
+type partitionBackend struct {
+	name    string
+	backend *cache.Cache[key, *item]
+}
+
+// allBackends returns the backends of all partitions.
+func (c *Cache) allBackends() []partitionBackend {
+	bs := []partitionBackend{{backend: c.backend}}
+	for _, p := range c.partitions {
+		bs = append(bs, partitionBackend{name: p.name, backend: p.backend})
+	}
+	return bs
+}
+
+func (c *Cache) closePartitions() error {
+	var errs []error
+	for _, p := range c.partitions {
+		errs = append(errs, p.backend.Close())
+		for _, m := range p.anonymousMatchers {
+			if closer, ok := m.(io.Closer); ok {
+				errs = append(errs, closer.Close())
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
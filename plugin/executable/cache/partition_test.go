@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/string_exp"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/vars"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// markedUpstream answers 0.0.0.0 to queries that have mark 1, like a
+// blocklist, and 1.1.1.1 to others.
+type markedUpstream struct {
+	n int
+}
+
+func (u *markedUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if qCtx.R() != nil {
+		return nil
+	}
+	u.n++
+	ip := net.IPv4(1, 1, 1, 1)
+	if qCtx.HasMark(1) {
+		ip = net.IPv4zero
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   ip,
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_Partitions(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, &Args{Partitions: []PartitionArgs{
+		{Name: "blocked", Matches: []string{"mark 1"}},
+		{Name: "doh", Matches: []string{"string_exp server_name eq doh.example", "!mark 1"}, Size: 2048},
+	}})
+	defer c.Close()
+	r.NoError(c.initPartitions(sequence.NewBQ(nil, zap.NewNop())))
+
+	up := &markedUpstream{}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(mark bool, serverName string) string {
+		q := new(dns.Msg)
+		q.SetQuestion("a.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		qCtx.ServerMeta.ServerName = serverName
+		if mark {
+			qCtx.SetMark(1)
+		}
+		r.NoError(c.Exec(context.Background(), qCtx, next))
+		return qCtx.R().Answer[0].(*dns.A).A.String()
+	}
+
+	r.Equal("0.0.0.0", exec(true, ""))
+	r.Equal("1.1.1.1", exec(false, ""))
+	r.Equal("0.0.0.0", exec(true, "doh.example"))
+	r.Equal("1.1.1.1", exec(false, "doh.example"))
+	r.Equal(3, up.n)
+	for i := 0; i < 2; i++ {
+		r.Equal("0.0.0.0", exec(true, ""))
+		r.Equal("1.1.1.1", exec(false, ""))
+		r.Equal("1.1.1.1", exec(false, "doh.example"))
+	}
+	r.Equal(3, up.n)
+
+	// Each partition has its own entries.
+	r.Equal(1, c.backend.Len())
+	for _, p := range c.partitions {
+		r.Equal(1, p.backend.Len(), p.name)
+	}
+	var names []string
+	for _, e := range c.entries(func(string, uint16) bool { return true }) {
+		names = append(names, e.Partition)
+	}
+	r.ElementsMatch([]string{"", "blocked", "doh"}, names)
+	r.Equal(3, c.delete(func(qname string, _ uint16) bool { return qname == "a." }))
+
+	// Invalid args.
+	for _, pa := range [][]PartitionArgs{
+		{{Name: "", Matches: []string{"mark 1"}}},
+		{{Name: "a"}},
+		{{Name: "a", Matches: []string{"mark 1"}}, {Name: "a", Matches: []string{"mark 2"}}},
+		{{Name: "a", Matches: []string{"no_such_matcher"}}},
+	} {
+		c := newTestCache(t, &Args{Partitions: pa})
+		r.Error(c.initPartitions(sequence.NewBQ(nil, zap.NewNop())))
+		c.Close()
+	}
+}
+
+func Test_cachePlugin_PartitionDump(t *testing.T) {
+	r := require.New(t)
+	bq := sequence.NewBQ(nil, zap.NewNop())
+	setTenant, err := sequence.GetExecQuickSetup("var")(bq, "tenant a")
+	r.NoError(err)
+	args := &Args{
+		DumpFile:   filepath.Join(t.TempDir(), "dump"),
+		Partitions: []PartitionArgs{{Name: "a", Matches: []string{"var tenant a"}}},
+	}
+	up := &markedUpstream{}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(c *Cache, tenant bool) {
+		q := new(dns.Msg)
+		q.SetQuestion("a.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		if tenant {
+			r.NoError(setTenant.(sequence.Executable).Exec(context.Background(), qCtx))
+		}
+		r.NoError(c.Exec(context.Background(), qCtx, next))
+	}
+
+	c := newTestCache(t, args)
+	r.NoError(c.initPartitions(bq))
+	exec(c, true)
+	exec(c, false)
+	r.Equal(2, up.n)
+	r.NoError(c.Close())
+
+	// Restart. Each partition gets its entries back.
+	c = newTestCache(t, args)
+	defer c.Close()
+	r.NoError(c.initPartitions(bq))
+	r.Equal(1, c.backend.Len())
+	r.Equal(1, c.partitions[0].backend.Len())
+	exec(c, true)
+	exec(c, false)
+	r.Equal(2, up.n)
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// prefetchScanInterval is how often the prefetcher looks for due entries.
+var prefetchScanInterval = time.Second
+
+// prefetcher refreshes popular items before they expire. It runs the
+// rest of the chain in the background with a copy of the query context
+// that made the item popular.
+type prefetcher struct {
+	c           *Cache
+	threshold   uint32
+	percent     int
+	maxEntries  int
+	sem         chan struct{}
+	closeNotify chan struct{}
+
+	m       sync.Mutex
+	entries map[*item]*prefetchEntry
+}
+
+type prefetchEntry struct {
+	msgKey string
+	due    time.Time
+
+	// For prefetch.
+	qCtx *query_context.Context
+	next sequence.ChainWalker
+
+	// checkOnly entries are prefetched items. They are checked for hits
+	// when they expire.
+	checkOnly bool
+}
+
+func newPrefetcher(c *Cache, args *Args) *prefetcher {
+	return &prefetcher{
+		c:           c,
+		threshold:   uint32(args.PrefetchThreshold),
+		percent:     args.PrefetchPercent,
+		maxEntries:  args.Size,
+		sem:         make(chan struct{}, args.PrefetchConcurrency),
+		closeNotify: c.closeNotify,
+		entries:     make(map[*item]*prefetchEntry),
+	}
+}
+
+// hit records the hits-th cache hit of v. Once v becomes popular, it is
+// scheduled for a prefetch in the last percent of its ttl.
+func (p *prefetcher) hit(msgKey string, v *item, hits uint32, qCtx *query_context.Context, next sequence.ChainWalker) {
+	if v.prefetched.Load() {
+		p.c.prefetchHitTotal.Inc()
+	}
+	if hits != p.threshold || v.resp.Rcode == dns.RcodeServerFailure {
+		return
+	}
+	ttl := v.expirationTime.Sub(v.storedTime)
+	e := &prefetchEntry{
+		msgKey: msgKey,
+		due:    v.expirationTime.Add(-ttl * time.Duration(p.percent) / 100),
+		qCtx:   qCtx.Copy(),
+		next:   next,
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.entries[v]; ok || len(p.entries) < p.maxEntries {
+		p.entries[v] = e
+	}
+}
+
+func (p *prefetcher) start() {
+	go func() {
+		ticker := time.NewTicker(prefetchScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.scan(time.Now())
+			case <-p.closeNotify:
+				return
+			}
+		}
+	}()
+}
+
+// scan issues due prefetches. If the concurrency limit is reached,
+// the remaining ones wait for the next scan.
+func (p *prefetcher) scan(now time.Time) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for v, e := range p.entries {
+		if now.Before(e.due) {
+			continue
+		}
+		if e.checkOnly {
+			if v.hits.Load() == 0 {
+				p.c.prefetchWastedTotal.Inc()
+			}
+			delete(p.entries, v)
+			continue
+		}
+		if !now.Before(v.expirationTime) {
+			delete(p.entries, v) // Too late.
+			continue
+		}
+		select {
+		case p.sem <- struct{}{}:
+			delete(p.entries, v)
+			p.c.prefetchIssuedTotal.Inc()
+			go p.run(v, e)
+		default:
+			return
+		}
+	}
+}
+
+func (p *prefetcher) run(old *item, e *prefetchEntry) {
+	defer func() { <-p.sem }()
+	qCtx := e.qCtx
+	p.c.logger.Debug("start prefetch", qCtx.InfoField())
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+	defer cancel()
+	if err := e.next.ExecNext(ctx, qCtx); err != nil {
+		p.c.logger.Warn("failed to prefetch", qCtx.InfoField(), zap.Error(err))
+	}
+	if qCtx.R() == nil {
+		return
+	}
+	p.c.save(e.msgKey, qCtx)
+
+	v, _, _ := p.c.lookupItem(e.msgKey, qCtx)
+	if v == nil || v == old {
+		return
+	}
+	v.prefetched.Store(true)
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.entries[v]; !ok && len(p.entries) < p.maxEntries {
+		p.entries[v] = &prefetchEntry{msgKey: e.msgKey, due: v.expirationTime, checkOnly: true}
+	}
+}
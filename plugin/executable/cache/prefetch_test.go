@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUpstream answers A queries with a fixed ttl and counts them.
+type countingUpstream struct {
+	ttl uint32
+	n   atomic.Int32
+}
+
+func (u *countingUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if qCtx.R() != nil {
+		return nil
+	}
+	u.n.Add(1)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl},
+		A:   net.IPv4zero,
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_Prefetch(t *testing.T) {
+	defer func(d time.Duration) { prefetchScanInterval = d }(prefetchScanInterval)
+	prefetchScanInterval = time.Millisecond * 20
+
+	r := require.New(t)
+	c := newTestCache(t, &Args{Prefetch: true, PrefetchThreshold: 2, PrefetchPercent: 50})
+	defer c.Close()
+
+	up := &countingUpstream{ttl: 2}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r.NoError(c.Exec(context.Background(), query_context.NewContext(q), next))
+	}
+	counter := func(c prometheus.Counter) int {
+		m := new(dto.Metric)
+		r.NoError(c.Write(m))
+		return int(m.GetCounter().GetValue())
+	}
+
+	for i := 0; i < 3; i++ { // A miss and two hits.
+		exec("a.")
+		exec("b.")
+	}
+	exec("c.") // Not popular.
+	r.Equal(int32(3), up.n.Load())
+
+	// Prefetched in the last half of the ttl.
+	r.Eventually(func() bool { return up.n.Load() == 5 }, time.Second*2, time.Millisecond*20)
+	r.Equal(2, counter(c.prefetchIssuedTotal))
+	exec("a.")
+	r.Equal(int32(5), up.n.Load())
+	r.Equal(1, counter(c.prefetchHitTotal))
+
+	// The prefetched b. expires without a hit.
+	r.Eventually(func() bool { return counter(c.prefetchWastedTotal) == 1 }, time.Second*3, time.Millisecond*20)
+	r.Equal(2, counter(c.prefetchIssuedTotal))
+}
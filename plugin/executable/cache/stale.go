@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// errStaleRefreshFailed is returned by a stale refresh that got no
+// usable response.
+var errStaleRefreshFailed = errors.New("stale refresh failed")
+
+// execStale executes the rest of the chain for a query that only has a
+// stale response in the cache. The stale response is only used if the
+// upstream fails or does not respond before the client response timer.
+// (RFC 8767 5)
+// Concurrent queries of the same key share one refresh. It runs in its own
+// goroutine, so it keeps going after the stale response was sent and
+// refreshes the cache. If a refresh failed in the last staleRecheckTimer,
+// the stale response is used without querying the upstream.
+func (c *Cache) execStale(ctx context.Context, msgKey string, stale *dns.Msg, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	sfKey := c.lazyUpdateKey(msgKey, qCtx)
+	if _, _, ok := c.staleRecheck.Get(key(sfKey)); ok {
+		c.serveStale(qCtx, stale, errStaleRefreshFailed)
+		return nil
+	}
+
+	qCtxCopy := qCtx.Copy()
+	done := c.lazyUpdateSF.DoChan(sfKey, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+		defer cancel()
+		err := next.ExecNext(ctx, qCtxCopy)
+		if r := qCtxCopy.R(); err == nil && r != nil && r.Rcode != dns.RcodeServerFailure {
+			c.save(msgKey, qCtxCopy)
+			return r, nil
+		}
+		c.staleRecheck.Store(key(sfKey), struct{}{}, time.Now().Add(staleRecheckTimer))
+		if err == nil {
+			err = errStaleRefreshFailed
+		}
+		return nil, err
+	})
+
+	timer := time.NewTimer(time.Duration(c.args.StaleClientTimeout) * time.Millisecond)
+	defer timer.Stop()
+	var err error
+	select {
+	case res := <-done:
+		if err = res.Err; err == nil {
+			r := res.Val.(*dns.Msg).Copy() // Shared by all callers.
+			r.Id = qCtx.Q().Id
+			qCtx.SetResponse(r)
+			return nil
+		}
+	case <-timer.C:
+	case <-ctx.Done(): // The query was canceled.
+		return ctx.Err()
+	}
+	c.serveStale(qCtx, stale, err)
+	return nil
+}
+
+// serveStale sets the stale response to qCtx. err is the reason.
+func (c *Cache) serveStale(qCtx *query_context.Context, stale *dns.Msg, err error) {
+	c.staleHitTotal.Inc()
+	c.logger.Debug("upstream failed, serve stale response", qCtx.InfoField(), zap.Error(err))
+	stale.Id = qCtx.Q().Id
+	qCtx.SetResponse(stale)
+	setStaleEDE(qCtx, stale)
+}
+
+// setStaleEDE adds a stale answer EDE to the response. (RFC 8914 4.4, 4.20)
+func setStaleEDE(qCtx *query_context.Context, r *dns.Msg) {
+	opt := qCtx.RespOpt()
+	if opt == nil {
+		return
+	}
+	code := dns.ExtendedErrorCodeStaleAnswer
+	if r.Rcode == dns.RcodeNameError {
+		code = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code})
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	upstreamOK = iota
+	upstreamBlackhole
+	upstreamServfail
+	upstreamSlow
+)
+
+// staleUpstream answers 1.1.1.1, or fails as its mode.
+type staleUpstream struct {
+	mode atomic.Int32
+	n    atomic.Int32
+}
+
+func (u *staleUpstream) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	u.n.Add(1)
+	switch u.mode.Load() {
+	case upstreamBlackhole:
+		<-ctx.Done()
+		return ctx.Err()
+	case upstreamServfail:
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeServerFailure)
+		qCtx.SetResponse(r)
+		return nil
+	case upstreamSlow:
+		time.Sleep(300 * time.Millisecond)
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 1, 1, 1),
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_ServeStale(t *testing.T) {
+	r := require.New(t)
+	c := newTestCache(t, &Args{ServeStale: true, StaleMaxAge: 60, StaleClientTimeout: 100})
+	defer c.Close()
+	up := new(staleUpstream)
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+
+	// storeStale stores a response that expired age ago.
+	storeStale := func(name string, rcode int, age time.Duration) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.SetEdns0(1232, false)
+		resp := new(dns.Msg)
+		resp.SetRcode(q, rcode)
+		if rcode == dns.RcodeSuccess {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(2, 2, 2, 2),
+			})
+		}
+		now := time.Now()
+		v := &item{resp: resp, storedTime: now.Add(-age - time.Minute), expirationTime: now.Add(-age)}
+		c.backend.Store(key(getMsgKey(q)), v, now.Add(time.Hour))
+	}
+	exec := func(name string) (*dns.Msg, *query_context.Context) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.SetEdns0(1232, false)
+		qCtx := query_context.NewContext(q)
+		r.NoError(c.Exec(context.Background(), qCtx, next))
+		return qCtx.R(), qCtx
+	}
+	staleEDE := func(qCtx *query_context.Context) uint16 {
+		for _, o := range qCtx.RespOpt().Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede.InfoCode
+			}
+		}
+		return 0
+	}
+
+	// The upstream is healthy. Stale data is not used.
+	storeStale("a.", dns.RcodeSuccess, time.Second)
+	resp, qCtx := exec("a.")
+	r.Equal("1.1.1.1", resp.Answer[0].(*dns.A).A.String())
+	r.Zero(staleEDE(qCtx))
+	resp, _ = exec("a.") // Refreshed.
+	r.Equal("1.1.1.1", resp.Answer[0].(*dns.A).A.String())
+
+	// The upstream blackholes. Stale data is used after the client response timer.
+	up.mode.Store(upstreamBlackhole)
+	storeStale("b.", dns.RcodeSuccess, time.Second)
+	start := time.Now()
+	resp, qCtx = exec("b.")
+	r.GreaterOrEqual(time.Since(start), 100*time.Millisecond)
+	r.Less(time.Since(start), time.Second)
+	r.Equal("2.2.2.2", resp.Answer[0].(*dns.A).A.String())
+	r.Equal(uint32(30), resp.Answer[0].Header().Ttl)
+	r.Equal(dns.ExtendedErrorCodeStaleAnswer, staleEDE(qCtx))
+
+	// The upstream fails.
+	up.mode.Store(upstreamServfail)
+	storeStale("c.", dns.RcodeNameError, time.Second)
+	resp, qCtx = exec("c.")
+	r.Equal(dns.RcodeNameError, resp.Rcode)
+	r.Equal(dns.ExtendedErrorCodeStaleNXDOMAINAnswer, staleEDE(qCtx))
+
+	// The refresh failed recently. Stale data is used without a query.
+	up.mode.Store(upstreamOK)
+	n := up.n.Load()
+	resp, qCtx = exec("c.")
+	r.Equal(dns.RcodeNameError, resp.Rcode)
+	r.Equal(dns.ExtendedErrorCodeStaleNXDOMAINAnswer, staleEDE(qCtx))
+	r.Equal(n, up.n.Load())
+	up.mode.Store(upstreamServfail)
+
+	// Older than the max stale age.
+	storeStale("d.", dns.RcodeSuccess, time.Minute*2)
+	resp, qCtx = exec("d.")
+	r.Equal(dns.RcodeServerFailure, resp.Rcode)
+	r.Zero(staleEDE(qCtx))
+
+	// The upstream is slow. Stale data is used, and the same resolution
+	// refreshes the cache when it finishes.
+	up.mode.Store(upstreamSlow)
+	storeStale("e.", dns.RcodeSuccess, time.Second)
+	n = up.n.Load()
+	resp, qCtx = exec("e.")
+	r.Equal("2.2.2.2", resp.Answer[0].(*dns.A).A.String())
+	r.Equal(dns.ExtendedErrorCodeStaleAnswer, staleEDE(qCtx))
+	r.Eventually(func() bool {
+		v, _, _ := c.backend.Get(key(getMsgKey(qCtx.Q())))
+		return v != nil && time.Now().Before(v.expirationTime)
+	}, time.Second, time.Millisecond*10)
+	r.Equal(n+1, up.n.Load(), "the upstream should be queried once")
+	resp, _ = exec("e.")
+	r.Equal("1.1.1.1", resp.Answer[0].(*dns.A).A.String())
+
+	// Concurrent queries share one refresh.
+	storeStale("f.", dns.RcodeSuccess, time.Second)
+	n = up.n.Load()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exec("f.")
+		}()
+	}
+	wg.Wait()
+	fq := new(dns.Msg)
+	fq.SetQuestion("f.", dns.TypeA)
+	fq.SetEdns0(1232, false)
+	r.Eventually(func() bool {
+		v, _, _ := c.backend.Get(key(getMsgKey(fq)))
+		return v != nil && time.Now().Before(v.expirationTime)
+	}, time.Second, time.Millisecond*10)
+	r.Equal(n+1, up.n.Load(), "the upstream should be queried once")
+
+	m := new(dto.Metric)
+	r.NoError(c.staleHitTotal.Write(m))
+	r.Equal(float64(4+8), m.GetCounter().GetValue())
+}
@@ -21,6 +21,7 @@ package cache
 
 import (
 	"hash/maphash"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
@@ -38,6 +39,14 @@ func (k key) Sum() uint64 {
 	return maphash.String(seed, string(k))
 }
 
+const (
+	adBit = 1 << iota
+	cdBit
+	doBit
+	subnetBit  // Set by subnetKey.
+	failureBit // Set by failureKey.
+)
+
 // getMsgKey returns a string key for the query msg, or an empty
 // string if query should not be cached.
 func getMsgKey(q *dns.Msg) string {
@@ -45,12 +54,6 @@ func getMsgKey(q *dns.Msg) string {
 		return ""
 	}
 
-	const (
-		adBit = 1 << iota
-		cdBit
-		doBit
-	)
-
 	question := q.Question[0]
 	buf := make([]byte, 1+2+1+len(question.Name)) // bits + qtype + qname length + qname
 	b := byte(0)
@@ -78,6 +81,34 @@ type item struct {
 	resp           *dns.Msg
 	storedTime     time.Time
 	expirationTime time.Time
+
+	// subnets holds the scoped responses of a name. Only set for the
+	// item of a subnetKey, which has a nil resp.
+	subnets []subnetItem
+
+	hits       atomic.Uint32 // Cache hits.
+	prefetched atomic.Bool   // The item was saved by a prefetch.
+}
+
+// Rough memory overheads in bytes. The packed length of a msg is
+// used as the size of its record data.
+const (
+	itemOverhead = 256
+	rrOverhead   = 96
+)
+
+// Cost implements cache.Coster. It returns the estimated memory size
+// of v in bytes.
+func (v *item) Cost() int {
+	if v.resp == nil {
+		c := itemOverhead
+		for _, s := range v.subnets {
+			c += s.item.Cost()
+		}
+		return c
+	}
+	r := v.resp
+	return itemOverhead + r.Len() + rrOverhead*(len(r.Question)+len(r.Answer)+len(r.Ns)+len(r.Extra))
 }
 
 func copyNoOpt(m *dns.Msg) *dns.Msg {
@@ -129,14 +160,11 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
-// getRespFromCache returns the cached response from cache.
+// getRespFromItem returns the cached response in v. v may be nil.
 // The ttl of returned msg will be changed properly.
 // Returned bool indicates whether this response is hit by lazy cache.
 // Note: Caller SHOULD change the msg id because it's not same as query's.
-func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
-	// Lookup cache
-	v, _, _ := backend.Get(key(msgKey))
-
+func getRespFromItem(v *item, lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
 	// Cache hit
 	if v != nil {
 		now := time.Now()
@@ -161,39 +189,82 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 	return nil, false
 }
 
+// failureKey returns the key of the cached SERVFAIL of msgKey. Failures
+// have their own keys, so they never replace other responses.
+func failureKey(msgKey string) key {
+	return derivedKey(msgKey, failureBit)
+}
+
+// derivedKey returns msgKey with the flag bit set.
+func derivedKey(msgKey string, bit byte) key {
+	b := []byte(msgKey)
+	b[0] |= bit
+	return key(b)
+}
+
+// isNegative reports whether r is a NXDOMAIN or NODATA response.
+func isNegative(r *dns.Msg) bool {
+	return r.Rcode == dns.RcodeNameError || r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0
+}
+
+// negativeTtl returns the ttl of a negative response. It is
+// min(SOA TTL, SOA MINIMUM) and is limited by args. (RFC 2308 5)
+func negativeTtl(r *dns.Msg, args *Args) uint32 {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := max(min(soa.Hdr.Ttl, soa.Minttl), uint32(args.NegativeMinTTL))
+			return min(ttl, uint32(args.NegativeMaxTTL))
+		}
+	}
+	return uint32(max(args.NegativeNoSOATTL, 0))
+}
+
 // saveRespToCache saves r to cache backend. It returns false if r
 // should not be cached and was skipped.
-func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], lazyCacheTtl int) bool {
-	if r.Truncated != false {
+// SERVFAIL is saved with failureKey.
+func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], args *Args) bool {
+	v, cacheExpire, ok := newItem(r, args)
+	if !ok {
 		return false
 	}
+	k := key(msgKey)
+	if r.Rcode == dns.RcodeServerFailure {
+		k = failureKey(msgKey)
+	}
+	backend.Store(k, v, cacheExpire)
+	return true
+}
+
+// newItem returns the cache item of r and its cache expiration time.
+// It returns false if r should not be cached.
+func newItem(r *dns.Msg, args *Args) (*item, time.Time, bool) {
+	if r.Truncated != false {
+		return nil, time.Time{}, false
+	}
 
 	var msgTtl time.Duration
 	var cacheTtl time.Duration
-	switch r.Rcode {
-	case dns.RcodeNameError:
-		msgTtl = time.Second * 30
+	switch {
+	case r.Rcode == dns.RcodeServerFailure:
+		// RFC 9520 3.2
+		msgTtl = time.Duration(max(args.ServfailTTL, 0)) * time.Second
 		cacheTtl = msgTtl
-	case dns.RcodeServerFailure:
-		msgTtl = time.Second * 5
+	case isNegative(r):
+		msgTtl = time.Duration(negativeTtl(r, args)) * time.Second
 		cacheTtl = msgTtl
-	case dns.RcodeSuccess:
-		minTTL := dnsutils.GetMinimalTTL(r)
-		if len(r.Answer) == 0 { // Empty answer. Set ttl between 0~300.
-			const maxEmtpyAnswerTtl = 300
-			msgTtl = time.Duration(min(minTTL, maxEmtpyAnswerTtl)) * time.Second
-			cacheTtl = msgTtl
+	case r.Rcode == dns.RcodeSuccess:
+		msgTtl = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
+		if args.LazyCacheTTL > 0 {
+			cacheTtl = time.Duration(args.LazyCacheTTL) * time.Second
 		} else {
-			msgTtl = time.Duration(minTTL) * time.Second
-			if lazyCacheTtl > 0 {
-				cacheTtl = time.Duration(lazyCacheTtl) * time.Second
-			} else {
-				cacheTtl = msgTtl
-			}
+			cacheTtl = msgTtl
 		}
 	}
 	if msgTtl <= 0 || cacheTtl <= 0 {
-		return false
+		return nil, time.Time{}, false
+	}
+	if args.ServeStale && r.Rcode != dns.RcodeServerFailure {
+		cacheTtl = max(cacheTtl, msgTtl+time.Duration(args.StaleMaxAge)*time.Second)
 	}
 
 	now := time.Now()
@@ -202,6 +273,5 @@ func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item]
 		storedTime:     now,
 		expirationTime: now.Add(msgTtl),
 	}
-	backend.Store(key(msgKey), v, now.Add(cacheTtl))
-	return true
+	return v, now.Add(cacheTtl), true
 }
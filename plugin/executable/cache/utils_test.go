@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_negativeTtl(t *testing.T) {
+	r := require.New(t)
+	args := &Args{NegativeMinTTL: 10, NegativeNoSOATTL: 3}
+	args.init()
+
+	newResp := func(soa string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("a.example.", dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		if len(soa) > 0 {
+			rr, err := dns.NewRR(soa)
+			r.NoError(err)
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+	r.Equal(uint32(300), negativeTtl(newResp("example. 600 IN SOA ns. admin. 1 3600 600 86400 300"), args))
+	r.Equal(uint32(200), negativeTtl(newResp("example. 200 IN SOA ns. admin. 1 3600 600 86400 300"), args))
+	r.Equal(uint32(10), negativeTtl(newResp("example. 1 IN SOA ns. admin. 1 3600 600 86400 300"), args))         // Floor
+	r.Equal(uint32(3600), negativeTtl(newResp("example. 86400 IN SOA ns. admin. 1 3600 600 86400 86400"), args)) // Cap
+	r.Equal(uint32(3), negativeTtl(newResp(""), args))
+
+	// Not cached by default.
+	args = new(Args)
+	args.init()
+	_, _, ok := newItem(newResp(""), args)
+	r.False(ok)
+	noData := newResp("example. 600 IN SOA ns. admin. 1 3600 600 86400 300")
+	noData.Rcode = dns.RcodeSuccess
+	_, cacheExpire, ok := newItem(noData, args)
+	r.True(ok)
+	r.WithinDuration(time.Now().Add(300*time.Second), cacheExpire, time.Second)
+}
+
+func Test_servfailCache(t *testing.T) {
+	r := require.New(t)
+	backend := cache.New[key, *item](cache.Opts{Size: 16})
+	defer backend.Close()
+	c := &Cache{args: new(Args), backend: backend}
+	c.args.init()
+
+	q := new(dns.Msg)
+	q.SetQuestion("a.example.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	msgKey := getMsgKey(q)
+
+	ok := new(dns.Msg)
+	ok.SetReply(q)
+	ok.Answer = append(ok.Answer, &dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}})
+	fail := new(dns.Msg)
+	fail.SetRcode(q, dns.RcodeServerFailure)
+
+	r.True(saveRespToCache(msgKey, fail, backend, c.args))
+	resp, _, _ := c.lookup(msgKey, qCtx)
+	r.Equal(dns.RcodeServerFailure, resp.Rcode)
+
+	// SERVFAIL does not replace the positive response.
+	r.True(saveRespToCache(msgKey, ok, backend, c.args))
+	r.True(saveRespToCache(msgKey, fail, backend, c.args))
+	resp, _, _ = c.lookup(msgKey, qCtx)
+	r.Equal(dns.RcodeSuccess, resp.Rcode)
+
+	c.args.ServfailTTL = -1
+	r.False(saveRespToCache(msgKey, fail, backend, c.args))
+}
+
+func Test_maxMemory(t *testing.T) {
+	r := require.New(t)
+	const maxMemory = 64 * 4096
+	c := newTestCache(t, &Args{Size: 4096, MaxMemory: maxMemory})
+	defer c.Close()
+
+	for i := 0; i < 2048; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("%d.example.", i), dns.TypeTXT)
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{strings.Repeat("a", i%255)},
+		})
+		v, _, ok := newItem(resp, c.args)
+		r.True(ok)
+		r.Greater(v.Cost(), resp.Len())
+		saveRespToCache(getMsgKey(q), resp, c.backend, c.args)
+		r.LessOrEqual(c.backend.Cost(), maxMemory)
+	}
+	r.Greater(c.backend.Cost(), 0)
+	r.Less(c.backend.Len(), 2048)
+}
+
+func Test_maxMemory_small(t *testing.T) {
+	r := require.New(t)
+	save := func(c *Cache, name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4zero,
+		})
+		r.True(saveRespToCache(getMsgKey(q), resp, c.backend, c.args))
+	}
+
+	// Less than one byte per shard is still a limit.
+	c := newTestCache(t, &Args{MaxMemory: 32})
+	defer c.Close()
+	save(c, "a.")
+	r.Equal(0, c.backend.Len())
+	r.LessOrEqual(c.backend.Cost(), 32)
+
+	// The window of a shard is smaller than one item.
+	const maxMemory = 64 * 1024
+	c = newTestCache(t, &Args{MaxMemory: maxMemory})
+	defer c.Close()
+	for i := 0; i < 4096; i++ {
+		save(c, fmt.Sprintf("%d.example.", i))
+		r.LessOrEqual(c.backend.Cost(), maxMemory)
+	}
+	r.Greater(c.backend.Len(), 64)
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// warmupLogInterval is the interval of warmup progress logs.
+var warmupLogInterval = time.Second * 10
+
+type WarmupArgs struct {
+	// Entry is the tag of the executable plugin, usually a sequence,
+	// that resolves the warmup questions. It is the part of the
+	// sequence after this cache. Required if there are Files.
+	Entry string `yaml:"entry"`
+	// Files can be cache dumps (the output of /dump), query_summary
+	// logs or `qname [qtype]` lines. The default qtype is A.
+	Files []string `yaml:"files"`
+	// Concurrency is the maximum number of concurrent queries. Default is 4.
+	Concurrency int `yaml:"concurrency"`
+	// QPS is the maximum queries per second. Default is 100.
+	QPS int `yaml:"qps"`
+}
+
+type warmupQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// loadWarmupQuestions loads the questions in files. Duplicated questions
+// are removed, and the most frequent ones come first.
+func loadWarmupQuestions(files []string) ([]warmupQuestion, error) {
+	count := make(map[warmupQuestion]int)
+	var qs []warmupQuestion
+	add := func(name string, qtype uint16) {
+		q := warmupQuestion{name: dns.CanonicalName(name), qtype: qtype}
+		if count[q] == 0 {
+			qs = append(qs, q)
+		}
+		count[q]++
+	}
+	for _, fp := range files {
+		if err := readWarmupFile(fp, add); err != nil {
+			return nil, fmt.Errorf("failed to read %s, %w", fp, err)
+		}
+	}
+	slices.SortStableFunc(qs, func(a, b warmupQuestion) int {
+		return cmp.Compare(count[b], count[a])
+	})
+	return qs, nil
+}
+
+func readWarmupFile(fp string, add func(name string, qtype uint16)) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b { // gzip, a cache dump.
+		_, err := ReadDump(br, func(entry *CachedEntry) error {
+			m := new(dns.Msg)
+			if err := m.Unpack(entry.GetMsg()); err != nil {
+				return fmt.Errorf("failed to decode dns msg, %w", err)
+			}
+			if len(m.Question) == 1 {
+				add(m.Question[0].Name, m.Question[0].Qtype)
+			}
+			return nil
+		})
+		return err
+	}
+
+	s := bufio.NewScanner(br)
+	for s.Scan() {
+		if name, qtype, ok := parseWarmupLine(s.Text()); ok {
+			add(name, qtype)
+		}
+	}
+	return s.Err()
+}
+
+// parseWarmupLine parses a `qname [qtype]` line or a query_summary log line.
+// ok is false if the line is empty, a comment or invalid.
+func parseWarmupLine(l string) (name string, qtype uint16, ok bool) {
+	l = strings.TrimSpace(l)
+	if len(l) == 0 || l[0] == '#' {
+		return "", 0, false
+	}
+
+	// A log line. The log fields are in a json object.
+	if i := strings.IndexByte(l, '{'); i >= 0 {
+		var v struct {
+			Qname string `json:"qname"`
+			Qtype uint16 `json:"qtype"`
+		}
+		if err := json.Unmarshal([]byte(l[i:]), &v); err != nil || len(v.Qname) == 0 {
+			return "", 0, false
+		}
+		name, qtype = v.Qname, v.Qtype
+	} else {
+		fs := strings.Fields(l)
+		name, qtype = fs[0], dns.TypeA
+		if len(fs) > 1 {
+			t, err := parseQtype(fs[1])
+			if err != nil {
+				return "", 0, false
+			}
+			qtype = t
+		}
+	}
+	if _, ok := dns.IsDomainName(name); !ok || qtype == 0 {
+		return "", 0, false
+	}
+	return dns.Fqdn(name), qtype, true
+}
+
+// startWarmup replays the questions in warmup files through entry
+// in the background.
+func (c *Cache) startWarmup(entry sequence.Executable) {
+	go c.warmup(entry)
+}
+
+func (c *Cache) warmup(entry sequence.Executable) {
+	args := c.args.Warmup
+	start := time.Now()
+	qs, err := loadWarmupQuestions(args.Files)
+	if err != nil {
+		c.logger.Error("failed to load warmup files", zap.Error(err))
+		return
+	}
+	c.logger.Info("cache warmup started", zap.Int("questions", len(qs)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closeNotify:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	limiter := rate.NewLimiter(rate.Limit(args.QPS), 1)
+	sem := make(chan struct{}, args.Concurrency)
+	wg := new(sync.WaitGroup)
+	lastLog := start
+	for i, q := range qs {
+		if err := limiter.Wait(ctx); err != nil {
+			break // Closed.
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.warmupQuery(ctx, q, entry)
+		}()
+		if time.Since(lastLog) >= warmupLogInterval {
+			lastLog = time.Now()
+			c.logger.Info("cache warmup in progress", zap.Int("done", i+1), zap.Int("questions", len(qs)))
+		}
+	}
+	wg.Wait()
+	c.logger.Info("cache warmup finished", zap.Int("questions", len(qs)), zap.Duration("elapsed", time.Since(start)))
+}
+
+// warmupQuery resolves wq and saves the response to the partition
+// that the query selects.
+func (c *Cache) warmupQuery(ctx context.Context, wq warmupQuestion, entry sequence.Executable) {
+	q := new(dns.Msg)
+	q.SetQuestion(wq.name, wq.qtype)
+	qCtx := query_context.NewContext(q)
+	msgKey := getMsgKey(q)
+	if _, err := c.selectPartition(ctx, qCtx); err != nil {
+		c.warmupFailedTotal.Inc()
+		c.logger.Debug("warmup query failed", qCtx.InfoField(), zap.Error(err))
+		return
+	}
+	if v, _, _ := c.lookupItem(msgKey, qCtx); v != nil && time.Now().Before(v.expirationTime) {
+		c.warmupSkippedTotal.Inc()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultLazyUpdateTimeout)
+	defer cancel()
+	err := entry.Exec(ctx, qCtx)
+	if err != nil || qCtx.R() == nil {
+		c.warmupFailedTotal.Inc()
+		c.logger.Debug("warmup query failed", qCtx.InfoField(), zap.Error(err))
+		return
+	}
+	c.save(msgKey, qCtx)
+	c.warmupQueryTotal.Inc()
+}
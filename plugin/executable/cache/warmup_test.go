@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/qtype"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWarmupLine(t *testing.T) {
+	tests := []struct {
+		l     string
+		name  string
+		qtype uint16
+		ok    bool
+	}{
+		{"example.com", "example.com.", dns.TypeA, true},
+		{" example.com.  AAAA ", "example.com.", dns.TypeAAAA, true},
+		{"example.com 65", "example.com.", dns.TypeHTTPS, true},
+		{"example.com BAD", "", 0, false},
+		{"# comment", "", 0, false},
+		{"", "", 0, false},
+		{`2024-01-01T00:00:00.000Z	INFO	query_summary	query summary	{"uqid": 1, "qname": "a.com.", "qtype": 28, "qclass": 1}`, "a.com.", dns.TypeAAAA, true},
+		{`{"level":"info","msg":"query summary","qname":"b.com.","qtype":1}`, "b.com.", dns.TypeA, true},
+		{`{"level":"info","msg":"other"}`, "", 0, false},
+	}
+	for _, tt := range tests {
+		name, qtype, ok := parseWarmupLine(tt.l)
+		require.Equal(t, tt.ok, ok, tt.l)
+		require.Equal(t, tt.name, name, tt.l)
+		require.Equal(t, tt.qtype, qtype, tt.l)
+	}
+}
+
+func Test_cachePlugin_Warmup(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	up := &countingUpstream{ttl: 300}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: up}}, nil)
+	exec := func(c *Cache, name string, qtype uint16) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		r.NoError(c.Exec(context.Background(), query_context.NewContext(q), next))
+	}
+
+	// A dump of d. and e.
+	c0 := newTestCache(t, &Args{})
+	exec(c0, "d.", dns.TypeA)
+	exec(c0, "e.", dns.TypeA)
+	dump := new(bytes.Buffer)
+	_, err := c0.writeDump(dump)
+	r.NoError(err)
+	c0.Close()
+	dumpFile := filepath.Join(dir, "dump")
+	r.NoError(os.WriteFile(dumpFile, dump.Bytes(), 0644))
+
+	listFile := filepath.Join(dir, "list")
+	r.NoError(os.WriteFile(listFile, []byte("# comment\na.\nb. AAAA\na.\n"+
+		`{"level":"info","msg":"query summary","qname":"c.","qtype":1}`+"\n"), 0644))
+
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"up": up})
+	args := &Args{
+		Warmup:     WarmupArgs{Entry: "up", Files: []string{listFile, dumpFile}, QPS: 1000},
+		Partitions: []PartitionArgs{{Name: "aaaa", Matches: []string{"qtype 28"}}},
+	}
+	_, err = Init(coremain.NewBP("cache_missing_entry", m), &Args{Warmup: WarmupArgs{Entry: "none", Files: args.Warmup.Files}})
+	r.Error(err)
+	v, err := Init(coremain.NewBP("cache", m), args) // Starts the warmup.
+	r.NoError(err)
+	c := v.(*Cache)
+	defer c.Close()
+
+	counter := func() (done, skipped int) {
+		m := new(dto.Metric)
+		r.NoError(c.warmupQueryTotal.Write(m))
+		done = int(m.GetCounter().GetValue())
+		r.NoError(c.warmupSkippedTotal.Write(m))
+		skipped = int(m.GetCounter().GetValue())
+		return
+	}
+	r.Eventually(func() bool {
+		done, skipped := counter()
+		return done+skipped == 5
+	}, time.Second, time.Millisecond*10)
+
+	// The dump cache and the warmup queries.
+	n := up.n.Load()
+	done, _ := counter()
+	r.Equal(5, done)
+	r.Equal(int32(2+5), n)
+	r.Equal(1, c.partitions[0].backend.Len(), "b. AAAA should be in its partition")
+	r.Equal(4, c.backend.Len())
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"a.", dns.TypeA}, {"b.", dns.TypeAAAA}, {"c.", dns.TypeA}, {"d.", dns.TypeA}, {"e.", dns.TypeA}} {
+		exec(c, q.name, q.qtype)
+	}
+	r.Equal(n, up.n.Load(), "warmed up queries should hit the cache")
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package conditional_forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	fastforward "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	base "github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_domain"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "conditional_forward"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*ConditionalForward)(nil)
+
+type Args struct {
+	// Groups are upstream groups. Each group has the same args as forward.
+	Groups map[string]*fastforward.Args `yaml:"groups"`
+	Rules  []Rule                       `yaml:"rules"`
+
+	// Default is the group for queries that match no rule. If it is empty,
+	// those queries are passed through without a response.
+	Default string `yaml:"default"`
+}
+
+// Rule routes the domains to the group. Full matches go first, then the
+// longest domain match, then regexp and keyword matches in rule order.
+// If the same full or domain expression is in multiple rules, the last
+// rule is used.
+type Rule struct {
+	// Domains format: "exp" | "$domain_set_tag" | "&domain_list_file".
+	Domains []string `yaml:"domains"`
+	Group   string   `yaml:"group"`
+}
+
+type ConditionalForward struct {
+	logger   *zap.Logger
+	rules    []Rule
+	sets     map[string]*domain_set.DomainSet
+	groups   map[string]sequence.Executable
+	closers  []io.Closer
+	defGroup sequence.Executable // May be nil.
+
+	matcher atomic.Pointer[ruleMatcher]
+}
+
+type group struct {
+	name string
+	e    sequence.Executable
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	cf, err := NewConditionalForward(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(cf.Api())
+	return cf, nil
+}
+
+func NewConditionalForward(bp *coremain.BP, args *Args) (*ConditionalForward, error) {
+	cf := &ConditionalForward{
+		logger: bp.L(),
+		rules:  args.Rules,
+		sets:   make(map[string]*domain_set.DomainSet),
+		groups: make(map[string]sequence.Executable),
+	}
+
+	reg := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())
+	for name, ga := range args.Groups {
+		if ga == nil {
+			_ = cf.Close()
+			return nil, fmt.Errorf("group %s is empty", name)
+		}
+		f, err := fastforward.NewForward(ga, fastforward.Opts{Logger: bp.L(), MetricsTag: bp.Tag() + "/" + name})
+		if err != nil {
+			_ = cf.Close()
+			return nil, fmt.Errorf("failed to init group %s, %w", name, err)
+		}
+		cf.closers = append(cf.closers, f)
+		if err := f.RegisterMetricsTo(reg); err != nil {
+			_ = cf.Close()
+			return nil, fmt.Errorf("failed to register metrics of group %s, %w", name, err)
+		}
+		cf.groups[name] = f
+	}
+
+	for i, r := range args.Rules {
+		for _, tag := range base.ParseQuickSetupArgs(strings.Join(r.Domains, " ")).DomainSets {
+			ds, _ := bp.M().GetPlugin(tag).(*domain_set.DomainSet)
+			if ds == nil {
+				_ = cf.Close()
+				return nil, fmt.Errorf("rule #%d, cannot find domain_set %s", i, tag)
+			}
+			cf.sets[tag] = ds
+		}
+	}
+
+	if err := cf.init(args.Default); err != nil {
+		_ = cf.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// init checks group names and loads the rules.
+func (cf *ConditionalForward) init(defGroup string) error {
+	if len(defGroup) > 0 {
+		cf.defGroup = cf.groups[defGroup]
+		if cf.defGroup == nil {
+			return fmt.Errorf("cannot find default group %s", defGroup)
+		}
+	}
+	for i, r := range cf.rules {
+		if cf.groups[r.Group] == nil {
+			return fmt.Errorf("rule #%d, cannot find group %s", i, r.Group)
+		}
+	}
+	return cf.Reload()
+}
+
+// Reload loads the rules again. Domain list files and domain sets are
+// read again.
+func (cf *ConditionalForward) Reload() error {
+	rm := &ruleMatcher{
+		full:   domain.NewFullMatcher[*group](),
+		domain: domain.NewSubDomainMatcher[*group](),
+	}
+	for i, r := range cf.rules {
+		g := &group{name: r.Group, e: cf.groups[r.Group]}
+		m := rm.newRule()
+		args := base.ParseQuickSetupArgs(strings.Join(r.Domains, " "))
+		exps := args.Exps
+		for _, tag := range args.DomainSets {
+			setExps, err := cf.sets[tag].Exps()
+			if err != nil {
+				return fmt.Errorf("rule #%d, failed to load domain_set %s, %w", i, tag, err)
+			}
+			exps = append(exps, setExps...)
+		}
+		for _, exp := range exps {
+			if err := m.Add(exp, g); err != nil {
+				return fmt.Errorf("rule #%d, failed to load expression %s, %w", i, exp, err)
+			}
+		}
+		for _, f := range args.Files {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("rule #%d, failed to read file %s, %w", i, f, err)
+			}
+			err = domain.LoadFromTextReader[*group](m, bytes.NewReader(b), func(s string) (string, *group, error) {
+				return s, g, nil
+			})
+			if err != nil {
+				return fmt.Errorf("rule #%d, failed to load file %s, %w", i, f, err)
+			}
+		}
+	}
+	cf.matcher.Store(rm)
+	return nil
+}
+
+// ruleMatcher matches domains in the precedence of Rule.
+type ruleMatcher struct {
+	full    *domain.FullMatcher[*group]
+	domain  *domain.SubDomainMatcher[*group]
+	regKeys []*domain.MixMatcher[*group] // Regexp and keyword matches of each rule.
+}
+
+func (m *ruleMatcher) Match(s string) (*group, bool) {
+	if g, ok := m.full.Match(s); ok {
+		return g, true
+	}
+	if g, ok := m.domain.Match(s); ok {
+		return g, true
+	}
+	for _, rk := range m.regKeys {
+		if g, ok := rk.Match(s); ok {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// newRule returns a domain.WriteableMatcher that adds expressions of
+// the next rule to m.
+func (m *ruleMatcher) newRule() *ruleWriter {
+	rk := domain.NewMixMatcher[*group]()
+	m.regKeys = append(m.regKeys, rk)
+	return &ruleWriter{m: m, regKey: rk}
+}
+
+type ruleWriter struct {
+	m      *ruleMatcher
+	regKey *domain.MixMatcher[*group]
+}
+
+func (w *ruleWriter) Match(s string) (*group, bool) {
+	return w.m.Match(s)
+}
+
+func (w *ruleWriter) Add(exp string, g *group) error {
+	typ, pattern, ok := strings.Cut(exp, ":")
+	if !ok {
+		typ, pattern = domain.MatcherDomain, exp
+	}
+	switch typ {
+	case domain.MatcherFull:
+		return w.m.full.Add(pattern, g)
+	case domain.MatcherDomain:
+		return w.m.domain.Add(pattern, g)
+	default:
+		return w.regKey.Add(exp, g)
+	}
+}
+
+// match returns the group for qname. It returns nil if there is no group.
+func (cf *ConditionalForward) match(qname string) *group {
+	if g, ok := cf.matcher.Load().Match(qname); ok {
+		return g
+	}
+	return nil
+}
+
+func (cf *ConditionalForward) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	e := cf.defGroup
+	if g := cf.match(qCtx.QQuestion().Name); g != nil {
+		e = g.e
+	}
+	if e == nil {
+		return nil
+	}
+	return e.Exec(ctx, qCtx)
+}
+
+func (cf *ConditionalForward) Close() error {
+	for _, c := range cf.closers {
+		_ = c.Close()
+	}
+	return nil
+}
+
+func (cf *ConditionalForward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := cf.Reload(); err != nil {
+			cf.logger.Warn("failed to reload rules", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cf.logger.Info("rules reloaded")
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Get("/match", func(w http.ResponseWriter, req *http.Request) {
+		qname := req.URL.Query().Get("qname")
+		if len(qname) == 0 {
+			http.Error(w, "missing qname", http.StatusBadRequest)
+			return
+		}
+		if g := cf.match(qname); g != nil {
+			_, _ = io.WriteString(w, g.name)
+		}
+	})
+	return r
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package conditional_forward
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type namedGroup string
+
+func (g namedGroup) Exec(_ context.Context, qCtx *query_context.Context) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{string(g)},
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_ConditionalForward(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	listFile := filepath.Join(dir, "list.txt")
+	r.NoError(os.WriteFile(listFile, []byte("# comment\nfile.com\nfull:full.b.com\n"), 0644))
+	setFile := filepath.Join(dir, "set.txt")
+	r.NoError(os.WriteFile(setFile, []byte("set.com\n"), 0644))
+	ds, err := domain_set.NewDomainSet(nil, &domain_set.Args{Exps: []string{"keyword:kw"}, Files: []string{setFile}})
+	r.NoError(err)
+
+	cf := &ConditionalForward{
+		logger: zap.NewNop(),
+		rules: []Rule{
+			{Domains: []string{"a.com", "&" + listFile}, Group: "a"},
+			{Domains: []string{"b.com", "$set"}, Group: "b"},
+			{Domains: []string{"sub.a.com"}, Group: "c"},
+			{Domains: []string{"regexp:^kw", "keyword:zz"}, Group: "c"},
+		},
+		sets: map[string]*domain_set.DomainSet{"set": ds},
+		groups: map[string]sequence.Executable{
+			"a": namedGroup("a"), "b": namedGroup("b"), "c": namedGroup("c"), "d": namedGroup("d"),
+		},
+	}
+	r.NoError(cf.init("d"))
+
+	exec := func(name string) string {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		r.NoError(cf.Exec(context.Background(), qCtx))
+		return qCtx.R().Answer[0].(*dns.TXT).Txt[0]
+	}
+	tests := map[string]string{
+		"a.com.":         "a",
+		"x.a.com.":       "a",
+		"sub.a.com.":     "c", // Longest suffix.
+		"x.SUB.a.com.":   "c",
+		"file.com.":      "a",
+		"b.com.":         "b",
+		"full.b.com.":    "a", // Full match goes first.
+		"x.full.b.com.":  "b",
+		"set.com.":       "b",
+		"kw.example.":    "b", // The first rule that has a regexp or keyword match.
+		"zz.kw.example.": "b",
+		"zz.example.":    "c",
+		"zz.a.com.":      "a", // Domain matches go before keywords.
+		"other.example.": "d",
+	}
+	for i := 0; i < 10; i++ { // The precedence is deterministic.
+		for name, want := range tests {
+			r.Equal(want, exec(name), name)
+		}
+	}
+
+	// Reload
+	r.NoError(os.WriteFile(setFile, []byte("set2.com\n"), 0644))
+	r.NoError(cf.Reload())
+	r.Equal("d", exec("set.com."))
+	r.Equal("b", exec("set2.com."))
+
+	// Rules reference unknown groups.
+	cf.rules = append(cf.rules, Rule{Domains: []string{"x.com"}, Group: "x"})
+	r.Error(cf.init(""))
+	r.Error(cf.init("x"))
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/miekg/dns"
+)
+
+const (
+	maxChainDepth = 64
+	minCacheTTL   = 5
+	maxCacheTTL   = 86400
+	bogusTTL      = 60
+	fetchErrTTL   = 5
+)
+
+var seed = maphash.MakeSeed()
+
+type key string
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+// fetchFunc fetches DNSSEC material. Returned msg rcode is either
+// NOERROR or NXDOMAIN.
+type fetchFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// status is a validation result.
+type status struct {
+	secure bool
+	keys   []*dns.DNSKEY // Validated zone keys. Only for zones.
+	err    *dnssec.Error // Not nil if bogus.
+}
+
+var insecure = &status{}
+
+func bogus(err error) *status {
+	if e, ok := err.(*dnssec.Error); ok {
+		return &status{err: e}
+	}
+	return &status{err: &dnssec.Error{Code: dns.ExtendedErrorCodeDNSBogus, Msg: err.Error()}}
+}
+
+func bogusf(code uint16, format string, a ...any) *status {
+	return &status{err: &dnssec.Error{Code: code, Msg: fmt.Sprintf(format, a...)}}
+}
+
+func (s *status) isBogus() bool {
+	return s.err != nil
+}
+
+func clampTTL(ttl uint32) time.Duration {
+	return time.Duration(min(max(ttl, minCacheTTL), maxCacheTTL)) * time.Second
+}
+
+func minTTL(rrs ...[]dns.RR) uint32 {
+	ttl := uint32(maxCacheTTL)
+	for _, s := range rrs {
+		for _, rr := range s {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	}
+	return ttl
+}
+
+func isStrictSubDomain(parent, child string) bool {
+	return dns.CanonicalName(parent) != dns.CanonicalName(child) && dns.IsSubDomain(parent, child)
+}
+
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// findSet returns the first set of name and t.
+func findSet(sets []*dnssec.RRSet, name string, t uint16) *dnssec.RRSet {
+	for _, s := range sets {
+		if s.Type == t && s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// zoneKeys returns the status of zone and its validated keys if it is secure.
+func (v *Validator) zoneKeys(ctx context.Context, f fetchFunc, zone string, depth int) *status {
+	zone = dns.CanonicalName(zone)
+	if depth > maxChainDepth {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "chain of trust is too long")
+	}
+	if s, _, ok := v.zones.Get(key(zone)); ok {
+		return s
+	}
+	res, _, _ := v.sf.Do("k"+zone, func() (any, error) {
+		s, ttl := v.buildZoneKeys(ctx, f, zone, depth)
+		v.zones.Store(key(zone), s, v.now().Add(ttl))
+		return s, nil
+	})
+	return res.(*status)
+}
+
+func (v *Validator) buildZoneKeys(ctx context.Context, f fetchFunc, zone string, depth int) (*status, time.Duration) {
+	now := v.now()
+	anchor, ok := v.anchors.Closest(zone)
+	if !ok {
+		return insecure, maxCacheTTL * time.Second
+	}
+
+	verifyKeys := func(trusted []*dns.DNSKEY) (*status, uint32) {
+		resp, err := f(ctx, zone, dns.TypeDNSKEY)
+		if err != nil {
+			return bogusf(dns.ExtendedErrorCodeDNSKEYMissing, "failed to fetch dnskey of %s, %s", zone, err), fetchErrTTL
+		}
+		set := findSet(dnssec.SplitRRSets(resp.Answer), zone, dns.TypeDNSKEY)
+		if set == nil {
+			return bogusf(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey for %s", zone), bogusTTL
+		}
+		var keys []*dns.DNSKEY
+		var sig *dns.RRSIG
+		if trusted == nil {
+			keys, sig, err = v.anchors.VerifyDNSKEYs(set, now)
+		} else {
+			keys, sig, err = dnssec.VerifyDNSKEYs(set, trusted, now)
+		}
+		if err != nil {
+			return bogus(err), bogusTTL
+		}
+		return &status{secure: true, keys: keys}, dnssec.SigTTL(set, sig, now)
+	}
+
+	if zone == anchor {
+		s, ttl := verifyKeys(nil)
+		return s, clampTTL(ttl)
+	}
+
+	resp, err := f(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "failed to fetch ds of %s, %s", zone, err), fetchErrTTL * time.Second
+	}
+	dsSet := findSet(dnssec.SplitRRSets(resp.Answer), zone, dns.TypeDS)
+	if dsSet == nil {
+		s := v.denyDS(ctx, f, zone, resp, depth)
+		if s.isBogus() {
+			return s, bogusTTL * time.Second
+		}
+		if s.secure {
+			return bogusf(dns.ExtendedErrorCodeDNSBogus, "%s is not a zone", zone), bogusTTL * time.Second
+		}
+		return s, clampTTL(minTTL(resp.Ns))
+	}
+	if len(dsSet.Sigs) == 0 {
+		// The zone of the parent is not signed. Make sure it is insecure.
+		ps := v.nameStatus(ctx, f, parentName(zone), depth+1)
+		if ps.secure {
+			return bogusf(dns.ExtendedErrorCodeRRSIGsMissing, "ds of %s is not signed", zone), bogusTTL * time.Second
+		}
+		return ps, clampTTL(dsSet.TTL())
+	}
+
+	ps := v.signerKeys(ctx, f, zone, dsSet, depth)
+	if !ps.secure {
+		return ps, clampTTL(dsSet.TTL())
+	}
+	sig, err := dnssec.VerifyRRSet(dsSet, ps.keys, now)
+	if err != nil {
+		return bogus(err), bogusTTL * time.Second
+	}
+	var dss []*dns.DS
+	for _, rr := range dsSet.RRs {
+		dss = append(dss, rr.(*dns.DS))
+	}
+	if !dnssec.HasSupportedDS(dss) {
+		return insecure, clampTTL(dsSet.TTL())
+	}
+	dsTTL := dnssec.SigTTL(dsSet, sig, now)
+
+	resp, err = f(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return bogusf(dns.ExtendedErrorCodeDNSKEYMissing, "failed to fetch dnskey of %s, %s", zone, err), fetchErrTTL * time.Second
+	}
+	set := findSet(dnssec.SplitRRSets(resp.Answer), zone, dns.TypeDNSKEY)
+	if set == nil {
+		return bogusf(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey for %s", zone), bogusTTL * time.Second
+	}
+	keys, sig, err := dnssec.VerifyDNSKEYs(set, dnssec.MatchDS(set.RRs, dss), now)
+	if err != nil {
+		return bogus(err), bogusTTL * time.Second
+	}
+	return &status{secure: true, keys: keys}, clampTTL(min(dsTTL, dnssec.SigTTL(set, sig, now)))
+}
+
+// signerKeys returns the keys of the signer of set. The signer must be a
+// strict ancestor of name.
+func (v *Validator) signerKeys(ctx context.Context, f fetchFunc, name string, set *dnssec.RRSet, depth int) *status {
+	if len(set.Sigs) == 0 {
+		return bogusf(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s is not signed", set.Name, dns.TypeToString[set.Type])
+	}
+	signer := dns.CanonicalName(set.Sigs[0].SignerName)
+	if !isStrictSubDomain(signer, name) {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "invalid signer %s for %s %s", signer, set.Name, dns.TypeToString[set.Type])
+	}
+	return v.zoneKeys(ctx, f, signer, depth+1)
+}
+
+// denyDS checks a response without DS for name. It returns insecure if
+// name is an insecure delegation, secure if name is not a delegation.
+func (v *Validator) denyDS(ctx context.Context, f fetchFunc, name string, resp *dns.Msg, depth int) *status {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	signed := false
+	for _, set := range dnssec.SplitRRSets(resp.Ns) {
+		if len(set.Sigs) == 0 {
+			continue
+		}
+		signed = true
+		ps := v.signerKeys(ctx, f, name, set, depth)
+		if !ps.secure {
+			return ps
+		}
+		if _, err := dnssec.VerifyRRSet(set, ps.keys, v.now()); err != nil {
+			return bogus(err)
+		}
+		n1, n3 := dnssec.DenialRecords(set.RRs)
+		nsecs, nsec3s = append(nsecs, n1...), append(nsec3s, n3...)
+	}
+	if !signed {
+		// The zone of the parent is not signed. Make sure it is insecure.
+		ps := v.nameStatus(ctx, f, parentName(name), depth+1)
+		if ps.secure {
+			return bogusf(dns.ExtendedErrorCodeRRSIGsMissing, "ds denial of %s is not signed", name)
+		}
+		return ps
+	}
+	if dnssec.NSEC3IterationsTooHigh(nsec3s) || dnssec.ProveInsecureDelegation(name, nsecs, nsec3s) {
+		return insecure
+	}
+	if resp.Rcode == dns.RcodeSuccess && dnssec.ProveNoData(name, dns.TypeDS, nsecs, nsec3s) {
+		return &status{secure: true}
+	}
+	if resp.Rcode == dns.RcodeNameError && dnssec.ProveNXDomain(name, nsecs, nsec3s) {
+		return &status{secure: true}
+	}
+	return bogusf(dns.ExtendedErrorCodeNSECMissing, "no ds denial proof for %s", name)
+}
+
+// nameStatus returns the status of the zone that unsigned data of name
+// belongs to. Unsigned data is bogus if the status is secure.
+func (v *Validator) nameStatus(ctx context.Context, f fetchFunc, name string, depth int) *status {
+	name = dns.CanonicalName(name)
+	if depth > maxChainDepth {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "chain of trust is too long")
+	}
+	anchor, ok := v.anchors.Closest(name)
+	if !ok {
+		return insecure
+	}
+	if name == anchor {
+		return v.zoneKeys(ctx, f, name, depth+1)
+	}
+	if s, _, ok := v.names.Get(key(name)); ok {
+		return s
+	}
+	res, _, _ := v.sf.Do("n"+name, func() (any, error) {
+		s, ttl := v.buildNameStatus(ctx, f, name, depth)
+		v.names.Store(key(name), s, v.now().Add(ttl))
+		return s, nil
+	})
+	return res.(*status)
+}
+
+func (v *Validator) buildNameStatus(ctx context.Context, f fetchFunc, name string, depth int) (*status, time.Duration) {
+	resp, err := f(ctx, name, dns.TypeDS)
+	if err != nil {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "failed to fetch ds of %s, %s", name, err), fetchErrTTL * time.Second
+	}
+	ttl := clampTTL(minTTL(resp.Answer, resp.Ns))
+	dsSet := findSet(dnssec.SplitRRSets(resp.Answer), name, dns.TypeDS)
+	if dsSet == nil {
+		s := v.denyDS(ctx, f, name, resp, depth)
+		if s.isBogus() {
+			ttl = bogusTTL * time.Second
+		}
+		return s, ttl
+	}
+	if len(dsSet.Sigs) == 0 {
+		ps := v.nameStatus(ctx, f, parentName(name), depth+1)
+		if ps.secure {
+			return bogusf(dns.ExtendedErrorCodeRRSIGsMissing, "ds of %s is not signed", name), bogusTTL * time.Second
+		}
+		return ps, ttl
+	}
+	// A signed delegation. Data of name must be signed by the child,
+	// unless the child uses unsupported algorithms.
+	s := v.zoneKeys(ctx, f, name, depth+1)
+	if s.isBogus() {
+		return s, bogusTTL * time.Second
+	}
+	return s, ttl
+}
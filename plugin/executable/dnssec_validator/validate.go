@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/miekg/dns"
+)
+
+type wildcardAnswer struct {
+	name string
+	ce   string
+}
+
+// validate validates r. The status is secure, insecure or bogus.
+// Verified records are collected into out.
+func (v *Validator) validate(ctx context.Context, f fetchFunc, question dns.Question, r *dns.Msg, out *dnssec.Validated) *status {
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return insecure // Nothing to validate.
+	}
+
+	now := v.now()
+	res := &status{secure: true}
+
+	// Answer section.
+	var wildcards []wildcardAnswer
+	for _, set := range dnssec.SplitRRSets(r.Answer) {
+		if len(set.Sigs) == 0 && synthesizedCNAME(set, r.Answer) {
+			continue // Its DNAME is validated.
+		}
+		if len(set.Sigs) == 0 {
+			s := v.nameStatus(ctx, f, set.Name, 0)
+			if s.isBogus() {
+				return s
+			}
+			if s.secure {
+				return bogusf(dns.ExtendedErrorCodeRRSIGsMissing, "no rrsig for %s %s", set.Name, dns.TypeToString[set.Type])
+			}
+			res = insecure
+			continue
+		}
+		zs := v.setKeys(ctx, f, set)
+		if zs.isBogus() {
+			return zs
+		}
+		if !zs.secure {
+			res = insecure
+			continue
+		}
+		sig, err := dnssec.VerifyRRSet(set, zs.keys, now)
+		if err != nil {
+			return bogus(err)
+		}
+		if ce, ok := dnssec.IsWildcardExpansion(sig); ok {
+			wildcards = append(wildcards, wildcardAnswer{name: set.Name, ce: ce})
+			set.Sigs = []*dns.RRSIG{sig}
+			out.Wildcards = append(out.Wildcards, set)
+		}
+	}
+
+	// Authority section. Only validated denial records are used.
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	authSigned, authInsecure := false, false
+	for _, set := range dnssec.SplitRRSets(r.Ns) {
+		if len(set.Sigs) == 0 {
+			continue // e.g. Unsigned NS.
+		}
+		authSigned = true
+		zs := v.setKeys(ctx, f, set)
+		if zs.isBogus() {
+			return zs
+		}
+		if !zs.secure {
+			authInsecure = true
+			continue
+		}
+		sig, err := dnssec.VerifyRRSet(set, zs.keys, now)
+		if err != nil {
+			return bogus(err)
+		}
+		set.Sigs = []*dns.RRSIG{sig}
+		switch set.Type {
+		case dns.TypeSOA:
+			out.SOA = set
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			out.Denial = append(out.Denial, set)
+		}
+		n1, n3 := dnssec.DenialRecords(set.RRs)
+		nsecs, nsec3s = append(nsecs, n1...), append(nsec3s, n3...)
+	}
+	if dnssec.NSEC3IterationsTooHigh(nsec3s) {
+		return insecure
+	}
+
+	for _, w := range wildcards {
+		if !dnssec.ProveWildcardAnswer(w.name, w.ce, nsecs, nsec3s) {
+			if dnssec.NSEC3OptOut(w.name, nsec3s) {
+				res = insecure
+				continue
+			}
+			return bogusf(dns.ExtendedErrorCodeNSECMissing, "no proof for wildcard answer %s", w.name)
+		}
+	}
+
+	// Negative response.
+	target, answered := chainTarget(r.Answer, question.Name, question.Qtype)
+	if answered {
+		return res
+	}
+	if !res.secure {
+		return res // The cname chain leads to an insecure zone.
+	}
+	if !authSigned || authInsecure {
+		s := v.nameStatus(ctx, f, target, 0)
+		if s.isBogus() {
+			return s
+		}
+		if s.secure {
+			return bogusf(dns.ExtendedErrorCodeNSECMissing, "no denial proof for %s", target)
+		}
+		return insecure
+	}
+	var proved bool
+	if r.Rcode == dns.RcodeNameError {
+		proved = dnssec.ProveNXDomain(target, nsecs, nsec3s)
+	} else {
+		proved = dnssec.ProveNoData(target, question.Qtype, nsecs, nsec3s)
+	}
+	if !proved {
+		if dnssec.NSEC3OptOut(target, nsec3s) {
+			return insecure
+		}
+		return bogusf(dns.ExtendedErrorCodeNSECMissing, "no denial proof for %s", target)
+	}
+	return res
+}
+
+// setKeys returns the keys of the signer of set.
+func (v *Validator) setKeys(ctx context.Context, f fetchFunc, set *dnssec.RRSet) *status {
+	signer := dns.CanonicalName(set.Sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.Name) {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "invalid signer %s for %s %s", signer, set.Name, dns.TypeToString[set.Type])
+	}
+	if set.Type == dns.TypeDS && signer == set.Name {
+		return bogusf(dns.ExtendedErrorCodeDNSBogus, "ds of %s is signed by itself", set.Name)
+	}
+	return v.zoneKeys(ctx, f, signer, 0)
+}
+
+// synthesizedCNAME reports whether set is a cname synthesized from
+// a DNAME in answer. (RFC 6672 5.3.1)
+func synthesizedCNAME(set *dnssec.RRSet, answer []dns.RR) bool {
+	if set.Type != dns.TypeCNAME || len(set.RRs) != 1 {
+		return false
+	}
+	target := dns.CanonicalName(set.RRs[0].(*dns.CNAME).Target)
+	for _, rr := range answer {
+		d, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(d.Hdr.Name)
+		if isStrictSubDomain(owner, set.Name) &&
+			set.Name[:len(set.Name)-len(owner)]+dns.CanonicalName(d.Target) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// chainTarget follows the cname chain from name in answer. It returns the
+// last name and whether there are records of qtype for it.
+func chainTarget(answer []dns.RR, name string, qtype uint16) (string, bool) {
+	name = dns.CanonicalName(name)
+	for i := 0; i <= len(answer); i++ {
+		next := ""
+		for _, rr := range answer {
+			h := rr.Header()
+			if dns.CanonicalName(h.Name) != name {
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				return name, true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+		if len(next) == 0 {
+			return name, false
+		}
+		name = next
+	}
+	return name, false
+}
@@ -0,0 +1,345 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	base "github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_domain"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const PluginType = "dnssec_validator"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*Validator)(nil)
+
+// fetchKey marks the queries sent by the validator itself.
+var fetchKey = query_context.RegKey()
+
+type Args struct {
+	// Fetcher is the tag of a sequence or forward that fetches DNSKEY and DS
+	// records. Default is the rest of the current sequence.
+	Fetcher string `yaml:"fetcher"`
+
+	TrustAnchors     []string `yaml:"trust_anchors"`      // DS or DNSKEY records. Default is the root KSK.
+	TrustAnchorFile  string   `yaml:"trust_anchor_file"`  // Zone file of DS or DNSKEY records.
+	TrustAnchorState string   `yaml:"trust_anchor_state"` // File that stores RFC 5011 key states.
+
+	// NegativeTrustAnchors are domains that will not be validated. (RFC 7646)
+	// Format: "domain" | "$domain_set_tag" | "&domain_list_file".
+	NegativeTrustAnchors []string `yaml:"negative_trust_anchors"`
+
+	CacheSize int `yaml:"cache_size"` // Chain cache size. Default is 16384.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultUnsignNum(&a.CacheSize, 16*1024)
+}
+
+// Validator validates responses with DNSSEC.
+type Validator struct {
+	logger  *zap.Logger
+	fetcher sequence.Executable // May be nil.
+	anchors *dnssec.TrustAnchors
+	nta     domain.Matcher[struct{}] // May be nil.
+
+	zones *cache.Cache[key, *status] // Zone keys.
+	names *cache.Cache[key, *status] // Status of unsigned names.
+	sf    singleflight.Group
+	now   func() time.Time
+
+	secureTotal   prometheus.Counter
+	insecureTotal prometheus.Counter
+	bogusTotal    prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	v, err := NewValidator(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	if err := v.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
+		_ = v.Close()
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	bp.RegAPI(v.Api())
+	return v, nil
+}
+
+func NewValidator(bp *coremain.BP, args *Args) (*Validator, error) {
+	args.init()
+
+	var fetcher sequence.Executable
+	if len(args.Fetcher) > 0 {
+		fetcher = sequence.ToExecutable(bp.M().GetPlugin(args.Fetcher))
+		if fetcher == nil {
+			return nil, fmt.Errorf("can not find fetcher %s", args.Fetcher)
+		}
+	}
+
+	rrs := args.TrustAnchors
+	if len(args.TrustAnchorFile) > 0 {
+		f, err := os.Open(args.TrustAnchorFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trust anchor file, %w", err)
+		}
+		fileRRs, err := dnssec.ReadTrustAnchors(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trust anchor file, %w", err)
+		}
+		rrs = append(rrs, fileRRs...)
+	}
+	if len(rrs) == 0 {
+		rrs = dnssec.RootAnchors
+	}
+	anchors, err := dnssec.NewTrustAnchors(rrs, dnssec.TrustAnchorsOpts{StateFile: args.TrustAnchorState})
+	if err != nil {
+		return nil, err
+	}
+
+	nta, err := newNTAMatcher(bp, args.NegativeTrustAnchors)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load negative trust anchors, %w", err)
+	}
+
+	return newValidator(bp.L(), bp.Tag(), fetcher, anchors, nta, args.CacheSize), nil
+}
+
+func newValidator(logger *zap.Logger, tag string, fetcher sequence.Executable, anchors *dnssec.TrustAnchors, nta domain.Matcher[struct{}], size int) *Validator {
+	lb := map[string]string{"tag": tag}
+	return &Validator{
+		logger:  logger,
+		fetcher: fetcher,
+		anchors: anchors,
+		nta:     nta,
+		zones:   cache.New[key, *status](cache.Opts{Size: size}),
+		names:   cache.New[key, *status](cache.Opts{Size: size}),
+		now:     time.Now,
+
+		secureTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "secure_total",
+			Help:        "The total number of secure responses",
+			ConstLabels: lb,
+		}),
+		insecureTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "insecure_total",
+			Help:        "The total number of insecure responses",
+			ConstLabels: lb,
+		}),
+		bogusTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "bogus_total",
+			Help:        "The total number of bogus responses",
+			ConstLabels: lb,
+		}),
+	}
+}
+
+func newNTAMatcher(bp *coremain.BP, exps []string) (domain.Matcher[struct{}], error) {
+	if len(exps) == 0 {
+		return nil, nil
+	}
+	args := base.ParseQuickSetupArgs(strings.Join(exps, " "))
+	var mg domain_set.MatcherGroup
+	for _, tag := range args.DomainSets {
+		p, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if p == nil {
+			return nil, fmt.Errorf("cannot find domain set %s", tag)
+		}
+		mg = append(mg, p.GetDomainMatcher())
+	}
+	if len(args.Exps)+len(args.Files) > 0 {
+		m := domain.NewDomainMixMatcher()
+		if err := domain_set.LoadExpsAndFiles(args.Exps, args.Files, m); err != nil {
+			return nil, err
+		}
+		mg = append(mg, m)
+	}
+	return mg, nil
+}
+
+func (v *Validator) RegMetricsTo(r prometheus.Registerer) error {
+	for _, collector := range [...]prometheus.Collector{v.secureTotal, v.insecureTotal, v.bogusTotal} {
+		if err := r.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *Validator) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if _, ok := qCtx.GetValue(fetchKey); ok {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	q := qCtx.Q()
+	question := qCtx.QQuestion()
+	if v.nta != nil {
+		if _, ok := v.nta.Match(question.Name); ok {
+			if err := next.ExecNext(ctx, qCtx); err != nil {
+				return err
+			}
+			if r := qCtx.R(); r != nil {
+				r.AuthenticatedData = false
+			}
+			return nil
+		}
+	}
+
+	clientOpt := qCtx.ClientOpt()
+	clientDO := clientOpt != nil && clientOpt.Do()
+	qCtx.QOpt().SetDo()
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	if q.CheckingDisabled {
+		// Client will validate the response itself.
+		if !clientDO {
+			stripDNSSEC(r, question.Qtype)
+		}
+		return nil
+	}
+
+	f := func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		return v.fetch(ctx, next, name, qtype)
+	}
+	validated := new(dnssec.Validated)
+	s := v.validate(ctx, f, question, r, validated)
+	switch {
+	case s.isBogus():
+		v.bogusTotal.Inc()
+		v.logger.Debug("bogus response", qCtx.InfoField(), zap.String("reason", s.err.Msg))
+		m := new(dns.Msg)
+		m.SetRcode(q, dns.RcodeServerFailure)
+		qCtx.SetResponse(m)
+		if opt := qCtx.RespOpt(); opt != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: s.err.Code, ExtraText: s.err.Msg})
+		}
+		return nil
+	case s.secure:
+		v.secureTotal.Inc()
+		qCtx.StoreValue(dnssec.ValidatedKey, validated)
+		// RFC 6840 5.8
+		r.AuthenticatedData = clientDO || q.AuthenticatedData
+	default:
+		v.insecureTotal.Inc()
+		r.AuthenticatedData = false
+	}
+	if !clientDO {
+		stripDNSSEC(r, question.Qtype)
+	}
+	return nil
+}
+
+// fetch sends a query with DO and CD bits through the fetcher or next.
+func (v *Validator) fetch(ctx context.Context, next sequence.ChainWalker, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.CheckingDisabled = true
+	qCtx := query_context.NewContext(q)
+	qCtx.QOpt().SetDo()
+	qCtx.StoreValue(fetchKey, struct{}{})
+
+	var err error
+	if v.fetcher != nil {
+		err = v.fetcher.Exec(ctx, qCtx)
+	} else {
+		err = next.ExecNext(ctx, qCtx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil, errors.New("no response")
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("rcode %s", dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// stripDNSSEC removes DNSSEC records that were not asked. (RFC 4035 3.2.1)
+func stripDNSSEC(r *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	r.Answer = strip(r.Answer)
+	r.Ns = strip(r.Ns)
+	r.Extra = strip(r.Extra)
+}
+
+func (v *Validator) Close() error {
+	_ = v.zones.Close()
+	_ = v.names.Close()
+	return nil
+}
+
+// Api returns the trust anchor key states and flushes the chain cache.
+func (v *Validator) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/trust_anchors", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v.anchors.States())
+	})
+	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
+		v.zones.Flush()
+		v.names.Flush()
+	})
+	return r
+}
@@ -0,0 +1,410 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"crypto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer // nil if the zone is unsigned.
+
+	sets  map[string][]dns.RR // "name type" -> rrs
+	sigs  map[string]*dns.RRSIG
+	nsecs []*dns.NSEC
+}
+
+func setKey(name string, t uint16) string {
+	return dns.CanonicalName(name) + " " + dns.TypeToString[t]
+}
+
+func newTestZone(t testing.TB, name string, signed bool, records ...string) *testZone {
+	z := &testZone{name: name, sets: make(map[string][]dns.RR), sigs: make(map[string]*dns.RRSIG)}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		require.NoError(t, err)
+		z.priv = priv.(crypto.Signer)
+		z.add(z.key)
+	}
+	records = append(records, "@ SOA ns. admin. 1 3600 600 86400 60", "@ NS ns.")
+	for _, s := range records {
+		rr, err := dns.NewRR("$ORIGIN " + name + "\n$TTL 300\n" + s)
+		require.NoError(t, err)
+		z.add(rr)
+	}
+	return z
+}
+
+func (z *testZone) add(rr dns.RR) {
+	k := setKey(rr.Header().Name, rr.Header().Rrtype)
+	z.sets[k] = append(z.sets[k], rr)
+}
+
+// sign builds the nsec chain and signs all sets.
+func (z *testZone) sign(t testing.TB) {
+	if z.priv == nil {
+		return
+	}
+	types := make(map[string][]uint16)
+	for _, rrs := range z.sets {
+		h := rrs[0].Header()
+		name := dns.CanonicalName(h.Name)
+		types[name] = append(types[name], h.Rrtype)
+	}
+	var names []string
+	for n := range types {
+		names = append(names, n)
+	}
+	slices.SortFunc(names, dnssec.CanonicalCompare)
+	for i, n := range names {
+		bitmap := append(types[n], dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(bitmap)
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: n, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap,
+		}
+		z.nsecs = append(z.nsecs, nsec)
+		z.add(nsec)
+	}
+
+	now := time.Now()
+	for k, rrs := range z.sets {
+		h := rrs[0].Header()
+		if h.Rrtype == dns.TypeNS && h.Name != z.name {
+			continue // Delegation NS is not signed.
+		}
+		sig := &dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+			TypeCovered: h.Rrtype,
+			Algorithm:   z.key.Algorithm,
+			Labels:      uint8(dns.CountLabel(h.Name)),
+			OrigTtl:     h.Ttl,
+			Expiration:  uint32(now.Add(time.Hour).Unix()),
+			Inception:   uint32(now.Add(-time.Hour).Unix()),
+			KeyTag:      z.key.KeyTag(),
+			SignerName:  z.name,
+		}
+		if strings.HasPrefix(h.Name, "*.") {
+			sig.Labels--
+		}
+		if strings.HasPrefix(h.Name, "expired.") {
+			sig.Expiration = uint32(now.Add(-time.Minute).Unix())
+		}
+		require.NoError(t, sig.Sign(z.priv, rrs))
+		z.sigs[k] = sig
+	}
+}
+
+func (z *testZone) withSig(name string, t uint16) []dns.RR {
+	k := setKey(name, t)
+	rrs := slices.Clone(z.sets[k])
+	if sig := z.sigs[k]; sig != nil {
+		rrs = append(rrs, sig)
+	}
+	return rrs
+}
+
+func (z *testZone) exist(name string) bool {
+	for _, rrs := range z.sets {
+		if dns.IsSubDomain(name, rrs[0].Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *testZone) nsecAt(name string, cover bool) []dns.RR {
+	for _, n := range z.nsecs {
+		if (cover && dnssec.NSECCovers(n, name)) || (!cover && n.Hdr.Name == name) {
+			return z.withSig(n.Hdr.Name, dns.TypeNSEC)
+		}
+	}
+	return nil
+}
+
+// testResolver answers queries from signed zones, like a resolver with CD bit.
+type testResolver struct {
+	zones  []*testZone
+	mutate func(m *dns.Msg)
+
+	m       sync.Mutex
+	queries map[string]int
+}
+
+func (tr *testResolver) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	tr.m.Lock()
+	tr.queries[setKey(question.Name, question.Qtype)]++
+	tr.m.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	tr.answer(r, dns.CanonicalName(question.Name), question.Qtype)
+	if tr.mutate != nil {
+		tr.mutate(r)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (tr *testResolver) zoneOf(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range tr.zones {
+		if !dns.IsSubDomain(z.name, name) || (qtype == dns.TypeDS && z.name == name && name != ".") {
+			continue
+		}
+		if best == nil || len(z.name) > len(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (tr *testResolver) answer(r *dns.Msg, name string, qtype uint16) {
+	z := tr.zoneOf(name, qtype)
+	if rrs := z.withSig(name, qtype); len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		return
+	}
+	if rrs := z.withSig(name, dns.TypeCNAME); len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		tr.answer(r, dns.CanonicalName(rrs[0].(*dns.CNAME).Target), qtype)
+		return
+	}
+	soa := z.withSig(z.name, dns.TypeSOA)
+	if z.exist(name) {
+		r.Ns = append(r.Ns, soa...)
+		if nsec := z.nsecAt(name, false); nsec != nil {
+			r.Ns = append(r.Ns, nsec...)
+		} else {
+			r.Ns = append(r.Ns, z.nsecAt(name, true)...) // Empty non-terminal.
+		}
+		return
+	}
+	ce := name
+	for !z.exist(ce) {
+		ce = parentName(ce)
+	}
+	wc := "*." + ce
+	if rrs := z.withSig(wc, qtype); len(rrs) > 0 {
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			r.Answer = append(r.Answer, rr)
+		}
+		r.Ns = append(r.Ns, z.nsecAt(name, true)...)
+		return
+	}
+	r.Rcode = dns.RcodeNameError
+	r.Ns = append(r.Ns, soa...)
+	r.Ns = append(r.Ns, z.nsecAt(name, true)...)
+	r.Ns = append(r.Ns, z.nsecAt(wc, true)...)
+}
+
+func newTestHierarchy(t testing.TB) (*testResolver, *dnssec.TrustAnchors) {
+	example := newTestZone(t, "example.com.", true,
+		"www A 1.2.3.4",
+		"*.wild A 5.6.7.8",
+		"alias CNAME www",
+		"bad A 1.1.1.1",
+		"expired A 2.2.2.2",
+		"nosig A 3.3.3.3",
+	)
+	insecure := newTestZone(t, "insecure.com.", false, "www A 9.9.9.9")
+	com := newTestZone(t, "com.", true,
+		"example NS ns.",
+		example.key.ToDS(dns.SHA256).String(),
+		"insecure NS ns.",
+	)
+	root := newTestZone(t, ".", true,
+		"com. NS ns.",
+		com.key.ToDS(dns.SHA256).String(),
+	)
+	for _, z := range []*testZone{example, com, root} {
+		z.sign(t)
+	}
+	// Tampered after signing.
+	example.sets[setKey("bad.example.com.", dns.TypeA)][0].(*dns.A).A[3] = 2
+	delete(example.sigs, setKey("nosig.example.com.", dns.TypeA))
+
+	ta, err := dnssec.NewTrustAnchors([]string{root.key.ToDS(dns.SHA256).String()}, dnssec.TrustAnchorsOpts{})
+	require.NoError(t, err)
+	return &testResolver{zones: []*testZone{root, com, example, insecure}, queries: make(map[string]int)}, ta
+}
+
+func Test_Validator(t *testing.T) {
+	tr, ta := newTestHierarchy(t)
+	v := newValidator(zap.NewNop(), "", nil, ta, nil, 1024)
+	defer v.Close()
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: tr}}, nil)
+
+	type result struct {
+		rcode int
+		ad    bool
+		ede   uint16
+		qCtx  *query_context.Context
+	}
+	exec := func(v *Validator, name string, qtype uint16, do, ad, cd bool) result {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		q.SetEdns0(1232, do)
+		q.AuthenticatedData = ad
+		q.CheckingDisabled = cd
+		qCtx := query_context.NewContext(q)
+		require.NoError(t, v.Exec(context.Background(), qCtx, next))
+		r := qCtx.R()
+		res := result{rcode: r.Rcode, ad: r.AuthenticatedData, qCtx: qCtx}
+		for _, o := range qCtx.RespOpt().Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				res.ede = ede.InfoCode
+			}
+		}
+		return res
+	}
+	hasSig := func(res result) bool {
+		for _, rr := range append(res.qCtx.R().Answer, res.qCtx.R().Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ad    bool
+		ede   uint16
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, true, 0},
+		{"WWW.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, 0}, // nodata
+		{"nx.example.com.", dns.TypeA, dns.RcodeNameError, true, 0},
+		{"a.wild.example.com.", dns.TypeA, dns.RcodeSuccess, true, 0},
+		{"alias.example.com.", dns.TypeA, dns.RcodeSuccess, true, 0},
+		{"example.com.", dns.TypeDS, dns.RcodeSuccess, true, 0},
+		{"www.insecure.com.", dns.TypeA, dns.RcodeSuccess, false, 0},
+		{"nx.insecure.com.", dns.TypeA, dns.RcodeNameError, false, 0},
+		{"bad.example.com.", dns.TypeA, dns.RcodeServerFailure, false, dns.ExtendedErrorCodeDNSBogus},
+		{"expired.example.com.", dns.TypeA, dns.RcodeServerFailure, false, dns.ExtendedErrorCodeSignatureExpired},
+		{"nosig.example.com.", dns.TypeA, dns.RcodeServerFailure, false, dns.ExtendedErrorCodeRRSIGsMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			res := exec(v, tt.name, tt.qtype, true, false, false)
+			require.Equal(t, tt.rcode, res.rcode)
+			require.Equal(t, tt.ad, res.ad)
+			require.Equal(t, tt.ede, res.ede)
+		})
+	}
+
+	r := require.New(t)
+	// RFC 6840 5.8 and RFC 4035 3.2.1.
+	res := exec(v, "www.example.com.", dns.TypeA, false, false, false)
+	r.False(res.ad)
+	r.False(hasSig(res))
+	res = exec(v, "www.example.com.", dns.TypeA, false, true, false)
+	r.True(res.ad)
+	r.True(exec(v, "www.example.com.", dns.TypeA, true, false, false).ad)
+	r.True(hasSig(exec(v, "www.example.com.", dns.TypeA, true, false, false)))
+
+	// Verified records for caches.
+	res = exec(v, "nx.example.com.", dns.TypeA, false, false, false)
+	val, ok := res.qCtx.GetValue(dnssec.ValidatedKey)
+	r.True(ok)
+	r.NotNil(val.(*dnssec.Validated).SOA)
+	r.Len(val.(*dnssec.Validated).Denial, 2)
+	res = exec(v, "a.wild.example.com.", dns.TypeA, true, false, false)
+	val, _ = res.qCtx.GetValue(dnssec.ValidatedKey)
+	r.Len(val.(*dnssec.Validated).Wildcards, 1)
+	r.Len(val.(*dnssec.Validated).Denial, 1)
+	_, ok = exec(v, "www.insecure.com.", dns.TypeA, true, false, false).qCtx.GetValue(dnssec.ValidatedKey)
+	r.False(ok)
+
+	// Checking disabled.
+	res = exec(v, "bad.example.com.", dns.TypeA, true, false, true)
+	r.Equal(dns.RcodeSuccess, res.rcode)
+
+	// Chain material is cached.
+	r.Equal(1, tr.queries[setKey("example.com.", dns.TypeDNSKEY)])
+	r.Equal(1, tr.queries[setKey(".", dns.TypeDNSKEY)])
+
+	// Stripped denial.
+	tr.mutate = func(m *dns.Msg) {
+		if m.Question[0].Name == "nx2.example.com." {
+			m.Ns = slices.DeleteFunc(m.Ns, func(rr dns.RR) bool {
+				return rr.Header().Rrtype == dns.TypeNSEC
+			})
+		}
+	}
+	res = exec(v, "nx2.example.com.", dns.TypeA, true, false, false)
+	r.Equal(dns.RcodeServerFailure, res.rcode)
+	r.Equal(dns.ExtendedErrorCodeNSECMissing, res.ede)
+
+	// Unsigned ds of a zone under a secure parent.
+	tr.mutate = func(m *dns.Msg) {
+		if m.Question[0].Qtype == dns.TypeDS {
+			m.Answer = slices.DeleteFunc(m.Answer, func(rr dns.RR) bool {
+				return rr.Header().Rrtype == dns.TypeRRSIG
+			})
+		}
+	}
+	v2 := newValidator(zap.NewNop(), "", nil, ta, nil, 1024)
+	defer v2.Close()
+	res = exec(v2, "www.example.com.", dns.TypeA, true, false, false)
+	r.Equal(dns.RcodeServerFailure, res.rcode)
+	r.Equal(dns.ExtendedErrorCodeRRSIGsMissing, res.ede)
+	tr.mutate = nil
+
+	// Negative trust anchor.
+	m := domain.NewDomainMixMatcher()
+	r.NoError(domain_set.LoadExps([]string{"example.com"}, m))
+	v = newValidator(zap.NewNop(), "", nil, ta, m, 1024)
+	defer v.Close()
+	res = exec(v, "bad.example.com.", dns.TypeA, true, false, false)
+	r.Equal(dns.RcodeSuccess, res.rcode)
+	r.False(res.ad)
+}
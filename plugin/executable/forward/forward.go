@@ -21,7 +21,6 @@ package fastforward
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand/v2"
@@ -56,11 +55,15 @@ type Args struct {
 	Concurrent int              `yaml:"concurrent"`
 
 	// Global options.
-	Socks5       string `yaml:"socks5"`
-	SoMark       int    `yaml:"so_mark"`
-	BindToDevice string `yaml:"bind_to_device"`
-	Bootstrap    string `yaml:"bootstrap"`
-	BootstrapVer int    `yaml:"bootstrap_version"`
+	Socks5         string   `yaml:"socks5"`
+	HTTPProxy      string   `yaml:"http_proxy"` // Not used by udp, quic and http3 upstreams.
+	SoMark         int      `yaml:"so_mark"`
+	BindToDevice   string   `yaml:"bind_to_device"`
+	Bootstrap      []string `yaml:"bootstrap"` // A single string is also accepted.
+	BootstrapVer   int      `yaml:"bootstrap_version"`
+	BootstrapCache string   `yaml:"bootstrap_cache"` // File to persist last-known bootstrap addrs.
+	LocalAddr      []string `yaml:"local_addr"`      // Source addresses, rotated per connection. A single string is also accepted.
+	LocalPrefix    string   `yaml:"local_prefix"`    // Source address prefix. e.g. 2001:db8::/64.
 }
 
 type UpstreamConfig struct {
@@ -76,11 +79,46 @@ type UpstreamConfig struct {
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
-	Socks5       string `yaml:"socks5"`
-	SoMark       int    `yaml:"so_mark"`
-	BindToDevice string `yaml:"bind_to_device"`
-	Bootstrap    string `yaml:"bootstrap"`
-	BootstrapVer int    `yaml:"bootstrap_version"`
+	// TCP/DoT options.
+	PipelineMode          string `yaml:"pipeline_mode"`           // auto (default), pipeline or reuse.
+	PipelineMaxConcurrent int    `yaml:"pipeline_max_concurrent"` // Default is 64.
+
+	// Limits. Queries prefer upstreams that are within their limits.
+	// If all upstreams hit the limits, queries queue on them in turn
+	// and wait at most the longest QueueTimeout of the upstreams in total.
+	MaxInflight  int     `yaml:"max_inflight"`  // Maximum concurrent queries.
+	QPS          float64 `yaml:"qps"`           // Maximum queries per second.
+	Burst        int     `yaml:"burst"`         // Default is the ceil of qps.
+	QueueTimeout int     `yaml:"queue_timeout"` // In milliseconds. Default is 0, no queuing.
+
+	// UDP options.
+	Enable0x20             bool `yaml:"enable_0x20"`
+	SkipQuestionValidation bool `yaml:"skip_question_validation"`
+
+	// TLS options. Available for DoT, DoH, DoQ and ODoH (relay) upstream.
+	CAFile     string   `yaml:"ca_file"`     // PEM CA bundle. Replaces system roots.
+	SPKIPins   []string `yaml:"spki_pins"`   // base64 sha256 digests of SubjectPublicKeyInfo.
+	ServerName string   `yaml:"server_name"` // SNI and verified name. Default is the addr host.
+	ClientCert string   `yaml:"client_cert"` // PEM cert for mutual TLS.
+	ClientKey  string   `yaml:"client_key"`  // PEM key for mutual TLS.
+
+	// DoH options.
+	Method  string            `yaml:"method"`  // GET (default) or POST.
+	Headers map[string]string `yaml:"headers"` // Extra http headers.
+	Format  string            `yaml:"format"`  // wire (default) or json.
+
+	// ODoH options.
+	Relay string `yaml:"relay"` // Oblivious relay url. Required by odoh upstream.
+
+	Socks5         string   `yaml:"socks5"`
+	HTTPProxy      string   `yaml:"http_proxy"`
+	SoMark         int      `yaml:"so_mark"`
+	BindToDevice   string   `yaml:"bind_to_device"`
+	Bootstrap      []string `yaml:"bootstrap"` // A single string is also accepted.
+	BootstrapVer   int      `yaml:"bootstrap_version"`
+	BootstrapCache string   `yaml:"bootstrap_cache"` // File to persist last-known bootstrap addrs.
+	LocalAddr      []string `yaml:"local_addr"`      // Source addresses, rotated per connection. A single string is also accepted.
+	LocalPrefix    string   `yaml:"local_prefix"`    // Source address prefix. e.g. 2001:db8::/64.
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -128,11 +166,30 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 	}
 
 	applyGlobal := func(c *UpstreamConfig) {
-		utils.SetDefaultString(&c.Socks5, args.Socks5)
+		// Upstream proxy overwrites global proxies. Only one of them can be set.
+		// The global http proxy is not used by udp based upstreams.
+		if len(c.Socks5) == 0 && len(c.HTTPProxy) == 0 {
+			c.Socks5 = args.Socks5
+			if len(args.HTTPProxy) > 0 {
+				if upstream.SupportsHTTPProxy(c.Addr, c.EnableHTTP3) {
+					c.HTTPProxy = args.HTTPProxy
+				} else {
+					opt.Logger.Warn("global http proxy does not support udp based protocols, upstream connects directly", zap.String("upstream", c.Addr))
+				}
+			}
+		}
 		utils.SetDefaultUnsignNum(&c.SoMark, args.SoMark)
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
-		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
+		if len(c.Bootstrap) == 0 {
+			c.Bootstrap = args.Bootstrap
+		}
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
+		utils.SetDefaultString(&c.BootstrapCache, args.BootstrapCache)
+		// Upstream source addresses overwrite global ones.
+		if len(c.LocalAddr) == 0 && len(c.LocalPrefix) == 0 {
+			c.LocalAddr = args.LocalAddr
+			c.LocalPrefix = args.LocalPrefix
+		}
 	}
 
 	for i, c := range args.Upstreams {
@@ -141,23 +198,42 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 		applyGlobal(&c)
 
+		localAddr, localPrefix, err := parseLocalAddr(c.LocalAddr, c.LocalPrefix)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream invalid args, %w", i, err)
+		}
 		uw := newWrapper(i, c, opt.MetricsTag)
+		tlsConfig, err := newTLSConfig(c, uw)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to init upstream #%d tls config: %w", i, err)
+		}
 		uOpt := upstream.Opt{
-			DialAddr:       c.DialAddr,
-			Socks5:         c.Socks5,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			EnablePipeline: c.EnablePipeline,
-			EnableHTTP3:    c.EnableHTTP3,
-			Bootstrap:      c.Bootstrap,
-			BootstrapVer:   c.BootstrapVer,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				ClientSessionCache: tls.NewLRUClientSessionCache(4),
-			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+			DialAddr:               c.DialAddr,
+			Socks5:                 c.Socks5,
+			HTTPProxy:              c.HTTPProxy,
+			SoMark:                 c.SoMark,
+			BindToDevice:           c.BindToDevice,
+			IdleTimeout:            time.Duration(c.IdleTimeout) * time.Second,
+			EnablePipeline:         c.EnablePipeline,
+			PipelineMode:           c.PipelineMode,
+			PipelineMaxConcurrent:  c.PipelineMaxConcurrent,
+			EnableHTTP3:            c.EnableHTTP3,
+			Enable0x20:             c.Enable0x20,
+			SkipQuestionValidation: c.SkipQuestionValidation,
+			HTTPMethod:             c.Method,
+			HTTPHeader:             toHTTPHeader(c.Headers),
+			DoHFormat:              c.Format,
+			ODoHRelay:              c.Relay,
+			Bootstrap:              c.Bootstrap,
+			BootstrapVer:           c.BootstrapVer,
+			BootstrapCacheFile:     c.BootstrapCache,
+			LocalAddr:              localAddr,
+			LocalPrefix:            localPrefix,
+			TLSConfig:              tlsConfig,
+			Logger:                 opt.Logger,
+			EventObserver:          uw,
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, uOpt)
@@ -262,18 +338,41 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	done := make(chan struct{})
 	defer close(done)
 
+	// One deadline for queuing on throttled upstreams, so a query never
+	// waits more than the longest queue_timeout.
+	var maxQueueTimeout time.Duration
+	for _, u := range us {
+		maxQueueTimeout = max(maxQueueTimeout, u.queueTimeout)
+	}
+	queueDeadline := time.Now().Add(maxQueueTimeout)
+
 	r := rand.IntN(len(us))
 	for i := 0; i < concurrent; i++ {
-		u := us[(r+i)%len(us)]
 		qc := copyPayload(queryPayload)
-		go func(uqid uint32, question dns.Question) {
+		go func(i int, uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
 			// Give each upstream a fixed timeout to finish the query.
 			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
 			defer cancel()
 
+			u, release := pickUpstream(upstreamCtx, us, r+i, queueDeadline)
+			if u == nil {
+				err := errAllThrottled
+				f.logger.Warn(
+					"upstream error",
+					zap.Uint32("uqid", uqid),
+					zap.String("qname", question.Name),
+					zap.Error(err),
+				)
+				select {
+				case resChan <- res{err: err}:
+				case <-done:
+				}
+				return
+			}
 			var r *dns.Msg
 			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
+			release()
 			if err != nil {
 				f.logger.Warn(
 					"upstream error",
@@ -296,7 +395,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			case resChan <- res{r: r, err: err}:
 			case <-done:
 			}
-		}(qCtx.Id(), qCtx.QQuestion())
+		}(i, qCtx.Id(), qCtx.QQuestion())
 	}
 
 	for i := 0; i < concurrent; i++ {
@@ -319,6 +418,28 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	return nil, errors.New("all upstream servers failed")
 }
 
+var errAllThrottled = errors.New("all upstreams are throttled")
+
+// pickUpstream returns the first upstream, starting from us[start], that
+// is not throttled. Upstreams that are free now are picked before queuing
+// on any of them, and queuing stops at deadline. It returns a nil u if all
+// upstreams are throttled.
+func pickUpstream(ctx context.Context, us []*upstreamWrapper, start int, deadline time.Time) (u *upstreamWrapper, release func()) {
+	for k := range us {
+		u := us[(start+k)%len(us)]
+		if release, ok := u.tryAcquire(); ok {
+			return u, release
+		}
+	}
+	for k := range us {
+		u := us[(start+k)%len(us)]
+		if release, ok := u.acquire(ctx, deadline); ok {
+			return u, release
+		}
+	}
+	return nil, nil
+}
+
 func quickSetup(bq sequence.BQ, s string) (any, error) {
 	args := new(Args)
 	args.Concurrent = maxConcurrentQueries
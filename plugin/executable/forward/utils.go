@@ -21,13 +21,21 @@ package fastforward
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 )
 
 type upstreamWrapper struct {
@@ -41,6 +49,14 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	tlsPinMismatch prometheus.Counter
+	respMismatch   prometheus.Counter
+	pipelineMode   prometheus.Gauge
+	throttled      prometheus.Counter
+
+	throttle     *rate_limiter.Throttle // nil if no limit
+	queueTimeout time.Duration
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -49,6 +65,12 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 		uw.connOpened.Inc()
 	case upstream.EventConnClose:
 		uw.connClosed.Inc()
+	case upstream.EventRespMismatch:
+		uw.respMismatch.Inc()
+	case upstream.EventReuseDetected:
+		uw.pipelineMode.Set(1)
+	case upstream.EventPipelineDetected:
+		uw.pipelineMode.Set(2)
 	}
 }
 
@@ -56,8 +78,14 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 // Note: upstreamWrapper.u still needs to be set.
 func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
+	var throttle *rate_limiter.Throttle
+	if cfg.MaxInflight > 0 || cfg.QPS > 0 {
+		throttle = rate_limiter.NewThrottle(cfg.MaxInflight, rate.Limit(cfg.QPS), cfg.Burst)
+	}
 	return &upstreamWrapper{
-		cfg: cfg,
+		cfg:          cfg,
+		throttle:     throttle,
+		queueTimeout: time.Duration(cfg.QueueTimeout) * time.Millisecond,
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
 			Help:        "The total number of queries processed by this upstream",
@@ -90,6 +118,26 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Help:        "The total number of connections that are closed",
 			ConstLabels: lb,
 		}),
+		tlsPinMismatch: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "tls_pin_mismatch_total",
+			Help:        "The total number of tls handshakes rejected because of spki pin mismatches",
+			ConstLabels: lb,
+		}),
+		respMismatch: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "resp_mismatch_total",
+			Help:        "The total number of udp responses dropped because their questions mismatched the queries",
+			ConstLabels: lb,
+		}),
+		pipelineMode: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "pipeline_mode",
+			Help:        "The detected tcp/dot query mode. 0: not detected, 1: connection reuse, 2: pipelining",
+			ConstLabels: lb,
+		}),
+		throttled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "throttled_total",
+			Help:        "The total number of queries that found this upstream at its max_inflight or qps limits",
+			ConstLabels: lb,
+		}),
 	}
 }
 
@@ -101,6 +149,10 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
+		uw.tlsPinMismatch,
+		uw.respMismatch,
+		uw.pipelineMode,
+		uw.throttled,
 	} {
 		if err := r.Register(collector); err != nil {
 			return err
@@ -118,6 +170,31 @@ func (uw *upstreamWrapper) name() string {
 	return uw.cfg.Addr
 }
 
+// tryAcquire acquires the permission from the upstream limits without
+// waiting. If ok, caller must call release after the query is done.
+// A failure is counted as throttled.
+func (uw *upstreamWrapper) tryAcquire() (release func(), ok bool) {
+	if uw.throttle == nil {
+		return func() {}, true
+	}
+	release, ok = uw.throttle.Acquire(context.Background(), 0)
+	if !ok {
+		uw.throttled.Inc()
+	}
+	return release, ok
+}
+
+// acquire acquires the permission from the upstream limits. It waits
+// at most the queue timeout of the upstream or until deadline.
+// If ok, caller must call release after the query is done.
+// It is called after tryAcquire failed, so failures are not counted again.
+func (uw *upstreamWrapper) acquire(ctx context.Context, deadline time.Time) (release func(), ok bool) {
+	if uw.throttle == nil {
+		return func() {}, true
+	}
+	return uw.throttle.Acquire(ctx, min(uw.queueTimeout, time.Until(deadline)))
+}
+
 func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	uw.queryTotal.Inc()
 
@@ -157,3 +234,71 @@ func copyPayload(b *[]byte) *[]byte {
 	copy(*bc, *b)
 	return bc
 }
+
+func toHTTPHeader(m map[string]string) http.Header {
+	if len(m) == 0 {
+		return nil
+	}
+	h := make(http.Header, len(m))
+	for k, v := range m {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// newTLSConfig builds the tls config of the upstream from c.
+// SPKI pin mismatches will be counted by uw.
+func newTLSConfig(c UpstreamConfig, uw *upstreamWrapper) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	if len(c.CAFile) > 0 {
+		rootCAs, err := utils.LoadCertPool([]string{c.CAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca file, %w", err)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if len(c.ClientCert) > 0 || len(c.ClientKey) > 0 {
+		if len(c.ClientCert) == 0 || len(c.ClientKey) == 0 {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert, %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.SPKIPins) > 0 {
+		verify, err := upstream.NewSPKIPinVerifier(c.SPKIPins, func(*upstream.SPKIPinMismatchError) {
+			uw.tlsPinMismatch.Inc()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid spki pins, %w", err)
+		}
+		tlsConfig.VerifyConnection = verify
+	}
+	return tlsConfig, nil
+}
+
+func parseLocalAddr(addrs []string, prefix string) ([]netip.Addr, netip.Prefix, error) {
+	var out []netip.Addr
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, netip.Prefix{}, fmt.Errorf("invalid local addr %s, %w", s, err)
+		}
+		out = append(out, addr)
+	}
+	var p netip.Prefix
+	if len(prefix) > 0 {
+		var err error
+		p, err = netip.ParsePrefix(prefix)
+		if err != nil {
+			return nil, netip.Prefix{}, fmt.Errorf("invalid local prefix %s, %w", prefix, err)
+		}
+	}
+	return out, p, nil
+}
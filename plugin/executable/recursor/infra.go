@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"cmp"
+	"hash/maphash"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+)
+
+const (
+	unknownRTT = time.Millisecond * 300 // Initial rtt of a server that was never queried.
+	maxRTT     = time.Second * 30
+	rttTTL     = time.Minute * 15
+
+	maxUpstreams       = 4096
+	upstreamCloseDelay = time.Minute
+)
+
+var seed = maphash.MakeSeed()
+
+type nameKey string
+
+func (k nameKey) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+type addrKey netip.Addr
+
+func (k addrKey) Sum() uint64 {
+	b := netip.Addr(k).As16()
+	return maphash.Bytes(seed, b[:])
+}
+
+// delegation is a zone cut and its name servers.
+type delegation struct {
+	zone string
+	ns   []nameServer
+}
+
+type nameServer struct {
+	name  string       // May be empty for root hints.
+	addrs []netip.Addr // Glue. May be empty.
+}
+
+// srtt returns the smoothed rtt of addr.
+func (r *resolver) srtt(addr netip.Addr) time.Duration {
+	v, _, ok := r.rtt.Get(addrKey(addr))
+	if !ok {
+		return unknownRTT
+	}
+	return v
+}
+
+func (r *resolver) updateRTT(addr netip.Addr, d time.Duration) {
+	if v, _, ok := r.rtt.Get(addrKey(addr)); ok {
+		d = (v*7 + d) / 8
+	}
+	r.rtt.Store(addrKey(addr), d, time.Now().Add(rttTTL))
+}
+
+// penalize doubles the srtt of a server that failed to answer.
+// So it will be tried after other servers.
+func (r *resolver) penalize(addr netip.Addr) {
+	d := max(r.srtt(addr)*2, r.opts.Timeout)
+	r.rtt.Store(addrKey(addr), min(d, maxRTT), time.Now().Add(rttTTL))
+}
+
+// sortByRTT sorts addrs by srtt. Servers with the same srtt
+// (e.g. unknown servers) are in random order.
+func (r *resolver) sortByRTT(addrs []netip.Addr) {
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	rtt := make(map[netip.Addr]time.Duration, len(addrs))
+	for _, addr := range addrs {
+		rtt[addr] = r.srtt(addr)
+	}
+	slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+		return cmp.Compare(rtt[a], rtt[b])
+	})
+}
+
+// upstreamPool holds upstreams of name servers.
+type upstreamPool struct {
+	opt upstream.Opt
+
+	m  sync.Mutex
+	us map[netip.AddrPort]upstream.Upstream
+}
+
+func newUpstreamPool(opt upstream.Opt) *upstreamPool {
+	return &upstreamPool{opt: opt, us: make(map[netip.AddrPort]upstream.Upstream)}
+}
+
+func (p *upstreamPool) get(addr netip.AddrPort) (upstream.Upstream, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if u := p.us[addr]; u != nil {
+		return u, nil
+	}
+	if len(p.us) >= maxUpstreams {
+		p.flushLocked()
+	}
+	u, err := upstream.NewUpstream("udp://"+addr.String(), p.opt)
+	if err != nil {
+		return nil, err
+	}
+	p.us[addr] = u
+	return u, nil
+}
+
+// flushLocked removes all upstreams. They are closed after a
+// delay, because they may be still in use.
+func (p *upstreamPool) flushLocked() {
+	old := p.us
+	p.us = make(map[netip.AddrPort]upstream.Upstream)
+	time.AfterFunc(upstreamCloseDelay, func() {
+		for _, u := range old {
+			_ = u.Close()
+		}
+	})
+}
+
+func (p *upstreamPool) close() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, u := range p.us {
+		_ = u.Close()
+	}
+	p.us = make(map[netip.AddrPort]upstream.Upstream)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "recursor"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const queryTimeout = time.Second * 10
+
+var _ sequence.Executable = (*Recursor)(nil)
+
+type Args struct {
+	RootHints           []string `yaml:"root_hints"` // Root server IPs. Default is the IANA root servers.
+	NoIPv6              bool     `yaml:"no_ipv6"`    // Do not query name servers over IPv6.
+	NoQnameMinimisation bool     `yaml:"no_qname_minimisation"`
+	Enable0x20          bool     `yaml:"enable_0x20"`
+	Timeout             int      `yaml:"timeout"`     // Per server query timeout in milliseconds. Default is 1500.
+	MaxDepth            int      `yaml:"max_depth"`   // Maximum nesting level of name server address resolution. Default is 6.
+	MaxCNAME            int      `yaml:"max_cname"`   // Maximum cname chain length. Default is 10.
+	MaxQueries          int      `yaml:"max_queries"` // Maximum upstream queries for one query. Default is 128.
+	CacheSize           int      `yaml:"cache_size"`  // Infrastructure cache size. Default is 16384.
+}
+
+// Recursor resolves queries iteratively from the root servers.
+type Recursor struct {
+	r *resolver
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRecursor(args.(*Args), bp)
+}
+
+func NewRecursor(args *Args, bp *coremain.BP) (*Recursor, error) {
+	hints := args.RootHints
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+	rootHints, err := parseRootHints(hints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root hints, %w", err)
+	}
+	r := newResolver(resolverOpts{
+		RootHints:           rootHints,
+		NoIPv6:              args.NoIPv6,
+		NoQnameMinimisation: args.NoQnameMinimisation,
+		Enable0x20:          args.Enable0x20,
+		Timeout:             time.Duration(args.Timeout) * time.Millisecond,
+		MaxDepth:            args.MaxDepth,
+		MaxCNAME:            args.MaxCNAME,
+		MaxQueries:          args.MaxQueries,
+		CacheSize:           args.CacheSize,
+		Logger:              bp.L(),
+	})
+	return &Recursor{r: r}, nil
+}
+
+func (p *Recursor) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return errors.New("query must have exactly one question")
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNotImplemented)
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	resp, err := p.r.Resolve(ctx, question.Name, question.Qtype)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s, %w", question.Name, err)
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, resp.Rcode)
+	r.RecursionAvailable = true
+	r.Answer = resp.Answer
+	r.Ns = resp.Ns
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (p *Recursor) Close() error {
+	p.r.close()
+	return nil
+}
@@ -0,0 +1,578 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTimeout    = time.Millisecond * 1500
+	defaultMaxDepth   = 6
+	defaultMaxCNAME   = 10
+	defaultMaxQueries = 128
+	defaultCacheSize  = 16 * 1024
+
+	ednsBufSize      = 1232
+	maxServerTries   = 4  // Maximum servers to try for one query.
+	maxMinimiseSteps = 10 // RFC 9156 MAX_MINIMISE_COUNT.
+	minInfraTTL      = 5
+	maxInfraTTL      = 86400
+)
+
+var (
+	errMaxQueries = errors.New("too many queries")
+	errMaxDepth   = errors.New("max depth exceeded")
+	errMaxCNAME   = errors.New("cname chain is too long")
+	errCNAMELoop  = errors.New("cname loop")
+	errNSLoop     = errors.New("name server address loop")
+	errNoServer   = errors.New("no available name server")
+	errBadResp    = errors.New("bad response")
+)
+
+type resolverOpts struct {
+	RootHints           []netip.Addr
+	Port                uint16 // Port of name servers. Default is 53.
+	NoIPv6              bool
+	NoQnameMinimisation bool
+	Enable0x20          bool
+	Timeout             time.Duration // Per server query timeout.
+	MaxDepth            int           // Maximum nesting level of name server address resolution.
+	MaxCNAME            int
+	MaxQueries          int // Maximum queries sent for one resolution.
+	CacheSize           int
+	Logger              *zap.Logger
+}
+
+// resolver is an iterative resolver. It resolves names from the root.
+type resolver struct {
+	opts resolverOpts
+	root *delegation
+
+	zones *cache.Cache[nameKey, *delegation]  // Delegations.
+	addrs *cache.Cache[nameKey, []netip.Addr] // Name server addresses.
+	rtt   *cache.Cache[addrKey, time.Duration]
+	ups   *upstreamPool
+}
+
+func (opts *resolverOpts) init() {
+	utils.SetDefaultNum(&opts.Port, 53)
+	utils.SetDefaultUnsignNum(&opts.Timeout, defaultTimeout)
+	utils.SetDefaultUnsignNum(&opts.MaxDepth, defaultMaxDepth)
+	utils.SetDefaultUnsignNum(&opts.MaxCNAME, defaultMaxCNAME)
+	utils.SetDefaultUnsignNum(&opts.MaxQueries, defaultMaxQueries)
+	utils.SetDefaultUnsignNum(&opts.CacheSize, defaultCacheSize)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+}
+
+func newResolver(opts resolverOpts) *resolver {
+	opts.init()
+	root := &delegation{zone: "."}
+	for _, addr := range opts.RootHints {
+		root.ns = append(root.ns, nameServer{addrs: []netip.Addr{addr}})
+	}
+	co := cache.Opts{Size: opts.CacheSize}
+	return &resolver{
+		opts:  opts,
+		root:  root,
+		zones: cache.New[nameKey, *delegation](co),
+		addrs: cache.New[nameKey, []netip.Addr](co),
+		rtt:   cache.New[addrKey, time.Duration](co),
+		ups:   newUpstreamPool(upstream.Opt{Enable0x20: opts.Enable0x20, Logger: opts.Logger}),
+	}
+}
+
+func (r *resolver) close() {
+	_ = r.zones.Close()
+	_ = r.addrs.Close()
+	_ = r.rtt.Close()
+	r.ups.close()
+}
+
+// state is the state of one resolution. Not safe for concurrent use.
+type state struct {
+	queries   int
+	depth     int
+	resolving map[string]struct{} // Name servers whose addresses are being resolved.
+}
+
+// Resolve resolves name from the root. The returned msg contains the
+// answer (including the cname chain), the authority section and the rcode.
+func (r *resolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	st := &state{resolving: make(map[string]struct{})}
+	return r.resolve(ctx, st, dns.CanonicalName(name), qtype)
+}
+
+func (r *resolver) resolve(ctx context.Context, st *state, name string, qtype uint16) (*dns.Msg, error) {
+	var chain []dns.RR
+	seen := make(map[string]struct{})
+	for i := 0; ; i++ {
+		if i > r.opts.MaxCNAME {
+			return nil, errMaxCNAME
+		}
+		seen[name] = struct{}{}
+		resp, err := r.iterate(ctx, st, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, resp.Answer...)
+		target, done := followAnswer(resp.Answer, name, qtype, seen)
+		if done || target == name || resp.Rcode != dns.RcodeSuccess {
+			resp.Answer = chain
+			return resp, nil
+		}
+		if _, dup := seen[target]; dup {
+			return nil, errCNAMELoop
+		}
+		name = target
+	}
+}
+
+// followAnswer follows the cname chain from name in answer. It returns the
+// last name of the chain and whether answer has the records of qtype for it.
+// Names in the chain are added to seen.
+func followAnswer(answer []dns.RR, name string, qtype uint16, seen map[string]struct{}) (string, bool) {
+	for i := 0; i <= len(answer); i++ {
+		var next string
+		for _, rr := range answer {
+			h := rr.Header()
+			if !equalName(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				return name, true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+		if len(next) == 0 {
+			return name, false
+		}
+		if _, dup := seen[next]; dup {
+			return next, false
+		}
+		seen[name] = struct{}{}
+		name = next
+	}
+	return name, false
+}
+
+// iterate resolves name from the closest known delegation, following referrals.
+// It does not chase cname.
+func (r *resolver) iterate(ctx context.Context, st *state, name string, qtype uint16) (*dns.Msg, error) {
+	d := r.findDelegation(name, qtype)
+	minimise := !r.opts.NoQnameMinimisation
+	known := d.zone // The deepest name that is known to exist in d.zone.
+	steps := 0
+	for {
+		qname, qt := name, qtype
+		if minimise && steps < maxMinimiseSteps {
+			qname = nextName(known, name)
+			if qname != name {
+				// RFC 9156 3: Use A for the minimised queries, because some
+				// servers do not handle NS queries well.
+				qt = dns.TypeA
+			}
+		}
+
+		resp, err := r.queryDelegation(ctx, st, d, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+		if child, ttl := referral(d.zone, qname, qt, resp); child != nil {
+			r.storeDelegation(child, ttl)
+			d = child
+			known = child.zone
+			continue
+		}
+		if qname != name {
+			if resp.Rcode != dns.RcodeSuccess {
+				// Some servers reply NXDOMAIN to empty non-terminals.
+				// Fallback to the full name.
+				minimise = false
+				continue
+			}
+			// No zone cut at qname.
+			known = qname
+			steps++
+			continue
+		}
+		return inBailiwick(resp, d.zone), nil
+	}
+}
+
+// findDelegation returns the closest cached delegation of name.
+func (r *resolver) findDelegation(name string, qtype uint16) *delegation {
+	if qtype == dns.TypeDS && name != "." {
+		// DS is in the parent side of the zone cut.
+		name = parentName(name)
+	}
+	for n := name; ; n = parentName(n) {
+		if d, _, ok := r.zones.Get(nameKey(n)); ok {
+			return d
+		}
+		if n == "." {
+			return r.root
+		}
+	}
+}
+
+func (r *resolver) storeDelegation(d *delegation, ttl uint32) {
+	r.zones.Store(nameKey(d.zone), d, time.Now().Add(time.Duration(clampTTL(ttl))*time.Second))
+}
+
+// referral returns the child delegation if resp is a referral from zone.
+func referral(zone, qname string, qtype uint16, resp *dns.Msg) (*delegation, uint32) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil, 0
+	}
+	child := ""
+	var ttl uint32
+	d := new(delegation)
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if len(child) == 0 {
+			if !isStrictSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+				continue
+			}
+			if qtype == dns.TypeDS && owner == qname {
+				// DS must be answered by the parent.
+				continue
+			}
+			child, ttl = owner, ns.Hdr.Ttl
+		}
+		if owner != child {
+			continue
+		}
+		ttl = min(ttl, ns.Hdr.Ttl)
+		d.ns = append(d.ns, nameServer{name: dns.CanonicalName(ns.Ns)})
+	}
+	if len(child) == 0 {
+		return nil, 0
+	}
+	d.zone = child
+
+	// Glue. Only in-bailiwick records are accepted.
+	for _, rr := range resp.Extra {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !addr.IsValid() || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		for i := range d.ns {
+			if d.ns[i].name == owner {
+				d.ns[i].addrs = append(d.ns[i].addrs, addr)
+			}
+		}
+	}
+	return d, ttl
+}
+
+// isLame reports whether resp is an upward or sideways referral from
+// a server of zone.
+func isLame(zone string, resp *dns.Msg) bool {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 || resp.Authoritative {
+		return false
+	}
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok && !isStrictSubDomain(zone, dns.CanonicalName(ns.Hdr.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inBailiwick removes records that are out of zone from resp.
+func inBailiwick(resp *dns.Msg, zone string) *dns.Msg {
+	filter := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			if dns.IsSubDomain(zone, dns.CanonicalName(rr.Header().Name)) {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = nil
+	return resp
+}
+
+// queryDelegation sends the query to the servers of d, in the order of rtt.
+func (r *resolver) queryDelegation(ctx context.Context, st *state, d *delegation, qname string, qtype uint16) (*dns.Msg, error) {
+	var lastErr error
+	tries := 0
+	tried := make(map[netip.Addr]struct{})
+	tryAddrs := func(addrs []netip.Addr) *dns.Msg {
+		r.sortByRTT(addrs)
+		for _, addr := range addrs {
+			if _, dup := tried[addr]; dup {
+				continue
+			}
+			if tries >= maxServerTries || lastErr == errMaxQueries || ctx.Err() != nil {
+				return nil
+			}
+			tries++
+			tried[addr] = struct{}{}
+			resp, err := r.exchange(ctx, st, addr, qname, qtype)
+			if err == nil && isLame(d.zone, resp) {
+				err = fmt.Errorf("lame server for zone %s", d.zone)
+			}
+			if err != nil {
+				r.opts.Logger.Debug(
+					"name server query failed",
+					zap.String("zone", d.zone),
+					zap.Stringer("server", addr),
+					zap.String("qname", qname),
+					zap.Error(err),
+				)
+				lastErr = err
+				continue
+			}
+			return resp
+		}
+		return nil
+	}
+
+	if resp := tryAddrs(r.knownAddrs(d)); resp != nil {
+		return resp, nil
+	}
+
+	// Resolve addresses of name servers that have no glue.
+	for _, ns := range d.ns {
+		if tries >= maxServerTries || lastErr == errMaxQueries || ctx.Err() != nil {
+			break
+		}
+		if len(ns.addrs) > 0 || len(ns.name) == 0 || dns.IsSubDomain(d.zone, ns.name) {
+			// In-bailiwick servers without glue can not be resolved.
+			continue
+		}
+		if _, ok := r.cachedAddrs(ns.name); ok {
+			continue // Already tried.
+		}
+		addrs, err := r.resolveNSAddrs(ctx, st, ns.name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp := tryAddrs(addrs); resp != nil {
+			return resp, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+	if lastErr == nil {
+		lastErr = errNoServer
+	}
+	return nil, fmt.Errorf("failed to query zone %s, %w", d.zone, lastErr)
+}
+
+// knownAddrs returns the addresses of d's servers from glue and the cache.
+func (r *resolver) knownAddrs(d *delegation) []netip.Addr {
+	var out []netip.Addr
+	for _, ns := range d.ns {
+		out = append(out, ns.addrs...)
+		if len(ns.addrs) == 0 && len(ns.name) > 0 {
+			addrs, _ := r.cachedAddrs(ns.name)
+			out = append(out, addrs...)
+		}
+	}
+	return r.filterAddrs(out)
+}
+
+func (r *resolver) cachedAddrs(name string) ([]netip.Addr, bool) {
+	addrs, _, ok := r.addrs.Get(nameKey(name))
+	return addrs, ok
+}
+
+func (r *resolver) filterAddrs(addrs []netip.Addr) []netip.Addr {
+	out := addrs[:0]
+	seen := make(map[netip.Addr]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if r.opts.NoIPv6 && addr.Is6() {
+			continue
+		}
+		if _, dup := seen[addr]; dup {
+			continue
+		}
+		seen[addr] = struct{}{}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// resolveNSAddrs resolves the addresses of a name server. AAAA is
+// only queried if there is no A record.
+func (r *resolver) resolveNSAddrs(ctx context.Context, st *state, name string) ([]netip.Addr, error) {
+	if st.depth >= r.opts.MaxDepth {
+		return nil, errMaxDepth
+	}
+	if _, dup := st.resolving[name]; dup {
+		return nil, errNSLoop
+	}
+	st.depth++
+	st.resolving[name] = struct{}{}
+	defer func() {
+		st.depth--
+		delete(st.resolving, name)
+	}()
+
+	var addrs []netip.Addr
+	ttl := uint32(maxInfraTTL)
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if len(addrs) > 0 || (qtype == dns.TypeAAAA && r.opts.NoIPv6) {
+			break
+		}
+		resp, err := r.resolve(ctx, st, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range resp.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			if addr.IsValid() {
+				addrs = append(addrs, addr)
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("name server %s has no address", name)
+		}
+		return nil, lastErr
+	}
+	r.addrs.Store(nameKey(name), addrs, time.Now().Add(time.Duration(clampTTL(ttl))*time.Second))
+	return r.filterAddrs(addrs), nil
+}
+
+// exchange sends one query to addr.
+func (r *resolver) exchange(ctx context.Context, st *state, addr netip.Addr, qname string, qtype uint16) (*dns.Msg, error) {
+	if st.queries >= r.opts.MaxQueries {
+		return nil, errMaxQueries
+	}
+	st.queries++
+
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(ednsBufSize, false)
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	u, err := r.ups.get(netip.AddrPortFrom(addr, r.opts.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	qCtx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	rb, err := u.ExchangeContext(qCtx, b)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil { // Not canceled by the caller.
+			r.penalize(addr)
+		}
+		return nil, err
+	}
+	r.updateRTT(addr, time.Since(start))
+	defer pool.ReleaseBuf(rb)
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(*rb); err != nil {
+		return nil, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%w, rcode %s", errBadResp, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// nextName returns the name that has one more label than known towards name.
+// known must be a parent of name.
+func nextName(known, name string) string {
+	idx := dns.Split(name)
+	n := dns.CountLabel(known) + 1
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+func isStrictSubDomain(parent, child string) bool {
+	return !equalName(parent, child) && dns.IsSubDomain(parent, child)
+}
+
+func equalName(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
+
+func clampTTL(ttl uint32) uint32 {
+	return min(max(ttl, minInfraTTL), maxInfraTTL)
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// authServer is a stand-in authoritative server. It does not chase cname.
+type authServer struct {
+	zone string
+	rrs  []dns.RR
+
+	m       sync.Mutex
+	queries []dns.Question
+}
+
+func newAuthServer(t testing.TB, zone string, records ...string) *authServer {
+	s := &authServer{zone: zone}
+	for _, str := range records {
+		rr, err := dns.NewRR("$ORIGIN " + zone + "\n$TTL 300\n" + str)
+		require.NoError(t, err)
+		s.rrs = append(s.rrs, rr)
+	}
+	return s
+}
+
+func (s *authServer) received() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var out []string
+	for _, q := range s.queries {
+		out = append(out, q.Name+" "+dns.TypeToString[q.Qtype])
+	}
+	return out
+}
+
+func (s *authServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	question := q.Question[0]
+	s.m.Lock()
+	s.queries = append(s.queries, question)
+	s.m.Unlock()
+	qname := dns.CanonicalName(question.Name)
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	// Referral
+	for _, rr := range s.rrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok || ns.Hdr.Name == s.zone || !dns.IsSubDomain(ns.Hdr.Name, qname) {
+			continue
+		}
+		if question.Qtype == dns.TypeDS && qname == ns.Hdr.Name {
+			continue
+		}
+		for _, rr := range s.rrs {
+			if rr.Header().Name == ns.Hdr.Name && rr.Header().Rrtype == dns.TypeNS {
+				r.Ns = append(r.Ns, rr)
+				for _, glue := range s.rrs {
+					if glue.Header().Name == rr.(*dns.NS).Ns && glue.Header().Rrtype != dns.TypeNS {
+						r.Extra = append(r.Extra, glue)
+					}
+				}
+			}
+		}
+		w.WriteMsg(r)
+		return
+	}
+
+	r.Authoritative = true
+	exist := false
+	for _, rr := range s.rrs {
+		h := rr.Header()
+		if dns.IsSubDomain(qname, h.Name) {
+			exist = true
+		}
+		if h.Name != qname {
+			continue
+		}
+		if h.Rrtype == question.Qtype || h.Rrtype == dns.TypeCNAME {
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+	if len(r.Answer) == 0 {
+		if !exist {
+			r.Rcode = dns.RcodeNameError
+		}
+		soa, _ := dns.NewRR(s.zone + " 300 IN SOA ns. admin. 1 3600 600 86400 60")
+		r.Ns = append(r.Ns, soa)
+	}
+	w.WriteMsg(r)
+}
+
+// startServers starts servers on the same port of different loopback addresses.
+func startServers(t testing.TB, servers map[string]dns.Handler) uint16 {
+	for try := 0; try < 10; try++ {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := netip.MustParseAddrPort(c.LocalAddr().String()).Port()
+		c.Close()
+
+		var conns []net.PacketConn
+		ok := true
+		for ip := range servers {
+			c, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", ip, port))
+			if err != nil {
+				ok = false
+				break
+			}
+			conns = append(conns, c)
+		}
+		if !ok {
+			for _, c := range conns {
+				c.Close()
+			}
+			continue
+		}
+		for _, c := range conns {
+			ip := netip.MustParseAddrPort(c.LocalAddr().String()).Addr().String()
+			s := &dns.Server{PacketConn: c, Handler: servers[ip]}
+			go s.ActivateAndServe()
+			t.Cleanup(func() { s.Shutdown() })
+		}
+		return port
+	}
+	t.Fatal("no available port")
+	return 0
+}
+
+func Test_resolver(t *testing.T) {
+	if c, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 is not available")
+	} else {
+		c.Close()
+	}
+
+	root := newAuthServer(t, ".",
+		"com. NS a.nic.com.",
+		"a.nic.com. A 127.0.0.2",
+		"net. NS a.nic.net.",
+		"a.nic.net. A 127.0.0.4",
+	)
+	com := newAuthServer(t, "com.",
+		"example NS ns.example.com.",
+		"ns.example A 127.0.0.3",
+		"other NS ns.other.net.", // Out of bailiwick, no glue.
+		"loop NS ns.loop.net.",
+	)
+	example := newAuthServer(t, "example.com.",
+		"www A 1.2.3.4",
+		"alias CNAME www.other.com.",
+		"a.b.c A 1.1.1.1", // b.c and c are empty non-terminals.
+		"loop1 CNAME loop2",
+		"loop2 CNAME loop1",
+	)
+	net_ := newAuthServer(t, "net.",
+		"ns.other A 127.0.0.5",
+		"loop NS ns.loop.com.",
+	)
+	other := newAuthServer(t, "other.com.",
+		"www A 5.6.7.8",
+	)
+	port := startServers(t, map[string]dns.Handler{
+		"127.0.0.1": root,
+		"127.0.0.2": com,
+		"127.0.0.3": example,
+		"127.0.0.4": net_,
+		"127.0.0.5": other,
+	})
+
+	newTestResolver := func(opts resolverOpts) *resolver {
+		opts.RootHints = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+		opts.Port = port
+		opts.Timeout = time.Millisecond * 500
+		r := newResolver(opts)
+		t.Cleanup(r.close)
+		return r
+	}
+	resolve := func(r *resolver, name string, qtype uint16) (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		return r.Resolve(ctx, name, qtype)
+	}
+	answers := func(m *dns.Msg) []string {
+		var out []string
+		for _, rr := range m.Answer {
+			out = append(out, strings.ReplaceAll(rr.String(), "\t", " "))
+		}
+		return out
+	}
+
+	r := require.New(t)
+	res := newTestResolver(resolverOpts{})
+
+	m, err := resolve(res, "www.EXAMPLE.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]string{"www.example.com. 300 IN A 1.2.3.4"}, answers(m))
+	// QNAME minimisation.
+	r.Equal([]string{"com. A"}, root.received())
+	r.Equal([]string{"example.com. A"}, com.received())
+	r.Equal([]string{"www.example.com. A"}, example.received())
+
+	// Delegations are cached.
+	m, err = resolve(res, "www.example.com.", dns.TypeAAAA)
+	r.NoError(err)
+	r.Equal(dns.RcodeSuccess, m.Rcode)
+	r.Empty(m.Answer)
+	r.Len(root.received(), 1)
+	r.Len(com.received(), 1)
+
+	m, err = resolve(res, "nx.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal(dns.RcodeNameError, m.Rcode)
+
+	// Empty non-terminals.
+	m, err = resolve(res, "a.b.c.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]string{"a.b.c.example.com. 300 IN A 1.1.1.1"}, answers(m))
+
+	// CNAME to a zone that has an out of bailiwick server.
+	m, err = resolve(res, "alias.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]string{
+		"alias.example.com. 300 IN CNAME www.other.com.",
+		"www.other.com. 300 IN A 5.6.7.8",
+	}, answers(m))
+	r.Contains(net_.received(), "ns.other.net. A")
+
+	_, err = resolve(res, "loop1.example.com.", dns.TypeA)
+	r.ErrorIs(err, errCNAMELoop)
+
+	// loop.com. and loop.net. are served by each other.
+	_, err = resolve(res, "www.loop.com.", dns.TypeA)
+	r.Error(err)
+
+	// Without minimisation.
+	res = newTestResolver(resolverOpts{NoQnameMinimisation: true})
+	m, err = resolve(res, "www.example.com.", dns.TypeA)
+	r.NoError(err)
+	r.Equal([]string{"www.example.com. 300 IN A 1.2.3.4"}, answers(m))
+	r.Equal("www.example.com. A", root.received()[len(root.received())-1])
+
+	// Query limit.
+	res = newTestResolver(resolverOpts{MaxQueries: 2})
+	_, err = resolve(res, "www.example.com.", dns.TypeA)
+	r.ErrorIs(err, errMaxQueries)
+}
+
+func Test_nextName(t *testing.T) {
+	r := require.New(t)
+	r.Equal("com.", nextName(".", "www.example.com."))
+	r.Equal("example.com.", nextName("com.", "www.example.com."))
+	r.Equal("www.example.com.", nextName("example.com.", "www.example.com."))
+	r.Equal("www.example.com.", nextName("www.example.com.", "www.example.com."))
+	r.Equal("com.", parentName("example.com."))
+	r.Equal(".", parentName("com."))
+	r.Equal(".", parentName("."))
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import "net/netip"
+
+// defaultRootHints are the addresses of the IANA root servers (a to m).
+// See https://www.iana.org/domains/root/servers.
+var defaultRootHints = []string{
+	"198.41.0.4", "2001:503:ba3e::2:30",
+	"170.247.170.2", "2801:1b8:10::b",
+	"192.33.4.12", "2001:500:2::c",
+	"199.7.91.13", "2001:500:2d::d",
+	"192.203.230.10", "2001:500:a8::e",
+	"192.5.5.241", "2001:500:2f::f",
+	"192.112.36.4", "2001:500:12::d0d",
+	"198.97.190.53", "2001:500:1::53",
+	"192.36.148.17", "2001:7fe::53",
+	"192.58.128.30", "2001:503:c27::2:30",
+	"193.0.14.129", "2001:7fd::1",
+	"199.7.83.42", "2001:500:9f::42",
+	"202.12.27.33", "2001:dc3::35",
+}
+
+func parseRootHints(s []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(s))
+	for _, h := range s {
+		addr, err := netip.ParseAddr(h)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -51,6 +51,11 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// BehindTLSProxy indicates the server is behind a tls-terminating
+	// reverse proxy. Queries without tls are treated as encrypted, so
+	// padded queries get padded responses.
+	BehindTLSProxy bool `yaml:"behind_tls_proxy"`
 }
 
 func (a *Args) init() {
@@ -80,6 +85,7 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		}
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
+			BehindTLSProxy:     args.BehindTLSProxy,
 			Logger:             bp.L(),
 		}
 		hh := server.NewHttpHandler(dh, hhOpts)
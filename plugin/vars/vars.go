@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vars
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "var"
+
+func init() {
+	sequence.MustRegExecQuickSetup(PluginType, func(_ sequence.BQ, args string) (any, error) {
+		return newSetter(args)
+	})
+	sequence.MustRegMatchQuickSetup(PluginType, func(_ sequence.BQ, args string) (sequence.Matcher, error) {
+		return newMatcher(args)
+	})
+}
+
+var _ sequence.Executable = (*setter)(nil)
+var _ sequence.Matcher = (*matcher)(nil)
+
+// keys maps var names to their query_context keys.
+var keys struct {
+	sync.Mutex
+	m map[string]uint32
+}
+
+func varKey(name string) uint32 {
+	keys.Lock()
+	defer keys.Unlock()
+	if k, ok := keys.m[name]; ok {
+		return k
+	}
+	if keys.m == nil {
+		keys.m = make(map[string]uint32)
+	}
+	k := query_context.RegKey()
+	keys.m[name] = k
+	return k
+}
+
+type setter struct {
+	k uint32
+	v string
+}
+
+func (s *setter) Exec(_ context.Context, qCtx *query_context.Context) error {
+	qCtx.StoreValue(s.k, s.v)
+	return nil
+}
+
+// newSetter format: name value
+func newSetter(s string) (*setter, error) {
+	fs := strings.Fields(s)
+	if len(fs) != 2 {
+		return nil, errors.New("invalid args, format is \"name value\"")
+	}
+	return &setter{k: varKey(fs[0]), v: fs[1]}, nil
+}
+
+type matcher struct {
+	k  uint32
+	vs []string
+}
+
+func (m *matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	v, ok := qCtx.GetValue(m.k)
+	if !ok {
+		return false, nil
+	}
+	if len(m.vs) == 0 {
+		return true, nil
+	}
+	s, _ := v.(string)
+	return slices.Contains(m.vs, s), nil
+}
+
+// newMatcher format: name [value]...
+// It matches if the var has one of the values, or if it is set
+// and there is no value.
+func newMatcher(s string) (*matcher, error) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 {
+		return nil, errors.New("missing var name")
+	}
+	return &matcher{k: varKey(fs[0]), vs: fs[1:]}, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vars
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVar(t *testing.T) {
+	r := require.New(t)
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+
+	set := func(args string) {
+		t.Helper()
+		s, err := newSetter(args)
+		r.NoError(err)
+		r.NoError(s.Exec(context.Background(), qCtx))
+	}
+	doTest := func(args string, want bool) {
+		t.Helper()
+		m, err := newMatcher(args)
+		r.NoError(err)
+		got, err := m.Match(context.Background(), qCtx)
+		r.NoError(err)
+		r.Equal(want, got, args)
+	}
+
+	// Unset vars match nothing.
+	doTest("var_test_a", false)
+	doTest("var_test_a 1", false)
+
+	set("var_test_a 1")
+	doTest("var_test_a", true)
+	doTest("var_test_a 1", true)
+	doTest("var_test_a 2 1", true)
+	doTest("var_test_a 2", false)
+
+	// Vars with different names do not share a key.
+	doTest("var_test_b", false)
+	set("var_test_b 2")
+	doTest("var_test_a 1", true)
+	doTest("var_test_a 2", false)
+	doTest("var_test_b 2", true)
+	doTest("var_test_b 1", false)
+
+	// The last value wins.
+	set("var_test_a 3")
+	doTest("var_test_a 1", false)
+	doTest("var_test_a 3", true)
+
+	// Other contexts are not affected.
+	m, err := newMatcher("var_test_a")
+	r.NoError(err)
+	got, err := m.Match(context.Background(), query_context.NewContext(q))
+	r.NoError(err)
+	r.False(got)
+}
+
+func TestVar_InvalidArgs(t *testing.T) {
+	r := require.New(t)
+	for _, args := range []string{"", "a", "a 1 2"} {
+		_, err := newSetter(args)
+		r.Error(err, args)
+	}
+	_, err := newMatcher("")
+	r.Error(err)
+}
@@ -0,0 +1,403 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// dumpFilter selects cache dump entries. Empty fields match all entries.
+type dumpFilter struct {
+	suffixes     []string
+	qtypes       []string
+	rcodes       []string
+	stripExpired bool
+
+	qtypeSet map[uint16]struct{}
+	rcodeSet map[int]struct{}
+}
+
+func (f *dumpFilter) addFlags(c *cobra.Command) {
+	c.Flags().StringSliceVar(&f.suffixes, "suffix", nil, "only keep entries of these domains and their subdomains")
+	c.Flags().StringSliceVar(&f.qtypes, "qtype", nil, "only keep entries of these qtypes, e.g. A,AAAA,65")
+	c.Flags().StringSliceVar(&f.rcodes, "rcode", nil, "only keep entries of these rcodes, e.g. NOERROR,NXDOMAIN")
+	c.Flags().BoolVar(&f.stripExpired, "strip-expired", false, "remove expired entries")
+}
+
+func (f *dumpFilter) init() error {
+	for i, s := range f.suffixes {
+		f.suffixes[i] = dns.CanonicalName(s)
+	}
+	f.qtypeSet = make(map[uint16]struct{})
+	for _, s := range f.qtypes {
+		t, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			u, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid qtype %s", s)
+			}
+			t = uint16(u)
+		}
+		f.qtypeSet[t] = struct{}{}
+	}
+	f.rcodeSet = make(map[int]struct{})
+	for _, s := range f.rcodes {
+		rc, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			return fmt.Errorf("invalid rcode %s", s)
+		}
+		f.rcodeSet[rc] = struct{}{}
+	}
+	return nil
+}
+
+func (f *dumpFilter) match(e *dumpEntry, now time.Time) bool {
+	if f.stripExpired && !now.Before(e.cacheExpire) {
+		return false
+	}
+	if len(f.suffixes) > 0 && !slices.ContainsFunc(f.suffixes, func(s string) bool {
+		return dns.IsSubDomain(s, e.qname)
+	}) {
+		return false
+	}
+	if len(f.qtypeSet) > 0 {
+		if _, ok := f.qtypeSet[e.qtype]; !ok {
+			return false
+		}
+	}
+	if len(f.rcodeSet) > 0 {
+		if _, ok := f.rcodeSet[e.msg.Rcode]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// dumpEntry is a decoded cache dump entry.
+type dumpEntry struct {
+	raw         *cache.CachedEntry
+	msg         *dns.Msg
+	qname       string
+	qtype       uint16
+	cacheExpire time.Time
+	msgExpire   time.Time
+}
+
+func decodeDumpEntry(raw *cache.CachedEntry) (*dumpEntry, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(raw.GetMsg()); err != nil {
+		return nil, fmt.Errorf("failed to decode dns msg, %w", err)
+	}
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("invalid dns msg, it has %d questions", len(m.Question))
+	}
+	return &dumpEntry{
+		raw:         raw,
+		msg:         m,
+		qname:       dns.CanonicalName(m.Question[0].Name),
+		qtype:       m.Question[0].Qtype,
+		cacheExpire: time.Unix(raw.GetCacheExpirationTime(), 0),
+		msgExpire:   time.Unix(raw.GetMsgExpirationTime(), 0),
+	}, nil
+}
+
+// newer reports whether e should replace old when dumps are merged.
+func (e *dumpEntry) newer(old *dumpEntry) bool {
+	if !e.cacheExpire.Equal(old.cacheExpire) {
+		return e.cacheExpire.After(old.cacheExpire)
+	}
+	return e.msgExpire.After(old.msgExpire)
+}
+
+// loadDumps reads entries from files. Entries that have the same key
+// are merged, and the one that expires last is kept. Entries are
+// sorted by qname and qtype.
+func loadDumps(files []string, f *dumpFilter) ([]*dumpEntry, error) {
+	now := time.Now()
+	m := make(map[string]*dumpEntry)
+	for _, fp := range files {
+		if err := readDumpFile(fp, func(e *dumpEntry) {
+			if !f.match(e, now) {
+				return
+			}
+			k := e.raw.GetPartition() + "\x00" + string(e.raw.GetKey())
+			if old := m[k]; old == nil || e.newer(old) {
+				m[k] = e
+			}
+		}); err != nil {
+			return nil, fmt.Errorf("failed to read %s, %w", fp, err)
+		}
+	}
+
+	es := make([]*dumpEntry, 0, len(m))
+	for _, e := range m {
+		es = append(es, e)
+	}
+	slices.SortFunc(es, func(a, b *dumpEntry) int {
+		if c := strings.Compare(a.qname, b.qname); c != 0 {
+			return c
+		}
+		if a.qtype != b.qtype {
+			return int(a.qtype) - int(b.qtype)
+		}
+		return strings.Compare(string(a.raw.GetKey()), string(b.raw.GetKey()))
+	})
+	return es, nil
+}
+
+func readDumpFile(fp string, f func(e *dumpEntry)) error {
+	file, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = cache.ReadDump(bufio.NewReader(file), func(raw *cache.CachedEntry) error {
+		e, err := decodeDumpEntry(raw)
+		if err != nil {
+			return err
+		}
+		f(e)
+		return nil
+	})
+	return err
+}
+
+func writeDumpFile(fp string, es []*dumpEntry) error {
+	file, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dw := cache.NewDumpWriter(file)
+	for _, e := range es {
+		if err := dw.Write(e.raw); err != nil {
+			return err
+		}
+	}
+	if err := dw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func newCacheListCmd() *cobra.Command {
+	var (
+		f      dumpFilter
+		format string
+	)
+	c := &cobra.Command{
+		Use:   "list [flags] dump_file...",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Print entries of cache dumps.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := listDumps(args, &f, format, os.Stdout); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+	}
+	f.addFlags(c)
+	c.Flags().StringVar(&format, "format", "text", "output format, one of text, zone, json (one object per line)")
+	return c
+}
+
+func newCacheFilterCmd() *cobra.Command {
+	var (
+		f   dumpFilter
+		out string
+	)
+	c := &cobra.Command{
+		Use:   "filter [flags] -o output_dump dump_file",
+		Args:  cobra.ExactArgs(1),
+		Short: "Write entries that match the filter flags to a new cache dump.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := convDumps(args, &f, out); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+	}
+	f.addFlags(c)
+	c.Flags().StringVarP(&out, "out", "o", "", "output dump")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func newCacheMergeCmd() *cobra.Command {
+	var (
+		f   dumpFilter
+		out string
+	)
+	c := &cobra.Command{
+		Use:   "merge [flags] -o output_dump dump_file...",
+		Args:  cobra.MinimumNArgs(1),
+		Short: "Merge cache dumps. If an entry is in many dumps, the one that expires last is kept.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := convDumps(args, &f, out); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+	}
+	f.addFlags(c)
+	c.Flags().StringVarP(&out, "out", "o", "", "output dump")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func newCacheStripCmd() *cobra.Command {
+	var out string
+	c := &cobra.Command{
+		Use:   "strip -o output_dump dump_file",
+		Args:  cobra.ExactArgs(1),
+		Short: "Remove expired entries from a cache dump.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := convDumps(args, &dumpFilter{stripExpired: true}, out); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&out, "out", "o", "", "output dump")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func convDumps(in []string, f *dumpFilter, out string) error {
+	if err := f.init(); err != nil {
+		return err
+	}
+	es, err := loadDumps(in, f)
+	if err != nil {
+		return err
+	}
+	if err := writeDumpFile(out, es); err != nil {
+		return fmt.Errorf("failed to write %s, %w", out, err)
+	}
+	mlog.S().Infof("%d entries written to %s", len(es), out)
+	return nil
+}
+
+func listDumps(in []string, f *dumpFilter, format string, w io.Writer) error {
+	if err := f.init(); err != nil {
+		return err
+	}
+	es, err := loadDumps(in, f)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	switch format {
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "QNAME\tQTYPE\tRCODE\tTTL\tCACHE_TTL\tANSWERS")
+		for _, e := range es {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n",
+				e.qname, dns.Type(e.qtype), dns.RcodeToString[e.msg.Rcode],
+				ttlLeft(e.msgExpire, now), ttlLeft(e.cacheExpire, now), len(e.msg.Answer))
+		}
+		return tw.Flush()
+	case "zone":
+		bw := bufio.NewWriter(w)
+		for _, e := range es {
+			fmt.Fprintf(bw, "; %s %s %s expires %s\n",
+				e.qname, dns.Type(e.qtype), dns.RcodeToString[e.msg.Rcode], e.msgExpire.Format(time.RFC3339))
+			ttl := uint32(ttlLeft(e.msgExpire, now))
+			for _, section := range [...][]dns.RR{e.msg.Answer, e.msg.Ns, e.msg.Extra} {
+				for _, rr := range section {
+					if rr.Header().Rrtype == dns.TypeOPT {
+						continue
+					}
+					rr.Header().Ttl = ttl
+					fmt.Fprintln(bw, rr.String())
+				}
+			}
+		}
+		return bw.Flush()
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, e := range es {
+			if err := enc.Encode(newDumpEntryJSON(e, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid format %s", format)
+	}
+}
+
+type dumpEntryJSON struct {
+	Partition           string    `json:"partition,omitempty"` // Empty for the default partition.
+	Qname               string    `json:"qname"`
+	Qtype               string    `json:"qtype"`
+	Rcode               string    `json:"rcode"`
+	TTL                 int       `json:"ttl"`       // Seconds left before the response expires.
+	CacheTTL            int       `json:"cache_ttl"` // Seconds left before the entry is removed.
+	MsgExpirationTime   time.Time `json:"msg_expiration_time"`
+	CacheExpirationTime time.Time `json:"cache_expiration_time"`
+	Answer              []string  `json:"answer"`
+	Ns                  []string  `json:"ns,omitempty"`
+	Extra               []string  `json:"extra,omitempty"`
+}
+
+func newDumpEntryJSON(e *dumpEntry, now time.Time) dumpEntryJSON {
+	rrs := func(section []dns.RR) []string {
+		s := make([]string, 0, len(section))
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				s = append(s, rr.String())
+			}
+		}
+		return s
+	}
+	return dumpEntryJSON{
+		Partition:           e.raw.GetPartition(),
+		Qname:               e.qname,
+		Qtype:               dns.Type(e.qtype).String(),
+		Rcode:               dns.RcodeToString[e.msg.Rcode],
+		TTL:                 ttlLeft(e.msgExpire, now),
+		CacheTTL:            ttlLeft(e.cacheExpire, now),
+		MsgExpirationTime:   e.msgExpire,
+		CacheExpirationTime: e.cacheExpire,
+		Answer:              rrs(e.msg.Answer),
+		Ns:                  rrs(e.msg.Ns),
+		Extra:               rrs(e.msg.Extra),
+	}
+}
+
+// ttlLeft returns the seconds left before t, or 0 if t has passed.
+func ttlLeft(t, now time.Time) int {
+	return max(int(t.Sub(now).Seconds()), 0)
+}
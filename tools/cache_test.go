@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDumpEntry(t *testing.T, partition, name string, ip string, cacheExpire, msgExpire time.Time) *cache.CachedEntry {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Response = true
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	})
+	b, err := m.Pack()
+	require.NoError(t, err)
+	return &cache.CachedEntry{
+		Key:                 []byte(name + "A"),
+		CacheExpirationTime: cacheExpire.Unix(),
+		MsgExpirationTime:   msgExpire.Unix(),
+		MsgStoredTime:       msgExpire.Add(-time.Minute).Unix(),
+		Msg:                 b,
+		Partition:           partition,
+	}
+}
+
+func writeTestDump(t *testing.T, es ...*cache.CachedEntry) string {
+	t.Helper()
+	fp := filepath.Join(t.TempDir(), "dump")
+	f, err := os.Create(fp)
+	require.NoError(t, err)
+	defer f.Close()
+	dw := cache.NewDumpWriter(f)
+	for _, e := range es {
+		require.NoError(t, dw.Write(e))
+	}
+	require.NoError(t, dw.Close())
+	return fp
+}
+
+func Test_loadDumps(t *testing.T) {
+	r := require.New(t)
+	now := time.Now()
+	h1, h2 := now.Add(time.Hour), now.Add(time.Hour*2)
+	f1 := writeTestDump(t,
+		newTestDumpEntry(t, "", "a.", "1.1.1.1", h1, h1),
+		newTestDumpEntry(t, "", "b.", "1.1.1.1", h2, h1),
+		newTestDumpEntry(t, "p", "a.", "3.3.3.3", h1, h1),
+		newTestDumpEntry(t, "", "c.", "1.1.1.1", now.Add(-time.Hour), now.Add(-time.Hour)),
+	)
+	f2 := writeTestDump(t,
+		newTestDumpEntry(t, "", "a.", "2.2.2.2", h2, h2), // Expires later.
+		newTestDumpEntry(t, "", "b.", "2.2.2.2", h2, h2), // Same cache expiry, but the msg expires later.
+		newTestDumpEntry(t, "p", "a.", "4.4.4.4", now, now),
+	)
+
+	load := func(f *dumpFilter, files ...string) []*dumpEntry {
+		t.Helper()
+		r.NoError(f.init())
+		es, err := loadDumps(files, f)
+		r.NoError(err)
+		return es
+	}
+	answer := func(e *dumpEntry) string {
+		return e.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	// Newest entries win, in any file order. Partitions are not merged.
+	for _, files := range [][]string{{f1, f2}, {f2, f1}} {
+		es := load(&dumpFilter{}, files...)
+		r.Len(es, 4)
+		got := make(map[string]string)
+		for _, e := range es {
+			got[e.raw.GetPartition()+"/"+e.qname] = answer(e)
+		}
+		r.Equal(map[string]string{
+			"/a.":  "2.2.2.2",
+			"p/a.": "3.3.3.3",
+			"/b.":  "2.2.2.2",
+			"/c.":  "1.1.1.1",
+		}, got)
+	}
+
+	r.Len(load(&dumpFilter{stripExpired: true}, f1, f2), 3)
+	r.Len(load(&dumpFilter{suffixes: []string{"A"}}, f1, f2), 2)
+	r.Len(load(&dumpFilter{qtypes: []string{"AAAA"}}, f1, f2), 0)
+	r.Len(load(&dumpFilter{rcodes: []string{"NOERROR"}}, f1, f2), 4)
+	r.Error((&dumpFilter{qtypes: []string{"X"}}).init())
+}
+
+func Test_listDumps(t *testing.T) {
+	r := require.New(t)
+	h1 := time.Now().Add(time.Hour)
+	fp := writeTestDump(t,
+		newTestDumpEntry(t, "", "a.", "1.1.1.1", h1, h1),
+		newTestDumpEntry(t, "p", "a.", "3.3.3.3", h1, h1),
+	)
+
+	buf := new(bytes.Buffer)
+	r.NoError(listDumps([]string{fp}, &dumpFilter{}, "json", buf))
+	var got []dumpEntryJSON
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e dumpEntryJSON
+		r.NoError(dec.Decode(&e))
+		got = append(got, e)
+	}
+	r.Len(got, 2)
+	partitions := map[string]string{}
+	for _, e := range got {
+		r.Equal("a.", e.Qname)
+		r.Equal("A", e.Qtype)
+		r.Equal("NOERROR", e.Rcode)
+		r.InDelta(3600, e.TTL, 2)
+		r.Len(e.Answer, 1)
+		partitions[e.Partition] = e.Answer[0]
+	}
+	r.Contains(partitions[""], "1.1.1.1")
+	r.Contains(partitions["p"], "3.3.3.3")
+
+	buf.Reset()
+	r.NoError(listDumps([]string{fp}, &dumpFilter{}, "text", buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	r.Len(lines, 3)
+	r.True(strings.HasPrefix(lines[0], "QNAME"))
+
+	buf.Reset()
+	r.NoError(listDumps([]string{fp}, &dumpFilter{}, "zone", buf))
+	r.Contains(buf.String(), "1.1.1.1")
+	r.Contains(buf.String(), "3.3.3.3")
+
+	r.Error(listDumps([]string{fp}, &dumpFilter{}, "x", buf))
+}
@@ -42,4 +42,16 @@ func init() {
 	}
 	configCmd.AddCommand(newGenCmd(), newConvCmd())
 	coremain.AddSubCmd(configCmd)
+
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Tools that can inspect/merge cache dump files.",
+	}
+	cacheCmd.AddCommand(
+		newCacheListCmd(),
+		newCacheFilterCmd(),
+		newCacheMergeCmd(),
+		newCacheStripCmd(),
+	)
+	coremain.AddSubCmd(cacheCmd)
 }
@@ -20,7 +20,7 @@
 package tools
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
@@ -155,49 +156,16 @@ func ProbServerPipeline(addr string) error {
 	}
 	defer c.Close()
 
-	conn := dns.Conn{Conn: c}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	start := time.Now()
+	supported, err := upstream.ProbePipeline(ctx, c)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	domains := make([]string, 0)
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return err
-	}
-	domains = append(domains, fmt.Sprintf("%x.com.", b))
-	domains = append(domains, ".")
-
-	for i, d := range domains {
-		conn.SetDeadline(time.Now().Add(time.Second * 3))
-
-		q := new(dns.Msg)
-		q.SetQuestion(d, dns.TypeNS)
-		q.Id = uint16(i)
-
-		err = conn.WriteMsg(q)
-		if err != nil {
-			return fmt.Errorf("failed to write #%d probe msg: %v", i, err)
-		}
-	}
-
-	oooPassed := false
-	start := time.Now()
-	for i := range domains {
-		conn.SetDeadline(time.Now().Add(time.Second * 10))
-		m, err := conn.ReadMsg()
-		if err != nil {
-			return fmt.Errorf("failed to read #%d probe msg response: %v", i, err)
-		}
-
-		mlog.S().Infof("#%d response received, latency: %d ms", m.Id, time.Since(start).Milliseconds())
-		if m.Id != uint16(i) {
-			oooPassed = true
-		}
-	}
+	mlog.S().Infof("probe finished, latency: %d ms", time.Since(start).Milliseconds())
 
-	if oooPassed {
+	if supported {
 		mlog.S().Info("server supports RFC7766 query pipelining")
 	} else {
 		mlog.S().Info("no out-of-order response received in this test, server MAY NOT support RFC7766 query pipelining")